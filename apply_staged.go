@@ -0,0 +1,26 @@
+// apply_staged.go defines the apply_staged tool types.
+package main
+
+// ApplyStagedArgs is the input for the apply_staged tool.
+type ApplyStagedArgs struct {
+	// TaskIDs applies specific tasks. If both TaskIDs and Tag are empty,
+	// every task with staged output is applied.
+	TaskIDs []string `json:"task_ids,omitempty" jsonschema:"Specific task IDs whose staged output to apply. Empty with no tag applies all."`
+	Tag     string   `json:"tag,omitempty"      jsonschema:"Apply all staged output for tasks with this tag"`
+}
+
+// ApplyStagedOutput reports what happened to each matched task's staged file.
+type ApplyStagedOutput struct {
+	Applied int                `json:"applied"` // tasks whose staged output was promoted into place
+	Results []StagedFileResult `json:"results"`
+}
+
+// StagedFileResult is the outcome of applying or discarding a single task's
+// staged output.
+type StagedFileResult struct {
+	ID         string `json:"id"`
+	OutputFile string `json:"output_file,omitempty"`
+	StagedFile string `json:"staged_file,omitempty"`
+	Action     string `json:"action"`          // applied, discarded, skipped, failed
+	Error      string `json:"error,omitempty"` // why the task was skipped or the operation failed
+}
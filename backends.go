@@ -0,0 +1,364 @@
+// backends.go spreads tasks across several Ollama servers.
+//
+// OLLAMA_HOSTS lists the backends, comma-separated, each with an optional
+// concurrency of its own after "=":
+//
+//	OLLAMA_HOSTS=http://127.0.0.1:11434=2,http://spare.local:11434=1
+//
+// Without it the pool has a single backend, OLLAMA_HOST, bounded only by the
+// pool's concurrency, and nothing below applies — except that the health
+// check still asks it which models are loaded (see model_limits.go).
+//
+// With several backends:
+//   - A health check lists each backend's models, and the models it has
+//     loaded in memory (/api/ps), every backendCheckInterval. A backend that
+//     doesn't answer is skipped until it answers again.
+//   - When the scheduler grants a slot (see scheduler.go) it also picks the
+//     backend: the least loaded healthy backend that has the task's model
+//     and a free slot of its own. A task whose model no healthy backend has
+//     fails with an error saying so. If no backend is healthy at all, tasks
+//     go to any backend with a free slot and fail or retry like they would
+//     against a single server that is down (see retry.go).
+//   - A retrying task queues for a slot again and may land on another
+//     backend.
+//   - The pool's concurrency (WORKER_CONCURRENCY, or concurrency on
+//     submit_tasks) still caps the total, and defaults to the sum of the
+//     backends' limits.
+//   - check_tasks reports the backend each task ran on, and list_models
+//     which backends have each model along with each backend's health.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+const (
+	backendCheckInterval = 30 * time.Second // how often backends' health and models are refreshed
+	backendCheckTimeout  = 5 * time.Second  // how long a backend has to answer a health check
+)
+
+// backend is one Ollama server the pool sends requests to.
+type backend struct {
+	host        string       // base URL, as shown to the caller
+	client      OllamaClient // API client for host
+	concurrency int          // max slots on this backend; 0 leaves only the pool's limit
+
+	// Guarded by WorkerPool.mu.
+	running int             // slots held on this backend
+	healthy bool            // the last health check succeeded
+	models  map[string]bool // installed models (see modelKey), from the last health check; nil accepts any model
+	err     string          // error from the last failed health check
+
+	modelRunning map[string]int  // model → slots it holds on this backend (see model_limits.go)
+	loaded       map[string]bool // models in memory, from the last health check's /api/ps plus models run since; nil if unknown
+	lastModel    string          // model of the most recent task granted a slot here
+}
+
+// parseBackends parses OLLAMA_HOSTS. Each entry is a host URL (scheme and
+// port optional, as in OLLAMA_HOST) optionally followed by "=<concurrency>";
+// entries without one get defaultLimit.
+func parseBackends(hosts string, defaultLimit int) ([]*backend, error) {
+	var backends []*backend
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(hosts, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		limit := defaultLimit
+		if i := strings.LastIndex(entry, "="); i >= 0 {
+			n, err := strconv.Atoi(entry[i+1:])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("OLLAMA_HOSTS entry %q: concurrency must be a positive integer", entry)
+			}
+			entry, limit = entry[:i], n
+		}
+		base, err := parseOllamaHost(entry)
+		if err != nil {
+			return nil, fmt.Errorf("OLLAMA_HOSTS entry %q: %v", entry, err)
+		}
+		if seen[base.String()] {
+			return nil, fmt.Errorf("OLLAMA_HOSTS lists %s more than once", base)
+		}
+		seen[base.String()] = true
+		backends = append(backends, &backend{
+			host:        base.String(),
+			client:      api.NewClient(base, http.DefaultClient),
+			concurrency: limit,
+		})
+	}
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("OLLAMA_HOSTS is set but lists no hosts")
+	}
+	return backends, nil
+}
+
+// parseOllamaHost turns "host", "host:port" or a full URL into a base URL,
+// defaulting to http and Ollama's port 11434.
+func parseOllamaHost(s string) (*url.URL, error) {
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("missing host")
+	}
+	if u.Port() == "" {
+		u.Host += ":11434"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return u, nil
+}
+
+// modelKey normalizes a model name the way Ollama resolves it, so "llama3.1"
+// matches the installed "llama3.1:latest".
+func modelKey(name string) string {
+	if !strings.Contains(name, ":") {
+		return name + ":latest"
+	}
+	return name
+}
+
+// checkBackends refreshes every backend's health, model list and loaded
+// models, then lets the scheduler hand slots to tasks that were waiting for a
+// backend. A single backend stays healthy and accepts any model whatever the
+// check finds; only its loaded models are refreshed.
+func (p *WorkerPool) checkBackends() {
+	type health struct {
+		models map[string]bool
+		loaded map[string]bool
+		err    error
+	}
+	single := len(p.backends) == 1
+	results := make([]health, len(p.backends))
+	var wg sync.WaitGroup
+	for i, b := range p.backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), backendCheckTimeout)
+			defer cancel()
+			if !single {
+				resp, err := b.client.List(ctx)
+				if err != nil {
+					results[i].err = err
+					return
+				}
+				results[i].models = make(map[string]bool, len(resp.Models))
+				for _, m := range resp.Models {
+					results[i].models[modelKey(m.Name)] = true
+				}
+			}
+			// Older Ollama versions lack /api/ps; loaded stays nil and
+			// modelLoaded falls back to the last model run
+			if ps, err := b.client.ListRunning(ctx); err == nil {
+				results[i].loaded = make(map[string]bool, len(ps.Models))
+				for _, m := range ps.Models {
+					results[i].loaded[modelKey(m.Name)] = true
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	for i, b := range p.backends {
+		b.loaded = results[i].loaded
+		if single {
+			continue
+		}
+		b.healthy = results[i].err == nil
+		if b.healthy {
+			b.models, b.err = results[i].models, ""
+		} else {
+			b.err = results[i].err.Error()
+		}
+	}
+	p.mu.Unlock()
+	p.dispatch()
+}
+
+// checkBackendsLoop re-runs checkBackends every backendCheckInterval until
+// stop is closed.
+func (p *WorkerPool) checkBackendsLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(backendCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.checkBackends()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// pickBackend chooses the backend for a task using model: among healthy
+// backends that have the model and a free slot for it (see model_limits.go),
+// one where the model is already loaded, then the least loaded. b is nil if
+// every such backend is busy; err is set instead if no healthy backend has
+// the model, so waiting won't help. Must be called with p.mu held.
+func (p *WorkerPool) pickBackend(model string) (b *backend, err error) {
+	key := modelKey(model)
+	anyHealthy, anyHasModel := false, false
+	for _, c := range p.backends {
+		if !c.healthy {
+			continue
+		}
+		anyHealthy = true
+		if c.models != nil && !c.models[key] {
+			continue
+		}
+		anyHasModel = true
+		if (c.concurrency > 0 && c.running >= c.concurrency) || !p.modelFree(c, model) {
+			continue
+		}
+		if b == nil || betterBackend(c, b, model) {
+			b = c
+		}
+	}
+	if anyHasModel {
+		return b, nil
+	}
+	if !anyHealthy {
+		// Nothing is answering; send the task anyway so it fails (or
+		// retries) with the backend's own error, as with a single server.
+		for _, c := range p.backends {
+			if (c.concurrency == 0 || c.running < c.concurrency) && p.modelFree(c, model) {
+				return c, nil
+			}
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("model %q is not installed on any healthy Ollama backend (%s). Pull it with 'ollama pull %s' on one of them, or pick another model from list_models",
+		model, strings.Join(p.backendHosts(), ", "), model)
+}
+
+// betterBackend reports whether c is a better place than b for a task of
+// model: one where the model is loaded wins, then the less loaded one. Must
+// be called with p.mu held.
+func betterBackend(c, b *backend, model string) bool {
+	if cl, bl := c.modelLoaded(model), b.modelLoaded(model); cl != bl {
+		return cl
+	}
+	return c.load() < b.load()
+}
+
+// load is the fraction of b's slots in use, for picking the least loaded
+// backend. Must be called with p.mu held.
+func (b *backend) load() float64 {
+	if b.concurrency == 0 {
+		return float64(b.running)
+	}
+	return float64(b.running) / float64(b.concurrency)
+}
+
+// backendHosts returns the healthy backends' hosts. Must be called with p.mu
+// held.
+func (p *WorkerPool) backendHosts() []string {
+	var hosts []string
+	for _, b := range p.backends {
+		if b.healthy {
+			hosts = append(hosts, b.host)
+		}
+	}
+	return hosts
+}
+
+// taskClient returns the client of the backend serving task id's current
+// slot, or the first backend's if it holds none.
+func (p *WorkerPool) taskClient(id string) OllamaClient {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if b := p.assigned[id]; b != nil {
+		return b.client
+	}
+	return p.backends[0].client
+}
+
+// modelClient returns the client of a healthy backend that has model, or the
+// first backend's if none is known to. Used for model metadata lookups,
+// which don't depend on where a task runs.
+func (p *WorkerPool) modelClient(model string) OllamaClient {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, b := range p.backends {
+		if b.healthy && (b.models == nil || b.models[modelKey(model)]) {
+			return b.client
+		}
+	}
+	return p.backends[0].client
+}
+
+// listModels lists the models installed on every backend, with each model's
+// concurrency limit if it has one. With several backends each model lists
+// the backends that have it, models on more than one backend appear once,
+// and the output reports each backend's health. Unreachable backends are
+// skipped; it fails only if none answers.
+func (p *WorkerPool) listModels(ctx context.Context) (ListModelsOutput, error) {
+	out := ListModelsOutput{Models: []ModelInfo{}}
+	byName := make(map[string]int) // model name → index in out.Models
+	var errs []string
+	for _, b := range p.backends {
+		resp, err := b.client.List(ctx)
+		if len(p.backends) > 1 {
+			p.mu.Lock()
+			status := BackendStatus{Host: b.host, Healthy: err == nil, Concurrency: b.concurrency, Running: b.running}
+			p.mu.Unlock()
+			if err != nil {
+				status.Error = err.Error()
+			} else {
+				status.Models = len(resp.Models)
+			}
+			out.Backends = append(out.Backends, status)
+		}
+		if err != nil {
+			if len(p.backends) > 1 {
+				err = fmt.Errorf("%s: %v", b.host, err)
+			}
+			errs = append(errs, err.Error())
+			continue
+		}
+		for _, m := range resp.Models {
+			i, ok := byName[m.Name]
+			if !ok {
+				i = len(out.Models)
+				byName[m.Name] = i
+				out.Models = append(out.Models, ModelInfo{
+					Name:              m.Name,
+					Size:              m.Size,
+					ParameterSize:     m.Details.ParameterSize,
+					QuantizationLevel: m.Details.QuantizationLevel,
+					Family:            m.Details.Family,
+				})
+			}
+			if len(p.backends) > 1 {
+				out.Models[i].Backends = append(out.Models[i].Backends, b.host)
+			}
+		}
+	}
+	if len(errs) == len(p.backends) {
+		return ListModelsOutput{}, fmt.Errorf("failed to list Ollama models: %s", strings.Join(errs, "; "))
+	}
+	limits := p.ModelLimits()
+	for i := range out.Models {
+		out.Models[i].Concurrency = limits[modelKey(out.Models[i].Name)]
+	}
+	if len(p.backends) > 1 {
+		sort.SliceStable(out.Models, func(i, j int) bool { return out.Models[i].Name < out.Models[j].Name })
+	}
+	return out, nil
+}
@@ -0,0 +1,219 @@
+// backup.go implements atomic output writes, pre-write backups, and the
+// restore logic behind the undo_tasks tool.
+//
+// Output files are written to a temp file in the target's directory and
+// renamed into place, so a crash or a failed write never leaves a truncated
+// file behind. Before a task first writes its output_file, the file's
+// current contents (or the fact that it didn't exist) are saved to the
+// backup directory, keyed by task ID. undo_tasks puts those contents back —
+// which matters most when input_file == output_file and a bad model response
+// would otherwise destroy the original.
+//
+// Backups live on disk rather than in memory so large batches don't pin
+// every original file in RAM: under STATE_DIR/backups when STATE_DIR is set
+// (so undo still works after a restart), otherwise in a directory of this
+// process's own under the system temp directory, removed on shutdown since
+// the tasks that own the backups don't outlive the process. BACKUP_DIR
+// overrides both.
+//
+// Only the backups of the most recently finished tasks are kept:
+// BACKUP_RETENTION (default defaultBackupRetention) bounds their number, and
+// older ones are deleted as new backups are made. Those tasks can no longer
+// be undone.
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+)
+
+// defaultBackupRetention is how many finished tasks keep their backups when
+// BACKUP_RETENTION isn't set.
+const defaultBackupRetention = 1000
+
+// FileBackup records the state of an output file before a task first wrote
+// to it. Stored on the task (and so in the journal) until the task is undone.
+type FileBackup struct {
+	Path    string      // backup copy of the original contents; empty if the file didn't exist
+	Existed bool        // whether output_file existed before the task wrote it
+	Mode    os.FileMode // original permissions, restored on undo
+}
+
+// backupDir returns the directory pre-write backups are saved in. The
+// BackupDir field can be set directly on WorkerPool to override it (used by
+// tests); otherwise BACKUP_DIR, then STATE_DIR/backups, then a temp
+// directory created for this process on first use.
+func (p *WorkerPool) backupDir() (string, error) {
+	if p.BackupDir != "" {
+		return p.BackupDir, nil
+	}
+	if dir := os.Getenv("BACKUP_DIR"); dir != "" {
+		return dir, nil
+	}
+	if dir := os.Getenv("STATE_DIR"); dir != "" {
+		return filepath.Join(dir, "backups"), nil
+	}
+	p.backupMu.Lock()
+	defer p.backupMu.Unlock()
+	if p.tempBackupDir == "" {
+		dir, err := os.MkdirTemp("", "OpusGoLlama-backups-")
+		if err != nil {
+			return "", err
+		}
+		p.tempBackupDir = dir
+	}
+	return p.tempBackupDir, nil
+}
+
+// removeTempBackupDir deletes the per-process backup directory, if
+// backupDir created one. Called on shutdown.
+func (p *WorkerPool) removeTempBackupDir() {
+	p.backupMu.Lock()
+	defer p.backupMu.Unlock()
+	if p.tempBackupDir != "" {
+		os.RemoveAll(p.tempBackupDir)
+		p.tempBackupDir = ""
+	}
+}
+
+// backupRetention returns how many finished tasks keep their backups: the
+// BackupRetention field if set (used by tests), then BACKUP_RETENTION, then
+// defaultBackupRetention.
+func (p *WorkerPool) backupRetention() int {
+	if p.BackupRetention > 0 {
+		return p.BackupRetention
+	}
+	if v := os.Getenv("BACKUP_RETENTION"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return defaultBackupRetention
+}
+
+// pruneBackups deletes the backups of finished tasks beyond the retention
+// limit, oldest first. Called after each new backup.
+func (p *WorkerPool) pruneBackups() {
+	for _, path := range p.store.PruneBackups(p.backupRetention()) {
+		os.Remove(path)
+	}
+}
+
+// backupOutputFile saves the current contents of task's output file before
+// the task overwrites it.
+func (p *WorkerPool) backupOutputFile(task *Task) (*FileBackup, error) {
+	dir, err := p.backupDir()
+	if err != nil {
+		return nil, err
+	}
+	return backupFile(dir, task.ID, task.OutputFile)
+}
+
+// backupFile saves the current contents of path to dir, under the given
+// task ID.
+func backupFile(dir, id, path string) (*FileBackup, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return &FileBackup{Existed: false}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	backupPath := filepath.Join(dir, id)
+	if err := writeFileAtomic(backupPath, data, 0600); err != nil {
+		return nil, err
+	}
+	return &FileBackup{Path: backupPath, Existed: true, Mode: info.Mode().Perm()}, nil
+}
+
+// restoreBackup puts outputFile back the way it was before the task wrote
+// it: the original contents and mode are restored, or the file is removed if
+// it didn't exist before. The backup copy is deleted afterwards. Returns the
+// action taken ("restored" or "removed").
+func restoreBackup(outputFile string, b *FileBackup) (string, error) {
+	if !b.Existed {
+		if err := os.Remove(outputFile); err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		return "removed", nil
+	}
+	data, err := os.ReadFile(b.Path)
+	if err != nil {
+		return "", fmt.Errorf("reading backup: %v", err)
+	}
+	if err := writeFileAtomic(outputFile, data, b.Mode); err != nil {
+		return "", err
+	}
+	os.Remove(b.Path)
+	return "restored", nil
+}
+
+// writeFileAtomic writes data to path via a temp file in the same directory
+// and a rename, so readers see either the old contents or the new ones and a
+// failed write leaves the original untouched.
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chmod(tmp, mode); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Undo restores the output files of the matched tasks from their pre-write
+// backups, most recent task first so that when several tasks wrote the same
+// file, the earliest original wins. Tasks that are still running, never got
+// as far as writing, or were already undone are reported as skipped; tasks
+// without an output_file are left out. Results are in task order. Only
+// tasks submitted by session are matched.
+func (p *WorkerPool) Undo(ids []string, tag, session string) []UndoResult {
+	targets := p.store.List(ids, tag, session)
+	var results []UndoResult
+	for i := len(targets) - 1; i >= 0; i-- {
+		id := targets[i].ID
+		outputFile, backup, err := p.store.UndoTarget(id)
+		if outputFile == "" && len(ids) == 0 {
+			continue // nothing to undo, and the caller didn't ask for it by ID
+		}
+		res := UndoResult{ID: id, OutputFile: outputFile}
+		if err != nil {
+			res.Action = "skipped"
+			res.Error = err.Error()
+		} else if res.Action, err = restoreBackup(outputFile, backup); err != nil {
+			res.Action = "failed"
+			res.Error = err.Error()
+		} else {
+			p.store.SetUndone(id)
+		}
+		results = append(results, res)
+	}
+	slices.Reverse(results)
+	return results
+}
@@ -0,0 +1,85 @@
+// chain.go implements output chaining: feeding one task's result into another
+// task's prompt without routing it through the orchestrating agent.
+//
+// A task consumes upstream output in two ways:
+//   - {{result:<ref>}} placeholders anywhere in its prompt, replaced with the
+//     referenced task's output
+//   - input_from_task, whose output is appended to the user message after any
+//     input_file contents
+//
+// <ref> is a task ID or a 0-based index into the same batch, exactly like
+// depends_on. The handler rewrites every reference to a task ID and adds it to
+// the task's dependencies, so by the time the worker resolves placeholders the
+// upstream task has completed.
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// resultPlaceholderRe matches {{result:<ref>}} and captures <ref>.
+var resultPlaceholderRe = regexp.MustCompile(`\{\{result:([^{}\s]+)\}\}`)
+
+// chainRefs returns every task reference whose output spec consumes.
+func chainRefs(spec TaskSpec) []string {
+	var refs []string
+	for _, m := range resultPlaceholderRe.FindAllStringSubmatch(spec.Prompt, -1) {
+		refs = append(refs, m[1])
+	}
+	if spec.InputFromTask != "" {
+		refs = append(refs, spec.InputFromTask)
+	}
+	return refs
+}
+
+// rewriteResultPlaceholders replaces the <ref> in each {{result:<ref>}} with
+// resolve(<ref>).
+func rewriteResultPlaceholders(prompt string, resolve func(ref string) string) string {
+	return resultPlaceholderRe.ReplaceAllStringFunc(prompt, func(m string) string {
+		ref := resultPlaceholderRe.FindStringSubmatch(m)[1]
+		return "{{result:" + resolve(ref) + "}}"
+	})
+}
+
+// resolveChainedPrompt substitutes upstream output for every {{result:<id>}}
+// placeholder in prompt. Each upstream task's output is fetched once even if
+// referenced several times.
+func (p *WorkerPool) resolveChainedPrompt(prompt string) (string, error) {
+	outputs := make(map[string]string)
+	var resolveErr error
+	resolved := resultPlaceholderRe.ReplaceAllStringFunc(prompt, func(m string) string {
+		id := resultPlaceholderRe.FindStringSubmatch(m)[1]
+		if out, ok := outputs[id]; ok {
+			return out
+		}
+		out, err := p.upstreamOutput(id)
+		if err != nil && resolveErr == nil {
+			resolveErr = err
+		}
+		outputs[id] = out
+		return out
+	})
+	if resolveErr != nil {
+		return "", resolveErr
+	}
+	return resolved, nil
+}
+
+// upstreamOutput returns the output of a completed upstream task. If the
+// upstream task wrote its output to a file, the in-memory result was cleared
+// on completion, so the file is read back from disk instead.
+func (p *WorkerPool) upstreamOutput(id string) (string, error) {
+	result, outputFile, err := p.store.CompletedOutput(id)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve result of task %s: %v", id, err)
+	}
+	if outputFile == "" {
+		return result, nil
+	}
+	content, err := readInputFile(outputFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve result of task %s: reading %s: %v", id, outputFile, err)
+	}
+	return content, nil
+}
@@ -0,0 +1,291 @@
+// chunking.go keeps prompts inside the model's context window.
+//
+// Ollama silently truncates a prompt longer than num_ctx, and the model then
+// answers a question nobody asked. Before calling Ollama the worker estimates
+// the prompt's size in tokens and compares it with the context window: the
+// num_ctx option if the task sets one, else OLLAMA_CONTEXT_LENGTH, else
+// Ollama's smallest default window (4096 tokens, or the model's trained
+// context length from the show endpoint if that is smaller) — without
+// num_ctx, Ollama doesn't run a model with its full trained length. A prompt
+// that can't fit fails the task up front with a message saying how to fix
+// it.
+//
+// With chunk set, the task instead splits input_file into pieces that fit
+// and makes one call per piece, in order, within the same worker slot. Each
+// call gets the full system prompt, prompt and other context, plus a note
+// saying which part of the file it is looking at. The outputs are stitched
+// back together in order and then written to output_file like any other
+// result. Files are split at top-level declarations where possible — a line
+// starting in column 0 after a blank line — and on line boundaries when a
+// single declaration is too big.
+//
+// When num_ctx isn't known, chunks are sized for Ollama's smallest default
+// window (4096 tokens) so they fit whatever the server picked; set num_ctx
+// in options to get bigger chunks.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+)
+
+const (
+	// charsPerToken is the rough ratio used to estimate token counts. Real
+	// tokenizers average 3-4 characters per token on code and prose.
+	charsPerToken = 4
+
+	// defaultChunkContext is the context window chunks are sized for when
+	// num_ctx isn't set: the smallest default Ollama picks.
+	defaultChunkContext = 4096
+
+	// minChunkTokens is the smallest chunk worth sending. If the prompt
+	// leaves less room than this, chunking can't help.
+	minChunkTokens = 256
+)
+
+// estimateTokens roughly estimates how many tokens s encodes to.
+func estimateTokens(s string) int {
+	return (len(s) + charsPerToken - 1) / charsPerToken
+}
+
+// estimateMessageTokens estimates the prompt size of a chat request.
+func estimateMessageTokens(messages []api.Message) int {
+	n := 0
+	for _, m := range messages {
+		n += estimateTokens(m.Content) + 4 // role and template overhead
+	}
+	return n
+}
+
+// contextWindow returns the context window task's prompt must fit in, and
+// whether it was set explicitly (num_ctx or OLLAMA_CONTEXT_LENGTH) rather
+// than taken from the model. Returns 0 if it can't be determined.
+func (p *WorkerPool) contextWindow(ctx context.Context, task *Task) (int, bool) {
+	if n := numCtxOption(task.Options); n > 0 {
+		return n, true
+	}
+	if v := os.Getenv("OLLAMA_CONTEXT_LENGTH"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n, true
+		}
+	}
+	return p.modelContextLength(ctx, task.Model), false
+}
+
+// numCtxOption returns the num_ctx generation option, or 0 if unset. Options
+// arrive as decoded JSON, so numbers are usually float64.
+func numCtxOption(options map[string]any) int {
+	switch v := options["num_ctx"].(type) {
+	case float64:
+		return int(v)
+	case int:
+		return v
+	case int64:
+		return int(v)
+	}
+	return 0
+}
+
+// modelContextLength returns the model's trained context length as reported
+// by Ollama's show endpoint, or 0 if unknown. Lookups are cached per model;
+// failures aren't, so a model pulled later is picked up.
+func (p *WorkerPool) modelContextLength(ctx context.Context, model string) int {
+	p.ctxMu.Lock()
+	n, ok := p.contextLengths[model]
+	p.ctxMu.Unlock()
+	if ok {
+		return n
+	}
+
+	resp, err := p.modelClient(model).Show(ctx, &api.ShowRequest{Model: model})
+	if err != nil || resp == nil {
+		return 0
+	}
+	// The key is prefixed with the architecture, e.g. "qwen2.context_length"
+	for key, v := range resp.ModelInfo {
+		if !strings.HasSuffix(key, ".context_length") {
+			continue
+		}
+		if f, ok := v.(float64); ok {
+			n = int(f)
+		}
+	}
+	if n <= 0 {
+		return 0
+	}
+	p.ctxMu.Lock()
+	if p.contextLengths == nil {
+		p.contextLengths = make(map[string]int)
+	}
+	p.contextLengths[model] = n
+	p.ctxMu.Unlock()
+	return n
+}
+
+// checkContextWindow returns an error if messages clearly won't fit in the
+// task's context window. Without an explicit window, that is the default one
+// Ollama runs the model with (see defaultChunkContext).
+func (p *WorkerPool) checkContextWindow(ctx context.Context, task *Task, messages []api.Message) error {
+	window, explicit := p.contextWindow(ctx, task)
+	if !explicit && (window <= 0 || window > defaultChunkContext) {
+		window = defaultChunkContext
+	}
+	if est := estimateMessageTokens(messages); est > window {
+		return fmt.Errorf("prompt too large for the context window: ~%d tokens estimated, but the window is %d tokens and Ollama would silently truncate it. "+
+			"Raise num_ctx in options, send less input, or set chunk: true to process input_file in pieces", est, window)
+	}
+	return nil
+}
+
+// fileChunk is one piece of a chunked input file.
+type fileChunk struct {
+	text               string
+	firstLine, endLine int // 1-based, inclusive
+}
+
+// generateChunked runs a chunked task: one Ollama call per chunk of
+// input_file, stitched back together in order. prompt and extra are the
+// task's resolved prompt and any other context (input_files, upstream
+// output) sent with every chunk. Returns false if the task should stop, as
+// generate does.
+func (p *WorkerPool) generateChunked(ctx context.Context, task *Task, prompt, content, extra string, seq uint64, release *func()) (string, bool) {
+	window, explicit := p.contextWindow(ctx, task)
+	if !explicit && (window <= 0 || window > defaultChunkContext) {
+		window = defaultChunkContext
+	}
+	system := joinSections(task.SystemPrompt, editInstructions(task.OutputMode))
+	overhead := estimateMessageTokens([]api.Message{
+		{Content: system},
+		// Sized for the longest note the chunks could get
+		{Content: joinSections(joinSections(prompt, chunkNote(task.InputFile, 999, 999, 99999, 99999)), extra)},
+	})
+	// The response to a chunk is about as long as the chunk, and both have
+	// to fit in the window.
+	budget := (window - overhead) / 2
+	if budget < minChunkTokens {
+		p.store.SetFailed(task.ID, fmt.Sprintf("prompt leaves no room for input_file chunks: ~%d tokens of prompt and context in a %d-token window. Raise num_ctx in options or shorten the prompt", overhead, window))
+		return "", false
+	}
+
+	chunks := splitChunks(content, budget*charsPerToken)
+	outputs := make([]string, 0, len(chunks))
+	p.store.SetChunkProgress(task.ID, 0, len(chunks))
+	for i, c := range chunks {
+		user := joinSections(prompt, extra)
+		if len(chunks) > 1 {
+			user = joinSections(joinSections(prompt, chunkNote(task.InputFile, i+1, len(chunks), c.firstLine, c.endLine)), extra)
+		}
+		messages := []api.Message{
+			{Role: "system", Content: system},
+			{Role: "user", Content: joinSections(user, c.text)},
+		}
+		out, ok := p.generate(ctx, task, messages, seq, release)
+		if !ok {
+			return "", false
+		}
+		if task.StripMarkdownFences {
+			out = stripMarkdownFences(out)
+		}
+		outputs = append(outputs, out)
+		p.store.SetChunkProgress(task.ID, i+1, len(chunks))
+	}
+	return stitchChunks(chunks, outputs, strings.HasSuffix(content, "\n")), true
+}
+
+// chunkNote tells the model which part of the file it is looking at.
+func chunkNote(path string, part, parts, firstLine, endLine int) string {
+	return fmt.Sprintf("This is part %d of %d of %s (lines %d-%d). The file is being processed in parts: "+
+		"apply the instructions to this part only and return only the result for this part.", part, parts, path, firstLine, endLine)
+}
+
+// splitChunks splits content into chunks of at most maxBytes, preferring to
+// cut before top-level declarations. Concatenating the chunks' text gives
+// back content exactly.
+func splitChunks(content string, maxBytes int) []fileChunk {
+	lines := strings.SplitAfter(content, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	// Segments run from one top-level declaration to the next.
+	var segments [][]string
+	for i, line := range lines {
+		if i == 0 || isDeclarationStart(lines[i-1], line) {
+			segments = append(segments, nil)
+		}
+		segments[len(segments)-1] = append(segments[len(segments)-1], line)
+	}
+
+	var chunks []fileChunk
+	var cur strings.Builder
+	first, next := 1, 1 // first line of the current chunk, next line to add
+	flush := func() {
+		if cur.Len() > 0 {
+			chunks = append(chunks, fileChunk{text: cur.String(), firstLine: first, endLine: next - 1})
+			cur.Reset()
+			first = next
+		}
+	}
+	for _, seg := range segments {
+		size := 0
+		for _, line := range seg {
+			size += len(line)
+		}
+		if cur.Len()+size > maxBytes {
+			flush()
+		}
+		for _, line := range seg {
+			// A declaration too big for one chunk is split between lines
+			if cur.Len() > 0 && cur.Len()+len(line) > maxBytes {
+				flush()
+			}
+			cur.WriteString(line)
+			next++
+		}
+	}
+	flush()
+	if len(chunks) == 0 {
+		chunks = []fileChunk{{text: content, firstLine: 1, endLine: 1}}
+	}
+	return chunks
+}
+
+// isDeclarationStart reports whether line starts a new top-level
+// declaration: it begins in column 0 after a blank line and isn't a closing
+// bracket.
+func isDeclarationStart(prev, line string) bool {
+	if strings.TrimSpace(prev) != "" || strings.TrimSpace(line) == "" {
+		return false
+	}
+	switch line[0] {
+	case ' ', '\t', '}', ')', ']':
+		return false
+	}
+	return true
+}
+
+// stitchChunks joins chunk outputs in order. Models drop leading and
+// trailing blank lines, so the separator between two outputs is restored
+// from the original: a blank line where the chunk boundary fell on one.
+func stitchChunks(chunks []fileChunk, outputs []string, trailingNewline bool) string {
+	var sb strings.Builder
+	for i, out := range outputs {
+		out = strings.Trim(out, "\n")
+		if i > 0 {
+			sb.WriteString("\n")
+			if strings.HasSuffix(chunks[i-1].text, "\n\n") {
+				sb.WriteString("\n")
+			}
+		}
+		sb.WriteString(out)
+	}
+	if trailingNewline {
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
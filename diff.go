@@ -0,0 +1,270 @@
+// diff.go computes what a file-writing task changed: the unified diff
+// get_result returns with include_diff, and the +/- line counts shown in
+// check_tasks.
+//
+// The "before" side is the task's pre-write backup (see backup.go), so the
+// diff covers everything the task did to the file — repair rewrites and
+// post_write_cmd formatting included. For a staged task, it is the real file
+// versus the staged copy. The diff is computed once, when the task finishes,
+// and stored with the task: by the time get_result asks for it the file may
+// have been edited again or rewritten by another task, and the diff must
+// still show what this task wrote.
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// diffContextLines is the number of unchanged lines shown around each change.
+const diffContextLines = 3
+
+// maxDiffCells bounds the line-matching table for the changed middle of a
+// file (after common leading and trailing lines are trimmed). Beyond it the
+// whole middle is reported as replaced rather than spending seconds and
+// gigabytes on an exact diff of two unrelated files.
+const maxDiffCells = 16 << 20
+
+// diffSource is a snapshot of the fields needed to diff a task's output,
+// copied under the store lock.
+type diffSource struct {
+	OutputFile, StagedFile, Staging string
+	Backup                          *FileBackup
+	FileWritten, Undone             bool
+}
+
+// recordDiff stores the diff of what task wrote to its output file, along
+// with the diff stat check_tasks shows. The worker calls it as the task
+// finishes, while the files still hold what the task wrote.
+func (p *WorkerPool) recordDiff(task *Task) {
+	if task.OutputFile == "" {
+		return
+	}
+	diff, added, removed, err := p.outputDiff(task.ID)
+	p.store.SetDiff(task.ID, diff, added, removed, err)
+}
+
+// outputDiff returns the unified diff of what task id changed in its output
+// file, with the number of lines added and removed, as the files are now.
+func (p *WorkerPool) outputDiff(id string) (diff string, added, removed int, err error) {
+	src, err := p.store.DiffSource(id)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	var beforePath, afterPath string
+	switch {
+	case src.OutputFile == "":
+		return "", 0, 0, fmt.Errorf("task has no output_file")
+	case src.Undone:
+		return "", 0, 0, fmt.Errorf("output was undone")
+	case !src.FileWritten:
+		return "", 0, 0, fmt.Errorf("task did not write an output file")
+	case src.Staging == "staged":
+		beforePath, afterPath = src.OutputFile, src.StagedFile
+	case src.Backup == nil:
+		return "", 0, 0, fmt.Errorf("no pre-write backup to diff against")
+	default:
+		beforePath, afterPath = src.Backup.Path, src.OutputFile
+		if !src.Backup.Existed {
+			beforePath = ""
+		}
+	}
+
+	before, err := readIfExists(beforePath)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("reading original: %v", err)
+	}
+	after, err := os.ReadFile(afterPath)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("reading output: %v", err)
+	}
+	diff, added, removed = unifiedDiff(src.OutputFile, before, string(after))
+	return diff, added, removed, nil
+}
+
+// readIfExists reads path, treating an empty path or a missing file as empty.
+func readIfExists(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return string(data), err
+}
+
+// diffOp is one line of an edit script: ' ' unchanged, '-' removed, '+' added.
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// unifiedDiff returns the unified diff between before and after, labelled
+// with path, and the number of lines added and removed. Identical inputs
+// give an empty diff.
+func unifiedDiff(path, before, after string) (string, int, int) {
+	a, _ := splitLines(before)
+	b, _ := splitLines(after)
+	ops := diffLines(a, b)
+
+	added, removed := 0, 0
+	for _, op := range ops {
+		switch op.kind {
+		case '+':
+			added++
+		case '-':
+			removed++
+		}
+	}
+	if added == 0 && removed == 0 {
+		return "", 0, 0
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- a%s\n+++ b%s\n", path, path)
+	// Walk the script, emitting a hunk for each run of changes plus context.
+	// Runs separated by no more than 2*diffContextLines unchanged lines share
+	// a hunk.
+	oldLine, newLine := 1, 1 // line numbers at ops[i]
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			oldLine++
+			newLine++
+			i++
+			continue
+		}
+		start := i
+		for start > 0 && i-start < diffContextLines && ops[start-1].kind == ' ' {
+			start--
+		}
+		oldStart, newStart := oldLine-(i-start), newLine-(i-start)
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(ops) && ops[run].kind == ' ' {
+				run++
+			}
+			if run == len(ops) || run-end > 2*diffContextLines {
+				end = min(end+diffContextLines, run)
+				break
+			}
+			end = run
+		}
+		oldCount, newCount := 0, 0
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				oldCount++
+			}
+			if op.kind != '-' {
+				newCount++
+			}
+		}
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(oldStart, oldCount), hunkRange(newStart, newCount))
+		for _, op := range ops[start:end] {
+			sb.WriteByte(op.kind)
+			sb.WriteString(op.line)
+			sb.WriteByte('\n')
+		}
+		for _, op := range ops[i:end] {
+			if op.kind != '+' {
+				oldLine++
+			}
+			if op.kind != '-' {
+				newLine++
+			}
+		}
+		i = end
+	}
+	return sb.String(), added, removed
+}
+
+// hunkRange formats one side of a hunk header. An empty side is numbered by
+// the line before it, as diff(1) does.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		start--
+	}
+	if count == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// diffLines returns an edit script turning a into b, using a longest common
+// subsequence over the lines that differ.
+func diffLines(a, b []string) []diffOp {
+	// Trim the common prefix and suffix — usually most of the file
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	ops := make([]diffOp, 0, len(a)+len(b))
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	ops = append(ops, diffMiddle(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
+
+// diffMiddle diffs the changed middle of two files by dynamic programming.
+func diffMiddle(a, b []string) []diffOp {
+	var ops []diffOp
+	if len(a)*len(b) > maxDiffCells {
+		for _, line := range a {
+			ops = append(ops, diffOp{'-', line})
+		}
+		for _, line := range b {
+			ops = append(ops, diffOp{'+', line})
+		}
+		return ops
+	}
+	// lcs[i][j] is the LCS length of a[i:] and b[j:]
+	lcs := make([][]int32, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		ops = append(ops, diffOp{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		ops = append(ops, diffOp{'+', b[j]})
+	}
+	return ops
+}
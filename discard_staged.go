@@ -0,0 +1,17 @@
+// discard_staged.go defines the discard_staged tool types.
+package main
+
+// DiscardStagedArgs is the input for the discard_staged tool.
+type DiscardStagedArgs struct {
+	// TaskIDs discards specific tasks. If both TaskIDs and Tag are empty,
+	// every task with staged output is discarded.
+	TaskIDs []string `json:"task_ids,omitempty" jsonschema:"Specific task IDs whose staged output to delete. Empty with no tag discards all."`
+	Tag     string   `json:"tag,omitempty"      jsonschema:"Discard all staged output for tasks with this tag"`
+}
+
+// DiscardStagedOutput reports what happened to each matched task's staged
+// file.
+type DiscardStagedOutput struct {
+	Discarded int                `json:"discarded"` // staged files deleted
+	Results   []StagedFileResult `json:"results"`
+}
@@ -0,0 +1,125 @@
+// eval_metrics.go records the generation metrics Ollama reports at the end
+// of every chat call — prompt and response token counts, model load time and
+// generation time — so throughput can be measured per task and per model.
+//
+// A task can make several calls (retries after a dropped connection, repair
+// turns, chunks, reduce rounds); its metrics are the sum over the calls that
+// completed, plus the largest single prompt. Ollama silently truncates a
+// prompt at num_ctx, so a max_prompt_eval_count sitting at the context
+// window means prompts are being cut off.
+package main
+
+import (
+	"sort"
+
+	"github.com/ollama/ollama/api"
+)
+
+// EvalMetrics are a task's Ollama generation metrics, summed over its calls.
+type EvalMetrics struct {
+	Calls              int     `json:"calls"`                   // completed Ollama calls
+	PromptEvalCount    int     `json:"prompt_eval_count"`       // prompt tokens processed
+	MaxPromptEvalCount int     `json:"max_prompt_eval_count"`   // largest prompt of a single call, to compare with num_ctx
+	EvalCount          int     `json:"eval_count"`              // response tokens generated
+	LoadMs             int64   `json:"load_duration_ms"`        // time spent loading the model
+	PromptEvalMs       int64   `json:"prompt_eval_duration_ms"` // time spent processing prompts
+	EvalMs             int64   `json:"eval_duration_ms"`        // time spent generating
+	TokensPerSecond    float64 `json:"tokens_per_second"`       // eval_count / eval_duration
+}
+
+// add accumulates the metrics of one completed call.
+func (m *EvalMetrics) add(call api.Metrics) {
+	m.Calls++
+	m.PromptEvalCount += call.PromptEvalCount
+	m.MaxPromptEvalCount = max(m.MaxPromptEvalCount, call.PromptEvalCount)
+	m.EvalCount += call.EvalCount
+	m.LoadMs += call.LoadDuration.Milliseconds()
+	m.PromptEvalMs += call.PromptEvalDuration.Milliseconds()
+	m.EvalMs += call.EvalDuration.Milliseconds()
+	m.TokensPerSecond = tokensPerSecond(m.EvalCount, m.EvalMs)
+}
+
+// clone returns a copy of m, for handing out from under the store lock.
+func (m *EvalMetrics) clone() *EvalMetrics {
+	if m == nil {
+		return nil
+	}
+	c := *m
+	return &c
+}
+
+// ModelMetrics totals the metrics of every matched task that used a model.
+type ModelMetrics struct {
+	Model              string  `json:"model"`
+	Tasks              int     `json:"tasks"` // tasks that completed at least one call
+	PromptEvalCount    int     `json:"prompt_eval_count"`
+	MaxPromptEvalCount int     `json:"max_prompt_eval_count"`
+	EvalCount          int     `json:"eval_count"`
+	LoadSeconds        float64 `json:"load_seconds"`
+	EvalSeconds        float64 `json:"eval_seconds"`
+	TokensPerSecond    float64 `json:"tokens_per_second"`
+}
+
+// metricsTotals accumulates check_tasks' aggregate metrics, per model.
+type metricsTotals struct {
+	byModel map[string]*EvalMetrics
+	tasks   map[string]int
+}
+
+// add counts one task's metrics toward the totals.
+func (mt *metricsTotals) add(model string, m *EvalMetrics) {
+	if m == nil || m.Calls == 0 {
+		return
+	}
+	if mt.byModel == nil {
+		mt.byModel = make(map[string]*EvalMetrics)
+		mt.tasks = make(map[string]int)
+	}
+	t, ok := mt.byModel[model]
+	if !ok {
+		t = &EvalMetrics{}
+		mt.byModel[model] = t
+	}
+	mt.tasks[model]++
+	t.Calls += m.Calls
+	t.PromptEvalCount += m.PromptEvalCount
+	t.MaxPromptEvalCount = max(t.MaxPromptEvalCount, m.MaxPromptEvalCount)
+	t.EvalCount += m.EvalCount
+	t.LoadMs += m.LoadMs
+	t.EvalMs += m.EvalMs
+}
+
+// fill sets summary's totals, with per-model entries sorted by model name.
+func (mt *metricsTotals) fill(summary *TaskSummary) {
+	var evalMs int64
+	for model, t := range mt.byModel {
+		summary.Models = append(summary.Models, ModelMetrics{
+			Model:              model,
+			Tasks:              mt.tasks[model],
+			PromptEvalCount:    t.PromptEvalCount,
+			MaxPromptEvalCount: t.MaxPromptEvalCount,
+			EvalCount:          t.EvalCount,
+			LoadSeconds:        msToSeconds(t.LoadMs),
+			EvalSeconds:        msToSeconds(t.EvalMs),
+			TokensPerSecond:    tokensPerSecond(t.EvalCount, t.EvalMs),
+		})
+		summary.PromptEvalCount += t.PromptEvalCount
+		summary.EvalCount += t.EvalCount
+		evalMs += t.EvalMs
+	}
+	summary.EvalSeconds = msToSeconds(evalMs)
+	sort.Slice(summary.Models, func(i, j int) bool { return summary.Models[i].Model < summary.Models[j].Model })
+}
+
+// tokensPerSecond returns tokens per second of generation, to one decimal.
+func tokensPerSecond(tokens int, ms int64) float64 {
+	if ms <= 0 {
+		return 0
+	}
+	return float64(int(float64(tokens)*10000/float64(ms))) / 10
+}
+
+// msToSeconds converts milliseconds to seconds, to one decimal.
+func msToSeconds(ms int64) float64 {
+	return float64(ms/100) / 10
+}
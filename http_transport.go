@@ -0,0 +1,202 @@
+// http_transport.go serves MCP over streamable HTTP, so one long-lived
+// server process can be shared by several Claude Code sessions.
+//
+// Over stdio (the default) each session spawns its own server with its own
+// worker pool, and two sessions each running a batch overload the GPU
+// between them. With TRANSPORT=http the server instead runs as a daemon
+// listening on HTTP_ADDR; sessions connect to http://<addr>/mcp and share
+// one worker pool and slot queue, so WORKER_CONCURRENCY bounds the total
+// load on Ollama.
+//
+// Tasks are isolated per MCP session: each task records the ID of the
+// session that submitted it, and every tool, resource and task reference
+// (depends_on, {{result:<id>}}, ...) only matches the caller's own tasks. A
+// task from another session is reported as not found. Pool-wide settings —
+// concurrency, fair_share, tag_weights and model_concurrency — are not per
+// session: a batch from any client that sets them changes them for every
+// client, so on a shared daemon they are best set once, by whoever runs it.
+//
+// A session ID is assigned when a client connects, so tasks don't follow a
+// client across reconnects. When a session closes — the client disconnects
+// with DELETE, or sends no request for HTTP_SESSION_TIMEOUT seconds — its
+// unfinished tasks are cancelled, and its tasks, backups and staging tree
+// are deleted (see releaseClosedSessions), so a long-running daemon doesn't
+// pile up tasks nobody can reach. Tasks recovered from the journal after a
+// restart (STATE_DIR) have no owner any more: every session can see them.
+//
+// The tools run shell commands and write files, so the endpoint is guarded
+// (see guardHTTP). A request whose Origin header isn't a loopback origin is
+// rejected, as the MCP spec requires, so web pages can't drive the server.
+// Without HTTP_TOKEN, the Host header must be a loopback name too, which
+// defeats DNS rebinding, and HTTP_ADDR must be a loopback address. With
+// HTTP_TOKEN set, every request must carry "Authorization: Bearer <token>",
+// and the server may listen on other addresses.
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// defaultHTTPAddr is the HTTP_ADDR default: loopback only, next to Ollama's
+// own port.
+const defaultHTTPAddr = "127.0.0.1:11435"
+
+// defaultHTTPSessionTimeout is how long a session may go without a request
+// before it is closed, unless HTTP_SESSION_TIMEOUT says otherwise.
+const defaultHTTPSessionTimeout = time.Hour
+
+// httpShutdownTimeout bounds how long the daemon waits for in-flight HTTP
+// requests when it is stopped.
+const httpShutdownTimeout = 5 * time.Second
+
+// sessionID returns the ID of the MCP session a request arrived on, which
+// owns the tasks it submits. It is empty over stdio, and for requests
+// without a session (handlers called directly).
+func sessionID[P mcp.Params](req *mcp.ServerRequest[P]) string {
+	if req == nil || req.Session == nil {
+		return ""
+	}
+	return req.Session.ID()
+}
+
+// httpSessionTimeout returns how long a session may sit idle before it is
+// closed: HTTP_SESSION_TIMEOUT in seconds, where 0 means never, else
+// defaultHTTPSessionTimeout.
+func httpSessionTimeout() time.Duration {
+	if v := os.Getenv("HTTP_SESSION_TIMEOUT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			return time.Duration(n) * time.Second
+		}
+	}
+	return defaultHTTPSessionTimeout
+}
+
+// httpHandler routes /mcp to the SDK's streamable HTTP handler, behind
+// guardHTTP. Every session shares s, and with it the store and worker pool.
+// Sessions idle for sessionTimeout are closed; 0 keeps them open.
+func httpHandler(s *mcp.Server, token string, sessionTimeout time.Duration) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/mcp", mcp.NewStreamableHTTPHandler(func(*http.Request) *mcp.Server { return s }, &mcp.StreamableHTTPOptions{
+		SessionTimeout: sessionTimeout,
+	}))
+	return guardHTTP(mux, token)
+}
+
+// releaseClosedSessions calls release with the ID of every session of s
+// once it has closed, so the caller can drop what the session left behind.
+// A session is noticed on its first request.
+func releaseClosedSessions(s *mcp.Server, release func(session string)) {
+	var mu sync.Mutex
+	open := make(map[*mcp.ServerSession]bool)
+	s.AddReceivingMiddleware(func(next mcp.MethodHandler) mcp.MethodHandler {
+		return func(ctx context.Context, method string, req mcp.Request) (mcp.Result, error) {
+			ss, ok := req.GetSession().(*mcp.ServerSession)
+			if ok && ss.ID() != "" {
+				mu.Lock()
+				first := !open[ss]
+				open[ss] = true
+				mu.Unlock()
+				if first {
+					go func() {
+						ss.Wait()
+						mu.Lock()
+						delete(open, ss)
+						mu.Unlock()
+						release(ss.ID())
+					}()
+				}
+			}
+			return next(ctx, method, req)
+		}
+	})
+}
+
+// guardHTTP rejects requests from non-loopback origins (403) and, if token
+// is set, requests without it as a bearer token (401). Without a token it
+// also rejects requests whose Host isn't a loopback name (403).
+func guardHTTP(next http.Handler, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" {
+			u, err := url.Parse(origin)
+			if err != nil || !isLoopbackHost(u.Hostname()) {
+				http.Error(w, "forbidden origin", http.StatusForbidden)
+				return
+			}
+		}
+		if token == "" {
+			host := r.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			if !isLoopbackHost(host) {
+				http.Error(w, "forbidden host", http.StatusForbidden)
+				return
+			}
+		} else {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "missing or invalid bearer token", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isLoopbackHost reports whether host (without a port) is "localhost" or a
+// loopback IP address.
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+// serveHTTP serves s over streamable HTTP at addr until the process
+// receives SIGINT or SIGTERM. token is HTTP_TOKEN; it is required unless
+// addr is a loopback address.
+func serveHTTP(s *mcp.Server, addr, token string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid HTTP_ADDR %q: %v", addr, err)
+	}
+	if token == "" && !isLoopbackHost(host) {
+		return fmt.Errorf("HTTP_ADDR %s is not a loopback address: set HTTP_TOKEN so clients must authenticate, or listen on 127.0.0.1", addr)
+	}
+	srv := &http.Server{Addr: addr, Handler: httpHandler(s, token, httpSessionTimeout())}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	fmt.Fprintf(os.Stderr, "Serving MCP over HTTP at http://%s/mcp\n", addr)
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+// input_files.go reads a task's input_files: several context files sent to
+// the model together, each under a labeled section.
+//
+// Unlike input_file, whose contents are appended raw (so a worker rewriting
+// the file sees exactly the file), input_files are for context — "this
+// interface, plus this implementation" — and the model needs to know where
+// one file ends and the next begins. Each file is rendered as
+//
+//	File: /repo/pkg/store.go (go)
+//	```go
+//	...contents...
+//	```
+//
+// with a longer fence if the file itself contains ``` lines.
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// languageByExt maps file extensions to the language named in section
+// headers and fences. Unknown extensions get no language.
+var languageByExt = map[string]string{
+	".go":    "go",
+	".py":    "python",
+	".js":    "javascript",
+	".jsx":   "jsx",
+	".ts":    "typescript",
+	".tsx":   "tsx",
+	".rs":    "rust",
+	".java":  "java",
+	".kt":    "kotlin",
+	".c":     "c",
+	".h":     "c",
+	".cc":    "cpp",
+	".cpp":   "cpp",
+	".hpp":   "cpp",
+	".cs":    "csharp",
+	".rb":    "ruby",
+	".php":   "php",
+	".swift": "swift",
+	".sh":    "bash",
+	".sql":   "sql",
+	".html":  "html",
+	".css":   "css",
+	".md":    "markdown",
+	".json":  "json",
+	".yaml":  "yaml",
+	".yml":   "yaml",
+	".toml":  "toml",
+	".xml":   "xml",
+	".proto": "protobuf",
+}
+
+// readInputFiles reads every file in paths and joins them into labeled
+// sections. read resolves where each path is actually read from (staged
+// tasks read staged copies). A file that can't be read is reported by its
+// position and path.
+func readInputFiles(paths []string, read func(path string) (string, error)) (string, error) {
+	sections := make([]string, 0, len(paths))
+	for i, path := range paths {
+		content, err := read(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read input_files[%d] %s: %v", i, path, err)
+		}
+		sections = append(sections, fileSection(path, content))
+	}
+	return strings.Join(sections, "\n\n"), nil
+}
+
+// fileSection renders one input file under its header.
+func fileSection(path, content string) string {
+	lang := languageByExt[strings.ToLower(filepath.Ext(path))]
+	header := "File: " + path
+	if lang != "" {
+		header += " (" + lang + ")"
+	}
+	fence := "```"
+	for strings.Contains(content, fence) {
+		fence += "`"
+	}
+	return header + "\n" + fence + lang + "\n" + strings.TrimSuffix(content, "\n") + "\n" + fence
+}
@@ -0,0 +1,271 @@
+// input_glob.go expands input_glob task specs into one task per matching file,
+// so refactoring 200 files costs the orchestrating agent one TaskSpec instead
+// of 200.
+//
+// A spec with input_glob (e.g. "/repo/**/*.go", or a directory to take every
+// file under it) is a template: the handler expands it before validation into
+// one spec per matching regular file, in lexical order, with input_file set
+// to the file. Files matching any exclude pattern are skipped. output_file,
+// input_files, prompt, post_write_cmd and validate_cmd may contain path
+// placeholders, filled in per file:
+//
+//	{{path}}  /repo/pkg/a.go    {{dir}}   /repo/pkg
+//	{{name}}  a.go              {{stem}}  a
+//	{{ext}}   .go               {{rel}}   pkg/a.go (relative to the glob's base directory)
+//
+// so "{{dir}}/{{stem}}_test.go" writes a test file next to each source file.
+// When the glob matches several files, output_file must use placeholders
+// that give each file its own output path; otherwise every task would write
+// the same file and only the last one's output would survive.
+//
+// The matches are counted before any task is built, so a glob that expands
+// past the batch limit is rejected without building the tasks.
+//
+// Batch indexes in depends_on, input_from_task and {{result:<index>}} keep
+// referring to positions in the submitted tasks list; they are remapped to
+// the expanded positions here. An expanded spec stands for many tasks, so
+// referencing one by index is an error.
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// expandInputGlobs replaces every spec that has an input_glob with one spec
+// per matching file and remaps batch index references to match. expanded[i]
+// is true for specs produced by a glob. Batches without input_glob are
+// returned unchanged. Returns an error if the expanded batch would have more
+// than limit tasks.
+func expandInputGlobs(specs []TaskSpec, limit int) (out []TaskSpec, expanded []bool, err error) {
+	hasGlob := false
+	for _, spec := range specs {
+		if spec.InputGlob != "" {
+			hasGlob = true
+		}
+	}
+	if !hasGlob {
+		return specs, nil, nil
+	}
+
+	// Glob every spec first, so the batch size is known before any task is
+	// built.
+	roots := make([]string, len(specs))
+	matches := make([][]string, len(specs))
+	total := 0
+	for i, spec := range specs {
+		if spec.InputGlob == "" {
+			total++
+			continue
+		}
+		if spec.InputFile != "" {
+			return nil, nil, fmt.Errorf("task %d: input_glob and input_file are mutually exclusive", i)
+		}
+		if !filepath.IsAbs(spec.InputGlob) {
+			return nil, nil, fmt.Errorf("task %d: input_glob must be an absolute path or pattern, got %q", i, spec.InputGlob)
+		}
+		root, files, err := globFiles(spec.InputGlob, spec.Exclude)
+		if err != nil {
+			return nil, nil, fmt.Errorf("task %d: input_glob: %v", i, err)
+		}
+		if len(files) == 0 {
+			return nil, nil, fmt.Errorf("task %d: input_glob %q matched no files", i, spec.InputGlob)
+		}
+		roots[i], matches[i] = root, files
+		total += len(files)
+	}
+	if total > limit {
+		return nil, nil, fmt.Errorf("batch too large: input_glob expands to %d tasks, exceeding the maximum of %d", total, limit)
+	}
+
+	// newIndex[i] is spec i's position in the expanded batch, or -1 if it
+	// expanded into several tasks.
+	newIndex := make([]int, len(specs))
+	var origin []int
+	for i, spec := range specs {
+		if spec.InputGlob == "" {
+			newIndex[i] = len(out)
+			out = append(out, spec)
+			expanded = append(expanded, false)
+			origin = append(origin, i)
+			continue
+		}
+		root, files := roots[i], matches[i]
+		newIndex[i] = -1
+		outputs := make(map[string]string, len(files)) // output_file → input file
+		for _, file := range files {
+			s := spec
+			s.InputGlob, s.Exclude = "", nil
+			s.InputFile = file
+			s.OutputFile = fillPathTemplate(spec.OutputFile, file, root)
+			if prev, ok := outputs[s.OutputFile]; ok && s.OutputFile != "" {
+				return nil, nil, fmt.Errorf("task %d: output_file %q gives %s and %s the same output file %s; use placeholders such as {{dir}}/{{name}} so each matched file gets its own",
+					i, spec.OutputFile, prev, file, s.OutputFile)
+			}
+			outputs[s.OutputFile] = file
+			s.Prompt = fillPathTemplate(spec.Prompt, file, root)
+			s.PostWriteCmd = fillPathTemplate(spec.PostWriteCmd, file, root)
+			s.ValidateCmd = fillPathTemplate(spec.ValidateCmd, file, root)
+			if len(spec.InputFiles) > 0 {
+				s.InputFiles = make([]string, len(spec.InputFiles))
+				for k, f := range spec.InputFiles {
+					s.InputFiles[k] = fillPathTemplate(f, file, root)
+				}
+			}
+			out = append(out, s)
+			expanded = append(expanded, true)
+			origin = append(origin, i)
+		}
+	}
+
+	// Remap batch index references to expanded positions.
+	for j := range out {
+		i := origin[j]
+		var remapErr error
+		remap := func(ref string) string {
+			n, err := strconv.Atoi(ref)
+			if err != nil || n < 0 || n >= len(specs) {
+				return ref // a task ID, or out of range: left for resolveTaskRef to judge
+			}
+			if newIndex[n] < 0 && remapErr == nil {
+				remapErr = fmt.Errorf("task %d: cannot reference task %d by index: its input_glob expands to many tasks", i, n)
+			}
+			return strconv.Itoa(newIndex[n])
+		}
+		if len(out[j].DependsOn) > 0 {
+			deps := make([]string, len(out[j].DependsOn))
+			for k, ref := range out[j].DependsOn {
+				deps[k] = remap(ref)
+			}
+			out[j].DependsOn = deps
+		}
+		if out[j].InputFromTask != "" {
+			out[j].InputFromTask = remap(out[j].InputFromTask)
+		}
+		out[j].Prompt = rewriteResultPlaceholders(out[j].Prompt, remap)
+		if remapErr != nil {
+			return nil, nil, remapErr
+		}
+	}
+	return out, expanded, nil
+}
+
+// globFiles returns the regular files matching pattern, minus those matching
+// an exclude pattern, and the base directory the pattern is rooted at. "**"
+// matches any number of directories. A pattern naming a directory matches
+// every file under it.
+func globFiles(pattern string, exclude []string) (root string, files []string, err error) {
+	pattern = filepath.Clean(pattern)
+	if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+		pattern = filepath.Join(pattern, "**")
+	}
+	for _, ex := range exclude {
+		if _, err := path.Match(ex, ""); err != nil {
+			return "", nil, fmt.Errorf("bad exclude pattern %q: %v", ex, err)
+		}
+	}
+
+	// Walk from the deepest directory without wildcards.
+	root = pattern
+	for strings.ContainsAny(root, "*?[") {
+		root = filepath.Dir(root)
+	}
+	if root == pattern {
+		// No wildcards: a single file
+		root = filepath.Dir(pattern)
+		if info, err := os.Stat(pattern); err == nil && info.Mode().IsRegular() && !excluded(pattern, root, exclude) {
+			files = append(files, pattern)
+		}
+		return root, files, nil
+	}
+
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root && os.IsNotExist(err) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if excluded(p, root, exclude) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() && matchGlob(pattern, p) {
+			files = append(files, p)
+		}
+		return nil
+	})
+	return root, files, err
+}
+
+// excluded reports whether p matches any exclude pattern. Patterns without a
+// slash match the base name ("*_test.go", "vendor"); others match the full
+// path, or the path relative to root.
+func excluded(p, root string, exclude []string) bool {
+	rel, _ := filepath.Rel(root, p)
+	for _, ex := range exclude {
+		if !strings.Contains(ex, "/") {
+			if ok, _ := path.Match(ex, filepath.Base(p)); ok {
+				return true
+			}
+			continue
+		}
+		if matchGlob(ex, p) || matchGlob(ex, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob reports whether name matches pattern, element by element, where a
+// "**" element matches zero or more path elements.
+func matchGlob(pattern, name string) bool {
+	return matchElems(strings.Split(filepath.ToSlash(pattern), "/"), strings.Split(filepath.ToSlash(name), "/"))
+}
+
+func matchElems(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchElems(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// fillPathTemplate substitutes the path placeholders in s for file, which
+// was matched by a glob rooted at root.
+func fillPathTemplate(s, file, root string) string {
+	if !strings.Contains(s, "{{") {
+		return s
+	}
+	name := filepath.Base(file)
+	ext := filepath.Ext(name)
+	rel, _ := filepath.Rel(root, file)
+	return strings.NewReplacer(
+		"{{path}}", file,
+		"{{dir}}", filepath.Dir(file),
+		"{{name}}", name,
+		"{{stem}}", strings.TrimSuffix(name, ext),
+		"{{ext}}", ext,
+		"{{rel}}", rel,
+	).Replace(s)
+}
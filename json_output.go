@@ -0,0 +1,83 @@
+// json_output.go implements structured output for response_hint "json".
+//
+// A task that wants JSON back has its Ollama request constrained with the
+// format parameter: the task's json_schema when one is given, otherwise plain
+// "json" mode. Constrained decoding makes conforming output very likely but
+// not guaranteed (e.g. num_predict can cut an object off mid-way), so the
+// worker also checks the final response — it must parse as JSON and, with a
+// schema, validate against it — and fails the task with the precise error
+// when it doesn't.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/jsonschema-go/jsonschema"
+)
+
+// jsonSchemaDraft is the only JSON Schema version jsonschema-go validates.
+const jsonSchemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+// compileJSONSchema checks that raw is a usable JSON Schema and returns its
+// JSON encoding, which is what the task stores and what Ollama receives as
+// its format parameter.
+func compileJSONSchema(raw map[string]any) (json.RawMessage, error) {
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid json_schema: %v", err)
+	}
+	if _, err := resolveJSONSchema(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// resolveJSONSchema parses and resolves a schema for validation.
+func resolveJSONSchema(data json.RawMessage) (*jsonschema.Resolved, error) {
+	var schema jsonschema.Schema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, fmt.Errorf("invalid json_schema: %v", err)
+	}
+	if schema.Schema != "" && schema.Schema != jsonSchemaDraft {
+		return nil, fmt.Errorf("invalid json_schema: unsupported $schema %q (only %s is supported)", schema.Schema, jsonSchemaDraft)
+	}
+	resolved, err := schema.Resolve(nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid json_schema: %v", err)
+	}
+	return resolved, nil
+}
+
+// ollamaFormat returns the format parameter for the task's chat request:
+// its JSON schema, "json" for response_hint "json" without a schema, or nil
+// for unconstrained output.
+func ollamaFormat(task *Task) json.RawMessage {
+	if len(task.JSONSchema) > 0 {
+		return task.JSONSchema
+	}
+	if task.ResponseHint == "json" {
+		return json.RawMessage(`"json"`)
+	}
+	return nil
+}
+
+// validateJSONOutput checks that output is a single JSON value and, if schema
+// is set, that it conforms to the schema.
+func validateJSONOutput(output string, schema json.RawMessage) error {
+	var instance any
+	if err := json.Unmarshal([]byte(output), &instance); err != nil {
+		return fmt.Errorf("response is not valid JSON: %v", err)
+	}
+	if len(schema) == 0 {
+		return nil
+	}
+	resolved, err := resolveJSONSchema(schema)
+	if err != nil {
+		return err
+	}
+	if err := resolved.Validate(instance); err != nil {
+		return fmt.Errorf("response does not match json_schema: %v", err)
+	}
+	return nil
+}
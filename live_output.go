@@ -0,0 +1,118 @@
+// live_output.go tracks the response of each task's in-flight Ollama call as
+// it streams in, for peek_task.
+//
+// Without it the streamed chunks are invisible until the call finishes, so a
+// model stuck repeating itself or rambling far past the expected length can
+// burn minutes of GPU time unnoticed. The worker records every chunk here;
+// peek_task reads the token count, the generation speed and the tail of the
+// text so far. Ollama streams roughly one token per chunk, so chunks are
+// counted as tokens until the final chunk reports the exact count.
+//
+// Live state lives in the worker pool rather than the task store: it changes
+// on every token, and the store journals every mutation.
+package main
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// liveOutput is the state of a task's current Ollama call. Guarded by
+// WorkerPool.liveMu.
+type liveOutput struct {
+	calls      int // calls started so far
+	text       strings.Builder
+	tokens     int
+	callStart  time.Time
+	firstToken time.Time
+	lastToken  time.Time
+}
+
+// startLive resets task id's live output for a new Ollama call.
+func (p *WorkerPool) startLive(id string) {
+	p.liveMu.Lock()
+	defer p.liveMu.Unlock()
+	if p.live == nil {
+		p.live = make(map[string]*liveOutput)
+	}
+	l, ok := p.live[id]
+	if !ok {
+		l = &liveOutput{}
+		p.live[id] = l
+	}
+	l.calls++
+	l.text.Reset()
+	l.tokens = 0
+	l.callStart = time.Now()
+	l.firstToken, l.lastToken = time.Time{}, time.Time{}
+}
+
+// appendLive records a streamed chunk of task id's response. evalCount is
+// the exact token count when Ollama reports one (on the final chunk), else 0.
+func (p *WorkerPool) appendLive(id, content string, evalCount int) {
+	p.liveMu.Lock()
+	defer p.liveMu.Unlock()
+	l, ok := p.live[id]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	if content != "" {
+		if l.firstToken.IsZero() {
+			l.firstToken = now
+		}
+		l.lastToken = now
+		l.text.WriteString(content)
+		l.tokens++
+	}
+	if evalCount > 0 {
+		l.tokens = evalCount
+	}
+}
+
+// endLive drops task id's live output once the task is done with Ollama.
+func (p *WorkerPool) endLive(id string) {
+	p.liveMu.Lock()
+	defer p.liveMu.Unlock()
+	delete(p.live, id)
+}
+
+// peekLive fills in out's live fields from task id's current call, with up
+// to tailChars characters from the end of the response. Reports false if the
+// task has no call in progress.
+func (p *WorkerPool) peekLive(id string, tailChars int, out *PeekTaskOutput) bool {
+	p.liveMu.Lock()
+	defer p.liveMu.Unlock()
+	l, ok := p.live[id]
+	if !ok {
+		return false
+	}
+	text := l.text.String()
+	out.Call = l.calls
+	out.Tokens = l.tokens
+	out.CallSeconds = int(time.Since(l.callStart).Seconds())
+	out.Chars = utf8.RuneCountInString(text)
+	if secs := l.lastToken.Sub(l.firstToken).Seconds(); secs > 0 && l.tokens > 1 {
+		// The first token marks the start of generation, so it isn't timed
+		out.TokensPerSecond = float64(int(float64(l.tokens-1)/secs*10)) / 10
+	}
+	out.Tail = tail(text, tailChars)
+	return true
+}
+
+// tail returns the last n characters of s.
+func tail(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	i := len(s)
+	for ; n > 0; n-- {
+		_, size := utf8.DecodeLastRuneInString(s[:i])
+		i -= size
+	}
+	return s[i:]
+}
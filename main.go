@@ -3,20 +3,43 @@
 // This server is designed to be spawned by Claude Code as an MCP server
 // process. It communicates over stdin/stdout using the MCP protocol (JSON-RPC).
 // Claude Code starts this process automatically when a new session begins —
-// there is no separate daemon to manage.
+// there is no separate daemon to manage. Alternatively, TRANSPORT=http runs
+// it as a daemon that several sessions share (see http_transport.go).
 //
-// The server exposes five tools:
+// The server exposes nine tools:
 //   - list_models:   discover available Ollama models and their capabilities
 //   - submit_tasks:  submit a batch of work items for Ollama to process
 //   - check_tasks:   poll task status (lightweight, no result content)
+//   - peek_task:     live token count, speed and output tail of a running task
 //   - get_result:    retrieve full results for specific completed tasks
 //   - cancel_tasks:  cancel pending or running tasks
+//   - undo_tasks:    restore output files to their contents before a task wrote them
+//   - apply_staged:  promote staged output files into place
+//   - discard_staged: delete staged output files without applying them
+//
+// It also exposes each task's result and prompt, and each tag's summary, as
+// MCP resources (task://<id>/result, task://<id>/prompt, tag://<tag>/summary),
+// with resources/updated notifications for subscribers.
+//
+// MCP prompts (refactor-files, summarize-codebase, add-struct-tags,
+// generate-tests) render ready-to-use submit_tasks plans for common jobs.
 //
 // Configuration via environment variables:
 //   - OLLAMA_HOST:         Ollama API address (default: http://127.0.0.1:11434)
-//   - WORKER_CONCURRENCY:  max parallel Ollama requests (default: 2)
+//   - WORKER_CONCURRENCY:  max parallel Ollama requests (default: 2, or the sum of OLLAMA_HOSTS limits)
+//   - MODEL_CONCURRENCY:   per-model limits on each backend as model=limit,... (default: unset, no per-model limits)
+//   - OLLAMA_HOSTS:        several Ollama servers to spread tasks across, as host[=concurrency],... (default: unset, OLLAMA_HOST only)
 //   - DEFAULT_MODEL:       fallback model when tasks don't specify one (default: qwen2.5-coder:14b)
 //   - TASK_TIMEOUT:        default per-task timeout in seconds (default: 600)
+//   - STATE_DIR:           directory for the on-disk task journal (default: unset, in-memory only)
+//   - BACKUP_DIR:          directory for pre-write output file backups (default: STATE_DIR/backups, else a per-process temp dir removed on exit)
+//   - BACKUP_RETENTION:    finished tasks whose backups are kept for undo_tasks (default: 1000)
+//   - OLLAMA_CONTEXT_LENGTH: context window assumed when a task doesn't set num_ctx (default: model's trained length; chunks sized for 4096)
+//   - STAGING_DIR:         root of the staging tree for staged batches (default: STATE_DIR/staging, else the system temp dir)
+//   - TRANSPORT:           stdio (default), or http to run as a daemon shared by several sessions
+//   - HTTP_ADDR:           listen address with TRANSPORT=http (default: 127.0.0.1:11435)
+//   - HTTP_TOKEN:          bearer token HTTP clients must send; required unless HTTP_ADDR is loopback (default: unset)
+//   - HTTP_SESSION_TIMEOUT: seconds an HTTP session may go without a request before it is closed and its tasks dropped; 0 for never (default: 3600)
 package main
 
 import (
@@ -37,8 +60,24 @@ func getDefaultModel() string {
 }
 
 func main() {
-	// Initialize shared state: the task store and worker pool.
+	transport := os.Getenv("TRANSPORT")
+	if transport != "" && transport != "stdio" && transport != "http" {
+		fmt.Fprintf(os.Stderr, "Unknown TRANSPORT %q: use stdio or http\n", transport)
+		os.Exit(1)
+	}
+
+	// Initialize shared state: the task store and worker pool. With
+	// STATE_DIR set, the store replays its journal so tasks from a previous
+	// server process (e.g. before Claude Code restarted it) are still visible.
 	store := NewTaskStore()
+	if dir := os.Getenv("STATE_DIR"); dir != "" {
+		var err error
+		store, err = NewPersistentTaskStore(dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load task state from %s: %v\n", dir, err)
+			os.Exit(1)
+		}
+	}
 
 	pool, err := NewWorkerPool(store)
 	if err != nil {
@@ -46,19 +85,65 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Re-queue any pending tasks recovered from the journal.
+	if n := pool.Resume(); n > 0 {
+		fmt.Fprintf(os.Stderr, "Resumed %d pending task(s) from %s\n", n, os.Getenv("STATE_DIR"))
+	}
+
 	handlers := &ToolHandlers{store: store, pool: pool}
 
-	// Create the MCP server using the official SDK. The Instructions field
-	// is sent to Claude during initialization and teaches it how to use
-	// the worker tools effectively.
+	s := newServer(handlers)
+	go handlers.publishResourceUpdates(s)
+
+	// Serve over stdio by default: Claude Code communicates with this
+	// process via stdin/stdout using JSON-RPC (the MCP transport protocol),
+	// and Run blocks until the client disconnects (i.e. the Claude Code
+	// session ends). With TRANSPORT=http the process is instead a daemon
+	// shared by every session that connects (see http_transport.go).
+	var serverErr error
+	if transport == "http" {
+		addr := os.Getenv("HTTP_ADDR")
+		if addr == "" {
+			addr = defaultHTTPAddr
+		}
+		releaseClosedSessions(s, pool.ReleaseSession)
+		serverErr = serveHTTP(s, addr, os.Getenv("HTTP_TOKEN"))
+	} else {
+		serverErr = s.Run(context.Background(), &mcp.StdioTransport{})
+	}
+
+	// Close the journal before shutting down the pool: the cancellations
+	// Shutdown performs are an artifact of this process exiting, not a user
+	// decision, so they must not be persisted. Pending tasks stay pending in
+	// the journal and are resumed by the next server process.
+	if err := store.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to close task journal: %v\n", err)
+	}
+
+	// Graceful shutdown: cancel in-flight tasks and wait for goroutines to drain
+	// so we don't leave orphaned Ollama requests consuming GPU time.
+	pool.Shutdown()
+
+	if serverErr != nil {
+		fmt.Fprintf(os.Stderr, "Server error: %v\n", serverErr)
+		os.Exit(1)
+	}
+}
+
+// newServer creates the MCP server and registers every tool, resource
+// template and prompt on it. The Instructions field is sent to Claude during
+// initialization and teaches it how to use the worker tools effectively.
+func newServer(handlers *ToolHandlers) *mcp.Server {
 	s := mcp.NewServer(&mcp.Implementation{
 		Name:    "OpusGoLlama",
 		Version: "3.0.0",
 	}, &mcp.ServerOptions{
-		Instructions: serverInstructions,
+		Instructions:       serverInstructions,
+		SubscribeHandler:   acceptSubscription,
+		UnsubscribeHandler: acceptUnsubscription,
 	})
 
-	// Register all five tools. The SDK auto-generates JSON Schema for each
+	// Register all nine tools. The SDK auto-generates JSON Schema for each
 	// tool's input/output from the struct tags on the arg/output types.
 	mcp.AddTool(s, &mcp.Tool{
 		Name: "list_models",
@@ -70,27 +155,55 @@ func main() {
 	mcp.AddTool(s, &mcp.Tool{
 		Name: "submit_tasks",
 		Description: "Submit one or more tasks for local Ollama workers to process. Returns task IDs immediately — work runs in the background. " +
-			"Each task needs a system_prompt and prompt. Use input_file to read file contents directly (keeps them out of your context) " +
+			"Each task needs a system_prompt and prompt. Use input_file to read file contents directly (keeps them out of your context), " +
+			"input_files for extra context files (each sent in a section labeled with its path and language), " +
+			"or input_glob (e.g. /repo/**/*.go, with exclude patterns) to expand one spec into a task per file, templating output_file like {{dir}}/{{stem}}_test.go, " +
 			"and output_file to write results to disk. strip_markdown_fences (default: true) removes code fences before writing. " +
+			"chunk: true splits an input_file too large for the context window into pieces, runs each, and stitches the outputs (oversized prompts otherwise fail instead of being truncated). " +
+			"output_mode unified_diff or search_replace has the model return only a patch, which the server applies to input_file and writes to output_file (fast edits to large files). " +
 			"post_write_cmd runs a shell command after writing (e.g. a formatter). " +
+			"validate_cmd (e.g. 'go build ./...') runs after that; if it fails, its output is fed back to the model for up to max_repair_attempts (default 2) repair turns. " +
 			"You can specify model, tag (for grouping/filtering), response_hint (status_only|content|json), and timeout_seconds (default 600). " +
+			"json_schema constrains the response to a JSON Schema and fails the task if the final response doesn't validate (response_hint json alone requires valid JSON). " +
+			"options passes Ollama generation options (temperature, num_ctx, seed, top_p, stop, ...) per task, with batch-level defaults in the top-level options field. " +
+			"Transient Ollama errors (connection refused, server busy, model loading) are retried automatically — tune with max_retries (default 2) and retry_backoff_seconds (default 5). " +
+			"Use depends_on (task IDs or 0-based indexes into this batch) to run a task only after others complete; failures cascade to dependents. " +
+			"Chain outputs with {{result:<id or index>}} placeholders in the prompt or input_from_task — the server substitutes upstream results directly. " +
+			"Add a batch-level reduce spec (prompt, optional system_prompt/model/options/output_file) to combine every task's result into one once they all finish; get_result only the returned reduce_task_id. " +
+			"Set priority (default 0) so higher-priority tasks get the next free worker slot ahead of queued background work. " +
+			"Set fair_share: true (optionally with tag_weights) so batches with different tags take turns for worker slots instead of running in submission order. " +
+			"concurrency, fair_share, tag_weights and model_concurrency are pool-wide: they affect every session's tasks, and are applied only if the batch is accepted. " +
+			"Set staging: true to write every output_file to a staging tree instead of the real path; review, then apply_staged or discard_staged. " +
+			"With staging, post_write_cmd and validate_cmd must name output_file by its absolute path — only that path is redirected to the staged copy, so a command like 'go build ./...' is rejected rather than silently checking the real tree. " +
 			"Set concurrency to adjust the number of parallel Ollama requests (e.g. lower for larger models, higher for lightweight tasks). " +
+			"Set model_concurrency (e.g. {\"qwen2.5-coder:32b\": 1}) to cap parallel tasks per model on each Ollama backend; other models use the remaining slots. Queued tasks for the model Ollama already has loaded go first to avoid reloading models. " +
+			"Set wait: true to keep the call open until the batch finishes and get its summary; with a progress token, progress notifications report each task starting and finishing meanwhile, the last one ending with the batch's counts. " +
 			"Always test with 2-3 tasks first before submitting a full batch.",
 	}, handlers.handleSubmitTasks)
 
 	mcp.AddTool(s, &mcp.Tool{
 		Name: "check_tasks",
-		Description: "Lightweight status poll. Returns aggregate counts (pending/running/completed/failed/cancelled) and per-task status without full result content. " +
+		Description: "Lightweight status poll. Returns aggregate counts (blocked/pending/running/retrying/completed/failed/cancelled) and per-task status without full result content. " +
 			"Use this for monitoring progress — it's cheap on your context window. " +
 			"Filter by task_ids or tag. Failed tasks include a brief error message — look for 'TIMEOUT:' prefix to identify tasks that need a longer timeout_seconds. " +
-			"Tasks with output_file show the path in the status.",
+			"Tasks with output_file show the path in the status, and completed ones a lines_added/lines_removed diff stat. " +
+			"Each task's metrics give Ollama's token counts and timings; the summary totals them, per model with tokens_per_second.",
 	}, handlers.handleCheckTasks)
 
+	mcp.AddTool(s, &mcp.Tool{
+		Name: "peek_task",
+		Description: "Look at a running task's Ollama call as it streams: tokens generated so far, tokens_per_second, and the last tail_chars (default 500) characters of the response. " +
+			"Use it when a task runs much longer than its siblings to spot a model looping or rambling, then cancel_tasks it early. " +
+			"Tasks that aren't running return only their status.",
+	}, handlers.handlePeekTask)
+
 	mcp.AddTool(s, &mcp.Tool{
 		Name: "get_result",
 		Description: "Retrieve the full Ollama response content for specific completed or failed tasks. " +
 			"Use selectively — spot-check a few results or investigate failures rather than retrieving everything. " +
 			"Takes a list of task_ids. Returns full content, status, and any error message for each. " +
+			"Tasks with validate_cmd also return repair_attempts and the full conversation with the model. " +
+			"Set include_diff to get the unified diff of what each output_file task changed — cheaper than reading the whole file. " +
 			"Note: tasks with output_file have their result written to disk — content will be empty but output_file path is returned.",
 	}, handlers.handleGetResult)
 
@@ -100,17 +213,31 @@ func main() {
 			"Filter by task_ids or tag. If both are empty, cancels all pending/running tasks.",
 	}, handlers.handleCancelTasks)
 
-	// Run the server over stdio. Claude Code communicates with this process
-	// via stdin/stdout using JSON-RPC (the MCP transport protocol).
-	// This blocks until the client disconnects (i.e. the Claude Code session ends).
-	serverErr := s.Run(context.Background(), &mcp.StdioTransport{})
+	mcp.AddTool(s, &mcp.Tool{
+		Name: "undo_tasks",
+		Description: "Restore the output files written by finished tasks to their contents before the task wrote them (files that didn't exist before are removed). " +
+			"Filter by task_ids or tag; if both are empty, undoes every task that wrote an output file. " +
+			"Running tasks are skipped — cancel them first. Each task can be undone once. Returns what happened to each file.",
+	}, handlers.handleUndoTasks)
 
-	// Graceful shutdown: cancel in-flight tasks and wait for goroutines to drain
-	// so we don't leave orphaned Ollama requests consuming GPU time.
-	pool.Shutdown()
+	mcp.AddTool(s, &mcp.Tool{
+		Name: "apply_staged",
+		Description: "Promote the staged output files of a staging batch into their real output_file paths. " +
+			"Filter by task_ids or tag; if both are empty, applies every staged task. Only completed tasks are applied; the rest are skipped with a reason. " +
+			"All-or-nothing: if any staged file can't be prepared or moved into place, the files already moved are restored and no real file is changed; the error names any file that couldn't be restored. Applied files can be reverted with undo_tasks.",
+	}, handlers.handleApplyStaged)
 
-	if serverErr != nil {
-		fmt.Fprintf(os.Stderr, "Server error: %v\n", serverErr)
-		os.Exit(1)
-	}
+	mcp.AddTool(s, &mcp.Tool{
+		Name: "discard_staged",
+		Description: "Delete the staged output files of a staging batch without touching the real files. " +
+			"Filter by task_ids or tag; if both are empty, discards every staged task. Running tasks are skipped.",
+	}, handlers.handleDiscardStaged)
+
+	// Expose tasks as resources too (see resources.go).
+	registerResources(s, handlers)
+
+	// Offer the delegation recipes as prompts (see prompts.go).
+	registerPrompts(s)
+
+	return s
 }
@@ -4,16 +4,30 @@ package main
 // ListModelsArgs is the input for the list_models tool. No arguments needed.
 type ListModelsArgs struct{}
 
-// ListModelsOutput lists all models available in the local Ollama instance.
+// ListModelsOutput lists all models available in the local Ollama instance,
+// or on every backend when there are several (see backends.go).
 type ListModelsOutput struct {
-	Models []ModelInfo `json:"models"`
+	Models   []ModelInfo     `json:"models"`
+	Backends []BackendStatus `json:"backends,omitempty"` // only with several backends
 }
 
 // ModelInfo describes a single Ollama model's capabilities.
 type ModelInfo struct {
-	Name              string `json:"name"`
-	Size              int64  `json:"size"`                // size in bytes
-	ParameterSize     string `json:"parameter_size"`      // e.g. "14B", "7B"
-	QuantizationLevel string `json:"quantization_level"`  // e.g. "Q4_K_M"
-	Family            string `json:"family"`              // e.g. "qwen2"
+	Name              string   `json:"name"`
+	Size              int64    `json:"size"`                  // size in bytes
+	ParameterSize     string   `json:"parameter_size"`        // e.g. "14B", "7B"
+	QuantizationLevel string   `json:"quantization_level"`    // e.g. "Q4_K_M"
+	Family            string   `json:"family"`                // e.g. "qwen2"
+	Backends          []string `json:"backends,omitempty"`    // hosts that have the model, with several backends
+	Concurrency       int      `json:"concurrency,omitempty"` // max parallel tasks per backend, if limited (see model_limits.go)
+}
+
+// BackendStatus describes one Ollama backend when there are several.
+type BackendStatus struct {
+	Host        string `json:"host"`
+	Healthy     bool   `json:"healthy"`
+	Error       string `json:"error,omitempty"`       // why it isn't healthy
+	Models      int    `json:"models"`                // number of installed models
+	Running     int    `json:"running"`               // worker slots in use on this backend
+	Concurrency int    `json:"concurrency,omitempty"` // max slots on this backend
 }
@@ -0,0 +1,145 @@
+// model_limits.go makes the scheduler aware of which model each task uses.
+//
+// Per-model limits: the pool's concurrency treats every slot alike, but a
+// 32B model may only fit once in a GPU's memory while a 3B model fits eight
+// times. MODEL_CONCURRENCY (or model_concurrency on submit_tasks) caps how
+// many tasks of a model run at once on each backend — the limit is per
+// backend, since each backend has its own GPU memory, so with OLLAMA_HOSTS
+// listing two backends a limit of 1 lets two tasks of the model run, one on
+// each:
+//
+//	MODEL_CONCURRENCY=qwen2.5-coder:32b=1,qwen2.5-coder:3b=8
+//
+// A task whose model is at its limit on every backend that has it waits in
+// the queue and is passed over, so tasks for other models can use the free
+// slots. Models without a limit are bounded only by the pool's and the
+// backend's concurrency.
+//
+// Loaded-model-first: Ollama swaps models in and out of GPU memory, and a
+// queue alternating between two models makes it reload on every request.
+// So among queued tasks of equal priority, the scheduler prefers those whose
+// model is already loaded on a backend — running there, or in memory
+// according to the backend's /api/ps at the last health check (see
+// backends.go) or since — and pickBackend prefers a backend where the model
+// is loaded. If /api/ps is unavailable, the last model that ran on the
+// backend is taken to be the loaded one. Fair-share ordering across tags
+// still comes first. To keep this from starving other models, a task passed
+// over maxModelSkips times for a loaded model gets its place in submission
+// order back.
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxModelSkips is how many times a queued task can be passed over for
+// tasks of a loaded model before it stops yielding to them.
+const maxModelSkips = 32
+
+// parseModelLimits parses MODEL_CONCURRENCY: comma-separated
+// "<model>=<limit>" entries.
+func parseModelLimits(s string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("MODEL_CONCURRENCY entry %q: expected <model>=<limit>", entry)
+		}
+		n, err := strconv.Atoi(entry[i+1:])
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("MODEL_CONCURRENCY entry %q: limit must be a positive integer", entry)
+		}
+		limits[modelKey(strings.TrimSpace(entry[:i]))] = n
+	}
+	return limits, nil
+}
+
+// SetModelLimits sets the per-backend concurrency limit of each model in
+// limits, keeping the limits of other models. Raising a limit grants slots
+// to queued tasks immediately.
+func (p *WorkerPool) SetModelLimits(limits map[string]int) {
+	p.mu.Lock()
+	if p.modelLimits == nil {
+		p.modelLimits = make(map[string]int)
+	}
+	for model, n := range limits {
+		p.modelLimits[modelKey(model)] = n
+	}
+	p.mu.Unlock()
+	p.dispatch()
+}
+
+// ModelLimits returns a copy of the per-model concurrency limits, keyed by
+// model name (see modelKey).
+func (p *WorkerPool) ModelLimits() map[string]int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	limits := make(map[string]int, len(p.modelLimits))
+	for model, n := range p.modelLimits {
+		limits[model] = n
+	}
+	return limits
+}
+
+// modelFree reports whether b can run another task of model without
+// exceeding the model's limit. Must be called with p.mu held.
+func (p *WorkerPool) modelFree(b *backend, model string) bool {
+	key := modelKey(model)
+	limit := p.modelLimits[key]
+	return limit == 0 || b.modelRunning[key] < limit
+}
+
+// modelLoaded reports whether model is loaded on b: running there, or in
+// memory according to /api/ps — or, if that is unknown, the last model that
+// ran there. Must be called with p.mu held.
+func (b *backend) modelLoaded(model string) bool {
+	key := modelKey(model)
+	if b.modelRunning[key] > 0 {
+		return true
+	}
+	if b.loaded != nil {
+		return b.loaded[key]
+	}
+	return b.lastModel == key
+}
+
+// modelLoadedAnywhere reports whether model is loaded on any backend. Must
+// be called with p.mu held.
+func (p *WorkerPool) modelLoadedAnywhere(model string) bool {
+	for _, b := range p.backends {
+		if b.modelLoaded(model) {
+			return true
+		}
+	}
+	return false
+}
+
+// startModel records that a task of model took a slot on b. Must be called
+// with p.mu held.
+func (b *backend) startModel(model string) {
+	key := modelKey(model)
+	if b.modelRunning == nil {
+		b.modelRunning = make(map[string]int)
+	}
+	b.modelRunning[key]++
+	b.lastModel = key
+	if b.loaded != nil {
+		// Ollama loads it now; the next health check confirms or evicts it
+		b.loaded[key] = true
+	}
+}
+
+// stopModel records that a task of model gave up its slot on b. Must be
+// called with p.mu held.
+func (b *backend) stopModel(model string) {
+	key := modelKey(model)
+	if b.modelRunning[key]--; b.modelRunning[key] <= 0 {
+		delete(b.modelRunning, key)
+	}
+}
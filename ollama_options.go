@@ -0,0 +1,66 @@
+// ollama_options.go validates and merges Ollama generation options
+// (temperature, num_ctx, seed, top_p, stop, ...) passed through to
+// api.ChatRequest.Options.
+//
+// Ollama itself only logs a warning for an unknown option name and carries
+// on, so a typo like "temprature" would silently run with the model default.
+// The server rejects unknown names and mistyped values at submit time instead,
+// using api.Options as the source of truth for what Ollama understands.
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+)
+
+// knownOllamaOptions is the set of option names Ollama accepts, taken from
+// the JSON tags on api.Options (including the embedded api.Runner fields).
+var knownOllamaOptions = func() map[string]bool {
+	names := make(map[string]bool)
+	for _, field := range reflect.VisibleFields(reflect.TypeOf(api.Options{})) {
+		if name := strings.Split(field.Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}()
+
+// validateOllamaOptions rejects option names Ollama doesn't know and values
+// of the wrong type (e.g. a string temperature). Values are expected as
+// decoded from JSON: numbers as float64, stop as a list of strings.
+func validateOllamaOptions(opts map[string]any) error {
+	var unknown []string
+	for name := range opts {
+		if !knownOllamaOptions[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown Ollama option(s) %s", strings.Join(unknown, ", "))
+	}
+	// FromMap performs Ollama's own type checks for each known option.
+	var parsed api.Options
+	return parsed.FromMap(opts)
+}
+
+// mergeOllamaOptions returns the batch-level defaults overlaid with the
+// task's own options; the task wins where both set the same name. Returns
+// nil when neither sets anything, so Ollama uses the model's defaults.
+func mergeOllamaOptions(defaults, task map[string]any) map[string]any {
+	if len(defaults) == 0 && len(task) == 0 {
+		return nil
+	}
+	merged := make(map[string]any, len(defaults)+len(task))
+	for name, v := range defaults {
+		merged[name] = v
+	}
+	for name, v := range task {
+		merged[name] = v
+	}
+	return merged
+}
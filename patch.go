@@ -0,0 +1,349 @@
+// patch.go implements the edit output modes, where the model returns changes
+// to input_file instead of re-emitting the whole file.
+//
+// In output_mode "unified_diff" the model answers with a unified diff; in
+// "search_replace" it answers with SEARCH/REPLACE blocks. Either way the
+// server applies the edit to the input file's contents and writes the result
+// to output_file. For a 2,000-line file where a handful of lines change, this
+// turns a slow, truncation-prone full rewrite into a few dozen lines of
+// output.
+//
+// Models are sloppy with diffs, so hunks are located by their context and
+// removed lines rather than trusted line numbers: the header's line number is
+// only where the search starts. A hunk that still can't be found — or a
+// SEARCH block that doesn't match exactly one place — fails the task with an
+// error naming the hunk and the lines that didn't match.
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Output modes for TaskSpec.OutputMode.
+const (
+	outputModeFull          = "full"
+	outputModeUnifiedDiff   = "unified_diff"
+	outputModeSearchReplace = "search_replace"
+)
+
+// isEditMode reports whether mode makes the model return an edit rather than
+// the full output.
+func isEditMode(mode string) bool {
+	return mode == outputModeUnifiedDiff || mode == outputModeSearchReplace
+}
+
+// validOutputMode reports whether mode is a known output mode ("" means full).
+func validOutputMode(mode string) bool {
+	return mode == "" || mode == outputModeFull || isEditMode(mode)
+}
+
+// editInstructions returns the format instructions appended to the system
+// prompt of an edit-mode task. Workers won't produce a usable patch unless
+// told exactly what one looks like.
+func editInstructions(mode string) string {
+	switch mode {
+	case outputModeUnifiedDiff:
+		return "Respond ONLY with a unified diff of your changes to the provided file — no explanations and no full file. " +
+			"Each hunk starts with a header like \"@@ -12,4 +12,6 @@\" followed by lines prefixed with a space (unchanged context), " +
+			"\"-\" (removed) or \"+\" (added). Include 2-3 unchanged context lines around every change and copy context and removed lines exactly."
+	case outputModeSearchReplace:
+		return "Respond ONLY with SEARCH/REPLACE blocks describing your changes to the provided file — no explanations and no full file. " +
+			"Each block looks like:\n<<<<<<< SEARCH\n(exact lines from the file)\n=======\n(the lines to put in their place)\n>>>>>>> REPLACE\n" +
+			"The SEARCH part must match the file exactly, including indentation, and be long enough to match only one place. Use one block per change."
+	}
+	return ""
+}
+
+// applyEdit applies an edit-mode response to the original file contents.
+func applyEdit(mode, original, response string) (string, error) {
+	lines, trailingNewline := splitLines(original)
+	var err error
+	switch mode {
+	case outputModeUnifiedDiff:
+		lines, err = applyUnifiedDiff(lines, response)
+	case outputModeSearchReplace:
+		lines, err = applySearchReplace(lines, response)
+	default:
+		return "", fmt.Errorf("unknown output_mode %q", mode)
+	}
+	if err != nil {
+		return "", err
+	}
+	out := strings.Join(lines, "\n")
+	if len(lines) > 0 && (trailingNewline || original == "") {
+		out += "\n"
+	}
+	return out, nil
+}
+
+// splitLines splits s into lines without their newlines, reporting whether s
+// ended with one.
+func splitLines(s string) ([]string, bool) {
+	trailing := strings.HasSuffix(s, "\n")
+	s = strings.TrimSuffix(s, "\n")
+	if s == "" {
+		return nil, trailing
+	}
+	return strings.Split(s, "\n"), trailing
+}
+
+// hunk is one parsed unified diff hunk.
+type hunk struct {
+	header   string
+	oldStart int      // 1-based line number from the header; 0 for an empty file
+	old, new []string // lines before and after the change, context included
+}
+
+// applyUnifiedDiff applies every hunk in diff to lines, in order.
+func applyUnifiedDiff(lines []string, diff string) ([]string, error) {
+	hunks, err := parseUnifiedDiff(diff)
+	if err != nil {
+		return nil, err
+	}
+	cursor := 0 // hunks apply in order, each after the previous one
+	for i, h := range hunks {
+		at := findHunk(lines, h, cursor)
+		if at < 0 {
+			return nil, fmt.Errorf("hunk %d (%s) does not apply: these lines were not found in the file after line %d:\n%s",
+				i+1, h.header, cursor, strings.Join(h.old, "\n"))
+		}
+		lines = append(lines[:at:at], append(append([]string{}, h.new...), lines[at+len(h.old):]...)...)
+		cursor = at + len(h.new)
+	}
+	return lines, nil
+}
+
+// hunkHeader matches a hunk header's line ranges, "@@ -a,b +c,d @@", where
+// the counts b and d default to 1.
+var hunkHeader = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+\d+(?:,(\d+))? @@`)
+
+// parseUnifiedDiff extracts the hunks from a diff. Anything outside a hunk —
+// file headers, code fences, commentary — is ignored.
+//
+// A hunk runs for as many lines as its header's counts say, so a removed
+// "-- comment" or an added "++i" line isn't mistaken for the next file's
+// "---"/"+++" headers. Models often leave the counts out or get them wrong,
+// so without counts, and after a hunk has used them up, a "---" or "+++"
+// line, or any line that isn't a diff line, ends the hunk instead.
+func parseUnifiedDiff(diff string) ([]hunk, error) {
+	var hunks []hunk
+	var cur *hunk
+	oldLeft, newLeft := 0, 0 // lines the header's counts still promise
+	finish := func() {
+		if cur == nil {
+			return
+		}
+		// Trailing blank lines are usually formatting, not context
+		for len(cur.old) > 0 && len(cur.new) > 0 && cur.old[len(cur.old)-1] == "" && cur.new[len(cur.new)-1] == "" {
+			cur.old = cur.old[:len(cur.old)-1]
+			cur.new = cur.new[:len(cur.new)-1]
+		}
+		hunks = append(hunks, *cur)
+		cur = nil
+	}
+	for _, line := range strings.Split(diff, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if strings.HasPrefix(line, "@@") {
+			finish()
+			cur = &hunk{header: line}
+			fmt.Sscanf(line, "@@ -%d", &cur.oldStart)
+			oldLeft, newLeft = 0, 0
+			if m := hunkHeader.FindStringSubmatch(line); m != nil {
+				oldLeft, newLeft = hunkCount(m[2]), hunkCount(m[3])
+			}
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		counted := oldLeft > 0 || newLeft > 0
+		if counted && line != "" {
+			switch line[0] {
+			case ' ':
+				oldLeft--
+				newLeft--
+			case '-':
+				oldLeft--
+			case '+':
+				newLeft--
+			}
+		} else if counted {
+			oldLeft--
+			newLeft--
+		}
+		switch {
+		case !counted && (strings.HasPrefix(line, "---") || strings.HasPrefix(line, "+++")):
+			finish() // next file's headers
+		case line == "":
+			cur.old = append(cur.old, "")
+			cur.new = append(cur.new, "")
+		case line[0] == ' ':
+			cur.old = append(cur.old, line[1:])
+			cur.new = append(cur.new, line[1:])
+		case line[0] == '-':
+			cur.old = append(cur.old, line[1:])
+		case line[0] == '+':
+			cur.new = append(cur.new, line[1:])
+		case line[0] == '\\':
+			// "\ No newline at end of file"
+		default:
+			finish()
+		}
+	}
+	finish()
+	if len(hunks) == 0 {
+		return nil, fmt.Errorf("response contains no unified diff hunks (expected @@ headers)")
+	}
+	return hunks, nil
+}
+
+// hunkCount parses a hunk header's line count, which is 1 when omitted.
+func hunkCount(s string) int {
+	if s == "" {
+		return 1
+	}
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// findHunk returns where h's old lines start in lines, searching from cursor
+// and preferring the match nearest the header's line number. Returns -1 if
+// they aren't found, even ignoring trailing whitespace.
+func findHunk(lines []string, h hunk, cursor int) int {
+	if len(h.old) == 0 {
+		// Pure insertion: trust the line number
+		at := h.oldStart
+		if at < cursor {
+			at = cursor
+		}
+		if at > len(lines) {
+			at = len(lines)
+		}
+		return at
+	}
+	for _, trim := range []bool{false, true} {
+		best := -1
+		for at := cursor; at+len(h.old) <= len(lines); at++ {
+			if !linesMatch(lines[at:at+len(h.old)], h.old, trim) {
+				continue
+			}
+			if best < 0 || abs(at-(h.oldStart-1)) < abs(best-(h.oldStart-1)) {
+				best = at
+			}
+		}
+		if best >= 0 {
+			return best
+		}
+	}
+	return -1
+}
+
+// applySearchReplace applies every SEARCH/REPLACE block in response to lines,
+// in order.
+func applySearchReplace(lines []string, response string) ([]string, error) {
+	blocks, err := parseSearchReplace(response)
+	if err != nil {
+		return nil, err
+	}
+	for i, b := range blocks {
+		at, err := findUnique(lines, b.search)
+		if err != nil {
+			return nil, fmt.Errorf("block %d does not apply: %v:\n%s", i+1, err, strings.Join(b.search, "\n"))
+		}
+		lines = append(lines[:at:at], append(append([]string{}, b.replace...), lines[at+len(b.search):]...)...)
+	}
+	return lines, nil
+}
+
+// searchReplaceBlock is one parsed SEARCH/REPLACE block.
+type searchReplaceBlock struct {
+	search, replace []string
+}
+
+// parseSearchReplace extracts the SEARCH/REPLACE blocks from a response.
+// Text outside the blocks is ignored.
+func parseSearchReplace(response string) ([]searchReplaceBlock, error) {
+	const (
+		outside = iota
+		inSearch
+		inReplace
+	)
+	var blocks []searchReplaceBlock
+	var cur searchReplaceBlock
+	state := outside
+	for _, line := range strings.Split(response, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		switch {
+		case state == outside && strings.HasPrefix(line, "<<<<<<<") && strings.Contains(line, "SEARCH"):
+			cur = searchReplaceBlock{}
+			state = inSearch
+		case state == inSearch && strings.HasPrefix(line, "=======") && strings.TrimRight(line, "=") == "":
+			state = inReplace
+		case state == inReplace && strings.HasPrefix(line, ">>>>>>>"):
+			blocks = append(blocks, cur)
+			state = outside
+		case state == inSearch:
+			cur.search = append(cur.search, line)
+		case state == inReplace:
+			cur.replace = append(cur.replace, line)
+		}
+	}
+	if state != outside {
+		return nil, fmt.Errorf("SEARCH/REPLACE block %d is not terminated (expected ======= and >>>>>>> REPLACE)", len(blocks)+1)
+	}
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("response contains no SEARCH/REPLACE blocks")
+	}
+	for i, b := range blocks {
+		if len(b.search) == 0 {
+			return nil, fmt.Errorf("SEARCH/REPLACE block %d has an empty SEARCH section", i+1)
+		}
+	}
+	return blocks, nil
+}
+
+// findUnique returns where want occurs in lines, which must be exactly once.
+// Trailing whitespace is ignored only if there's no exact match.
+func findUnique(lines, want []string) (int, error) {
+	for _, trim := range []bool{false, true} {
+		found := -1
+		for at := 0; at+len(want) <= len(lines); at++ {
+			if !linesMatch(lines[at:at+len(want)], want, trim) {
+				continue
+			}
+			if found >= 0 {
+				return 0, fmt.Errorf("SEARCH text matches more than one place (lines %d and %d); include more context", found+1, at+1)
+			}
+			found = at
+		}
+		if found >= 0 {
+			return found, nil
+		}
+	}
+	return 0, fmt.Errorf("SEARCH text not found in the file")
+}
+
+// linesMatch compares two equal-length line slices, optionally ignoring
+// trailing whitespace.
+func linesMatch(a, b []string, trimTrailing bool) bool {
+	for i := range a {
+		x, y := a[i], b[i]
+		if trimTrailing {
+			x, y = strings.TrimRight(x, " \t"), strings.TrimRight(y, " \t")
+		}
+		if x != y {
+			return false
+		}
+	}
+	return true
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,25 @@
+// peek_task.go defines the peek_task tool types.
+package main
+
+// PeekTaskArgs is the input for the peek_task tool.
+type PeekTaskArgs struct {
+	TaskID string `json:"task_id" jsonschema:"The running task to look at"`
+
+	// TailChars is how much of the response so far to return, from the end.
+	// Nil means the default (500); 0 returns only the counters.
+	TailChars *int `json:"tail_chars,omitempty" jsonschema:"Characters of the response so far to return, counted from the end (default 500, max 20000, 0 for counters only)"`
+}
+
+// PeekTaskOutput is a live view of one task's current Ollama call. The live
+// fields are only set while the task is running.
+type PeekTaskOutput struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+
+	Call            int     `json:"call,omitempty"`              // Ollama calls made so far, counting retries, repair turns and chunks
+	Tokens          int     `json:"tokens,omitempty"`            // tokens generated so far in the current call
+	TokensPerSecond float64 `json:"tokens_per_second,omitempty"` // generation speed since the first token
+	CallSeconds     int     `json:"call_seconds,omitempty"`      // time since the current call started
+	Chars           int     `json:"chars,omitempty"`             // length of the response so far
+	Tail            string  `json:"tail,omitempty"`              // end of the response so far
+}
@@ -0,0 +1,142 @@
+// progress.go implements submit_tasks' wait mode, which keeps the call open
+// until the batch has finished, sending MCP progress notifications while it
+// waits so a client can follow the batch instead of polling check_tasks.
+//
+// The MCP spec only allows progress for a request while it is in flight, so
+// notifications are sent only in wait mode, and only if the call carries a
+// progress token (in the request's _meta). Each time a task starts running,
+// completes, fails or is cancelled, a notification goes out whose progress
+// is the number of finished tasks plus half the running ones, out of the
+// batch total, with a message naming the task — so progress rises with every
+// notification, as the spec requires. The notification for the last task to
+// finish adds the batch's counts ("batch done") and the call returns. If the
+// call is cancelled or the session goes away, waiting stops; the tasks keep
+// running.
+//
+// Without wait, submit_tasks returns at once; clients that want updates can
+// subscribe to the task and tag resources instead (see resources.go).
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// progressNotifyTimeout bounds each notification send, so a client that has
+// stopped reading can't stall the reporter forever.
+const progressNotifyTimeout = 10 * time.Second
+
+// TaskEvent is one status change of a watched task.
+type TaskEvent struct {
+	ID      string
+	Tag     string
+	Session string
+	Status  string
+	Error   string
+}
+
+// taskWatch collects status changes of a set of tasks, or of every task
+// (see TaskStore.Watch and WatchAll). Its fields are guarded by the store's
+// mutex.
+type taskWatch struct {
+	all    bool              // watch every task, not just those in status
+	status map[string]string // task ID → last status seen
+	events []TaskEvent
+	notify chan struct{} // receives a value when events are added
+}
+
+// observe records t's status if it changed and t is watched. Called from
+// TaskStore.transitioned with the store's mutex held.
+func (w *taskWatch) observe(t *Task) {
+	last, ok := w.status[t.ID]
+	if (!ok && !w.all) || last == t.Status {
+		return
+	}
+	w.status[t.ID] = t.Status
+	w.events = append(w.events, TaskEvent{ID: t.ID, Tag: t.Tag, Session: t.Session, Status: t.Status, Error: t.Error})
+	select {
+	case w.notify <- struct{}{}:
+	default: // a wakeup is already pending
+	}
+}
+
+// progressToken returns the progress token of a tool call, or nil if the
+// client didn't ask for progress.
+func progressToken(req *mcp.CallToolRequest) any {
+	if req == nil || req.Params == nil || req.Session == nil {
+		return nil
+	}
+	return req.Params.GetProgressToken()
+}
+
+// awaitBatch blocks until the tasks in ids have all finished or ctx — the
+// submit_tasks call's context — is done, sending progress notifications for
+// token meanwhile if token is non-nil. w must have been registered before
+// the tasks were added to the store. Reports whether the batch finished.
+func (h *ToolHandlers) awaitBatch(ctx context.Context, session *mcp.ServerSession, token any, ids []string, w *taskWatch) bool {
+	defer h.store.Unwatch(w)
+
+	notify := func(progress float64, message string) {
+		if token == nil || session == nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(ctx, progressNotifyTimeout)
+		defer cancel()
+		if err := session.NotifyProgress(ctx, &mcp.ProgressNotificationParams{
+			ProgressToken: token,
+			Progress:      progress,
+			Total:         float64(len(ids)),
+			Message:       message,
+		}); err != nil {
+			token = nil // the client stopped listening; keep waiting quietly
+		}
+	}
+
+	// A task counts half once it starts and fully once it finishes, so
+	// progress rises with every notification, as the MCP spec requires.
+	credit := make(map[string]float64, len(ids))
+	progress := 0.0
+	counts := make(map[string]int)
+	finished := 0
+	for finished < len(ids) {
+		select {
+		case <-w.notify:
+		case <-ctx.Done():
+			return false
+		}
+		for _, e := range h.store.WatchEvents(w) {
+			var message string
+			switch {
+			case e.Status == "running" && credit[e.ID] == 0:
+				credit[e.ID] = 0.5
+				progress += 0.5
+				message = "started"
+			case isTerminalStatus(e.Status):
+				progress += 1 - credit[e.ID]
+				credit[e.ID] = 1
+				finished++
+				counts[e.Status]++
+				message = e.Status
+				if e.Error != "" {
+					message += ": " + e.Error
+				}
+			default:
+				continue // queued, blocked, retrying, or running again after a retry
+			}
+			label := "task " + e.ID
+			if e.Tag != "" {
+				label += " [" + e.Tag + "]"
+			}
+			message = label + " " + message
+			if finished == len(ids) {
+				message += fmt.Sprintf("; batch done: %d completed, %d failed, %d cancelled",
+					counts["completed"], counts["failed"], counts["cancelled"])
+			}
+			notify(progress, message)
+		}
+	}
+	return true
+}
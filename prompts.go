@@ -0,0 +1,370 @@
+// prompts.go registers MCP prompts: reusable recipes for common delegation
+// patterns, so the worker system prompt and the batch layout don't have to be
+// rewritten each session.
+//
+// Each prompt takes a few arguments (always an absolute input_glob, plus
+// what the recipe needs) and returns one user message holding:
+//   - the worker system prompt, written for a literal-minded local model
+//   - a submit_tasks plan: a SubmitTasksArgs value rendered as JSON, so it
+//     can be passed to submit_tasks as is
+//   - the steps to run it: pilot on one file, submit, monitor, verify
+//
+// Plans are built from the real submit_tasks types, so a field rename here
+// is a compile error rather than a recipe that silently stops working.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// recipe is one MCP prompt and the function that builds its plan.
+type recipe struct {
+	prompt *mcp.Prompt
+	build  func(args map[string]string) recipePlan
+}
+
+// recipePlan is what a recipe renders into its prompt message.
+type recipePlan struct {
+	intro        string
+	systemPrompt string
+	plan         SubmitTasksArgs
+	steps        []string
+}
+
+// Arguments shared by every recipe.
+var (
+	argGlob = &mcp.PromptArgument{
+		Name:        "input_glob",
+		Description: "Absolute glob of the files to process, e.g. /repo/**/*.go (** matches any directories)",
+		Required:    true,
+	}
+	argExclude = &mcp.PromptArgument{
+		Name:        "exclude",
+		Description: "Comma-separated patterns of files to skip, e.g. vendor, internal/gen/**",
+	}
+	argModel = &mcp.PromptArgument{
+		Name:        "model",
+		Description: "Ollama model for the workers (default: the server's default model)",
+	}
+	argTag = &mcp.PromptArgument{
+		Name:        "tag",
+		Description: "Tag for the batch (default: derived from the recipe name)",
+	}
+)
+
+// recipes lists every prompt the server registers, in the order clients
+// list them.
+var recipes = []recipe{
+	{
+		prompt: &mcp.Prompt{
+			Name:        "refactor-files",
+			Title:       "Refactor files",
+			Description: "Apply one mechanical change to every matching file, writing each file back in place.",
+			Arguments: []*mcp.PromptArgument{
+				argGlob,
+				{Name: "instruction", Description: "The change to make, stated explicitly, e.g. \"Replace every log.Printf call with slog.Info\"", Required: true},
+				argExclude,
+				{Name: "validate_cmd", Description: "Command that checks each result, e.g. \"cd /repo && go build ./...\"; failures are fed back to the worker for repair"},
+				argModel,
+				argTag,
+			},
+		},
+		build: refactorFilesPlan,
+	},
+	{
+		prompt: &mcp.Prompt{
+			Name:        "summarize-codebase",
+			Title:       "Summarize a codebase",
+			Description: "Summarize every matching file, then combine the summaries into one architecture overview with a reduce step.",
+			Arguments: []*mcp.PromptArgument{
+				argGlob,
+				{Name: "focus", Description: "What the summaries should pay attention to, e.g. \"error handling\" or \"the public API\""},
+				{Name: "output_file", Description: "Absolute path to write the overview to (default: kept in memory for get_result)"},
+				argExclude,
+				argModel,
+				argTag,
+			},
+		},
+		build: summarizeCodebasePlan,
+	},
+	{
+		prompt: &mcp.Prompt{
+			Name:        "add-struct-tags",
+			Title:       "Add Go struct tags",
+			Description: "Add missing struct tags (json by default, snake_case names) to the exported fields of every Go struct in the matching files.",
+			Arguments: []*mcp.PromptArgument{
+				argGlob,
+				{Name: "tags", Description: "Comma-separated tag keys to add (default: json)"},
+				{Name: "naming", Description: "Name style for the tag values: snake_case (default) or camelCase"},
+				argExclude,
+				argModel,
+				argTag,
+			},
+		},
+		build: addStructTagsPlan,
+	},
+	{
+		prompt: &mcp.Prompt{
+			Name:        "generate-tests",
+			Title:       "Generate tests",
+			Description: "Write a test file for every matching source file, validated and repaired with a test command.",
+			Arguments: []*mcp.PromptArgument{
+				argGlob,
+				{Name: "test_file", Description: "Output path template for each test file (default: {{dir}}/{{stem}}_test{{ext}})"},
+				{Name: "framework", Description: "Test framework and style, e.g. \"pytest\" or \"Go testing package, table-driven\""},
+				{Name: "validate_cmd", Description: "Command that runs the new tests, e.g. \"cd /repo && go test ./...\"; failures are fed back to the worker for repair"},
+				argExclude,
+				argModel,
+				argTag,
+			},
+		},
+		build: generateTestsPlan,
+	},
+}
+
+// registerPrompts adds every recipe to s.
+func registerPrompts(s *mcp.Server) {
+	for _, r := range recipes {
+		s.AddPrompt(r.prompt, r.handler)
+	}
+}
+
+// handler validates the arguments and renders the recipe's plan.
+func (r recipe) handler(_ context.Context, req *mcp.GetPromptRequest) (*mcp.GetPromptResult, error) {
+	args := req.Params.Arguments
+	for _, a := range r.prompt.Arguments {
+		if a.Required && strings.TrimSpace(args[a.Name]) == "" {
+			return nil, fmt.Errorf("%s: %s is required", r.prompt.Name, a.Name)
+		}
+	}
+	if !filepath.IsAbs(args["input_glob"]) {
+		return nil, fmt.Errorf("%s: input_glob must be an absolute path, got %q", r.prompt.Name, args["input_glob"])
+	}
+	if out := args["output_file"]; out != "" && !filepath.IsAbs(out) {
+		return nil, fmt.Errorf("%s: output_file must be an absolute path, got %q", r.prompt.Name, out)
+	}
+
+	p := r.build(args)
+	plan, err := json.MarshalIndent(p.plan, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to render plan: %v", r.prompt.Name, err)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n%s\n\n", r.prompt.Title, p.intro)
+	fmt.Fprintf(&b, "## Worker system prompt\n\n```\n%s\n```\n\n", p.systemPrompt)
+	fmt.Fprintf(&b, "## submit_tasks plan\n\n```json\n%s\n```\n\n## Steps\n\n", plan)
+	for i, step := range p.steps {
+		fmt.Fprintf(&b, "%d. %s\n", i+1, step)
+	}
+	return &mcp.GetPromptResult{
+		Description: r.prompt.Description,
+		Messages: []*mcp.PromptMessage{
+			{Role: "user", Content: &mcp.TextContent{Text: b.String()}},
+		},
+	}, nil
+}
+
+// pilotStep is the first step of every recipe.
+const pilotStep = "Pilot: submit the plan with input_glob replaced by the path of one or two matching files, read the results, and tighten the prompt until they are right."
+
+func refactorFilesPlan(args map[string]string) recipePlan {
+	system := "You are a code refactoring worker. You receive one source file and an instruction.\n" +
+		"Apply the instruction to the file and return the complete modified file.\n" +
+		"Return ONLY the file contents. No explanations.\n" +
+		"Do NOT change anything the instruction doesn't ask for: keep formatting, comments, names and imports as they are.\n" +
+		"If the instruction doesn't apply to the file, return the file unchanged."
+	return recipePlan{
+		intro:        "Apply one mechanical change to every file matching " + args["input_glob"] + ". Each file is rewritten in place; the originals are backed up, so the batch can be reverted with undo_tasks.",
+		systemPrompt: system,
+		plan: SubmitTasksArgs{
+			Options: map[string]any{"temperature": 0},
+			Tasks: []TaskSpec{{
+				Tag:          recipeTag(args, "refactor"),
+				SystemPrompt: system,
+				Prompt:       args["instruction"],
+				InputGlob:    args["input_glob"],
+				Exclude:      splitList(args["exclude"]),
+				OutputFile:   "{{path}}",
+				ValidateCmd:  args["validate_cmd"],
+				Model:        args["model"],
+				ResponseHint: "status_only",
+			}},
+		},
+		steps: []string{
+			pilotStep + " If the instruction is subtle, add a before/after example to the prompt.",
+			"Submit the full plan.",
+			"Monitor with check_tasks on the tag. Spot-check a few completed tasks with get_result include_diff: true; watch lines_added/lines_removed for outliers.",
+			"If the results are bad, cancel_tasks the tag, then undo_tasks it to restore the files already written.",
+		},
+	}
+}
+
+func summarizeCodebasePlan(args map[string]string) recipePlan {
+	system := "You are a file summarization worker. You receive one source file.\n" +
+		"Summarize it in 3-6 bullet points: its purpose, the main types and functions it defines, what it depends on, and anything unusual.\n" +
+		"Name identifiers exactly as they appear in the file.\n" +
+		"Return ONLY the bullet points."
+	prompt := "Summarize this file."
+	overview := "Write an architecture overview of the codebase from these per-file summaries: the main components and their responsibilities, " +
+		"how they interact, and the key data flows. Group related files into components; don't just list the files."
+	if focus := args["focus"]; focus != "" {
+		prompt += " Pay particular attention to " + focus + "."
+		overview += " Pay particular attention to " + focus + "."
+	}
+	return recipePlan{
+		intro:        "Summarize every file matching " + args["input_glob"] + " and combine the summaries into one overview. The per-file summaries never enter your context: fetch only the reduce task's result.",
+		systemPrompt: system,
+		plan: SubmitTasksArgs{
+			Tasks: []TaskSpec{{
+				Tag:          recipeTag(args, "summarize"),
+				SystemPrompt: system,
+				Prompt:       prompt,
+				InputGlob:    args["input_glob"],
+				Exclude:      append([]string{"vendor"}, splitList(args["exclude"])...),
+				Model:        args["model"],
+				ResponseHint: "content",
+			}},
+			Reduce: &ReduceSpec{
+				SystemPrompt: "You are a software architect writing documentation for developers new to a codebase. Be concrete and name the files involved.",
+				Prompt:       overview,
+				Model:        args["model"],
+				OutputFile:   args["output_file"],
+			},
+		},
+		steps: []string{
+			pilotStep + " Drop the reduce spec for the pilot.",
+			"Submit the full plan and note reduce_task_id in the response.",
+			"Wait for the reduce task: check_tasks with task_ids [reduce_task_id].",
+			"get_result the reduce task only (or read output_file), then reason over the overview yourself, reading individual files where it matters.",
+		},
+	}
+}
+
+func addStructTagsPlan(args map[string]string) recipePlan {
+	keys := splitList(args["tags"])
+	if len(keys) == 0 {
+		keys = []string{"json"}
+	}
+	naming := args["naming"]
+	if naming == "" {
+		naming = "snake_case"
+	}
+	example := "UserID"
+	value := "user_id"
+	if naming != "snake_case" {
+		value = "userID"
+	}
+	var tag []string
+	for _, k := range keys {
+		tag = append(tag, fmt.Sprintf("%s:\"%s\"", k, value))
+	}
+	system := "You are a Go refactoring worker. You receive one Go source file.\n" +
+		"Add struct tags to the exported fields of every struct type, as instructed.\n" +
+		"Keep existing tags: add only missing keys, inside the same backquoted tag.\n" +
+		"Do NOT change anything else: no renames, no new imports, no reformatting.\n" +
+		"Return ONLY the complete Go file. No explanations."
+	prompt := fmt.Sprintf("Add %s struct tags with %s names to every exported struct field that lacks them. "+
+		"Leave unexported fields and fields that already have these keys alone.\n\n"+
+		"Before:\n\ttype User struct {\n\t\t%s int\n\t}\n\nAfter:\n\ttype User struct {\n\t\t%s int `%s`\n\t}",
+		strings.Join(keys, " and "), naming, example, example, strings.Join(tag, " "))
+	return recipePlan{
+		intro:        "Add " + strings.Join(keys, ", ") + " struct tags to the Go files matching " + args["input_glob"] + ". Each file is rewritten in place and run through gofmt.",
+		systemPrompt: system,
+		plan: SubmitTasksArgs{
+			Options: map[string]any{"temperature": 0},
+			Tasks: []TaskSpec{{
+				Tag:          recipeTag(args, "struct_tags"),
+				SystemPrompt: system,
+				Prompt:       prompt,
+				InputGlob:    args["input_glob"],
+				Exclude:      append([]string{"*_test.go", "vendor"}, splitList(args["exclude"])...),
+				OutputFile:   "{{path}}",
+				PostWriteCmd: "gofmt -w {{path}}",
+				Model:        args["model"],
+				ResponseHint: "status_only",
+			}},
+		},
+		steps: []string{
+			pilotStep,
+			"Submit the full plan.",
+			"Monitor with check_tasks on the tag. A \"post-write command failed\" error means gofmt rejected the output: the file doesn't parse. undo_tasks those tasks and resubmit them.",
+			"Build the module to confirm nothing else changed.",
+		},
+	}
+}
+
+func generateTestsPlan(args map[string]string) recipePlan {
+	testFile := args["test_file"]
+	if testFile == "" {
+		testFile = "{{dir}}/{{stem}}_test{{ext}}"
+	}
+	framework := args["framework"]
+	if framework == "" {
+		framework = "the language's standard test framework, table-driven where it fits"
+	}
+	system := "You are a test-writing worker. You receive one source file.\n" +
+		"Write a test file for it that covers its exported functions: normal cases, edge cases and error paths.\n" +
+		"Only call functions and types that appear in the file or in the test framework. Do NOT invent helpers.\n" +
+		"Put the test file in the same package as the source file.\n" +
+		"Return ONLY the test file's contents. No explanations."
+	var maxRepairs *int
+	if args["validate_cmd"] != "" {
+		n := 3
+		maxRepairs = &n
+	}
+	steps := []string{
+		pilotStep,
+		"Submit the full plan.",
+		"Monitor with check_tasks on the tag. Generating tests is slower than editing: expect each task to take a few times longer than a refactor of the same file.",
+	}
+	if args["validate_cmd"] != "" {
+		steps = append(steps, "For tasks that fail with \"validation command failed\", get_result shows the test output and the repair conversation. Fix those test files yourself or undo_tasks them.")
+	} else {
+		steps = append(steps, "Run the tests yourself; nothing validated them. Fix or undo_tasks the files that don't pass.")
+	}
+	return recipePlan{
+		intro:        "Write a test file for every source file matching " + args["input_glob"] + ", at " + testFile + ". Existing files at those paths are backed up and can be restored with undo_tasks.",
+		systemPrompt: system,
+		plan: SubmitTasksArgs{
+			Tasks: []TaskSpec{{
+				Tag:               recipeTag(args, "gen_tests"),
+				SystemPrompt:      system,
+				Prompt:            "Write tests for this file ({{name}}) using " + framework + ".",
+				InputGlob:         args["input_glob"],
+				Exclude:           append([]string{"*_test.*", "test_*", "vendor"}, splitList(args["exclude"])...),
+				OutputFile:        testFile,
+				ValidateCmd:       args["validate_cmd"],
+				MaxRepairAttempts: maxRepairs,
+				Model:             args["model"],
+				ResponseHint:      "status_only",
+				TimeoutSeconds:    900,
+			}},
+		},
+		steps: steps,
+	}
+}
+
+// recipeTag returns the tag argument, or def.
+func recipeTag(args map[string]string, def string) string {
+	if tag := args["tag"]; tag != "" {
+		return tag
+	}
+	return def
+}
+
+// splitList splits a comma-separated argument, dropping empty items.
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,121 @@
+// reduce.go implements the reduce stage of a map-reduce batch.
+//
+// When submit_tasks is given a reduce spec, the handler adds one more task to
+// the batch: a reduce task that waits until every other task in the batch
+// has finished, then runs the reduce prompt over their concatenated results
+// and exposes a single final result. The per-task results never pass through
+// the orchestrating agent's context — it fetches only the reduced one.
+//
+// Unlike depends_on, the wait doesn't cascade failures: the reduce runs over
+// whichever map tasks completed and tells the model which inputs are
+// missing. It fails only if none completed.
+//
+// Results that don't fit in one prompt are reduced hierarchically: they are
+// grouped into prompts that fit the context window (sized like chunk mode's
+// pieces, see chunking.go), each group is reduced with the same prompt, and
+// the partial results are reduced again until one prompt holds them all.
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+)
+
+// ReduceInput is one map task a reduce task consumes.
+type ReduceInput struct {
+	ID    string // map task ID
+	Label string // what the map task processed (its input or output file), shown to the model
+}
+
+// generateReduce gathers the map results and reduces them, hierarchically if
+// needed. Returns false if the task should stop, as generate does.
+func (p *WorkerPool) generateReduce(ctx context.Context, task *Task, prompt string, seq uint64, release *func()) (string, bool) {
+	var sections, missing []string
+	for _, in := range task.ReduceOver {
+		out, err := p.upstreamOutput(in.ID)
+		if err != nil {
+			missing = append(missing, in.ID)
+			continue
+		}
+		label := in.Label
+		if label == "" {
+			label = "task " + in.ID
+		}
+		sections = append(sections, "### Result for "+label+"\n"+strings.TrimSpace(out))
+	}
+	if len(sections) == 0 {
+		p.store.SetFailed(task.ID, fmt.Sprintf("none of the %d map tasks completed; nothing to reduce", len(task.ReduceOver)))
+		return "", false
+	}
+	if len(missing) > 0 {
+		prompt = joinSections(prompt, fmt.Sprintf("Note: %d of %d inputs failed or were cancelled and are not included.", len(missing), len(task.ReduceOver)))
+	}
+
+	window, explicit := p.contextWindow(ctx, task)
+	if !explicit && (window <= 0 || window > defaultChunkContext) {
+		window = defaultChunkContext
+	}
+	overhead := estimateMessageTokens([]api.Message{
+		{Content: task.SystemPrompt},
+		{Content: joinSections(prompt, partialNote(999, 999))},
+	})
+	// Leave a quarter of the window for the response, which should be much
+	// shorter than its inputs.
+	budget := (window - overhead) * 3 / 4
+	if budget < minChunkTokens {
+		p.store.SetFailed(task.ID, fmt.Sprintf("reduce prompt leaves no room for results: ~%d tokens of prompt in a %d-token window. Raise num_ctx in the reduce options or shorten the prompt", overhead, window))
+		return "", false
+	}
+
+	for round := 1; ; round++ {
+		groups := groupSections(sections, budget*charsPerToken)
+		if len(groups) == 1 || (round > 1 && len(groups) == len(sections)) {
+			// Everything fits — or the partial results no longer combine
+			// into fewer groups, so another round wouldn't shrink anything.
+			return p.reduceGroup(ctx, task, prompt, sections, seq, release)
+		}
+		partials := make([]string, 0, len(groups))
+		for i, group := range groups {
+			out, ok := p.reduceGroup(ctx, task, joinSections(prompt, partialNote(i+1, len(groups))), group, seq, release)
+			if !ok {
+				return "", false
+			}
+			partials = append(partials, fmt.Sprintf("### Partial result %d of %d\n%s", i+1, len(groups), strings.TrimSpace(out)))
+		}
+		sections = partials
+	}
+}
+
+// reduceGroup runs the reduce prompt over one group of results.
+func (p *WorkerPool) reduceGroup(ctx context.Context, task *Task, prompt string, group []string, seq uint64, release *func()) (string, bool) {
+	messages := []api.Message{
+		{Role: "system", Content: task.SystemPrompt},
+		{Role: "user", Content: joinSections(prompt, strings.Join(group, "\n\n"))},
+	}
+	return p.generate(ctx, task, messages, seq, release)
+}
+
+// partialNote tells the model it is reducing one group of several.
+func partialNote(group, groups int) string {
+	return fmt.Sprintf("The inputs are too many for one prompt. This is group %d of %d: combine these inputs only; "+
+		"your result will be combined with the other groups' results using the same instructions.", group, groups)
+}
+
+// groupSections packs sections, in order, into groups of at most maxBytes.
+// A section larger than maxBytes gets a group of its own.
+func groupSections(sections []string, maxBytes int) [][]string {
+	var groups [][]string
+	size := 0
+	for _, s := range sections {
+		if len(groups) == 0 || (size > 0 && size+len(s) > maxBytes) {
+			groups = append(groups, nil)
+			size = 0
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], s)
+		size += len(s) + 2
+	}
+	return groups
+}
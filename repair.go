@@ -0,0 +1,56 @@
+// repair.go implements the validate-and-repair loop behind validate_cmd.
+//
+// post_write_cmd is fire-and-check: if the formatter fails, the task fails.
+// validate_cmd goes one step further. After the output is written (and any
+// post-write command has run), the validation command — typically a compiler,
+// vet or test run — is executed. If it fails, its output is sent back to the
+// model as a follow-up user turn in the same chat, the model's corrected
+// response is written again, and validation re-runs. This repeats up to
+// max_repair_attempts times before the task is reported failed, so a worker
+// can fix its own compile errors without the orchestrating agent stepping in.
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+const (
+	defaultMaxRepairAttempts  = 2               // follow-up turns after a failed validation (handler default)
+	defaultValidateCmdTimeout = 2 * time.Minute // builds and tests take longer than formatters
+)
+
+// repairPrompt is the follow-up user turn sent after the validation command
+// failed. It quotes the command and its output verbatim so the model sees
+// exactly what a developer would.
+func repairPrompt(cmd string, err error, cmdOutput string) string {
+	if cmdOutput == "" {
+		cmdOutput = "(no output)"
+	}
+	return fmt.Sprintf(
+		"Your previous response was written to disk, but the validation command `%s` failed (%v):\n\n%s\n\n"+
+			"Fix every problem reported above and return the complete corrected output, in the same format as before. Do not explain the changes.",
+		cmd, err, cmdOutput,
+	)
+}
+
+// validationFailedError is the task error after the last allowed repair
+// attempt still failed validation.
+func validationFailedError(err error, cmdOutput string, repairs int) string {
+	msg := fmt.Sprintf("validation command failed after %d repair attempt(s): %v", repairs, err)
+	if cmdOutput != "" {
+		msg += ": " + cmdOutput
+	}
+	return msg
+}
+
+// conversationTurns converts the chat history into the get_result form.
+func conversationTurns(messages []api.Message) []ChatTurn {
+	turns := make([]ChatTurn, len(messages))
+	for i, m := range messages {
+		turns[i] = ChatTurn{Role: m.Role, Content: m.Content}
+	}
+	return turns
+}
@@ -0,0 +1,202 @@
+// resources.go exposes tasks as MCP resources, so a client can attach a
+// task's result or a tag's status to the conversation without a tool call:
+//
+//	task://<id>/result   the task's output: the response, or the written
+//	                     output_file (staged copy for staged tasks)
+//	task://<id>/prompt   what the task was asked: system prompt, prompt and
+//	                     input files, until the task finishes and they are
+//	                     cleared from memory
+//	tag://<tag>/summary  check_tasks for the tag, as JSON
+//
+// Clients can subscribe to any of these URIs. Whenever a task changes status
+// the server sends resources/updated for its result and prompt and for its
+// tag's summary — only to the session that submitted the task (to every
+// subscriber, for a task with no owner), so over TRANSPORT=http a session
+// subscribed to a tag another session also uses doesn't hear about the
+// other session's tasks.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// updateOwnerKey is the _meta key publishResourceUpdates uses to tell
+// ownerOnlyUpdates which session a resources/updated notification is for.
+// It is removed before the notification is sent.
+const updateOwnerKey = "opusgollama/session"
+
+// registerResources adds the task and tag resource templates to s.
+func registerResources(s *mcp.Server, h *ToolHandlers) {
+	s.AddSendingMiddleware(ownerOnlyUpdates)
+	s.AddResourceTemplate(&mcp.ResourceTemplate{
+		Name:        "task_result",
+		URITemplate: "task://{id}/result",
+		MIMEType:    "text/plain",
+		Description: "Output of a completed task: the model's response, or the contents of the output_file it wrote.",
+	}, h.readTaskResult)
+	s.AddResourceTemplate(&mcp.ResourceTemplate{
+		Name:        "task_prompt",
+		URITemplate: "task://{id}/prompt",
+		MIMEType:    "text/markdown",
+		Description: "System prompt, prompt and input files of a task that hasn't finished yet.",
+	}, h.readTaskPrompt)
+	s.AddResourceTemplate(&mcp.ResourceTemplate{
+		Name:        "tag_summary",
+		URITemplate: "tag://{tag}/summary",
+		MIMEType:    "application/json",
+		Description: "check_tasks output for every task with this tag: aggregate counts and per-task status.",
+	}, h.readTagSummary)
+}
+
+// acceptSubscription lets clients subscribe to any resource URI. The SDK
+// tracks subscriptions; publishResourceUpdates notifies subscribers.
+func acceptSubscription(context.Context, *mcp.SubscribeRequest) error { return nil }
+
+// acceptUnsubscription is the matching unsubscribe handler.
+func acceptUnsubscription(context.Context, *mcp.UnsubscribeRequest) error { return nil }
+
+// ownerOnlyUpdates drops resources/updated notifications addressed to a
+// session other than the task's owner; those for an unowned task go to
+// every subscriber. The SDK sends them to every session
+// subscribed to the URI, so publishResourceUpdates records the owner in the
+// notification's _meta and this middleware filters on it.
+func ownerOnlyUpdates(next mcp.MethodHandler) mcp.MethodHandler {
+	return func(ctx context.Context, method string, req mcp.Request) (mcp.Result, error) {
+		sreq, ok := req.(*mcp.ServerRequest[*mcp.ResourceUpdatedNotificationParams])
+		if !ok || method != "notifications/resources/updated" {
+			return next(ctx, method, req)
+		}
+		owner, ok := sreq.Params.Meta[updateOwnerKey]
+		if !ok {
+			return next(ctx, method, req)
+		}
+		if owner != "" && owner != sreq.Session.ID() {
+			return nil, nil
+		}
+		// The params are shared by every recipient; send a copy without the key
+		params := &mcp.ResourceUpdatedNotificationParams{URI: sreq.Params.URI}
+		for k, v := range sreq.Params.Meta {
+			if k != updateOwnerKey {
+				if params.Meta == nil {
+					params.Meta = mcp.Meta{}
+				}
+				params.Meta[k] = v
+			}
+		}
+		return next(ctx, method, &mcp.ServerRequest[*mcp.ResourceUpdatedNotificationParams]{Session: sreq.Session, Params: params, Extra: sreq.Extra})
+	}
+}
+
+// publishResourceUpdates sends resources/updated for a task's resources and
+// its tag's summary on every status change, to the task's session only (see
+// ownerOnlyUpdates). It runs for the life of the server.
+func (h *ToolHandlers) publishResourceUpdates(s *mcp.Server) {
+	w := h.store.WatchAll()
+	defer h.store.Unwatch(w)
+	for range w.notify {
+		for _, e := range h.store.WatchEvents(w) {
+			uris := []string{"task://" + e.ID + "/result", "task://" + e.ID + "/prompt"}
+			if e.Tag != "" {
+				uris = append(uris, "tag://"+url.PathEscape(e.Tag)+"/summary")
+			}
+			for _, uri := range uris {
+				s.ResourceUpdated(context.Background(), &mcp.ResourceUpdatedNotificationParams{
+					Meta: mcp.Meta{updateOwnerKey: e.Session},
+					URI:  uri,
+				})
+			}
+		}
+	}
+}
+
+// resourceName extracts the {id} or {tag} part of a scheme://<name>/<kind>
+// URI.
+func resourceName(uri, scheme, kind string) (string, bool) {
+	name, ok := strings.CutPrefix(uri, scheme+"://")
+	if !ok {
+		return "", false
+	}
+	if name, ok = strings.CutSuffix(name, "/"+kind); !ok || name == "" {
+		return "", false
+	}
+	name, err := url.PathUnescape(name)
+	return name, err == nil
+}
+
+// readTaskResult serves task://<id>/result.
+func (h *ToolHandlers) readTaskResult(_ context.Context, req *mcp.ReadResourceRequest) (*mcp.ReadResourceResult, error) {
+	uri := req.Params.URI
+	id, ok := resourceName(uri, "task", "result")
+	if !ok {
+		return nil, mcp.ResourceNotFoundError(uri)
+	}
+	r := h.store.Results([]string{id}, sessionID(req))[0]
+	switch r.Status {
+	case "not_found":
+		return nil, mcp.ResourceNotFoundError(uri)
+	case "completed":
+	case "failed":
+		return nil, fmt.Errorf("task %s failed: %s", id, r.Error)
+	default:
+		return nil, fmt.Errorf("task %s is %s; its result isn't available yet", id, r.Status)
+	}
+	output, err := h.pool.upstreamOutput(id)
+	if err != nil {
+		return nil, err
+	}
+	return &mcp.ReadResourceResult{Contents: []*mcp.ResourceContents{{URI: uri, Text: output}}}, nil
+}
+
+// readTaskPrompt serves task://<id>/prompt.
+func (h *ToolHandlers) readTaskPrompt(_ context.Context, req *mcp.ReadResourceRequest) (*mcp.ReadResourceResult, error) {
+	uri := req.Params.URI
+	id, ok := resourceName(uri, "task", "prompt")
+	if !ok {
+		return nil, mcp.ResourceNotFoundError(uri)
+	}
+	p, err := h.store.PromptSnapshot(id)
+	if err != nil || !h.store.Visible(id, sessionID(req)) {
+		return nil, mcp.ResourceNotFoundError(uri)
+	}
+	if isTerminalStatus(p.Status) {
+		return nil, fmt.Errorf("task %s is %s; prompts are cleared from memory when a task finishes", id, p.Status)
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# System prompt\n\n%s\n\n# Prompt\n\n%s\n", p.SystemPrompt, p.Prompt)
+	if p.InputFile != "" || len(p.InputFiles) > 0 {
+		sb.WriteString("\n# Input files\n\n")
+		for _, f := range append([]string{p.InputFile}, p.InputFiles...) {
+			if f != "" {
+				fmt.Fprintf(&sb, "- %s\n", f)
+			}
+		}
+	}
+	return &mcp.ReadResourceResult{Contents: []*mcp.ResourceContents{{URI: uri, Text: sb.String()}}}, nil
+}
+
+// readTagSummary serves tag://<tag>/summary.
+func (h *ToolHandlers) readTagSummary(ctx context.Context, req *mcp.ReadResourceRequest) (*mcp.ReadResourceResult, error) {
+	uri := req.Params.URI
+	tag, ok := resourceName(uri, "tag", "summary")
+	if !ok {
+		return nil, mcp.ResourceNotFoundError(uri)
+	}
+	_, out, err := h.handleCheckTasks(ctx, &mcp.CallToolRequest{Session: req.Session}, CheckTasksArgs{Tag: tag})
+	if err != nil {
+		return nil, err
+	}
+	if out.Summary.Total == 0 {
+		return nil, mcp.ResourceNotFoundError(uri)
+	}
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return &mcp.ReadResourceResult{Contents: []*mcp.ResourceContents{{URI: uri, Text: string(data)}}}, nil
+}
@@ -0,0 +1,83 @@
+// retry.go classifies Ollama errors as transient or permanent and computes
+// retry backoff.
+//
+// Ollama frequently returns errors that succeed a few seconds later: the
+// server is still starting (connection refused), it is busy serving other
+// requests (503), or it is swapping a model into memory. Those are retried
+// with exponential backoff. Everything else — unknown model, bad request,
+// invalid options — fails immediately, since retrying can't change the outcome.
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+const (
+	defaultMaxRetries   = 2               // retries after the first attempt (handler default)
+	defaultRetryBackoff = 5 * time.Second // first backoff; doubles on each retry
+	maxRetryBackoff     = 2 * time.Minute // cap so large max_retries values don't stall for hours
+)
+
+// retryableStatusCodes are HTTP statuses Ollama (or a proxy in front of it)
+// returns for conditions that resolve on their own.
+var retryableStatusCodes = map[int]bool{
+	http.StatusTooManyRequests:    true,
+	http.StatusBadGateway:         true,
+	http.StatusServiceUnavailable: true,
+	http.StatusGatewayTimeout:     true,
+}
+
+// retryableMessages are substrings of transient errors that don't come with
+// a useful status code (e.g. mid-stream errors, which the client surfaces as
+// plain errors, or dial failures wrapped by net/http).
+var retryableMessages = []string{
+	"connection refused",
+	"connection reset",
+	"server busy",
+	"loading model",
+	"model is loading",
+	"unexpected eof",
+}
+
+// isRetryableError reports whether err is a transient Ollama failure worth
+// retrying. Context cancellation and timeouts are never retryable — they are
+// handled by the caller before classification.
+func isRetryableError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var statusErr api.StatusError
+	if errors.As(err, &statusErr) && retryableStatusCodes[statusErr.StatusCode] {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, m := range retryableMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryBackoff returns how long to wait before retry number attempt (1-based),
+// doubling the task's base backoff each time up to maxRetryBackoff.
+func retryBackoff(task *Task, attempt int) time.Duration {
+	backoff := task.RetryBackoff
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	for i := 1; i < attempt && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxRetryBackoff)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// ---------------------------------------------------------------------------
+// Error classification
+// ---------------------------------------------------------------------------
+
+func TestIsRetryableError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"connection refused errno", fmt.Errorf("dial tcp: %w", syscall.ECONNREFUSED), true},
+		{"connection refused message", errors.New("Post \"http://127.0.0.1:11434/api/chat\": dial tcp 127.0.0.1:11434: connect: connection refused"), true},
+		{"503 status", api.StatusError{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable", ErrorMessage: "server busy, please try again"}, true},
+		{"429 status", api.StatusError{StatusCode: http.StatusTooManyRequests}, true},
+		{"server busy mid-stream", errors.New("server busy, please try again.  maximum pending requests exceeded"), true},
+		{"model loading", errors.New("llama runner process is loading model"), true},
+		{"unexpected EOF", fmt.Errorf("read: %w", errors.New("unexpected EOF")), true},
+		{"model not found", api.StatusError{StatusCode: http.StatusNotFound, ErrorMessage: "model \"nope\" not found, try pulling it first"}, false},
+		{"bad request", api.StatusError{StatusCode: http.StatusBadRequest, ErrorMessage: "invalid options"}, false},
+		{"plain error", errors.New("model not found"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryableError(tt.err); got != tt.want {
+				t.Fatalf("isRetryableError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Backoff
+// ---------------------------------------------------------------------------
+
+func TestRetryBackoffDoublesAndCaps(t *testing.T) {
+	task := &Task{RetryBackoff: 10 * time.Second}
+	want := []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, 80 * time.Second, maxRetryBackoff, maxRetryBackoff}
+	for i, w := range want {
+		if got := retryBackoff(task, i+1); got != w {
+			t.Fatalf("attempt %d: expected %v, got %v", i+1, w, got)
+		}
+	}
+}
+
+func TestRetryBackoffDefault(t *testing.T) {
+	if got := retryBackoff(&Task{}, 1); got != defaultRetryBackoff {
+		t.Fatalf("expected default %v, got %v", defaultRetryBackoff, got)
+	}
+}
@@ -0,0 +1,288 @@
+// scheduler.go implements the worker pool's slot queue.
+//
+// Submit files a slotRequest for each task as soon as it is ready to run
+// (immediately, or once its dependencies complete), and the task goroutine
+// waits for it to be granted. Filing the request synchronously in Submit —
+// rather than from the goroutine — is what makes order deterministic.
+// Whenever a slot frees up (or a request arrives while one is free),
+// dispatch hands slots to waiting requests in priority order:
+// higher TaskSpec.Priority first, then submission order. This replaces the
+// old shared semaphore, where every waiting goroutine raced for the next slot
+// and execution order was effectively random.
+//
+// In fair-share mode (fair_share on submit_tasks), requests of equal priority
+// are no longer strictly FIFO: slots are shared across tags using stride
+// scheduling. Each tag has a pass value that advances by 1/weight every time
+// one of its tasks is granted a slot, and the tag with the lowest pass goes
+// next — so two tags of weight 1 alternate, and a tag of weight 3 gets three
+// slots for every one of a weight-1 tag. Within a tag, order stays FIFO. A
+// tag that had nothing queued starts at the current virtual time rather than
+// its old pass, so it can't bank credit while idle and then burst.
+//
+// With several Ollama backends (see backends.go) a request also needs a
+// backend that has its model and a free slot. Requests that can't be placed
+// yet are passed over, so a task for a model on an idle backend doesn't wait
+// behind one whose backend is busy.
+//
+// Requests are also model-aware (see model_limits.go): a request whose model
+// is at its MODEL_CONCURRENCY limit is passed over the same way, and among
+// requests of equal priority, those for a model already loaded in Ollama go
+// first.
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// slotRequest is a task waiting in the scheduler queue for a worker slot.
+type slotRequest struct {
+	taskID   string
+	tag      string
+	model    string
+	priority int
+	seq      uint64        // submission order; FIFO tiebreak within a priority
+	granted  chan struct{} // closed by dispatch when the slot is handed over, or when err is set
+	backend  *backend      // the backend the slot is on; set by dispatch
+	err      error         // why no backend can ever run the task; set by dispatch instead of a slot
+	skipped  int           // times passed over for a task of a loaded model (see model_limits.go)
+}
+
+// before reports whether r should be granted a slot ahead of o.
+func (r *slotRequest) before(o *slotRequest) bool {
+	if r.priority != o.priority {
+		return r.priority > o.priority
+	}
+	return r.seq < o.seq
+}
+
+// enqueue files a slot request for task. seq is the task's submission number
+// (see Submit); a retrying task re-queues with its original seq and so keeps
+// its place. The slot may be granted immediately if one is free.
+func (p *WorkerPool) enqueue(task *Task, seq uint64) *slotRequest {
+	req := &slotRequest{
+		taskID:   task.ID,
+		tag:      task.Tag,
+		model:    task.Model,
+		priority: task.Priority,
+		seq:      seq,
+		granted:  make(chan struct{}),
+	}
+	p.mu.Lock()
+	if !p.tagQueued(req.tag) {
+		p.tagPass[req.tag] = max(p.tagPass[req.tag], p.virtualTime)
+	}
+	p.queue = append(p.queue, req)
+	p.mu.Unlock()
+	p.dispatch()
+	return req
+}
+
+// awaitSlot blocks until req is granted a worker slot or ctx is cancelled. On
+// success it returns a function that releases the slot (safe to call more
+// than once); on cancellation the request is withdrawn and the returned
+// release is a no-op, so callers can defer it unconditionally. If no backend
+// can run the task, it is failed and ok is false.
+func (p *WorkerPool) awaitSlot(ctx context.Context, req *slotRequest) (release func(), ok bool) {
+	select {
+	case <-req.granted:
+	case <-ctx.Done():
+		p.mu.Lock()
+		queued := p.removeRequest(req)
+		p.mu.Unlock()
+		if !queued && req.err == nil {
+			// Granted concurrently with cancellation — hand the slot back.
+			p.releaseSlot(req)
+		}
+		return func() {}, false
+	}
+	if req.err != nil {
+		// SetFailed only moves running tasks, so the queued task passes
+		// through running on its way out.
+		if p.store.SetRunning(req.taskID) {
+			p.store.SetFailed(req.taskID, req.err.Error())
+		}
+		return func() {}, false
+	}
+
+	// Double-check cancellation after acquiring the slot
+	if ctx.Err() != nil {
+		p.releaseSlot(req)
+		return func() {}, false
+	}
+	if len(p.backends) > 1 {
+		p.store.SetBackend(req.taskID, req.backend.host)
+	}
+	var once sync.Once
+	return func() { once.Do(func() { p.releaseSlot(req) }) }, true
+}
+
+// releaseSlot returns req's slot to the pool and grants it to the next
+// request.
+func (p *WorkerPool) releaseSlot(req *slotRequest) {
+	p.mu.Lock()
+	p.running--
+	req.backend.running--
+	req.backend.stopModel(req.model)
+	delete(p.assigned, req.taskID)
+	p.mu.Unlock()
+	p.dispatch()
+}
+
+// dispatch grants free slots to queued requests in priority order, each on
+// the backend pickBackend chooses. Requests no backend can run are failed
+// (see awaitSlot) without taking a slot.
+func (p *WorkerPool) dispatch() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	placeable := func(r *slotRequest) bool {
+		b, err := p.pickBackend(r.model)
+		return b != nil || err != nil
+	}
+	for p.running < p.concurrency && len(p.queue) > 0 {
+		next := p.nextRequest(p.queue, p.tagPass, placeable)
+		if next < 0 {
+			return // every backend the queued tasks can use is busy
+		}
+		req := p.queue[next]
+		p.queue = append(p.queue[:next], p.queue[next+1:]...)
+		b, err := p.pickBackend(req.model)
+		if err != nil {
+			req.err = err
+			close(req.granted)
+			continue
+		}
+		for _, q := range p.queue {
+			if q.priority == req.priority && q.seq < req.seq && modelKey(q.model) != modelKey(req.model) {
+				q.skipped++
+			}
+		}
+		p.virtualTime = p.tagPass[req.tag]
+		p.charge(p.tagPass, req.tag)
+		p.running++
+		b.running++
+		b.startModel(req.model)
+		req.backend = b
+		p.assigned[req.taskID] = b
+		close(req.granted)
+	}
+}
+
+// nextRequest returns the index in queue of the request to grant next, given
+// the tags' current pass values, considering only requests ok accepts (all
+// of them if ok is nil). Returns -1 if there are none. Must be called with
+// p.mu held.
+func (p *WorkerPool) nextRequest(queue []*slotRequest, pass map[string]float64, ok func(*slotRequest) bool) int {
+	next := -1
+	for i, req := range queue {
+		if ok != nil && !ok(req) {
+			continue
+		}
+		if next < 0 || p.grantBefore(req, queue[next], pass) {
+			next = i
+		}
+	}
+	return next
+}
+
+// grantBefore reports whether r should be granted a slot ahead of o. Priority
+// always wins; in fair-share mode the tag with the lower pass comes next;
+// then a task whose model is loaded goes ahead of one whose model isn't,
+// unless either has been passed over maxModelSkips times; otherwise
+// submission order decides.
+func (p *WorkerPool) grantBefore(r, o *slotRequest, pass map[string]float64) bool {
+	if r.priority != o.priority {
+		return r.priority > o.priority
+	}
+	if p.fairShare && r.tag != o.tag && pass[r.tag] != pass[o.tag] {
+		return pass[r.tag] < pass[o.tag]
+	}
+	if r.skipped < maxModelSkips && o.skipped < maxModelSkips {
+		if rl, ol := p.modelLoadedAnywhere(r.model), p.modelLoadedAnywhere(o.model); rl != ol {
+			return rl
+		}
+	}
+	return r.before(o)
+}
+
+// charge advances tag's pass after one of its tasks is granted a slot.
+// Higher-weight tags advance more slowly and so are picked more often. Must
+// be called with p.mu held.
+func (p *WorkerPool) charge(pass map[string]float64, tag string) {
+	weight := p.tagWeights[tag]
+	if weight <= 0 {
+		weight = 1
+	}
+	pass[tag] += 1 / float64(weight)
+}
+
+// tagQueued reports whether any request with the given tag is waiting.
+// Must be called with p.mu held.
+func (p *WorkerPool) tagQueued(tag string) bool {
+	for _, r := range p.queue {
+		if r.tag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// SetFairShare turns fair-share scheduling across tags on or off. Applies to
+// every slot granted from now on, including to tasks already queued.
+func (p *WorkerPool) SetFairShare(enabled bool) {
+	p.mu.Lock()
+	p.fairShare = enabled
+	p.mu.Unlock()
+}
+
+// FairShare reports whether fair-share scheduling across tags is enabled.
+func (p *WorkerPool) FairShare() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.fairShare
+}
+
+// SetTagWeights sets the fair-share weight of each tag in weights, keeping
+// the weights of other tags. Tags without a weight count as weight 1.
+func (p *WorkerPool) SetTagWeights(weights map[string]int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for tag, w := range weights {
+		p.tagWeights[tag] = w
+	}
+}
+
+// removeRequest removes req from the queue. Returns false if it was no longer
+// queued (i.e. it has already been granted). Must be called with p.mu held.
+func (p *WorkerPool) removeRequest(req *slotRequest) bool {
+	for i, r := range p.queue {
+		if r == req {
+			p.queue = append(p.queue[:i], p.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// QueuePositions returns the 1-based position of every task waiting for a
+// worker slot, in the order slots will be granted if nothing else is queued
+// first. Tasks that aren't queued (blocked, running, finished) are absent.
+func (p *WorkerPool) QueuePositions() map[string]int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Replay dispatch on copies of the queue and pass values.
+	queue := append([]*slotRequest(nil), p.queue...)
+	pass := make(map[string]float64, len(p.tagPass))
+	for tag, v := range p.tagPass {
+		pass[tag] = v
+	}
+	positions := make(map[string]int, len(queue))
+	for pos := 1; len(queue) > 0; pos++ {
+		next := p.nextRequest(queue, pass, nil)
+		positions[queue[next].taskID] = pos
+		p.charge(pass, queue[next].tag)
+		queue = append(queue[:next], queue[next+1:]...)
+	}
+	return positions
+}
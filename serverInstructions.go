@@ -14,7 +14,7 @@ const serverInstructions = `You have access to a local Ollama worker pool for de
 This is a Go server sitting between you and Ollama. It handles everything that isn't a language problem:
 
 - **File I/O**: Reads input files from disk, writes output files after Ollama responds. Deterministic and instant — no model hallucinating paths or permissions.
-- **Concurrency**: Manages a semaphore-bounded worker pool with runtime-adjustable concurrency. Multiple tasks run in parallel across GPU slots, with queuing, execution, and cleanup handled automatically. Use the ` + "`concurrency`" + ` parameter on submit_tasks to tune parallelism at runtime.
+- **Concurrency**: Manages a priority-queued worker pool with runtime-adjustable concurrency. Multiple tasks run in parallel across GPU slots, with queuing, execution, and cleanup handled automatically. Use the ` + "`concurrency`" + ` parameter on submit_tasks to tune parallelism at runtime.
 - **Text processing**: Strips markdown code fences from output before writing to disk (configurable). A string operation that would cost inference tokens if done by a model.
 - **Process execution**: Runs formatters (gofmt, prettier, etc.) after each file write with timeouts and error capture.
 - **Memory lifecycle**: Clears completed results from memory once written to disk. Cleans up input fields after terminal states. Keeps memory steady across large batches.
@@ -38,6 +38,8 @@ If no models are available, tell the user to pull one (e.g. "ollama pull qwen2.5
 
 Pick the smallest model that can handle the task. Start with smaller models in pilot batches — retry with a larger one if quality isn't good enough.
 
+For common jobs — refactoring files in place, summarizing a codebase, adding Go struct tags, generating tests — the server's MCP prompts (refactor-files, summarize-codebase, add-struct-tags, generate-tests) produce a tested worker system prompt and a submit_tasks plan. Start from those rather than writing prompts from scratch.
+
 ## WHEN TO DELEGATE
 
 Proactively delegate when:
@@ -65,6 +67,7 @@ The server reads input files and writes output files directly — file contents
 - ` + "`output_file`" + `: Absolute path. Server writes the response here and clears it from memory. get_result returns the path but not the content.
 - ` + "`strip_markdown_fences`" + `: (default: true) Strips markdown code fences from output before writing. Set to false to preserve them.
 - ` + "`post_write_cmd`" + `: Shell command run after writing output_file (30s timeout). Must reference the absolute output path (e.g. "gofmt -w /abs/path/to/file.go").
+- ` + "`validate_cmd`" + `: Shell command run after post_write_cmd (2 min timeout), e.g. "cd /abs/repo && go build ./...". If it fails, its output is sent back to the worker as a follow-up message and the corrected response is written and validated again, up to ` + "`max_repair_attempts`" + ` (default 2) times. Requires output_file. get_result shows repair_attempts and the full conversation.
 
 **Example — fire-and-forget file transform:**
 ` + "```" + `
@@ -80,8 +83,14 @@ submit_tasks({tasks: [{
 
 **Error handling:** If Ollama succeeds but file write or post-command fails, the task is marked "failed" but the Ollama result is preserved — retrieve it with get_result.
 
+**Undo:** Output files are written atomically, and the server backs up each file's previous contents before the first write. If a batch produced bad output, call undo_tasks with the tag (or task_ids) to restore the originals — files that didn't exist before are removed. Cancel still-running tasks first; running tasks are skipped.
+
+**Staging:** For risky batches, submit with staging: true. Output files then go to a staging tree (each task's staged_file in check_tasks) and the real files are untouched. Review the staged files, then apply_staged the tag to promote them all at once, or discard_staged to drop them. Applied batches can still be reverted with undo_tasks. In a staged batch, post_write_cmd and validate_cmd must name the output_file by its absolute path (e.g. "gofmt -w /repo/a.go", "go vet /repo/a.go"): only that path is redirected to the staged copy, so package-wide commands like "go build ./..." are rejected — run them after apply_staged instead.
+
 **Tasks without output_file** (e.g. summarization where you need results in context): retrieve with get_result and process in smaller groups to manage context.
 
+**Map-reduce:** When you only need the combined answer (e.g. an architecture overview from per-file summaries), add ` + "`reduce`" + ` to the batch with a prompt saying how to combine the results. The server runs it once every task has finished — over whichever completed — and you get_result only ` + "`reduce_task_id`" + `. Large result sets are combined in rounds automatically.
+
 ## STRUCTURING PROMPTS FOR WORKERS
 
 Workers are less sophisticated than you. Treat them like a capable but literal junior developer. Every task must be COMPLETELY self-contained:
@@ -96,12 +105,17 @@ Workers are less sophisticated than you. Treat them like a capable but literal j
    - GOOD: "Replace every call to assert.Equal(t, expected, actual) with require.Equal(t, actual, expected). The argument order is reversed. Do not change any other code."
 
 3. **Include a before/after example** so the worker can see the pattern concretely.
+   When the worker needs more than the file it's changing — the interface it implements, a helper it calls — list those in ` + "`input_files`" + `. Each arrives in its own section labeled with the path, so refer to them by path in the prompt.
 
 4. **Don't worry about markdown fences** — strip_markdown_fences (default: true) removes them automatically when using output_file.
 
 5. **One concern per task** — break multi-step work into separate rounds. Don't ask a worker to do multiple unrelated changes in one task.
 
-6. **Respect context windows** — local models typically have 4K-8K token context. For large files, send just the relevant section, split into chunks, or handle it yourself. Test with a pilot — truncated or garbled output means the input was too large.
+6. **Respect context windows** — local models typically have 4K-8K token context. The server estimates each prompt's size and fails a task that won't fit rather than letting Ollama silently truncate it. For large files, send just the relevant section, set ` + "`chunk: true`" + ` (the server splits input_file at top-level declarations, runs each piece, and stitches the outputs — best for per-declaration work like adding doc comments, not for changes that need the whole file), raise ` + "`num_ctx`" + ` in ` + "`options`" + ` (costs GPU memory), or handle it yourself.
+
+7. **Tune generation with options** — ` + "`options`" + ` on a task (or on submit_tasks for the whole batch) is passed to Ollama: ` + "`temperature: 0`" + ` for deterministic mechanical edits, a fixed ` + "`seed`" + ` for reproducible output, ` + "`stop`" + ` sequences to cut off rambling. Unknown option names are rejected at submit time.
+
+8. **Edit large files with output_mode** — re-emitting a long file is slow and often truncates. For targeted changes, set ` + "`output_mode: \"unified_diff\"`" + ` (or ` + "`\"search_replace\"`" + `) with input_file and output_file: the worker returns only its changes and the server applies them. Ask for the change, not the file ("Add a nil check at the top of ParseConfig"). A patch that doesn't apply fails with a hunk-mismatch error; retry those in full mode.
 
 ## SUBMITTING WORK
 
@@ -109,32 +123,42 @@ Workers are less sophisticated than you. Treat them like a capable but literal j
 
 2. **Use tags**: Tag every batch for tracking and filtering (e.g. "refactor_batch1", "summarize_docs").
 
-3. **Prefer many small tasks** over fewer large ones. Run multi-step work as separate rounds:
+3. **Let the server enumerate files**: Instead of sending one task per file, send one task with ` + "`input_glob`" + ` (e.g. "/repo/**/*.go", ` + "`exclude`" + `: ["*_test.go", "vendor"]) and a templated output_file like "{{dir}}/{{stem}}_test.go". The response lists every expanded file with its task ID. Pilot by pointing input_glob at a single file first.
+
+4. **Prefer many small tasks** over fewer large ones. Run multi-step work as separate rounds:
    - Round 1: Submit all files for step 1. Wait. Verify.
    - Round 2: Submit successful results for step 2. Wait. Verify.
 
-4. **Set response_hint**:
+   When a later step only needs an earlier one to finish (not your review), use ` + "`depends_on`" + ` instead: list task IDs from earlier batches or 0-based indexes into the same batch (e.g. "generate the interface" as task 0, then 12 implementations with depends_on: ["0"]). Dependent tasks stay "blocked" without using a worker slot; if a dependency fails or is cancelled, its dependents fail or are cancelled too.
+
+   To feed one task's output into another, embed ` + "`{{result:<id or index>}}`" + ` in the prompt or set ` + "`input_from_task`" + ` (appended like input_file). Both imply depends_on. This builds summarize-then-synthesize pipelines without pulling intermediate results into your context with get_result.
+
+5. **Set response_hint**:
    - "status_only": pass/fail only (fire-and-forget file transforms, validation checks)
    - "content": need the output in memory (summaries you'll reason over)
-   - "json": structured data
+   - "json": structured data — Ollama is put in JSON mode and a response that doesn't parse fails the task. Add ` + "`json_schema`" + ` to pin down the exact shape; the server passes it to Ollama and fails any response that doesn't validate, with an error naming the offending field.
 
-5. **Adjust concurrency when switching models**: Set ` + "`concurrency`" + ` on submit_tasks to control parallel Ollama requests. Use fewer workers for larger models (e.g. 1-2 for 30B+) and more for smaller ones (e.g. 3-4 for 7B). The setting persists across batches until changed again.
+6. **Adjust concurrency when switching models**: Set ` + "`concurrency`" + ` on submit_tasks to control parallel Ollama requests. Use fewer workers for larger models (e.g. 1-2 for 30B+) and more for smaller ones (e.g. 3-4 for 7B). The setting persists across batches until changed again. When batches for different models share the queue, set ` + "`model_concurrency`" + ` (e.g. {"qwen2.5-coder:32b": 1}) instead of lowering ` + "`concurrency`" + ` for everyone — the big model is capped (per Ollama backend) while small models use the remaining slots. list_models shows each model's limit. The scheduler already runs queued tasks for the currently loaded model first, so don't interleave models by hand.
+
+7. **Keep interactive work responsive**: If a large background batch is running and you need a few quick results, either give the new tasks a higher ` + "`priority`" + ` or set ` + "`fair_share: true`" + ` on submit_tasks so tags take turns for worker slots. ` + "`tag_weights`" + ` (e.g. {"interactive": 3}) gives a tag a larger share. Both settings persist until changed.
 
 ## MONITORING
 
+When you have nothing else to do until a batch finishes, submit it with ` + "`wait: true`" + `: the call returns once every task has finished, with the batch's counts, and clients that show MCP progress notifications see each task start and finish meanwhile — no polling needed. Don't use wait for large batches while you could be doing other work. Results and tag summaries are also available as resources (task://<id>/result, tag://<tag>/summary) that the user can attach directly. Otherwise:
+
 1. **Don't over-poll** — every check_tasks call costs tokens and context window. Before polling, ask yourself: given the model size, input size, and number of tasks, is it likely that meaningful progress has occurred since the last check? If not, do something else first.
 
-2. **Use elapsed_seconds to calibrate** — each task in check_tasks includes elapsed_seconds. For completed/failed tasks this is the actual work duration (start to finish). For running tasks it's time so far. For pending tasks it's queue wait time. Use completed task durations to estimate how long remaining tasks will take and to decide when to poll next.
+2. **Use elapsed_seconds to calibrate** — each task in check_tasks includes elapsed_seconds. For completed/failed tasks this is the actual work duration (start to finish). For running tasks it's time so far. For pending tasks it's queue wait time, and queue_position shows where the task sits in line (1 = next to get a worker slot; higher priority tasks move ahead). Use completed task durations to estimate how long remaining tasks will take and to decide when to poll next.
 
-3. **Use progress counts to adapt** — check_tasks returns aggregate counts (pending/running/completed/failed/cancelled). Use these to gauge pace. If you check and see significant progress, you can check again after a similar interval. If nothing changed, back off — wait longer before the next check. Once all tasks are in terminal states, stop.
+3. **Use progress counts to adapt** — check_tasks returns aggregate counts (pending/running/retrying/completed/failed/cancelled). A "retrying" task hit a transient Ollama error and is backing off before its next attempt; its retries and last_attempt_error show what happened. Use these to gauge pace. If you check and see significant progress, you can check again after a similar interval. If nothing changed, back off — wait longer before the next check. Once all tasks are in terminal states, stop.
 
-4. **Report metrics after a batch completes** — tell the user: total elapsed time (max elapsed_seconds across completed tasks), average time per task, and success/failure/cancelled counts. The user wants visibility into how the work went.
+4. **Report metrics after a batch completes** — tell the user: total elapsed time (max elapsed_seconds across completed tasks), average time per task, and success/failure/cancelled counts. The check_tasks summary also totals tokens and generation time, with tokens_per_second per model. The user wants visibility into how the work went. If a task's metrics show max_prompt_eval_count at the model's num_ctx, its prompt was probably truncated — raise num_ctx or send less input.
 
 5. **Use tag filters, not per-task checks** — one check_tasks call with a tag gives you everything. Don't poll individual task IDs one at a time.
 
 6. **Do other work while waiting** — don't sit idle between polls. Read files, plan next steps, prepare prompts for follow-up batches, or work on unrelated parts of the user's request. Come back to check progress when enough time has likely passed.
 
-7. **Spot-check mid-batch**: Read 2-3 completed output files directly to verify quality. Cancel remaining tasks immediately if quality is bad.
+7. **Spot-check mid-batch**: Call get_result with include_diff: true on 2-3 completed tasks to see exactly what they changed (cheaper than reading whole files), and watch check_tasks' lines_added/lines_removed for outliers — a tiny edit that rewrote 400 lines is suspect. Cancel remaining tasks immediately if quality is bad, then undo_tasks the tag to restore the files already written. If one task runs far longer than its siblings, peek_task it: a tail that repeats itself or a token count well past the expected output length means the model is looping — cancel it and resubmit with a tighter prompt or num_predict.
 
 8. **Report final results** to the user with actual counts and timing metrics (e.g. "42/45 completed, 3 failed. Average 12s per task.").
 
@@ -143,11 +167,16 @@ Workers are less sophisticated than you. Treat them like a capable but literal j
    - "failed to read input file" — wrong path or file doesn't exist.
    - "failed to write output file" — directory doesn't exist or permissions issue.
    - "post-write command failed" — formatter error; the output file was already written.
-   - Other — unclear prompt (adjust and resubmit), task too complex (handle it yourself), or transient error (retry once).
+   - "validation command failed after N repair attempt(s)" — the worker couldn't fix the validate_cmd errors. The last (still failing) output is on disk; check the conversation in get_result to see what it tried, then fix it yourself or resubmit with clearer instructions.
+   - "response is not valid JSON" / "response does not match json_schema" — structured output check failed; the raw response is in get_result. Simplify the schema, raise num_predict if output was cut off, or use a larger model.
+   - "prompt too large for the context window" — the input won't fit. Resubmit with chunk: true, a larger num_ctx in options, or less input.
+   - "does not apply to input_file" — an output_mode patch didn't match the file (the hunk and lines are in the error). Resubmit in full mode or with a more precise prompt.
+   - "(after N retries)" — a transient Ollama error (connection refused, server busy, model loading) persisted through every automatic retry. Check that Ollama is healthy before resubmitting.
+   - Other — unclear prompt (adjust and resubmit) or task too complex (handle it yourself). Transient errors are already retried automatically (max_retries, default 2).
 
 10. **Don't blindly retry** — understand why a task failed before resubmitting.
 
-11. **Infrastructure errors**: If list_models fails or all tasks fail with connection errors, Ollama isn't running — tell the user ("try 'ollama serve'"). "Model not found" means user needs to pull it. Don't retry infrastructure failures.
+11. **Infrastructure errors**: If list_models fails or all tasks fail with connection errors, Ollama isn't running — tell the user ("try 'ollama serve'"). "Model not found" (or "not installed on any healthy Ollama backend") means user needs to pull it; list_models shows which backends have each model and which are down. Don't retry infrastructure failures.
 
 12. **Validate when possible**: compile/lint code output, verify patterns were applied, check structured output parses correctly. Discuss discrepancies with the user.
 `
@@ -0,0 +1,353 @@
+// staging.go implements staging mode: output_file writes go to a mirror tree
+// under a staging root instead of the real path, so a whole batch can be
+// reviewed before any real file is touched.
+//
+// With staging set on submit_tasks, a task whose output_file is
+// /repo/pkg/a.go writes to <root>/session_<id>/tag_<tag>/repo/pkg/a.go
+// instead. The tree is per session and tag so two staged batches — or two
+// sessions of a TRANSPORT=http daemon using the same tag — can't overwrite
+// each other's files, and a later staged task of the same session and tag
+// that reads /repo/pkg/a.go as its input_file sees the staged version —
+// multi-pass pipelines build on their own staged output. An output_file
+// whose ".." elements would lead out of the tree is rejected.
+//
+// post_write_cmd and validate_cmd have the output path rewritten to the
+// staged path, so "gofmt -w /repo/pkg/a.go" formats the staged copy. Only
+// the literal absolute path is rewritten — a command such as
+// "go build ./..." would still run against the real tree, validating code
+// that doesn't include the staged output — so submit_tasks rejects staged
+// tasks whose commands don't name output_file.
+//
+// apply_staged promotes staged files into place in two phases: every staged
+// file is first copied to a temp file next to its destination, and only when
+// all copies succeeded are they renamed over the real files. Each real file
+// is backed up just before its rename, so if a backup or rename fails, the
+// files already promoted are restored from their backups and no real file is
+// left changed. The same backups let undo_tasks revert applied tasks exactly
+// as it does tasks that wrote directly. discard_staged deletes staged files.
+//
+// The staging root is STAGING_DIR, else STATE_DIR/staging, else a directory
+// in the system temp dir.
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// stagingDir returns the staging root. The StagingDir field can be set
+// directly on WorkerPool to override it (used by tests).
+func (p *WorkerPool) stagingDir() string {
+	if p.StagingDir != "" {
+		return p.StagingDir
+	}
+	if dir := os.Getenv("STAGING_DIR"); dir != "" {
+		return dir
+	}
+	if dir := os.Getenv("STATE_DIR"); dir != "" {
+		return filepath.Join(dir, "staging")
+	}
+	return filepath.Join(os.TempDir(), "OpusGoLlama-staging")
+}
+
+// sessionStagingDir returns the part of the staging tree that belongs to
+// session. The session is escaped so it forms exactly one path element.
+func (p *WorkerPool) sessionStagingDir(session string) string {
+	if session == "" {
+		return filepath.Join(p.stagingDir(), "local")
+	}
+	return filepath.Join(p.stagingDir(), "session_"+url.PathEscape(session))
+}
+
+// stagedPath maps a real absolute path to its mirror in the staging tree of
+// session and tag. The tag is escaped so it forms exactly one path element.
+// Returns an error if path would land outside that tree.
+func (p *WorkerPool) stagedPath(session, tag, path string) (string, error) {
+	tagDir := "untagged"
+	if tag != "" {
+		tagDir = "tag_" + url.PathEscape(tag)
+	}
+	root := filepath.Join(p.sessionStagingDir(session), tagDir)
+	staged := filepath.Join(root, path)
+	if !strings.HasPrefix(staged, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("output_file %q leads outside the staging tree", path)
+	}
+	return staged, nil
+}
+
+// stagedInput returns the staged copy of a file a staged task reads, if an
+// earlier task of the same session and tag staged one; otherwise path
+// itself.
+func (p *WorkerPool) stagedInput(task *Task, path string) string {
+	if task.StagedFile == "" || path == "" {
+		return path
+	}
+	staged, err := p.stagedPath(task.Session, task.Tag, path)
+	if err == nil && fileExists(staged) {
+		return staged
+	}
+	return path
+}
+
+// stagedCommand rewrites references to a staged task's output file in a
+// post_write_cmd or validate_cmd so the command acts on the staged copy.
+func stagedCommand(task *Task, cmd string) string {
+	if task.StagedFile == "" || cmd == "" {
+		return cmd
+	}
+	cmd, _ = replacePath(cmd, task.OutputFile, task.StagedFile)
+	return cmd
+}
+
+// replacePath replaces each occurrence of path in cmd that stands alone as a
+// path — not part of a longer one such as path+".bak" or "/x"+path — with
+// repl, and reports whether there were any.
+func replacePath(cmd, path, repl string) (string, bool) {
+	if path == "" {
+		return cmd, false
+	}
+	var b strings.Builder
+	found := false
+	for {
+		i := strings.Index(cmd, path)
+		if i < 0 {
+			b.WriteString(cmd)
+			return b.String(), found
+		}
+		end := i + len(path)
+		if (i > 0 && isPathByte(cmd[i-1])) || (end < len(cmd) && isPathByte(cmd[end])) {
+			b.WriteString(cmd[:i+1])
+			cmd = cmd[i+1:]
+			continue
+		}
+		b.WriteString(cmd[:i])
+		b.WriteString(repl)
+		cmd = cmd[end:]
+		found = true
+	}
+}
+
+// isPathByte reports whether c can continue a file path in a shell command.
+func isPathByte(c byte) bool {
+	return c == '/' || c == '.' || c == '_' || c == '-' || c == '~' ||
+		('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// writeStagedFile writes a staged output, creating the mirror directories.
+func writeStagedFile(path, content string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeOutputFile(path, content)
+}
+
+// fileExists reports whether path exists.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// stagedPromotion is one staged file being moved into place by ApplyStaged.
+type stagedPromotion struct {
+	staged, dest, tmp string
+	taskIDs           []string    // tasks that staged this file, in task order
+	backup            *FileBackup // the real file before its rename
+}
+
+// ApplyStaged promotes the staged output of the matched completed tasks into
+// place (see the file comment for the two-phase approach). When several
+// tasks staged the same file, it is promoted once and every one of them is
+// marked applied. Tasks that aren't completed, or have nothing staged, are
+// skipped and reported. Only tasks visible to session are matched.
+func (p *WorkerPool) ApplyStaged(ids []string, tag, session string) ([]StagedFileResult, error) {
+	targets := p.store.StagedTargets(ids, tag, session)
+	var results []StagedFileResult
+	var promotions []*stagedPromotion
+	byStaged := make(map[string]*stagedPromotion)
+	for _, t := range targets {
+		if t.Staging != "staged" || t.Status != "completed" {
+			results = append(results, skippedStagedFile(t, "apply"))
+			continue
+		}
+		if pr, ok := byStaged[t.StagedFile]; ok {
+			pr.taskIDs = append(pr.taskIDs, t.ID)
+			continue
+		}
+		pr := &stagedPromotion{staged: t.StagedFile, dest: t.OutputFile, taskIDs: []string{t.ID}}
+		byStaged[t.StagedFile] = pr
+		promotions = append(promotions, pr)
+	}
+
+	// Phase 1: copy every staged file next to its destination.
+	cleanup := func() {
+		for _, pr := range promotions {
+			if pr.tmp != "" {
+				os.Remove(pr.tmp)
+			}
+		}
+	}
+	for _, pr := range promotions {
+		tmp, err := stageBesideDestination(pr.staged, pr.dest)
+		if err != nil {
+			cleanup()
+			return nil, fmt.Errorf("nothing was applied: preparing %s: %v", pr.dest, err)
+		}
+		pr.tmp = tmp
+	}
+
+	// Phase 2: back up each real file and rename the copy over it. On a
+	// failure, roll back the files promoted so far.
+	dir, err := p.backupDir()
+	if err != nil {
+		cleanup()
+		return nil, fmt.Errorf("nothing was applied: creating backup directory: %v", err)
+	}
+	for i, pr := range promotions {
+		backup, err := backupFile(dir, pr.taskIDs[0], pr.dest)
+		if err == nil {
+			if err = os.Rename(pr.tmp, pr.dest); err != nil && backup.Existed {
+				os.Remove(backup.Path)
+			}
+		}
+		if err != nil {
+			cleanup()
+			err = fmt.Errorf("applying %s: %v", pr.dest, err)
+			return nil, p.rollBackPromotions(promotions[:i], err)
+		}
+		pr.tmp, pr.backup = "", backup
+	}
+	for _, pr := range promotions {
+		results = append(results, p.markApplied(pr)...)
+	}
+	p.pruneBackups()
+	sortStagedResults(results, targets)
+	return results, nil
+}
+
+// markApplied records that pr's staged file is now the real file, and
+// returns a result for each task that staged it.
+func (p *WorkerPool) markApplied(pr *stagedPromotion) []StagedFileResult {
+	os.Remove(pr.staged)
+	results := make([]StagedFileResult, 0, len(pr.taskIDs))
+	for i, id := range pr.taskIDs {
+		// Only the first task owns the backup, so undo restores the
+		// original exactly once.
+		if i == 0 {
+			p.store.SetStagingApplied(id, pr.backup)
+		} else {
+			p.store.SetStagingApplied(id, nil)
+		}
+		results = append(results, StagedFileResult{
+			ID: id, OutputFile: pr.dest, StagedFile: pr.staged, Action: "applied",
+		})
+	}
+	return results
+}
+
+// rollBackPromotions restores the real files of promotions that were already
+// renamed into place when a later one failed with cause, and returns the
+// error to report. A file that can't be restored keeps the staged version
+// and its tasks are marked applied, so undo_tasks can still revert it; the
+// error names those files.
+func (p *WorkerPool) rollBackPromotions(done []*stagedPromotion, cause error) error {
+	var kept []string
+	for i := len(done) - 1; i >= 0; i-- {
+		pr := done[i]
+		if _, err := restoreBackup(pr.dest, pr.backup); err != nil {
+			p.markApplied(pr)
+			kept = append(kept, fmt.Sprintf("%s (%v)", pr.dest, err))
+		}
+	}
+	if len(kept) == 0 {
+		return fmt.Errorf("nothing was applied: %v", cause)
+	}
+	slices.Reverse(kept)
+	return fmt.Errorf("%v; rolling back failed, so these files were applied "+
+		"and the rest were not: %s. undo_tasks can revert the applied ones",
+		cause, strings.Join(kept, ", "))
+}
+
+// DiscardStaged deletes the staged output of the matched tasks without
+// touching the real files. Running tasks are skipped, since they could stage
+// the file again. Only tasks visible to session are matched.
+func (p *WorkerPool) DiscardStaged(ids []string, tag, session string) []StagedFileResult {
+	var results []StagedFileResult
+	for _, t := range p.store.StagedTargets(ids, tag, session) {
+		if t.Staging != "staged" || !isTerminalStatus(t.Status) {
+			results = append(results, skippedStagedFile(t, "discard"))
+			continue
+		}
+		res := StagedFileResult{ID: t.ID, OutputFile: t.OutputFile, StagedFile: t.StagedFile, Action: "discarded"}
+		if err := os.Remove(t.StagedFile); err != nil && !os.IsNotExist(err) {
+			res.Action = "failed"
+			res.Error = err.Error()
+		} else {
+			p.store.SetStagingDiscarded(t.ID)
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// skippedStagedFile explains why a task's staged output can't be applied or
+// discarded.
+func skippedStagedFile(t stagedTarget, verb string) StagedFileResult {
+	res := StagedFileResult{ID: t.ID, OutputFile: t.OutputFile, StagedFile: t.StagedFile, Action: "skipped"}
+	switch {
+	case t.Staging == "applied" || t.Staging == "discarded":
+		res.Error = "already " + t.Staging
+	case t.Staging == "":
+		res.Error = "task has no staged output"
+	case !isTerminalStatus(t.Status):
+		res.Error = fmt.Sprintf("task is %s; wait for it to finish before you %s its output", t.Status, verb)
+	default:
+		res.Error = fmt.Sprintf("task %s; only completed tasks can be applied (discard_staged removes its staged output)", t.Status)
+	}
+	return res
+}
+
+// sortStagedResults puts results back in task order.
+func sortStagedResults(results []StagedFileResult, targets []stagedTarget) {
+	order := make(map[string]int, len(targets))
+	for i, t := range targets {
+		order[t.ID] = i
+	}
+	slices.SortStableFunc(results, func(a, b StagedFileResult) int {
+		return order[a.ID] - order[b.ID]
+	})
+}
+
+// stageBesideDestination copies staged into a temp file in dest's directory,
+// so the final rename stays on one filesystem and is atomic. An existing
+// destination keeps its permissions.
+func stageBesideDestination(staged, dest string) (string, error) {
+	data, err := os.ReadFile(staged)
+	if err != nil {
+		return "", err
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(dest); err == nil {
+		mode = info.Mode().Perm()
+	}
+	f, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, mode)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
@@ -1,9 +1,11 @@
 // task.go defines the internal task representation used by the store and worker pool.
-// Not exposed via MCP.
+// Not exposed via MCP. When STATE_DIR is set, Task is also the on-disk journal
+// record, so every field except Cancel must stay JSON-serializable.
 package main
 
 import (
 	"context"
+	"encoding/json"
 	"time"
 )
 
@@ -12,27 +14,67 @@ import (
 //
 // Lifecycle: pending -> running -> completed | failed
 //
-//	pending/running -> cancelled (via cancel_tasks)
+//	blocked -> pending (all dependencies completed)
+//	blocked -> failed | cancelled (a dependency failed / was cancelled)
+//	blocked -> pending (reduce task: all map tasks finished, see reduce.go)
+//	running -> retrying -> running (transient Ollama error, see retry.go)
+//	blocked/pending/running/retrying -> cancelled (via cancel_tasks)
 type Task struct {
 	ID           string
 	Tag          string
+	Session      string // MCP session that submitted the task; only it sees the task, or every session if empty (see http_transport.go)
 	SystemPrompt string
 	Prompt       string
 	Model        string
 	ResponseHint string
+	// JSONSchema is the schema the response must conform to (see
+	// json_output.go). omitempty keeps a nil schema from coming back from
+	// the journal as a literal null.
+	JSONSchema json.RawMessage `json:",omitempty"`
 
 	InputFile           string
+	InputFiles          []string // context files sent as labeled sections (see input_files.go)
 	OutputFile          string
 	StripMarkdownFences bool   // plain bool — handler resolves default from *bool
+	OutputMode          string // full (or empty), unified_diff, or search_replace (see patch.go)
+	Chunk               bool   // process input_file in context-sized pieces (see chunking.go)
+	Chunks              int    // chunk mode: number of chunks input_file was split into
+	ChunksDone          int    // chunk mode: chunks processed so far
+	Backend             string // Ollama backend the task last ran on, with several backends (see backends.go)
 	PostWriteCmd        string
-	FileWritten         bool   // set by worker after successful file write
+	ValidateCmd         string      // run after writing; failures are fed back to the model (see repair.go)
+	FileWritten         bool        // set by worker after successful file write
+	LinesAdded          int         // lines the task added to output_file (see diff.go)
+	LinesRemoved        int         // lines the task removed from output_file
+	Diff                string      // unified diff of what the task wrote, recorded when it finished
+	DiffError           string      // why Diff couldn't be computed
+	Backup              *FileBackup // output file's state before the first write (see backup.go)
+	Undone              bool        // output file restored via undo_tasks
+	BackupPruned        bool        // backup deleted to stay within BACKUP_RETENTION, so undo is no longer possible
+	StagedFile          string      // staging mode: where output_file is written until applied (see staging.go)
+	Staging             string      // staging state: "staged", "applied", or "discarded"; empty if not staged
 
-	TimeoutSeconds int              // per-task timeout; 0 means use default
+	Options        map[string]any // Ollama generation options (batch defaults merged in)
+	TimeoutSeconds int            // per-task timeout; 0 means use default
+	Priority       int            // higher runs first; FIFO within a priority
+	DependsOn      []string       // IDs of tasks that must complete before this one runs
+	InputFromTask  string         // ID of a task whose output is appended to the prompt (see chain.go)
+	ReduceOver     []ReduceInput  // reduce task: the map tasks whose results it combines (see reduce.go)
 
-	Status      string             // pending, running, completed, failed, cancelled
+	MaxRetries       int           // retries allowed for transient Ollama errors; 0 disables
+	RetryBackoff     time.Duration // base backoff before the first retry; 0 means use default
+	Retries          int           // retries performed so far
+	LastAttemptError string        // error from the most recent failed attempt
+	Metrics          *EvalMetrics  // Ollama token counts and timings over completed calls (see eval_metrics.go)
+
+	MaxRepairAttempts int        // follow-up turns allowed after validate_cmd failures
+	RepairAttempts    int        // follow-up turns sent so far
+	Conversation      []ChatTurn // chat history, recorded for validate_cmd tasks
+
+	Status      string             // blocked, pending, running, retrying, completed, failed, cancelled
 	Result      string             // full Ollama response (populated on completion)
 	Error       string             // error message (populated on failure)
-	Cancel      context.CancelFunc // cancels this task's context, aborting the Ollama call
+	Cancel      context.CancelFunc `json:"-"` // cancels this task's context, aborting the Ollama call
 	CreatedAt   time.Time
 	StartedAt   time.Time
 	CompletedAt time.Time
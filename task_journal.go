@@ -0,0 +1,195 @@
+// task_journal.go implements the optional on-disk journal behind TaskStore.
+//
+// When STATE_DIR is set, every task transition (Add, SetRunning, SetCompleted,
+// SetFailed, SetCancelled, ...) appends a full JSON snapshot of the task to
+// STATE_DIR/tasks.jsonl. On startup the journal is replayed — the last
+// snapshot for each task ID wins — so task IDs, statuses, and results that
+// were not written to disk survive a restart of the MCP server.
+//
+// Snapshots (rather than per-field deltas) keep replay trivial: new Task
+// fields are persisted automatically, and a torn final line from a crash
+// mid-write only loses that one transition. A task dropped from the store
+// (see TaskStore.RemoveSession) is recorded as a removal line, and replay
+// forgets it.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	journalFileName = "tasks.jsonl"
+
+	// interruptedByRestartError is recorded on tasks that were running when
+	// the previous server process exited. Their Ollama call was lost with the
+	// process, so they cannot be resumed mid-flight.
+	interruptedByRestartError = "interrupted by restart: the server stopped while this task was running. Resubmit it if the work is still needed."
+)
+
+// journalRemoval is the journal line recording that a task was dropped from
+// the store. It decodes as a Task without an ID, so replay can tell the two
+// apart.
+type journalRemoval struct {
+	Removed string
+}
+
+// taskJournal is an append-only log of task snapshots. It is not safe for
+// concurrent use — TaskStore only writes to it while holding its own mutex,
+// which also keeps journal order identical to transition order.
+type taskJournal struct {
+	f   *os.File
+	enc *json.Encoder
+}
+
+// openTaskJournal replays the journal in dir (if any), compacts it down to
+// one snapshot per task, and opens it for appending. Returns the recovered
+// tasks in their original insertion order.
+func openTaskJournal(dir string) (*taskJournal, []*Task, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, fmt.Errorf("failed to create state dir: %v", err)
+	}
+	path := filepath.Join(dir, journalFileName)
+
+	tasks, err := replayJournal(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	recoverInterruptedTasks(tasks)
+
+	if err := compactJournal(path, tasks); err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open task journal: %v", err)
+	}
+	return &taskJournal{f: f, enc: json.NewEncoder(f)}, tasks, nil
+}
+
+// replayJournal reads every snapshot in the journal. Later snapshots replace
+// earlier ones for the same task ID; insertion order is the order in which
+// each ID first appeared. Undecodable lines (e.g. a torn final write) are
+// skipped. A missing journal is not an error — it means a fresh start.
+func replayJournal(path string) ([]*Task, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open task journal: %v", err)
+	}
+	defer f.Close()
+
+	byID := make(map[string]*Task)
+	var order []string
+
+	scanner := bufio.NewScanner(f)
+	// Snapshots carry full prompts and results, which can be far larger
+	// than bufio's 64KB default line limit.
+	scanner.Buffer(make([]byte, 0, 64*1024), 256*1024*1024)
+	for scanner.Scan() {
+		var t Task
+		if err := json.Unmarshal(scanner.Bytes(), &t); err != nil {
+			continue
+		}
+		if t.ID == "" {
+			var r journalRemoval
+			if json.Unmarshal(scanner.Bytes(), &r) == nil && r.Removed != "" {
+				delete(byID, r.Removed)
+			}
+			continue
+		}
+		if _, seen := byID[t.ID]; !seen {
+			order = append(order, t.ID)
+		}
+		byID[t.ID] = &t
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read task journal: %v", err)
+	}
+
+	tasks := make([]*Task, 0, len(byID))
+	for _, id := range order {
+		if t, ok := byID[id]; ok {
+			tasks = append(tasks, t)
+		}
+	}
+	return tasks, nil
+}
+
+// recoverInterruptedTasks fails every task that was mid-flight when the
+// previous process exited. Pending tasks are left pending so the worker pool
+// can re-queue them (see WorkerPool.Resume).
+func recoverInterruptedTasks(tasks []*Task) {
+	now := time.Now()
+	for _, t := range tasks {
+		if t.Status != "running" && t.Status != "retrying" {
+			continue
+		}
+		t.Status = "failed"
+		t.Error = interruptedByRestartError
+		t.CompletedAt = now
+		t.SystemPrompt = ""
+		t.Prompt = ""
+		t.InputFile = ""
+		t.PostWriteCmd = ""
+	}
+}
+
+// compactJournal atomically rewrites the journal with a single snapshot per
+// task, so the file doesn't grow without bound across restarts.
+func compactJournal(path string, tasks []*Task) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), journalFileName+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to compact task journal: %v", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, t := range tasks {
+		if err := enc.Encode(t); err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to compact task journal: %v", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to compact task journal: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to compact task journal: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to compact task journal: %v", err)
+	}
+	return nil
+}
+
+// record appends a snapshot of t. Write errors are reported on stderr rather
+// than failing the transition — losing durability is better than losing the
+// in-memory state the current session depends on.
+func (j *taskJournal) record(t *Task) {
+	if err := j.enc.Encode(t); err != nil {
+		fmt.Fprintf(os.Stderr, "task journal: failed to record task %s: %v\n", t.ID, err)
+	}
+}
+
+// remove appends a removal line for task id. Like record, it reports write
+// errors on stderr.
+func (j *taskJournal) remove(id string) {
+	if err := j.enc.Encode(journalRemoval{Removed: id}); err != nil {
+		fmt.Fprintf(os.Stderr, "task journal: failed to record removal of task %s: %v\n", id, err)
+	}
+}
+
+// close flushes and closes the journal file.
+func (j *taskJournal) close() error {
+	return j.f.Close()
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// reopenStore closes s and opens a new persistent store on the same dir,
+// simulating a server restart.
+func reopenStore(t *testing.T, s *TaskStore, dir string) *TaskStore {
+	t.Helper()
+	if err := s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	s2, err := NewPersistentTaskStore(dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	t.Cleanup(func() { s2.Close() })
+	return s2
+}
+
+// ---------------------------------------------------------------------------
+// Replay after restart
+// ---------------------------------------------------------------------------
+
+func TestJournalReplaysTerminalTasks(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewPersistentTaskStore(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s.Add([]*Task{makeTask("done", "batch", "pending"), makeTask("bad", "batch", "pending")})
+	s.SetRunning("done")
+	s.SetCompleted("done", "the result")
+	s.SetRunning("bad")
+	s.SetFailed("bad", "model not found")
+
+	s2 := reopenStore(t, s, dir)
+
+	results := s2.Results([]string{"done", "bad"}, "")
+	if results[0].Status != "completed" || results[0].Content != "the result" || results[0].Tag != "batch" {
+		t.Fatalf("unexpected replayed completed task: %+v", results[0])
+	}
+	if results[1].Status != "failed" || results[1].Error != "model not found" {
+		t.Fatalf("unexpected replayed failed task: %+v", results[1])
+	}
+}
+
+func TestJournalPreservesInsertionOrder(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewPersistentTaskStore(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s.Add([]*Task{makeTask("c", "", "pending"), makeTask("a", "", "pending"), makeTask("b", "", "pending")})
+	s.SetRunning("a") // later transitions must not reorder
+
+	s2 := reopenStore(t, s, dir)
+
+	got := s2.List(nil, "", "")
+	if len(got) != 3 || got[0].ID != "c" || got[1].ID != "a" || got[2].ID != "b" {
+		t.Fatalf("expected order c,a,b after replay")
+	}
+}
+
+func TestJournalRunningTaskMarkedInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewPersistentTaskStore(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s.Add([]*Task{makeTask("t1", "", "pending")})
+	s.SetRunning("t1")
+
+	s2 := reopenStore(t, s, dir)
+
+	got := s2.Get("t1")
+	if got.Status != "failed" {
+		t.Fatalf("expected failed, got %s", got.Status)
+	}
+	if !strings.HasPrefix(got.Error, "interrupted by restart") {
+		t.Fatalf("expected interrupted-by-restart error, got %q", got.Error)
+	}
+	if got.Prompt != "" || got.SystemPrompt != "" || got.InputFile != "" {
+		t.Fatal("input fields should be cleared on interrupted task")
+	}
+}
+
+func TestJournalPendingTaskStaysPending(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewPersistentTaskStore(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s.Add([]*Task{makeTask("t1", "", "pending")})
+
+	s2 := reopenStore(t, s, dir)
+
+	got := s2.Get("t1")
+	if got.Status != "pending" {
+		t.Fatalf("expected pending, got %s", got.Status)
+	}
+	if got.Prompt != "prompt:t1" {
+		t.Fatalf("pending task should keep its prompt, got %q", got.Prompt)
+	}
+	if len(s2.Resumable()) != 1 {
+		t.Fatal("recovered pending task should be resumable")
+	}
+}
+
+func TestJournalRecoveredTasksUnowned(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewPersistentTaskStore(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	task := makeTask("t1", "", "pending")
+	task.Session = "before-restart"
+	s.Add([]*Task{task})
+
+	s2 := reopenStore(t, s, dir)
+
+	if !s2.Visible("t1", "after-restart") || !s2.Visible("t1", "") {
+		t.Fatal("a recovered task should be visible to every session")
+	}
+}
+
+func TestJournalForgetsRemovedSession(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewPersistentTaskStore(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	gone, kept := makeTask("gone", "", "pending"), makeTask("kept", "", "pending")
+	gone.Session, kept.Session = "s1", "s2"
+	s.Add([]*Task{gone, kept})
+	s.RemoveSession("s1")
+
+	s2 := reopenStore(t, s, dir)
+
+	if s2.Get("gone") != nil {
+		t.Fatal("a removed task should not be replayed")
+	}
+	if got := s2.List(nil, "", ""); len(got) != 1 || got[0].ID != "kept" {
+		t.Fatalf("expected only the kept task after replay, got %v", got)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, journalFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "gone") {
+		t.Fatal("expected compaction to drop the removed task from the journal")
+	}
+}
+
+func TestJournalSkipsTornLine(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewPersistentTaskStore(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s.Add([]*Task{makeTask("t1", "", "pending")})
+	s.Close()
+
+	// Simulate a crash halfway through writing a snapshot.
+	f, err := os.OpenFile(filepath.Join(dir, journalFileName), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"ID":"t1","Status":"runn`)
+	f.Close()
+
+	s2, err := NewPersistentTaskStore(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer s2.Close()
+	if got := s2.Get("t1"); got == nil || got.Status != "pending" {
+		t.Fatal("expected last complete snapshot (pending) to win over torn line")
+	}
+}
+
+func TestJournalCompactsOnOpen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewPersistentTaskStore(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s.Add([]*Task{makeTask("t1", "", "pending")})
+	s.SetRunning("t1")
+	s.SetCompleted("t1", "done")
+
+	s2 := reopenStore(t, s, dir)
+	_ = s2
+
+	data, err := os.ReadFile(filepath.Join(dir, journalFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 1 {
+		t.Fatalf("expected 1 snapshot after compaction, got %d", lines)
+	}
+}
+
+func TestJournalClosedStoreStopsPersisting(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewPersistentTaskStore(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s.Add([]*Task{makeTask("t1", "", "pending")})
+	s.Close()
+
+	// Shutdown cancellations happen after Close and must not be persisted.
+	s.Cancel(nil, "", "")
+
+	s2, err := NewPersistentTaskStore(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer s2.Close()
+	if got := s2.Get("t1"); got.Status != "pending" {
+		t.Fatalf("expected pending, got %s", got.Status)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Resume re-queues recovered pending tasks
+// ---------------------------------------------------------------------------
+
+func TestWorkerPoolResume(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewPersistentTaskStore(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s.Add([]*Task{{ID: "t1", Prompt: "p", Model: "m", Status: "pending", CreatedAt: time.Now()}})
+
+	s2 := reopenStore(t, s, dir)
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			fn(api.ChatResponse{Message: api.Message{Content: "resumed"}})
+			return nil
+		},
+	}
+	pool := newTestPool(s2, 1, mock)
+
+	if n := pool.Resume(); n != 1 {
+		t.Fatalf("expected 1 resumed task, got %d", n)
+	}
+	waitForStatus(t, s2, "t1", 2*time.Second, "completed")
+	if got := s2.Results([]string{"t1"}, "")[0].Content; got != "resumed" {
+		t.Fatalf("expected 'resumed', got %q", got)
+	}
+	if n := pool.Resume(); n != 0 {
+		t.Fatalf("completed task should not be resumed again, got %d", n)
+	}
+}
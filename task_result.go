@@ -5,6 +5,11 @@ package main
 // GetResultArgs is the input for the get_result tool.
 type GetResultArgs struct {
 	TaskIDs []string `json:"task_ids" jsonschema:"Task IDs to retrieve full results for"`
+
+	// IncludeDiff adds the unified diff between each output_file's pre-write
+	// contents and what the task wrote, so written files can be spot-checked
+	// without reading them whole.
+	IncludeDiff bool `json:"include_diff,omitempty" jsonschema:"For tasks with output_file, also return the unified diff of what the task changed in the file"`
 }
 
 // GetResultOutput contains the full content for each requested task.
@@ -17,7 +22,22 @@ type TaskResult struct {
 	ID         string `json:"id"`
 	Tag        string `json:"tag,omitempty"`
 	Status     string `json:"status"`
-	Content    string `json:"content,omitempty"`     // full Ollama response (empty if written to output_file)
+	Content    string `json:"content,omitempty"` // full Ollama response (empty if written to output_file)
 	Error      string `json:"error,omitempty"`
 	OutputFile string `json:"output_file,omitempty"` // path where output was written (if applicable)
+	StagedFile string `json:"staged_file,omitempty"` // staging mode: where output_file is written until applied
+	Staging    string `json:"staging,omitempty"`     // staged, applied, or discarded (staging mode only)
+	Diff       string `json:"diff,omitempty"`        // unified diff of output_file changes (include_diff only)
+	DiffError  string `json:"diff_error,omitempty"`  // why no diff could be produced (include_diff only)
+
+	Metrics *EvalMetrics `json:"metrics,omitempty"` // Ollama token counts and timings, summed over the task's calls
+
+	RepairAttempts int        `json:"repair_attempts,omitempty"` // follow-up turns after validate_cmd failures
+	Conversation   []ChatTurn `json:"conversation,omitempty"`    // full chat history (validate_cmd tasks only)
+}
+
+// ChatTurn is one message of a task's conversation with the model.
+type ChatTurn struct {
+	Role    string `json:"role"` // system, user, or assistant
+	Content string `json:"content"`
 }
@@ -7,8 +7,51 @@ type SubmitTasksArgs struct {
 	// Concurrency optionally adjusts the worker pool size for this and all
 	// subsequent batches. Use a lower value when running a larger model (to
 	// avoid OOM) or a higher value for lightweight tasks. If nil, the current
-	// concurrency is unchanged.
-	Concurrency *int `json:"concurrency,omitempty" jsonschema:"Set worker pool concurrency (number of parallel Ollama requests). Persists until changed again. Omit to keep current value."`
+	// concurrency is unchanged. Like the other scheduler settings below, it
+	// is pool-wide: it applies to every session's tasks, not just this
+	// batch's, and only takes effect if the batch is accepted.
+	Concurrency *int `json:"concurrency,omitempty" jsonschema:"Set worker pool concurrency (number of parallel Ollama requests). Pool-wide: affects every queued and future task, including other sessions'. Persists until changed again. Omit to keep current value."`
+
+	// FairShare optionally switches fair-share scheduling across tags on or
+	// off for this and all subsequent batches. When on, tasks of equal
+	// priority from different tags take turns for worker slots instead of
+	// running strictly in submission order, so a small interactive batch
+	// isn't stuck behind a large background batch. If nil, the current
+	// setting is unchanged (default: off).
+	FairShare *bool `json:"fair_share,omitempty" jsonschema:"Share worker slots across tags instead of strict submission order. Pool-wide: affects every queued and future task, including other sessions'. Persists until changed again. Omit to keep current setting (default: off)."`
+
+	// TagWeights optionally sets fair-share weights per tag, e.g.
+	// {"interactive": 3, "background": 1} gives interactive tasks three slots
+	// for every one background slot. Tags without a weight count as 1.
+	// Weights persist until changed and only matter when fair_share is on.
+	TagWeights map[string]int `json:"tag_weights,omitempty" jsonschema:"Fair-share weight per tag (default 1). Higher-weight tags get proportionally more worker slots when fair_share is on. Pool-wide: weights apply to these tags in every session. Persists until changed."`
+
+	// ModelConcurrency optionally caps how many tasks of each model run at
+	// once on each backend, e.g. {"qwen2.5-coder:32b": 1} for a model that
+	// only fits in GPU memory once. Models not listed keep their current
+	// limit (see model_limits.go). Limits persist until changed.
+	ModelConcurrency map[string]int `json:"model_concurrency,omitempty" jsonschema:"Max parallel tasks per model on each Ollama backend, e.g. {\"qwen2.5-coder:32b\": 1, \"qwen2.5-coder:3b\": 8}. Tasks of a model at its limit wait while other models use the free slots. Pool-wide: limits apply to every session's tasks. Persists until changed."`
+
+	// Options sets default Ollama generation options for every task in this
+	// batch. A task's own options override these name by name. Unlike
+	// concurrency, the defaults apply to this batch only.
+	Options map[string]any `json:"options,omitempty" jsonschema:"Default Ollama generation options for every task in this batch (e.g. {\"temperature\": 0, \"num_ctx\": 16384}). Per-task options override these."`
+
+	// Staging writes every output_file in this batch to a mirror tree under
+	// the staging root instead of the real path (see staging.go). Nothing is
+	// changed on disk until apply_staged promotes the files.
+	Staging bool `json:"staging,omitempty" jsonschema:"Write output_file results to a staging tree instead of the real paths. Review them, then promote with apply_staged or drop with discard_staged."`
+
+	// Wait keeps the call open until every task in the batch has finished
+	// and returns the batch's summary (see progress.go). Progress
+	// notifications are only sent in this mode. Cancelling the call stops
+	// waiting, not the tasks.
+	Wait bool `json:"wait,omitempty" jsonschema:"Keep this call open until every task in the batch has finished, then return the batch's summary. With a progress token, progress notifications report each task meanwhile. Cancelling the call stops waiting but not the tasks."`
+
+	// Reduce adds a reduce task to the batch (see reduce.go). Once every
+	// task in the batch has finished, it runs the reduce prompt over their
+	// combined results and its own result is the batch's single answer.
+	Reduce *ReduceSpec `json:"reduce,omitempty" jsonschema:"Combine the results of every task in this batch with one more prompt once they have all finished. Fetch only the reduce task's result instead of each task's."`
 
 	Tasks []TaskSpec `json:"tasks" jsonschema:"List of tasks to submit"`
 }
@@ -35,6 +78,40 @@ type TaskSpec struct {
 	// passes directly to Ollama.
 	InputFile string `json:"input_file,omitempty" jsonschema:"Absolute path to file whose contents are read and appended to the prompt"`
 
+	// Chunk splits input_file into pieces that fit the model's context
+	// window and runs the prompt on each piece in turn, stitching the
+	// outputs back together in order (see chunking.go). Without it, a
+	// prompt estimated to overflow the context window fails the task rather
+	// than being silently truncated by Ollama. Requires input_file.
+	Chunk bool `json:"chunk,omitempty" jsonschema:"Split input_file on top-level declarations into pieces that fit the context window, run the prompt on each, and stitch the outputs back together in order. Use for files too large for the model."`
+
+	// InputFiles lists further absolute paths whose contents are sent to the
+	// model as context, each in its own section headed by the path and
+	// language (see input_files.go). They follow any input_file contents.
+	// A missing file fails the task, naming the file.
+	InputFiles []string `json:"input_files,omitempty" jsonschema:"Absolute paths of context files sent with the prompt, each in a section labeled with its path and language (e.g. an interface plus its implementation)"`
+
+	// InputGlob turns this spec into a template expanded into one task per
+	// matching file (see input_glob.go), e.g. "/repo/**/*.go" or a directory.
+	// Each task gets the file as its input_file; {{path}}, {{dir}}, {{name}},
+	// {{stem}}, {{ext}} and {{rel}} in output_file, input_files, prompt,
+	// post_write_cmd and validate_cmd are filled in per file.
+	InputGlob string `json:"input_glob,omitempty" jsonschema:"Absolute glob (** matches any directories) or directory; expands into one task per matching file with that file as input_file. Use {{path}} {{dir}} {{name}} {{stem}} {{ext}} {{rel}} in output_file, input_files, prompt, post_write_cmd, validate_cmd (e.g. {{dir}}/{{stem}}_test.go); output_file must differ per matched file."`
+
+	// Exclude lists patterns for files input_glob should skip. A pattern
+	// without a slash matches file and directory names ("*_test.go",
+	// "vendor"); one with a slash matches the path, absolute or relative to
+	// the glob's base directory.
+	Exclude []string `json:"exclude,omitempty" jsonschema:"Patterns for files input_glob skips: names like *_test.go or vendor, or paths like internal/**"`
+
+	// InputFromTask names a task whose output is appended to the prompt (after
+	// any input_file contents), like input_file but reading another task's
+	// result. Accepts a task ID or a 0-based index into this batch, and
+	// implies depends_on. The output never passes through the orchestrating
+	// agent's context. To place upstream output mid-prompt instead, write a
+	// {{result:<task ID or index>}} placeholder in the prompt.
+	InputFromTask string `json:"input_from_task,omitempty" jsonschema:"Task ID or 0-based batch index whose result is appended to the prompt (implies depends_on). Alternatively embed {{result:<id or index>}} placeholders in the prompt."`
+
 	// OutputFile is an optional absolute path where the worker's response will
 	// be written. When set, the result is written to disk and cleared from
 	// memory (use get_result to see the output_file path, not the content).
@@ -45,10 +122,30 @@ type TaskSpec struct {
 	// Set explicitly to false to preserve fences.
 	StripMarkdownFences *bool `json:"strip_markdown_fences,omitempty" jsonschema:"Strip markdown code fences from output before writing (default: true)"`
 
+	// OutputMode selects what the model returns. "full" (the default) is the
+	// whole output. "unified_diff" and "search_replace" have the model return
+	// only its changes to input_file, which the server applies and writes to
+	// output_file — much faster for small edits to large files. Edit modes
+	// require input_file and output_file; a response that doesn't apply
+	// cleanly fails the task.
+	OutputMode string `json:"output_mode,omitempty" jsonschema:"full (default) | unified_diff | search_replace. Edit modes have the model return a patch that the server applies to input_file and writes to output_file — use for small edits to large files."`
+
 	// PostWriteCmd is an optional shell command to run after writing output_file
 	// (e.g. "gofmt -w" or "prettier --write"). Runs with a 30-second timeout.
 	PostWriteCmd string `json:"post_write_cmd,omitempty" jsonschema:"Shell command to run after writing output_file (30s timeout)"`
 
+	// ValidateCmd is an optional shell command run after output_file is
+	// written and post_write_cmd has run (e.g. "go build ./..." or
+	// "go vet ./pkg/..."). If it exits non-zero, its output is sent back to
+	// the model as a follow-up message asking for a corrected response, which
+	// is written and validated again — up to max_repair_attempts times before
+	// the task fails. Requires output_file. Runs with a 2-minute timeout.
+	ValidateCmd string `json:"validate_cmd,omitempty" jsonschema:"Shell command run after writing output_file (e.g. go build ./...). On failure its output is fed back to the model for a repair attempt. Requires output_file (2 min timeout)."`
+
+	// MaxRepairAttempts is how many follow-up turns validate_cmd failures may
+	// trigger. Default is 2 (nil → 2); set explicitly to 0 to just validate.
+	MaxRepairAttempts *int `json:"max_repair_attempts,omitempty" jsonschema:"Repair turns allowed after validate_cmd failures (default: 2, 0 validates without repairing)"`
+
 	// Model specifies which Ollama model to use. Defaults to DEFAULT_MODEL env
 	// var or "qwen2.5-coder:14b" if unset.
 	Model string `json:"model,omitempty" jsonschema:"Ollama model to use (default: qwen2.5-coder:14b)"`
@@ -59,16 +156,83 @@ type TaskSpec struct {
 	//   "status_only" — caller only needs pass/fail (skip get_result)
 	//   "content"     — caller will retrieve the full response text
 	//   "json"        — caller expects structured JSON output
-	ResponseHint string `json:"response_hint,omitempty" jsonschema:"What the caller wants back: status_only|content|json (default: content)"`
+	ResponseHint string `json:"response_hint,omitempty" jsonschema:"What the caller wants back: status_only|content|json (default: content, or json when json_schema is set)"`
+
+	// JSONSchema is an optional JSON Schema (draft 2020-12) the response must
+	// conform to. It is passed to Ollama as the format parameter so the model
+	// is constrained to matching output, and the server validates the final
+	// response against it — a non-conforming response fails the task with the
+	// validation error (the raw response stays available via get_result).
+	// Implies response_hint "json". With response_hint "json" but no schema,
+	// Ollama's plain JSON mode is used and the response must parse as JSON.
+	JSONSchema map[string]any `json:"json_schema,omitempty" jsonschema:"JSON Schema the response must conform to. Passed to Ollama as the output format and validated server-side; non-conforming responses fail the task. Implies response_hint json."`
+
+	// Options are Ollama generation options passed through on the chat
+	// request, e.g. {"temperature": 0, "num_ctx": 16384, "seed": 42,
+	// "top_p": 0.9, "stop": ["<END>"]}. Use temperature 0 for deterministic
+	// refactors, a larger num_ctx for large input files, and a fixed seed for
+	// reproducible output. Names are validated against the options Ollama
+	// understands; unset options use the model's defaults.
+	Options map[string]any `json:"options,omitempty" jsonschema:"Ollama generation options: temperature, num_ctx, seed, top_p, top_k, num_predict, stop, repeat_penalty, etc. Overrides the batch-level options name by name."`
 
 	// TimeoutSeconds sets a per-task timeout in seconds. If the Ollama model
 	// doesn't respond within this duration, the task fails with a timeout error.
 	// Default is 600 (10 minutes), configurable via TASK_TIMEOUT env var.
 	// Increase for large inputs or complex generation tasks.
 	TimeoutSeconds int `json:"timeout_seconds,omitempty" jsonschema:"Per-task timeout in seconds. Default 600 (10 min). Increase for large/complex tasks. Tasks that hit this limit fail with a clear timeout error so you can retry with a longer value."`
+
+	// Priority orders tasks waiting for a worker slot: higher values run
+	// first, and tasks of equal priority run in submission order. Default is
+	// 0. Use a positive priority for a small urgent batch that shouldn't wait
+	// behind a large background batch submitted earlier.
+	Priority int `json:"priority,omitempty" jsonschema:"Scheduling priority: higher runs first, FIFO within a priority (default: 0)"`
+
+	// MaxRetries is how many times a transient Ollama failure (connection
+	// refused, 503 server busy, model still loading) is retried before the
+	// task fails. Permanent errors (unknown model, bad request) and timeouts
+	// are never retried. Default is 2 (nil → 2); set explicitly to 0 to disable.
+	MaxRetries *int `json:"max_retries,omitempty" jsonschema:"Retries for transient Ollama errors like connection refused or 503 server busy (default: 2, 0 disables)"`
+
+	// RetryBackoffSeconds is the wait before the first retry. Each subsequent
+	// retry doubles it, capped at 2 minutes. The worker slot is released while
+	// waiting so other tasks can run. Default is 5.
+	RetryBackoffSeconds int `json:"retry_backoff_seconds,omitempty" jsonschema:"Seconds to wait before the first retry; doubles on each retry (default: 5)"`
+
+	// DependsOn lists tasks that must complete before this one starts. Each
+	// entry is either the ID of a previously submitted task or the 0-based
+	// index of another task in the same batch (e.g. "0"). The task stays
+	// "blocked" until all dependencies complete; if any dependency fails or
+	// is cancelled, this task fails or is cancelled too without running.
+	DependsOn []string `json:"depends_on,omitempty" jsonschema:"Tasks that must complete first: task IDs from earlier batches or 0-based indexes into this batch's tasks list (e.g. \"0\")"`
+}
+
+// ReduceSpec describes the reduce stage of a map-reduce batch: a prompt run
+// over the concatenated results of the batch's tasks. Results too large for
+// one prompt are reduced in groups, then the group results are reduced again.
+type ReduceSpec struct {
+	// Tag defaults to the batch's tag when every task shares one.
+	Tag          string `json:"tag,omitempty" jsonschema:"Grouping label for the reduce task (default: the tasks' tag, if they all share one)"`
+	SystemPrompt string `json:"system_prompt,omitempty" jsonschema:"System prompt for the reduce step"`
+	Prompt       string `json:"prompt" jsonschema:"Instructions for combining the results, e.g. \"Write an architecture overview from these per-file summaries\". Each result follows, labeled with its task's input_file."`
+
+	Model          string         `json:"model,omitempty" jsonschema:"Ollama model for the reduce step (default: the server's default model)"`
+	Options        map[string]any `json:"options,omitempty" jsonschema:"Ollama generation options for the reduce step. Overrides the batch-level options name by name."`
+	OutputFile     string         `json:"output_file,omitempty" jsonschema:"Absolute path to write the final result to"`
+	TimeoutSeconds int            `json:"timeout_seconds,omitempty" jsonschema:"Timeout for each reduce call in seconds (default 600)"`
 }
 
 // SubmitTasksOutput is returned synchronously from submit_tasks.
 type SubmitTasksOutput struct {
-	TaskIDs []string `json:"task_ids"`
+	TaskIDs      []string       `json:"task_ids"`
+	Expanded     []ExpandedTask `json:"expanded,omitempty"`       // tasks created from input_glob, in task_ids order
+	ReduceTaskID string         `json:"reduce_task_id,omitempty"` // the reduce task, if the batch has a reduce spec
+	Finished     bool           `json:"finished,omitempty"`       // wait mode: every task finished before the call returned
+	Summary      *TaskSummary   `json:"summary,omitempty"`        // wait mode: the batch's counts when the call returned
+}
+
+// ExpandedTask is one task created by expanding an input_glob.
+type ExpandedTask struct {
+	ID         string `json:"id"`
+	InputFile  string `json:"input_file"`
+	OutputFile string `json:"output_file,omitempty"`
 }
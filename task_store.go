@@ -1,29 +1,99 @@
 // store.go implements a thread-safe, in-memory task store.
 //
 // All MCP tool handlers and worker goroutines access tasks through this store.
-// The mutex ensures safe concurrent access. State is ephemeral — it lives only
-// for the duration of the MCP server process (i.e. one Claude Code session).
+// The mutex ensures safe concurrent access. By default state is ephemeral — it
+// lives only for the duration of the MCP server process (i.e. one Claude Code
+// session). With STATE_DIR set, every transition is also appended to an
+// on-disk journal (see task_journal.go) so tasks survive a restart.
 package main
 
 import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
 	"sync"
 	"time"
+
+	"github.com/ollama/ollama/api"
 )
 
 // TaskStore holds all tasks in memory, protected by a mutex. Tasks are stored
 // in a map for O(1) lookup and a separate slice to preserve insertion order
 // for stable iteration in List/Summary.
 type TaskStore struct {
-	mu    sync.Mutex
-	tasks map[string]*Task
-	order []string // insertion order for stable iteration
+	mu       sync.Mutex
+	tasks    map[string]*Task
+	order    []string      // insertion order for stable iteration
+	journal  *taskJournal  // nil when running without STATE_DIR
+	finished chan struct{} // closed and replaced whenever a task reaches a terminal state
+	watches  []*taskWatch  // followers of task transitions: waiting batches (see progress.go) and resource updates
 }
 
-// NewTaskStore creates an empty task store.
+// NewTaskStore creates an empty, purely in-memory task store.
 func NewTaskStore() *TaskStore {
 	return &TaskStore{
-		tasks: make(map[string]*Task),
+		tasks:    make(map[string]*Task),
+		finished: make(chan struct{}),
+	}
+}
+
+// NewPersistentTaskStore creates a task store backed by a journal in dir,
+// replaying any tasks recorded by a previous server process. Tasks that were
+// running at the time are marked failed with an "interrupted by restart"
+// error; pending tasks stay pending and are re-queued by WorkerPool.Resume.
+//
+// The sessions that submitted the recovered tasks ended with that process,
+// so the tasks lose their owner and every session can see them.
+func NewPersistentTaskStore(dir string) (*TaskStore, error) {
+	journal, recovered, err := openTaskJournal(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := NewTaskStore()
+	s.journal = journal
+	for _, t := range recovered {
+		t.Session = ""
+		s.tasks[t.ID] = t
+		s.order = append(s.order, t.ID)
 	}
+	return s, nil
+}
+
+// Close releases the journal file, if any. The store remains usable in
+// memory afterwards but no further transitions are persisted.
+func (s *TaskStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.journal == nil {
+		return nil
+	}
+	err := s.journal.close()
+	s.journal = nil
+	return err
+}
+
+// transitioned is called after every mutation of t. It records a snapshot in
+// the journal, reports status changes to any watch following t and, if t
+// reached a terminal state, wakes goroutines blocked in WaitForDependencies.
+// Must be called with s.mu held so journal order matches transition order.
+func (s *TaskStore) transitioned(t *Task) {
+	if s.journal != nil {
+		s.journal.record(t)
+	}
+	for _, w := range s.watches {
+		w.observe(t)
+	}
+	if isTerminalStatus(t.Status) {
+		close(s.finished)
+		s.finished = make(chan struct{})
+	}
+}
+
+// isTerminalStatus reports whether a task in this status will never change
+// status again.
+func isTerminalStatus(status string) bool {
+	return status == "completed" || status == "failed" || status == "cancelled"
 }
 
 // Add inserts a batch of tasks into the store. Called by submit_tasks.
@@ -33,9 +103,84 @@ func (s *TaskStore) Add(tasks []*Task) {
 	for _, t := range tasks {
 		s.tasks[t.ID] = t
 		s.order = append(s.order, t.ID)
+		s.transitioned(t)
+	}
+}
+
+// Watch starts collecting status changes for the tasks in ids. Call it before
+// the tasks are added so no transition is missed, and Unwatch when done.
+func (s *TaskStore) Watch(ids []string) *taskWatch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := &taskWatch{status: make(map[string]string, len(ids)), notify: make(chan struct{}, 1)}
+	for _, id := range ids {
+		w.status[id] = ""
+	}
+	s.watches = append(s.watches, w)
+	return w
+}
+
+// WatchAll starts collecting status changes for every task, including tasks
+// added later.
+func (s *TaskStore) WatchAll() *taskWatch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := &taskWatch{all: true, status: make(map[string]string), notify: make(chan struct{}, 1)}
+	s.watches = append(s.watches, w)
+	return w
+}
+
+// Unwatch stops collecting status changes for w.
+func (s *TaskStore) Unwatch(w *taskWatch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, x := range s.watches {
+		if x == w {
+			s.watches = append(s.watches[:i], s.watches[i+1:]...)
+			return
+		}
 	}
 }
 
+// WatchEvents returns the status changes collected by w since the last
+// call, oldest first. Waits on w.notify to learn when there are more.
+func (s *TaskStore) WatchEvents(w *taskWatch) []TaskEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := w.events
+	w.events = nil
+	return events
+}
+
+// Resumable returns the pending/blocked tasks that have no cancel function
+// attached — i.e. tasks recovered from the journal that no worker goroutine
+// owns yet. Like List, the returned pointers must only be read for their ID.
+func (s *TaskStore) Resumable() []*Task {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result []*Task
+	for _, id := range s.order {
+		t := s.tasks[id]
+		if (t.Status == "pending" || t.Status == "blocked") && t.Cancel == nil {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// AttachCancel sets the cancel function for a pending/blocked task that is
+// about to be handed to the worker pool. Returns false if the task is no
+// longer waiting (e.g. it was cancelled in the meantime).
+func (s *TaskStore) AttachCancel(id string, cancel context.CancelFunc) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.tasks[id]; ok && (t.Status == "pending" || t.Status == "blocked") {
+		t.Cancel = cancel
+		return true
+	}
+	return false
+}
+
 // Get returns a single task by ID, or nil if not found.
 //
 // WARNING: Returns a raw *Task pointer. Reading fields on the returned pointer
@@ -48,18 +193,33 @@ func (s *TaskStore) Get(id string) *Task {
 	return s.tasks[id]
 }
 
+// Visible reports whether task id exists and session can see it.
+func (s *TaskStore) Visible(id, session string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tasks[id]
+	return ok && visibleTo(t, session)
+}
+
+// visibleTo reports whether session can see t: it submitted t, or t has no
+// owner (stdio, or recovered from the journal; see NewPersistentTaskStore).
+func visibleTo(t *Task, session string) bool {
+	return t.Session == "" || t.Session == session
+}
+
 // List returns tasks matching the filter criteria, in insertion order.
+//   - Only tasks visible to session are included (see visibleTo).
 //   - If ids is non-empty, only tasks with those IDs are included.
 //   - If tag is non-empty, only tasks with that tag are included.
 //   - Both filters can be combined (AND logic).
-//   - If both are empty, all tasks are returned.
+//   - If both are empty, all tasks visible to the session are returned.
 //
 // WARNING: Like Get(), this returns raw *Task pointers. Reading mutable fields
 // on the returned pointers without holding the store lock is a data race if a
 // worker goroutine is concurrently mutating the task. The only safe field to
 // read without the lock is ID (immutable after creation). For safe reads of
 // mutable fields, use Results() or Summary() which return copies under the lock.
-func (s *TaskStore) List(ids []string, tag string) []*Task {
+func (s *TaskStore) List(ids []string, tag, session string) []*Task {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -71,7 +231,7 @@ func (s *TaskStore) List(ids []string, tag string) []*Task {
 	var result []*Task
 	for _, id := range s.order {
 		t := s.tasks[id]
-		if len(idSet) > 0 && !idSet[t.ID] {
+		if !visibleTo(t, session) || (len(idSet) > 0 && !idSet[t.ID]) {
 			continue
 		}
 		if tag != "" && t.Tag != tag {
@@ -85,8 +245,9 @@ func (s *TaskStore) List(ids []string, tag string) []*Task {
 // Summary returns aggregate counts and per-task statuses for the check_tasks
 // tool. This is intentionally lightweight — no result content is included.
 // The lock is held for the entire operation to avoid races with worker
-// goroutines that mutate task status concurrently.
-func (s *TaskStore) Summary(ids []string, tag string) (TaskSummary, []TaskStatus) {
+// goroutines that mutate task status concurrently. Only tasks submitted by
+// session are counted.
+func (s *TaskStore) Summary(ids []string, tag, session string) (TaskSummary, []TaskStatus) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -97,11 +258,12 @@ func (s *TaskStore) Summary(ids []string, tag string) (TaskSummary, []TaskStatus
 
 	var summary TaskSummary
 	var statuses []TaskStatus
+	var totals metricsTotals
 	now := time.Now()
 
 	for _, id := range s.order {
 		t := s.tasks[id]
-		if len(idSet) > 0 && !idSet[t.ID] {
+		if !visibleTo(t, session) || (len(idSet) > 0 && !idSet[t.ID]) {
 			continue
 		}
 		if tag != "" && t.Tag != tag {
@@ -111,8 +273,12 @@ func (s *TaskStore) Summary(ids []string, tag string) (TaskSummary, []TaskStatus
 		switch t.Status {
 		case "pending":
 			summary.Pending++
+		case "blocked":
+			summary.Blocked++
 		case "running":
 			summary.Running++
+		case "retrying":
+			summary.Retrying++
 		case "completed":
 			summary.Completed++
 		case "failed":
@@ -120,6 +286,7 @@ func (s *TaskStore) Summary(ids []string, tag string) (TaskSummary, []TaskStatus
 		case "cancelled":
 			summary.Cancelled++
 		}
+		totals.add(t.Model, t.Metrics)
 		statuses = append(statuses, TaskStatus{
 			ID:             t.ID,
 			Tag:            t.Tag,
@@ -127,21 +294,57 @@ func (s *TaskStore) Summary(ids []string, tag string) (TaskSummary, []TaskStatus
 			Error:          t.Error,
 			OutputFile:     t.OutputFile,
 			ElapsedSeconds: taskElapsedSeconds(t, now),
+
+			Retries:          t.Retries,
+			LastAttemptError: t.LastAttemptError,
+			RepairAttempts:   t.RepairAttempts,
+			Undone:           t.Undone,
+			StagedFile:       t.StagedFile,
+			Staging:          t.Staging,
+			LinesAdded:       t.LinesAdded,
+			LinesRemoved:     t.LinesRemoved,
+			Chunks:           t.Chunks,
+			ChunksDone:       t.ChunksDone,
+			Backend:          t.Backend,
+			Metrics:          t.Metrics.clone(),
+			BlockedOn:        s.unfinishedDependencies(t),
 		})
 	}
+	totals.fill(&summary)
 	return summary, statuses
 }
 
+// unfinishedDependencies returns the IDs of t's dependencies that haven't
+// reached a terminal state yet. Only blocked tasks report them. Must be
+// called with s.mu held.
+func (s *TaskStore) unfinishedDependencies(t *Task) []string {
+	if t.Status != "blocked" {
+		return nil
+	}
+	var ids []string
+	for _, dep := range t.DependsOn {
+		if d, ok := s.tasks[dep]; ok && !isTerminalStatus(d.Status) {
+			ids = append(ids, dep)
+		}
+	}
+	for _, in := range t.ReduceOver {
+		if d, ok := s.tasks[in.ID]; ok && !isTerminalStatus(d.Status) {
+			ids = append(ids, in.ID)
+		}
+	}
+	return ids
+}
+
 // taskElapsedSeconds computes wall-clock seconds for a task based on its state.
-//   - pending: seconds since created (queue wait time)
-//   - running: seconds since started (inference time so far)
+//   - pending/blocked: seconds since created (queue wait time)
+//   - running/retrying: seconds since first started (inference time so far)
 //   - completed/failed: seconds from start to completion (actual work duration)
 //   - cancelled: seconds from start to completion if it ran, else 0
 func taskElapsedSeconds(t *Task, now time.Time) int {
 	switch t.Status {
-	case "pending":
+	case "pending", "blocked":
 		return int(now.Sub(t.CreatedAt).Seconds())
-	case "running":
+	case "running", "retrying":
 		return int(now.Sub(t.StartedAt).Seconds())
 	case "completed", "failed":
 		return int(t.CompletedAt.Sub(t.StartedAt).Seconds())
@@ -155,15 +358,16 @@ func taskElapsedSeconds(t *Task, now time.Time) int {
 }
 
 // Results returns the full content for specific task IDs. Used by get_result.
-// If a task ID is not found, a "not_found" entry is returned for that ID.
-func (s *TaskStore) Results(ids []string) []TaskResult {
+// If a task ID is not found, or belongs to another session, a "not_found"
+// entry is returned for that ID.
+func (s *TaskStore) Results(ids []string, session string) []TaskResult {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	results := make([]TaskResult, 0, len(ids))
 	for _, id := range ids {
 		t, ok := s.tasks[id]
-		if !ok {
+		if !ok || !visibleTo(t, session) {
 			results = append(results, TaskResult{
 				ID:     id,
 				Status: "not_found",
@@ -178,20 +382,155 @@ func (s *TaskStore) Results(ids []string) []TaskResult {
 			Content:    t.Result,
 			Error:      t.Error,
 			OutputFile: t.OutputFile,
+			StagedFile: t.StagedFile,
+			Staging:    t.Staging,
+			Metrics:    t.Metrics.clone(),
+
+			RepairAttempts: t.RepairAttempts,
+			Conversation:   t.Conversation,
 		})
 	}
 	return results
 }
 
+// WaitForDependencies blocks until every dependency of task id has completed,
+// any dependency has failed or been cancelled, or ctx is done. On success
+// failedDep is empty. Otherwise failedDep and depStatus identify the first
+// dependency that will never complete, so the caller can cascade the outcome.
+// A reduce task also waits for its map tasks to finish, however they finish.
+func (s *TaskStore) WaitForDependencies(ctx context.Context, id string) (failedDep, depStatus string, err error) {
+	for {
+		s.mu.Lock()
+		t, ok := s.tasks[id]
+		if !ok {
+			s.mu.Unlock()
+			return "", "", fmt.Errorf("task %s not found", id)
+		}
+		waiting := false
+		for _, dep := range t.DependsOn {
+			d, ok := s.tasks[dep]
+			switch {
+			case !ok:
+				s.mu.Unlock()
+				return dep, "not_found", nil
+			case d.Status == "failed" || d.Status == "cancelled":
+				s.mu.Unlock()
+				return dep, d.Status, nil
+			case d.Status != "completed":
+				waiting = true
+			}
+		}
+		for _, in := range t.ReduceOver {
+			if d, ok := s.tasks[in.ID]; ok && !isTerminalStatus(d.Status) {
+				waiting = true
+			}
+		}
+		finished := s.finished
+		s.mu.Unlock()
+
+		if !waiting {
+			return "", "", nil
+		}
+		select {
+		case <-finished:
+		case <-ctx.Done():
+			return "", "", ctx.Err()
+		}
+	}
+}
+
+// CompletedOutput returns the output of a completed task, for output chaining.
+// If the output was written to disk (and so cleared from memory), result is
+// empty and outputFile names the file to read instead. An in-memory result is
+// fence-stripped when the task was configured to strip fences, matching what
+// would have been written to an output file.
+func (s *TaskStore) CompletedOutput(id string) (result, outputFile string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tasks[id]
+	if !ok {
+		return "", "", fmt.Errorf("task not found")
+	}
+	if t.Status != "completed" {
+		return "", "", fmt.Errorf("task is %s, not completed", t.Status)
+	}
+	if t.FileWritten && t.Staging == "staged" {
+		return "", t.StagedFile, nil
+	}
+	if t.FileWritten {
+		return "", t.OutputFile, nil
+	}
+	if t.StripMarkdownFences {
+		return stripMarkdownFences(t.Result), "", nil
+	}
+	return t.Result, "", nil
+}
+
+// SetUnblocked moves a blocked task to pending once its dependencies have
+// completed, so it can queue for a worker slot. Returns false if the task
+// isn't blocked (e.g. it was cancelled while waiting).
+func (s *TaskStore) SetUnblocked(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.tasks[id]; ok && t.Status == "blocked" {
+		t.Status = "pending"
+		s.transitioned(t)
+		return true
+	}
+	return false
+}
+
+// SetDependencyFailed fails a blocked task whose dependency failed, without
+// the task ever running. Input fields are cleared as in SetFailed.
+func (s *TaskStore) SetDependencyFailed(id string, errMsg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.tasks[id]; ok && t.Status == "blocked" {
+		t.Status = "failed"
+		t.Error = errMsg
+		t.CompletedAt = time.Now()
+		t.SystemPrompt = ""
+		t.Prompt = ""
+		t.InputFile = ""
+		t.InputFiles = nil
+		t.PostWriteCmd = ""
+		t.ValidateCmd = ""
+		t.Cancel = nil
+		s.transitioned(t)
+	}
+}
+
 // SetRunning marks a task as running. Returns false if the task doesn't exist
-// or isn't pending (e.g. it was already cancelled). Called by the worker pool
-// when a goroutine acquires a semaphore slot and begins processing.
+// or isn't pending/retrying (e.g. it was already cancelled). Called by the
+// worker pool when a goroutine acquires a worker slot and begins
+// processing. A retrying task keeps its original StartedAt so elapsed time
+// covers every attempt.
 func (s *TaskStore) SetRunning(id string) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if t, ok := s.tasks[id]; ok && t.Status == "pending" {
-		t.Status = "running"
+	t, ok := s.tasks[id]
+	if !ok || (t.Status != "pending" && t.Status != "retrying") {
+		return false
+	}
+	if t.Status == "pending" {
 		t.StartedAt = time.Now()
+	}
+	t.Status = "running"
+	s.transitioned(t)
+	return true
+}
+
+// SetRetrying moves a running task into "retrying" after a transient Ollama
+// error, incrementing its retry counter and recording the error. Returns false
+// if the task isn't running (e.g. it was cancelled mid-attempt).
+func (s *TaskStore) SetRetrying(id string, errMsg string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.tasks[id]; ok && t.Status == "running" {
+		t.Status = "retrying"
+		t.Retries++
+		t.LastAttemptError = errMsg
+		s.transitioned(t)
 		return true
 	}
 	return false
@@ -212,12 +551,15 @@ func (s *TaskStore) SetCompleted(id string, result string) {
 		t.SystemPrompt = ""
 		t.Prompt = ""
 		t.InputFile = ""
+		t.InputFiles = nil
 		t.PostWriteCmd = ""
+		t.ValidateCmd = ""
 		t.Cancel = nil
 		// If the result was written to a file, clear it from memory
 		if t.FileWritten {
 			t.Result = ""
 		}
+		s.transitioned(t)
 	}
 }
 
@@ -235,8 +577,11 @@ func (s *TaskStore) SetFailed(id string, errMsg string) {
 		t.SystemPrompt = ""
 		t.Prompt = ""
 		t.InputFile = ""
+		t.InputFiles = nil
 		t.PostWriteCmd = ""
+		t.ValidateCmd = ""
 		t.Cancel = nil
+		s.transitioned(t)
 	}
 }
 
@@ -254,8 +599,271 @@ func (s *TaskStore) SetFailedWithResult(id string, result string, errMsg string)
 		t.SystemPrompt = ""
 		t.Prompt = ""
 		t.InputFile = ""
+		t.InputFiles = nil
 		t.PostWriteCmd = ""
+		t.ValidateCmd = ""
 		t.Cancel = nil
+		s.transitioned(t)
+	}
+}
+
+// SetConversation records the chat history of a validate_cmd task and how
+// many repair turns it has taken so far. Called by the worker while the task
+// is running; the history stays available to get_result after it finishes.
+func (s *TaskStore) SetConversation(id string, repairs int, turns []ChatTurn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.tasks[id]; ok && t.Status == "running" {
+		t.RepairAttempts = repairs
+		t.Conversation = turns
+		s.transitioned(t)
+	}
+}
+
+// SetBackup records the pre-write state of a task's output file. Called by
+// the worker just before the first write.
+func (s *TaskStore) SetBackup(id string, backup *FileBackup) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.tasks[id]; ok && t.Status == "running" {
+		t.Backup = backup
+		s.transitioned(t)
+	}
+}
+
+// PruneBackups drops the backups of finished tasks beyond the keep most
+// recently finished, marking those tasks BackupPruned, and returns the
+// backup files to delete. Tasks still running keep theirs.
+func (s *TaskStore) PruneBackups(keep int) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var finished []*Task
+	for _, id := range s.order {
+		if t := s.tasks[id]; t.Backup != nil && isTerminalStatus(t.Status) {
+			finished = append(finished, t)
+		}
+	}
+	if len(finished) <= keep {
+		return nil
+	}
+	sort.SliceStable(finished, func(i, j int) bool { return finished[i].CompletedAt.After(finished[j].CompletedAt) })
+	var paths []string
+	for _, t := range finished[keep:] {
+		if t.Backup.Path != "" {
+			paths = append(paths, t.Backup.Path)
+		}
+		t.Backup = nil
+		t.BackupPruned = true
+		s.transitioned(t)
+	}
+	return paths
+}
+
+// UndoTarget returns the output file and backup of a task that can be
+// undone. Only finished tasks qualify — a running task could write again
+// after the restore.
+func (s *TaskStore) UndoTarget(id string) (outputFile string, backup *FileBackup, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tasks[id]
+	switch {
+	case !ok:
+		return "", nil, fmt.Errorf("task not found")
+	case !isTerminalStatus(t.Status):
+		return t.OutputFile, nil, fmt.Errorf("task is %s; cancel it or wait for it to finish first", t.Status)
+	case t.Undone:
+		return t.OutputFile, nil, fmt.Errorf("already undone")
+	case t.Staging == "staged" || t.Staging == "discarded":
+		return t.OutputFile, nil, fmt.Errorf("output was %s, not applied; nothing to undo", t.Staging)
+	case t.BackupPruned:
+		return t.OutputFile, nil, fmt.Errorf("backup was pruned to stay within BACKUP_RETENTION; nothing to restore")
+	case t.Backup == nil:
+		return t.OutputFile, nil, fmt.Errorf("task did not write an output file")
+	}
+	return t.OutputFile, t.Backup, nil
+}
+
+// SetUndone records that a task's output file was restored, so it can't be
+// undone twice.
+func (s *TaskStore) SetUndone(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.tasks[id]; ok {
+		t.Undone = true
+		t.Backup = nil
+		s.transitioned(t)
+	}
+}
+
+// stagedTarget is a snapshot of the staging fields apply_staged and
+// discard_staged need, copied under the store lock.
+type stagedTarget struct {
+	ID, Status, OutputFile, StagedFile, Staging string
+}
+
+// StagedTargets returns the staging state of the matched tasks, in task
+// order. With no IDs given, only tasks that were submitted with staging are
+// included. Only tasks visible to session are matched.
+func (s *TaskStore) StagedTargets(ids []string, tag, session string) []stagedTarget {
+	var targets []stagedTarget
+	for _, t := range s.List(ids, tag, session) {
+		s.mu.Lock()
+		if len(ids) > 0 || t.StagedFile != "" {
+			targets = append(targets, stagedTarget{
+				ID:         t.ID,
+				Status:     t.Status,
+				OutputFile: t.OutputFile,
+				StagedFile: t.StagedFile,
+				Staging:    t.Staging,
+			})
+		}
+		s.mu.Unlock()
+	}
+	return targets
+}
+
+// SetStagingApplied records that a task's staged output was promoted into
+// place. backup is the real file's pre-apply state, so undo_tasks can
+// restore it; nil for every task but one when several staged the same file.
+func (s *TaskStore) SetStagingApplied(id string, backup *FileBackup) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.tasks[id]; ok {
+		t.Staging = "applied"
+		t.Backup = backup
+		s.transitioned(t)
+	}
+}
+
+// SetStagingDiscarded records that a task's staged output was deleted.
+func (s *TaskStore) SetStagingDiscarded(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.tasks[id]; ok {
+		t.Staging = "discarded"
+		s.transitioned(t)
+	}
+}
+
+// DiffSource returns the fields outputDiff needs to diff a task's output.
+func (s *TaskStore) DiffSource(id string) (diffSource, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tasks[id]
+	if !ok {
+		return diffSource{}, fmt.Errorf("task not found")
+	}
+	return diffSource{
+		OutputFile:  t.OutputFile,
+		StagedFile:  t.StagedFile,
+		Staging:     t.Staging,
+		Backup:      t.Backup,
+		FileWritten: t.FileWritten,
+		Undone:      t.Undone,
+	}, nil
+}
+
+// SetDiff records the diff of what a task wrote to its output file and how
+// many lines it added and removed, or why the diff failed. Called by the
+// worker just before the task finishes (see diff.go).
+func (s *TaskStore) SetDiff(id, diff string, added, removed int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.tasks[id]; ok && t.Status == "running" {
+		t.Diff, t.DiffError = diff, ""
+		t.LinesAdded = added
+		t.LinesRemoved = removed
+		if err != nil {
+			t.DiffError = err.Error()
+		}
+		s.transitioned(t)
+	}
+}
+
+// Diff returns the diff recorded when task id finished (see SetDiff), or
+// why there is none.
+func (s *TaskStore) Diff(id string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tasks[id]
+	switch {
+	case !ok:
+		return "", fmt.Errorf("task not found")
+	case t.OutputFile == "":
+		return "", fmt.Errorf("task has no output_file")
+	case t.Undone:
+		return "", fmt.Errorf("output was undone")
+	case t.Staging == "discarded":
+		return "", fmt.Errorf("staged output was discarded")
+	case !t.FileWritten:
+		return "", fmt.Errorf("task did not write an output file")
+	case !isTerminalStatus(t.Status):
+		return "", fmt.Errorf("task is %s; its diff is recorded when it finishes", t.Status)
+	case t.DiffError != "":
+		return "", fmt.Errorf("%s", t.DiffError)
+	}
+	return t.Diff, nil
+}
+
+// promptSnapshot is a copy of what a task was asked, for the task://<id>/prompt
+// resource (see resources.go).
+type promptSnapshot struct {
+	Status, SystemPrompt, Prompt, InputFile string
+	InputFiles                              []string
+}
+
+// PromptSnapshot returns a copy of task id's prompts and input paths, taken
+// under the lock. They are empty once the task has finished.
+func (s *TaskStore) PromptSnapshot(id string) (promptSnapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tasks[id]
+	if !ok {
+		return promptSnapshot{}, fmt.Errorf("task %s not found", id)
+	}
+	return promptSnapshot{
+		Status:       t.Status,
+		SystemPrompt: t.SystemPrompt,
+		Prompt:       t.Prompt,
+		InputFile:    t.InputFile,
+		InputFiles:   append([]string(nil), t.InputFiles...),
+	}, nil
+}
+
+// AddEvalMetrics adds the metrics of one completed Ollama call to task id's
+// totals (see eval_metrics.go).
+func (s *TaskStore) AddEvalMetrics(id string, call api.Metrics) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.tasks[id]; ok && t.Status == "running" {
+		if t.Metrics == nil {
+			t.Metrics = &EvalMetrics{}
+		}
+		t.Metrics.add(call)
+		s.transitioned(t)
+	}
+}
+
+// SetBackend records the Ollama backend a task's current slot is on (see
+// backends.go).
+func (s *TaskStore) SetBackend(id, host string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.tasks[id]; ok && !isTerminalStatus(t.Status) {
+		t.Backend = host
+		s.transitioned(t)
+	}
+}
+
+// SetChunkProgress records how many of a chunked task's chunks have been
+// processed.
+func (s *TaskStore) SetChunkProgress(id string, done, total int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.tasks[id]; ok && t.Status == "running" {
+		t.ChunksDone = done
+		t.Chunks = total
+		s.transitioned(t)
 	}
 }
 
@@ -266,17 +874,18 @@ func (s *TaskStore) SetFileWritten(id string) {
 	defer s.mu.Unlock()
 	if t, ok := s.tasks[id]; ok {
 		t.FileWritten = true
+		s.transitioned(t)
 	}
 }
 
 // SetCancelled marks a single task as cancelled and calls its cancel function
-// to abort any in-flight Ollama request. Only affects pending/running tasks.
+// to abort any in-flight Ollama request. Only affects non-terminal tasks.
 // Returns true if the task was actually cancelled.
 func (s *TaskStore) SetCancelled(id string) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	t, ok := s.tasks[id]
-	if !ok || (t.Status != "pending" && t.Status != "running") {
+	if !ok || isTerminalStatus(t.Status) {
 		return false
 	}
 	prev := t.Status
@@ -286,21 +895,78 @@ func (s *TaskStore) SetCancelled(id string) bool {
 		t.Cancel()
 	}
 	t.Cancel = nil
-	// Only clear input fields for pending tasks. Running tasks may have a
-	// worker goroutine concurrently reading these fields in callOllama.
-	if prev == "pending" {
+	// Only clear input fields for pending/blocked tasks. Running/retrying
+	// tasks may have a worker goroutine concurrently reading these fields in
+	// callOllama.
+	if prev == "pending" || prev == "blocked" {
 		t.SystemPrompt = ""
 		t.Prompt = ""
 		t.InputFile = ""
+		t.InputFiles = nil
 		t.PostWriteCmd = ""
+		t.ValidateCmd = ""
 	}
+	s.transitioned(t)
 	return true
 }
 
+// CancelAll cancels every non-terminal task, whichever session submitted it.
+func (s *TaskStore) CancelAll() {
+	s.mu.Lock()
+	ids := append([]string(nil), s.order...)
+	s.mu.Unlock()
+	for _, id := range ids {
+		s.SetCancelled(id)
+	}
+}
+
+// RemoveSession cancels the unfinished tasks session submitted and drops all
+// of its tasks from the store, recording the removal in the journal. It
+// returns the backup files of the removed tasks, for the caller to delete.
+// Called when the session closes (see http_transport.go); unowned tasks are
+// never removed.
+func (s *TaskStore) RemoveSession(session string) []string {
+	if session == "" {
+		return nil
+	}
+	s.mu.Lock()
+	var ids []string
+	for _, id := range s.order {
+		if s.tasks[id].Session == session {
+			ids = append(ids, id)
+		}
+	}
+	s.mu.Unlock()
+	for _, id := range ids {
+		s.SetCancelled(id)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := make(map[string]bool, len(ids))
+	var backups []string
+	for _, id := range ids {
+		t := s.tasks[id]
+		if t.Backup != nil && t.Backup.Path != "" {
+			backups = append(backups, t.Backup.Path)
+		}
+		delete(s.tasks, id)
+		removed[id] = true
+		if s.journal != nil {
+			s.journal.remove(id)
+		}
+	}
+	if len(removed) > 0 {
+		s.order = slices.DeleteFunc(s.order, func(id string) bool { return removed[id] })
+	}
+	return backups
+}
+
 // Cancel cancels all tasks matching the filter and returns the count.
-// If both ids and tag are empty, all pending/running tasks are cancelled.
-func (s *TaskStore) Cancel(ids []string, tag string) int {
-	targets := s.List(ids, tag)
+// If both ids and tag are empty, every non-terminal task visible to the
+// session is cancelled.
+func (s *TaskStore) Cancel(ids []string, tag, session string) int {
+	targets := s.List(ids, tag, session)
 	count := 0
 	for _, t := range targets {
 		if s.SetCancelled(t.ID) {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"sync"
 	"testing"
 	"time"
@@ -48,7 +49,7 @@ func TestListAll(t *testing.T) {
 	s := NewTaskStore()
 	s.Add([]*Task{makeTask("a", "", "pending"), makeTask("b", "", "pending")})
 
-	all := s.List(nil, "")
+	all := s.List(nil, "", "")
 	if len(all) != 2 {
 		t.Fatalf("expected 2 tasks, got %d", len(all))
 	}
@@ -232,7 +233,7 @@ func TestListFilterByIDs(t *testing.T) {
 	s := NewTaskStore()
 	s.Add([]*Task{makeTask("a", "x", "pending"), makeTask("b", "y", "pending"), makeTask("c", "x", "pending")})
 
-	got := s.List([]string{"a", "c"}, "")
+	got := s.List([]string{"a", "c"}, "", "")
 	if len(got) != 2 {
 		t.Fatalf("expected 2 tasks, got %d", len(got))
 	}
@@ -245,7 +246,7 @@ func TestListFilterByTag(t *testing.T) {
 	s := NewTaskStore()
 	s.Add([]*Task{makeTask("a", "x", "pending"), makeTask("b", "y", "pending"), makeTask("c", "x", "pending")})
 
-	got := s.List(nil, "x")
+	got := s.List(nil, "x", "")
 	if len(got) != 2 {
 		t.Fatalf("expected 2, got %d", len(got))
 	}
@@ -255,15 +256,79 @@ func TestListFilterByIDsAndTag(t *testing.T) {
 	s := NewTaskStore()
 	s.Add([]*Task{makeTask("a", "x", "pending"), makeTask("b", "y", "pending"), makeTask("c", "x", "pending")})
 
-	got := s.List([]string{"a", "b"}, "x")
+	got := s.List([]string{"a", "b"}, "x", "")
 	if len(got) != 1 || got[0].ID != "a" {
 		t.Fatalf("expected only task a, got %v", got)
 	}
 }
 
+func TestListFilterBySession(t *testing.T) {
+	s := NewTaskStore()
+	a, b := makeTask("a", "x", "pending"), makeTask("b", "x", "pending")
+	a.Session, b.Session = "s1", "s2"
+	s.Add([]*Task{a, b})
+
+	got := s.List(nil, "x", "s1")
+	if len(got) != 1 || got[0].ID != "a" {
+		t.Fatalf("expected only task a, got %v", got)
+	}
+	if res := s.Results([]string{"b"}, "s1")[0]; res.Status != "not_found" {
+		t.Fatalf("expected another session's task to be not_found, got %q", res.Status)
+	}
+	if !s.Visible("a", "s1") || s.Visible("b", "s1") || s.Visible("a", "") {
+		t.Fatal("Visible should match only the submitting session")
+	}
+	if n := s.Cancel(nil, "", "s2"); n != 1 || s.Get("a").Status != "pending" {
+		t.Fatalf("expected cancel to touch only s2's task, cancelled %d", n)
+	}
+}
+
+func TestListIncludesUnownedTasks(t *testing.T) {
+	s := NewTaskStore()
+	owned, unowned := makeTask("owned", "x", "pending"), makeTask("unowned", "x", "pending")
+	owned.Session = "s1"
+	s.Add([]*Task{owned, unowned})
+
+	if got := s.List(nil, "x", "s2"); len(got) != 1 || got[0].ID != "unowned" {
+		t.Fatalf("expected another session to see only the unowned task, got %v", got)
+	}
+	if !s.Visible("unowned", "s2") || s.Visible("owned", "s2") {
+		t.Fatal("Visible should match unowned tasks for every session")
+	}
+}
+
+func TestRemoveSession(t *testing.T) {
+	s := NewTaskStore()
+	done, queued, other := makeTask("done", "", "pending"), makeTask("queued", "", "pending"), makeTask("other", "", "pending")
+	done.Session, queued.Session, other.Session = "s1", "s1", "s2"
+	s.Add([]*Task{done, queued, other})
+	s.SetRunning("done")
+	s.SetBackup("done", &FileBackup{Path: "/backups/done"})
+	s.SetCompleted("done", "result")
+	cancelled := false
+	s.AttachCancel("queued", func() { cancelled = true })
+
+	backups := s.RemoveSession("s1")
+	if len(backups) != 1 || backups[0] != "/backups/done" {
+		t.Fatalf("expected the removed task's backup to be returned, got %v", backups)
+	}
+	if !cancelled {
+		t.Fatal("expected the unfinished task's cancel function to be called")
+	}
+	if s.Get("done") != nil || s.Get("queued") != nil {
+		t.Fatal("expected the session's tasks to be removed")
+	}
+	if got := s.List(nil, "", "s2"); len(got) != 1 || got[0].ID != "other" {
+		t.Fatalf("expected the other session's task to remain, got %v", got)
+	}
+	if s.RemoveSession("") != nil || s.Get("other") == nil {
+		t.Fatal("RemoveSession with no session should remove nothing")
+	}
+}
+
 func TestListEmpty(t *testing.T) {
 	s := NewTaskStore()
-	got := s.List(nil, "")
+	got := s.List(nil, "", "")
 	if len(got) != 0 {
 		t.Fatalf("expected 0, got %d", len(got))
 	}
@@ -289,7 +354,7 @@ func TestSummaryCounts(t *testing.T) {
 	s.SetFailed("d", "err")
 	s.SetCancelled("e")
 
-	summary, statuses := s.Summary(nil, "")
+	summary, statuses := s.Summary(nil, "", "")
 	if summary.Total != 5 {
 		t.Fatalf("total: want 5, got %d", summary.Total)
 	}
@@ -316,7 +381,7 @@ func TestSummaryCounts(t *testing.T) {
 func TestSummaryFiltered(t *testing.T) {
 	s := NewTaskStore()
 	s.Add([]*Task{makeTask("a", "x", "pending"), makeTask("b", "y", "pending")})
-	summary, statuses := s.Summary(nil, "x")
+	summary, statuses := s.Summary(nil, "x", "")
 	if summary.Total != 1 || len(statuses) != 1 {
 		t.Fatalf("expected 1 task for tag x, got total=%d statuses=%d", summary.Total, len(statuses))
 	}
@@ -332,7 +397,7 @@ func TestResultsFound(t *testing.T) {
 	s.SetRunning("a")
 	s.SetCompleted("a", "hello world")
 
-	results := s.Results([]string{"a"})
+	results := s.Results([]string{"a"}, "")
 	if len(results) != 1 {
 		t.Fatalf("expected 1 result, got %d", len(results))
 	}
@@ -343,7 +408,7 @@ func TestResultsFound(t *testing.T) {
 
 func TestResultsNotFound(t *testing.T) {
 	s := NewTaskStore()
-	results := s.Results([]string{"missing"})
+	results := s.Results([]string{"missing"}, "")
 	if len(results) != 1 {
 		t.Fatalf("expected 1 result, got %d", len(results))
 	}
@@ -358,7 +423,7 @@ func TestResultsMixed(t *testing.T) {
 	s.SetRunning("a")
 	s.SetCompleted("a", "ok")
 
-	results := s.Results([]string{"a", "missing"})
+	results := s.Results([]string{"a", "missing"}, "")
 	if len(results) != 2 {
 		t.Fatalf("expected 2 results, got %d", len(results))
 	}
@@ -380,7 +445,7 @@ func TestResultsErrorField(t *testing.T) {
 	s.SetRunning("a")
 	s.SetFailed("a", "connection refused")
 
-	results := s.Results([]string{"a"})
+	results := s.Results([]string{"a"}, "")
 	if len(results) != 1 {
 		t.Fatalf("expected 1 result, got %d", len(results))
 	}
@@ -405,7 +470,7 @@ func TestSummaryErrorField(t *testing.T) {
 	s.SetRunning("a")
 	s.SetFailed("a", "out of memory")
 
-	_, statuses := s.Summary(nil, "")
+	_, statuses := s.Summary(nil, "", "")
 	if len(statuses) != 1 {
 		t.Fatalf("expected 1 status, got %d", len(statuses))
 	}
@@ -456,7 +521,7 @@ func TestCancelByIDsAndTag(t *testing.T) {
 		makeTask("c", "x", "pending"),
 	})
 	// Only "a" matches both the ID list and the tag
-	count := s.Cancel([]string{"a", "b"}, "x")
+	count := s.Cancel([]string{"a", "b"}, "x", "")
 	if count != 1 {
 		t.Fatalf("expected 1 cancelled (AND logic), got %d", count)
 	}
@@ -478,7 +543,7 @@ func TestCancelByIDsAndTag(t *testing.T) {
 func TestCancelByTag(t *testing.T) {
 	s := NewTaskStore()
 	s.Add([]*Task{makeTask("a", "x", "pending"), makeTask("b", "y", "pending"), makeTask("c", "x", "pending")})
-	count := s.Cancel(nil, "x")
+	count := s.Cancel(nil, "x", "")
 	if count != 2 {
 		t.Fatalf("expected 2 cancelled, got %d", count)
 	}
@@ -490,7 +555,7 @@ func TestCancelByTag(t *testing.T) {
 func TestCancelByIDs(t *testing.T) {
 	s := NewTaskStore()
 	s.Add([]*Task{makeTask("a", "", "pending"), makeTask("b", "", "pending"), makeTask("c", "", "pending")})
-	count := s.Cancel([]string{"a", "c"}, "")
+	count := s.Cancel([]string{"a", "c"}, "", "")
 	if count != 2 {
 		t.Fatalf("expected 2 cancelled, got %d", count)
 	}
@@ -503,7 +568,7 @@ func TestCancelAll(t *testing.T) {
 	s := NewTaskStore()
 	s.Add([]*Task{makeTask("a", "", "pending"), makeTask("b", "", "pending")})
 	s.SetRunning("b")
-	count := s.Cancel(nil, "")
+	count := s.Cancel(nil, "", "")
 	if count != 2 {
 		t.Fatalf("expected 2 cancelled, got %d", count)
 	}
@@ -600,7 +665,7 @@ func TestMemoryPreservedOnCancelledRunning(t *testing.T) {
 
 func TestSummaryEmpty(t *testing.T) {
 	s := NewTaskStore()
-	summary, statuses := s.Summary(nil, "")
+	summary, statuses := s.Summary(nil, "", "")
 	if summary.Total != 0 {
 		t.Fatalf("expected 0 total, got %d", summary.Total)
 	}
@@ -615,7 +680,7 @@ func TestSummaryEmpty(t *testing.T) {
 
 func TestCancelEmpty(t *testing.T) {
 	s := NewTaskStore()
-	count := s.Cancel(nil, "")
+	count := s.Cancel(nil, "", "")
 	if count != 0 {
 		t.Fatalf("expected 0 cancelled on empty store, got %d", count)
 	}
@@ -631,7 +696,7 @@ func TestResultsDuplicateIDs(t *testing.T) {
 	s.SetRunning("a")
 	s.SetCompleted("a", "result")
 
-	results := s.Results([]string{"a", "a"})
+	results := s.Results([]string{"a", "a"}, "")
 	if len(results) != 2 {
 		t.Fatalf("expected 2 results for duplicate IDs, got %d", len(results))
 	}
@@ -653,7 +718,7 @@ func TestSummaryTagPropagation(t *testing.T) {
 		makeTask("b", "batch2", "pending"),
 	})
 
-	_, statuses := s.Summary(nil, "")
+	_, statuses := s.Summary(nil, "", "")
 	if len(statuses) != 2 {
 		t.Fatalf("expected 2 statuses, got %d", len(statuses))
 	}
@@ -681,7 +746,7 @@ func TestResultsIncludeOutputFile(t *testing.T) {
 	s.SetRunning("a")
 	s.SetCompleted("a", "result")
 
-	results := s.Results([]string{"a"})
+	results := s.Results([]string{"a"}, "")
 	if len(results) != 1 {
 		t.Fatalf("expected 1 result, got %d", len(results))
 	}
@@ -704,7 +769,7 @@ func TestSummaryIncludesOutputFile(t *testing.T) {
 	}
 	s.Add([]*Task{task})
 
-	_, statuses := s.Summary(nil, "")
+	_, statuses := s.Summary(nil, "", "")
 	if len(statuses) != 1 {
 		t.Fatalf("expected 1 status, got %d", len(statuses))
 	}
@@ -836,7 +901,7 @@ func TestSummaryElapsedPending(t *testing.T) {
 	task := &Task{ID: "a", Status: "pending", CreatedAt: time.Now().Add(-2 * time.Second)}
 	s.Add([]*Task{task})
 
-	_, statuses := s.Summary(nil, "")
+	_, statuses := s.Summary(nil, "", "")
 	if len(statuses) != 1 {
 		t.Fatalf("expected 1 status, got %d", len(statuses))
 	}
@@ -856,7 +921,7 @@ func TestSummaryElapsedRunning(t *testing.T) {
 	s.tasks["a"].StartedAt = time.Now().Add(-3 * time.Second)
 	s.mu.Unlock()
 
-	_, statuses := s.Summary(nil, "")
+	_, statuses := s.Summary(nil, "", "")
 	if len(statuses) != 1 {
 		t.Fatalf("expected 1 status, got %d", len(statuses))
 	}
@@ -878,7 +943,7 @@ func TestSummaryElapsedCompleted(t *testing.T) {
 
 	s.SetCompleted("a", "done")
 
-	_, statuses1 := s.Summary(nil, "")
+	_, statuses1 := s.Summary(nil, "", "")
 	if len(statuses1) != 1 {
 		t.Fatalf("expected 1 status, got %d", len(statuses1))
 	}
@@ -889,7 +954,7 @@ func TestSummaryElapsedCompleted(t *testing.T) {
 
 	// Verify stable — doesn't grow on subsequent calls
 	time.Sleep(10 * time.Millisecond)
-	_, statuses2 := s.Summary(nil, "")
+	_, statuses2 := s.Summary(nil, "", "")
 	elapsed2 := statuses2[0].ElapsedSeconds
 	if elapsed2 != elapsed1 {
 		t.Fatalf("completed elapsed_seconds should be stable, got %d then %d", elapsed1, elapsed2)
@@ -902,7 +967,7 @@ func TestSummaryElapsedCancelledFromPending(t *testing.T) {
 	s.Add([]*Task{task})
 	s.SetCancelled("a")
 
-	_, statuses := s.Summary(nil, "")
+	_, statuses := s.Summary(nil, "", "")
 	if len(statuses) != 1 {
 		t.Fatalf("expected 1 status, got %d", len(statuses))
 	}
@@ -910,3 +975,134 @@ func TestSummaryElapsedCancelledFromPending(t *testing.T) {
 		t.Fatalf("cancelled-from-pending elapsed_seconds should be 0, got %d", statuses[0].ElapsedSeconds)
 	}
 }
+
+// ---------------------------------------------------------------------------
+// Retrying state
+// ---------------------------------------------------------------------------
+
+func TestSetRetryingFromRunning(t *testing.T) {
+	s := NewTaskStore()
+	s.Add([]*Task{makeTask("t1", "", "pending")})
+	s.SetRunning("t1")
+	started := s.Get("t1").StartedAt
+
+	if !s.SetRetrying("t1", "server busy") {
+		t.Fatal("SetRetrying should succeed from running")
+	}
+	summary, statuses := s.Summary(nil, "", "")
+	if summary.Retrying != 1 || statuses[0].Status != "retrying" {
+		t.Fatalf("expected 1 retrying, got %+v", summary)
+	}
+	if statuses[0].Retries != 1 || statuses[0].LastAttemptError != "server busy" {
+		t.Fatalf("unexpected retry fields: %+v", statuses[0])
+	}
+
+	// Back to running keeps the original start time.
+	if !s.SetRunning("t1") {
+		t.Fatal("SetRunning should succeed from retrying")
+	}
+	if !s.Get("t1").StartedAt.Equal(started) {
+		t.Fatal("StartedAt should not reset on retry")
+	}
+}
+
+func TestSetRetryingOnlyFromRunning(t *testing.T) {
+	s := NewTaskStore()
+	s.Add([]*Task{makeTask("t1", "", "pending")})
+	if s.SetRetrying("t1", "err") {
+		t.Fatal("SetRetrying should fail from pending")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Blocked state and dependencies
+// ---------------------------------------------------------------------------
+
+func TestWaitForDependenciesCompleted(t *testing.T) {
+	s := NewTaskStore()
+	dep := makeTask("dep", "", "pending")
+	child := makeTask("child", "", "blocked")
+	child.DependsOn = []string{"dep"}
+	s.Add([]*Task{dep, child})
+
+	done := make(chan string, 1)
+	go func() {
+		failed, _, _ := s.WaitForDependencies(context.Background(), "child")
+		done <- failed
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("WaitForDependencies returned before dependency finished")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	s.SetRunning("dep")
+	s.SetCompleted("dep", "ok")
+	select {
+	case failed := <-done:
+		if failed != "" {
+			t.Fatalf("expected no failed dependency, got %q", failed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitForDependencies did not wake on completion")
+	}
+}
+
+func TestWaitForDependenciesFailed(t *testing.T) {
+	s := NewTaskStore()
+	dep := makeTask("dep", "", "pending")
+	child := makeTask("child", "", "blocked")
+	child.DependsOn = []string{"dep"}
+	s.Add([]*Task{dep, child})
+	s.SetRunning("dep")
+	s.SetFailed("dep", "boom")
+
+	failed, status, err := s.WaitForDependencies(context.Background(), "child")
+	if err != nil || failed != "dep" || status != "failed" {
+		t.Fatalf("expected dep/failed, got %q/%q/%v", failed, status, err)
+	}
+}
+
+func TestWaitForDependenciesContextCancelled(t *testing.T) {
+	s := NewTaskStore()
+	dep := makeTask("dep", "", "pending")
+	child := makeTask("child", "", "blocked")
+	child.DependsOn = []string{"dep"}
+	s.Add([]*Task{dep, child})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := s.WaitForDependencies(ctx, "child"); err == nil {
+		t.Fatal("expected context error")
+	}
+}
+
+func TestBlockedTaskTransitions(t *testing.T) {
+	s := NewTaskStore()
+	s.Add([]*Task{makeTask("a", "", "blocked"), makeTask("b", "", "blocked")})
+
+	if s.SetRunning("a") {
+		t.Fatal("blocked task must not start running")
+	}
+	if !s.SetUnblocked("a") || s.Get("a").Status != "pending" {
+		t.Fatal("expected blocked -> pending")
+	}
+
+	s.SetDependencyFailed("b", "dependency x failed; task was not run")
+	got := s.Get("b")
+	if got.Status != "failed" || got.Prompt != "" {
+		t.Fatalf("expected failed with cleared inputs, got %s", got.Status)
+	}
+}
+
+func TestCancelBlockedTask(t *testing.T) {
+	s := NewTaskStore()
+	s.Add([]*Task{makeTask("a", "", "blocked")})
+	if !s.SetCancelled("a") {
+		t.Fatal("blocked task should be cancellable")
+	}
+	if s.Get("a").Prompt != "" {
+		t.Fatal("input fields should be cleared when cancelling a blocked task")
+	}
+}
@@ -19,11 +19,19 @@ type CheckTasksOutput struct {
 // TaskSummary provides aggregate counts across all matched tasks.
 type TaskSummary struct {
 	Total     int `json:"total"`
+	Blocked   int `json:"blocked"`
 	Pending   int `json:"pending"`
 	Running   int `json:"running"`
+	Retrying  int `json:"retrying"`
 	Completed int `json:"completed"`
 	Failed    int `json:"failed"`
 	Cancelled int `json:"cancelled"`
+
+	// Ollama metrics totalled over the matched tasks (see eval_metrics.go)
+	PromptEvalCount int            `json:"prompt_eval_count,omitempty"` // prompt tokens processed
+	EvalCount       int            `json:"eval_count,omitempty"`        // response tokens generated
+	EvalSeconds     float64        `json:"eval_seconds,omitempty"`      // time spent generating
+	Models          []ModelMetrics `json:"models,omitempty"`            // the same totals per model, with throughput
 }
 
 // TaskStatus is the per-task view in check_tasks. Intentionally omits the
@@ -35,4 +43,21 @@ type TaskStatus struct {
 	Error          string `json:"error,omitempty"`       // brief error message if failed
 	OutputFile     string `json:"output_file,omitempty"` // path where output was written (if applicable)
 	ElapsedSeconds int    `json:"elapsed_seconds"`       // wall-clock seconds (meaning varies by status)
+
+	Retries          int    `json:"retries,omitempty"`            // transient-error retries performed so far
+	LastAttemptError string `json:"last_attempt_error,omitempty"` // error from the most recent failed attempt
+	RepairAttempts   int    `json:"repair_attempts,omitempty"`    // follow-up turns after validate_cmd failures
+	Undone           bool   `json:"undone,omitempty"`             // output file restored via undo_tasks
+	StagedFile       string `json:"staged_file,omitempty"`        // staging mode: where output_file is written until applied
+	Staging          string `json:"staging,omitempty"`            // staged, applied, or discarded (staging mode only)
+	LinesAdded       int    `json:"lines_added,omitempty"`        // diff stat against the pre-write file (completed file-writing tasks)
+	LinesRemoved     int    `json:"lines_removed,omitempty"`      // diff stat against the pre-write file (completed file-writing tasks)
+	Chunks           int    `json:"chunks,omitempty"`             // chunk mode: number of pieces input_file was split into
+	ChunksDone       int    `json:"chunks_done,omitempty"`        // chunk mode: pieces processed so far
+	Backend          string `json:"backend,omitempty"`            // Ollama backend the task ran on, with several backends
+
+	Metrics *EvalMetrics `json:"metrics,omitempty"` // Ollama token counts and timings, summed over the task's calls
+
+	BlockedOn     []string `json:"blocked_on,omitempty"`     // unfinished dependency IDs (blocked tasks only)
+	QueuePosition int      `json:"queue_position,omitempty"` // 1-based position in the scheduler queue (waiting tasks only)
 }
@@ -1,6 +1,6 @@
 // tools.go contains the MCP tool handler functions.
 //
-// Each function corresponds to one of the five MCP tools exposed by the server.
+// Each function corresponds to one of the nine MCP tools exposed by the server.
 // The handlers are methods on ToolHandlers so they share access to the task
 // store and worker pool.
 //
@@ -16,8 +16,10 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/google/uuid"
@@ -43,37 +45,162 @@ func (h *ToolHandlers) handleSubmitTasks(ctx context.Context, req *mcp.CallToolR
 		return nil, SubmitTasksOutput{}, fmt.Errorf("batch too large: %d tasks exceeds maximum of %d", len(args.Tasks), maxBatchSize)
 	}
 
-	// Apply concurrency change if requested (before task creation so the
-	// new semaphore is active when workers start)
-	if args.Concurrency != nil {
-		if *args.Concurrency <= 0 {
-			return nil, SubmitTasksOutput{}, fmt.Errorf("concurrency must be > 0, got %d", *args.Concurrency)
+	// Expand input_glob specs into one task per file (see input_glob.go)
+	specs, expanded, err := expandInputGlobs(args.Tasks, maxBatchSize)
+	if err != nil {
+		return nil, SubmitTasksOutput{}, err
+	}
+	args.Tasks = specs
+
+	for tag, w := range args.TagWeights {
+		if w <= 0 {
+			return nil, SubmitTasksOutput{}, fmt.Errorf("tag_weights[%q] must be > 0, got %d", tag, w)
 		}
-		h.pool.SetConcurrency(*args.Concurrency)
 	}
 
-	// Validate all paths are absolute before creating any tasks (fail fast)
+	for model, n := range args.ModelConcurrency {
+		if n <= 0 {
+			return nil, SubmitTasksOutput{}, fmt.Errorf("model_concurrency[%q] must be > 0, got %d", model, n)
+		}
+	}
+
+	if args.Concurrency != nil && *args.Concurrency <= 0 {
+		return nil, SubmitTasksOutput{}, fmt.Errorf("concurrency must be > 0, got %d", *args.Concurrency)
+	}
+
+	session := sessionID(req)
+
+	// Validate all tasks before creating any (fail fast)
+	if err := validateOllamaOptions(args.Options); err != nil {
+		return nil, SubmitTasksOutput{}, fmt.Errorf("options: %v", err)
+	}
+	schemas := make([]json.RawMessage, len(args.Tasks))
+	stagedFiles := make([]string, len(args.Tasks))
 	for i, spec := range args.Tasks {
 		if spec.InputFile != "" && !filepath.IsAbs(spec.InputFile) {
 			return nil, SubmitTasksOutput{}, fmt.Errorf("task %d: input_file must be an absolute path, got %q", i, spec.InputFile)
 		}
+		for j, path := range spec.InputFiles {
+			if !filepath.IsAbs(path) {
+				return nil, SubmitTasksOutput{}, fmt.Errorf("task %d: input_files[%d] must be an absolute path, got %q", i, j, path)
+			}
+		}
 		if spec.OutputFile != "" && !filepath.IsAbs(spec.OutputFile) {
 			return nil, SubmitTasksOutput{}, fmt.Errorf("task %d: output_file must be an absolute path, got %q", i, spec.OutputFile)
 		}
+		if spec.MaxRetries != nil && *spec.MaxRetries < 0 {
+			return nil, SubmitTasksOutput{}, fmt.Errorf("task %d: max_retries must be >= 0, got %d", i, *spec.MaxRetries)
+		}
+		if spec.RetryBackoffSeconds < 0 {
+			return nil, SubmitTasksOutput{}, fmt.Errorf("task %d: retry_backoff_seconds must be >= 0, got %d", i, spec.RetryBackoffSeconds)
+		}
+		if err := validateOllamaOptions(spec.Options); err != nil {
+			return nil, SubmitTasksOutput{}, fmt.Errorf("task %d: options: %v", i, err)
+		}
+		if spec.ValidateCmd != "" && spec.OutputFile == "" {
+			return nil, SubmitTasksOutput{}, fmt.Errorf("task %d: validate_cmd requires output_file", i)
+		}
+		if args.Staging {
+			// Staging can only redirect commands that name output_file
+			// (see staging.go); anything else would act on the real tree.
+			for _, c := range []struct{ name, cmd string }{{"post_write_cmd", spec.PostWriteCmd}, {"validate_cmd", spec.ValidateCmd}} {
+				if c.cmd == "" {
+					continue
+				}
+				if _, ok := replacePath(c.cmd, spec.OutputFile, ""); !ok {
+					return nil, SubmitTasksOutput{}, fmt.Errorf("task %d: with staging, %s must name output_file (%s) by its absolute path, since only that path is redirected to the staged copy; commands like 'go build ./...' would check the real tree instead", i, c.name, spec.OutputFile)
+				}
+			}
+			if spec.OutputFile != "" {
+				var err error
+				if stagedFiles[i], err = h.pool.stagedPath(session, spec.Tag, spec.OutputFile); err != nil {
+					return nil, SubmitTasksOutput{}, fmt.Errorf("task %d: %v", i, err)
+				}
+			}
+		}
+		if spec.MaxRepairAttempts != nil && *spec.MaxRepairAttempts < 0 {
+			return nil, SubmitTasksOutput{}, fmt.Errorf("task %d: max_repair_attempts must be >= 0, got %d", i, *spec.MaxRepairAttempts)
+		}
+		if !validOutputMode(spec.OutputMode) {
+			return nil, SubmitTasksOutput{}, fmt.Errorf("task %d: unknown output_mode %q (want full, unified_diff, or search_replace)", i, spec.OutputMode)
+		}
+		if isEditMode(spec.OutputMode) {
+			if spec.InputFile == "" || spec.OutputFile == "" {
+				return nil, SubmitTasksOutput{}, fmt.Errorf("task %d: output_mode %s requires input_file and output_file", i, spec.OutputMode)
+			}
+			if spec.JSONSchema != nil || spec.ResponseHint == "json" {
+				return nil, SubmitTasksOutput{}, fmt.Errorf("task %d: output_mode %s can't be combined with json output", i, spec.OutputMode)
+			}
+		}
+		if spec.Chunk {
+			switch {
+			case spec.InputFile == "":
+				return nil, SubmitTasksOutput{}, fmt.Errorf("task %d: chunk requires input_file", i)
+			case isEditMode(spec.OutputMode):
+				return nil, SubmitTasksOutput{}, fmt.Errorf("task %d: chunk can't be combined with output_mode %s", i, spec.OutputMode)
+			case spec.JSONSchema != nil || spec.ResponseHint == "json":
+				return nil, SubmitTasksOutput{}, fmt.Errorf("task %d: chunk can't be combined with json output", i)
+			case spec.ValidateCmd != "":
+				return nil, SubmitTasksOutput{}, fmt.Errorf("task %d: chunk can't be combined with validate_cmd", i)
+			}
+		}
+		if spec.JSONSchema != nil && spec.ResponseHint != "" && spec.ResponseHint != "json" {
+			return nil, SubmitTasksOutput{}, fmt.Errorf("task %d: json_schema requires response_hint \"json\", got %q", i, spec.ResponseHint)
+		}
+		if spec.JSONSchema != nil {
+			var err error
+			if schemas[i], err = compileJSONSchema(spec.JSONSchema); err != nil {
+				return nil, SubmitTasksOutput{}, fmt.Errorf("task %d: %v", i, err)
+			}
+		}
+	}
+	var reduceStaged string
+	if r := args.Reduce; r != nil {
+		switch {
+		case len(args.Tasks) == 0:
+			return nil, SubmitTasksOutput{}, fmt.Errorf("reduce requires at least one task to reduce")
+		case r.Prompt == "":
+			return nil, SubmitTasksOutput{}, fmt.Errorf("reduce: prompt is required")
+		case r.OutputFile != "" && !filepath.IsAbs(r.OutputFile):
+			return nil, SubmitTasksOutput{}, fmt.Errorf("reduce: output_file must be an absolute path, got %q", r.OutputFile)
+		}
+		if err := validateOllamaOptions(r.Options); err != nil {
+			return nil, SubmitTasksOutput{}, fmt.Errorf("reduce: options: %v", err)
+		}
+		if args.Staging && r.OutputFile != "" {
+			var err error
+			if reduceStaged, err = h.pool.stagedPath(session, reduceTag(args), r.OutputFile); err != nil {
+				return nil, SubmitTasksOutput{}, fmt.Errorf("reduce: %v", err)
+			}
+		}
+	}
+
+	// Assign IDs up front so depends_on and output chaining can reference
+	// tasks in this batch.
+	ids := make([]string, 0, len(args.Tasks))
+	for range args.Tasks {
+		ids = append(ids, uuid.New().String())
+	}
+	deps, err := h.resolveDependencies(args.Tasks, ids, session)
+	if err != nil {
+		return nil, SubmitTasksOutput{}, err
 	}
 
 	tasks := make([]*Task, 0, len(args.Tasks))
 	taskCtxs := make([]context.Context, 0, len(args.Tasks))
 	taskCancels := make([]context.CancelFunc, 0, len(args.Tasks))
-	ids := make([]string, 0, len(args.Tasks))
 
-	for _, spec := range args.Tasks {
-		id := uuid.New().String()
+	for i, spec := range args.Tasks {
+		id := ids[i]
 		model := spec.Model
 		if model == "" {
 			model = getDefaultModel()
 		}
 		hint := spec.ResponseHint
+		schema := schemas[i]
+		if schema != nil {
+			hint = "json"
+		}
 		if hint == "" {
 			hint = "content"
 		}
@@ -84,46 +211,296 @@ func (h *ToolHandlers) handleSubmitTasks(ctx context.Context, req *mcp.CallToolR
 			stripFences = *spec.StripMarkdownFences
 		}
 
+		// Resolve MaxRetries the same way: nil → default, explicit 0 disables
+		maxRetries := defaultMaxRetries
+		if spec.MaxRetries != nil {
+			maxRetries = *spec.MaxRetries
+		}
+		maxRepairs := defaultMaxRepairAttempts
+		if spec.MaxRepairAttempts != nil {
+			maxRepairs = *spec.MaxRepairAttempts
+		}
+
+		// Rewrite output-chaining references to task IDs so the worker can
+		// resolve them without knowing about batch indexes. Every reference
+		// was already validated by resolveDependencies.
+		resolveRef := func(ref string) string {
+			id, _, _ := h.resolveTaskRef(ref, i, ids, session)
+			return id
+		}
+		prompt := rewriteResultPlaceholders(spec.Prompt, resolveRef)
+		var inputFromTask string
+		if spec.InputFromTask != "" {
+			inputFromTask = resolveRef(spec.InputFromTask)
+		}
+
+		// Tasks with dependencies start out blocked rather than pending
+		status := "pending"
+		if len(deps[i]) > 0 {
+			status = "blocked"
+		}
+
+		var staging string
+		if stagedFiles[i] != "" {
+			staging = "staged"
+		}
+
 		taskCtx, cancel := context.WithCancel(context.Background())
 
 		task := &Task{
 			ID:                  id,
 			Tag:                 spec.Tag,
+			Session:             session,
 			SystemPrompt:        spec.SystemPrompt,
-			Prompt:              spec.Prompt,
+			Prompt:              prompt,
 			InputFile:           spec.InputFile,
+			InputFiles:          spec.InputFiles,
 			OutputFile:          spec.OutputFile,
+			StagedFile:          stagedFiles[i],
+			Staging:             staging,
 			StripMarkdownFences: stripFences,
+			OutputMode:          spec.OutputMode,
+			Chunk:               spec.Chunk,
 			PostWriteCmd:        spec.PostWriteCmd,
+			ValidateCmd:         spec.ValidateCmd,
+			MaxRepairAttempts:   maxRepairs,
 			Model:               model,
 			ResponseHint:        hint,
+			JSONSchema:          schema,
+			Options:             mergeOllamaOptions(args.Options, spec.Options),
 			TimeoutSeconds:      spec.TimeoutSeconds,
-			Status:              "pending",
+			Priority:            spec.Priority,
+			MaxRetries:          maxRetries,
+			RetryBackoff:        time.Duration(spec.RetryBackoffSeconds) * time.Second,
+			DependsOn:           deps[i],
+			InputFromTask:       inputFromTask,
+			Status:              status,
 			CreatedAt:           time.Now(),
 			Cancel:              cancel,
 		}
 		tasks = append(tasks, task)
 		taskCtxs = append(taskCtxs, taskCtx)
 		taskCancels = append(taskCancels, cancel)
-		ids = append(ids, id)
+	}
+
+	var reduceID string
+	if args.Reduce != nil {
+		task := h.reduceTask(args, ids, session, reduceStaged)
+		reduceID = task.ID
+		taskCtx, cancel := context.WithCancel(context.Background())
+		task.Cancel = cancel
+		tasks = append(tasks, task)
+		taskCtxs = append(taskCtxs, taskCtx)
+		taskCancels = append(taskCancels, cancel)
+	}
+
+	// The batch is valid. Apply the pool-wide scheduler settings now — not
+	// before validation, so a rejected batch leaves them alone — and before
+	// any task is queued, so the new settings govern this batch.
+	if args.Concurrency != nil {
+		h.pool.SetConcurrency(*args.Concurrency)
+	}
+	if len(args.TagWeights) > 0 {
+		h.pool.SetTagWeights(args.TagWeights)
+	}
+	if args.FairShare != nil {
+		h.pool.SetFairShare(*args.FairShare)
+	}
+	if len(args.ModelConcurrency) > 0 {
+		h.pool.SetModelLimits(args.ModelConcurrency)
+	}
+
+	// In wait mode, watch the batch so the call can return once it has
+	// finished (see progress.go). The watch goes in before the tasks do, so
+	// no transition is missed.
+	var watched []string
+	var w *taskWatch
+	if args.Wait {
+		watched = make([]string, len(tasks))
+		for i, task := range tasks {
+			watched[i] = task.ID
+		}
+		w = h.store.Watch(watched)
 	}
 
 	h.store.Add(tasks)
 
-	// Start a worker goroutine for each task. They'll block on the semaphore
-	// if all worker slots are occupied.
+	// Start a worker goroutine for each task. They'll wait for dependencies
+	// and then wait in the scheduler queue if all worker slots are occupied.
 	for i, task := range tasks {
 		h.pool.Submit(taskCtxs[i], taskCancels[i], task)
 	}
 
-	return nil, SubmitTasksOutput{TaskIDs: ids}, nil
+	out := SubmitTasksOutput{TaskIDs: ids, ReduceTaskID: reduceID}
+	for i, spec := range args.Tasks {
+		if i < len(expanded) && expanded[i] {
+			out.Expanded = append(out.Expanded, ExpandedTask{ID: ids[i], InputFile: spec.InputFile, OutputFile: spec.OutputFile})
+		}
+	}
+	if args.Wait {
+		var ss *mcp.ServerSession
+		if req != nil {
+			ss = req.Session
+		}
+		out.Finished = h.awaitBatch(ctx, ss, progressToken(req), watched, w)
+		summary, _ := h.store.Summary(watched, "", session)
+		out.Summary = &summary
+	}
+	return nil, out, nil
+}
+
+// reduceTag returns the reduce task's tag: the reduce spec's own, else the
+// tag every task in the batch shares, if any.
+func reduceTag(args SubmitTasksArgs) string {
+	if args.Reduce.Tag != "" {
+		return args.Reduce.Tag
+	}
+	for _, spec := range args.Tasks {
+		if spec.Tag != args.Tasks[0].Tag {
+			return ""
+		}
+	}
+	return args.Tasks[0].Tag
+}
+
+// reduceTask builds the reduce task for a batch with a reduce spec: blocked
+// until every task in ids has finished, then run over their results (see
+// reduce.go). Each result is labeled with the file its task read or wrote.
+// stagedFile is the staged path of the reduce output_file, if staged.
+func (h *ToolHandlers) reduceTask(args SubmitTasksArgs, ids []string, session, stagedFile string) *Task {
+	r := args.Reduce
+	over := make([]ReduceInput, len(args.Tasks))
+	for i, spec := range args.Tasks {
+		label := spec.InputFile
+		if label == "" {
+			label = spec.OutputFile
+		}
+		over[i] = ReduceInput{ID: ids[i], Label: label}
+	}
+	model := r.Model
+	if model == "" {
+		model = getDefaultModel()
+	}
+	var staging string
+	if stagedFile != "" {
+		staging = "staged"
+	}
+	return &Task{
+		ID:                  uuid.New().String(),
+		Tag:                 reduceTag(args),
+		Session:             session,
+		SystemPrompt:        r.SystemPrompt,
+		Prompt:              r.Prompt,
+		OutputFile:          r.OutputFile,
+		StagedFile:          stagedFile,
+		Staging:             staging,
+		StripMarkdownFences: true,
+		Model:               model,
+		ResponseHint:        "content",
+		Options:             mergeOllamaOptions(args.Options, r.Options),
+		TimeoutSeconds:      r.TimeoutSeconds,
+		MaxRetries:          defaultMaxRetries,
+		ReduceOver:          over,
+		Status:              "blocked",
+		CreatedAt:           time.Now(),
+	}
+}
+
+// resolveDependencies converts each spec's dependency references into task
+// IDs. References come from depends_on plus any task whose output the spec
+// consumes ({{result:<ref>}} placeholders and input_from_task) — consuming a
+// result implies waiting for it. See resolveTaskRef for the reference format.
+// Rejects cycles within the batch — a cycle would leave every task in it
+// blocked forever.
+func (h *ToolHandlers) resolveDependencies(specs []TaskSpec, ids []string, session string) ([][]string, error) {
+	deps := make([][]string, len(specs))
+	edges := make([][]int, len(specs)) // batch-local edges, for cycle detection
+	for i, spec := range specs {
+		refs := append(append([]string{}, spec.DependsOn...), chainRefs(spec)...)
+		seen := make(map[string]bool, len(refs))
+		for _, ref := range refs {
+			depID, idx, err := h.resolveTaskRef(ref, i, ids, session)
+			if err != nil {
+				return nil, err
+			}
+			if idx >= 0 {
+				edges[i] = append(edges[i], idx)
+			}
+			if !seen[depID] {
+				seen[depID] = true
+				deps[i] = append(deps[i], depID)
+			}
+		}
+	}
+
+	// Depth-first search for cycles among batch-local references.
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make([]int, len(specs))
+	var visit func(i int) error
+	visit = func(i int) error {
+		state[i] = visiting
+		for _, j := range edges[i] {
+			switch state[j] {
+			case visiting:
+				return fmt.Errorf("task %d: depends_on forms a cycle through task %d", i, j)
+			case unvisited:
+				if err := visit(j); err != nil {
+					return err
+				}
+			}
+		}
+		state[i] = done
+		return nil
+	}
+	for i := range specs {
+		if state[i] == unvisited {
+			if err := visit(i); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return deps, nil
+}
+
+// resolveTaskRef resolves a reference made by task i of a batch. A reference
+// that parses as an integer is a 0-based index into the batch (resolved via
+// ids, and returned as idx); anything else must be the ID of a task already
+// in the store that session can see (idx is -1). Self-references and
+// out-of-range indexes are rejected.
+func (h *ToolHandlers) resolveTaskRef(ref string, i int, ids []string, session string) (id string, idx int, err error) {
+	if n, err := strconv.Atoi(ref); err == nil {
+		if n < 0 || n >= len(ids) {
+			return "", -1, fmt.Errorf("task %d: reference to index %d out of range (batch has %d tasks)", i, n, len(ids))
+		}
+		if n == i {
+			return "", -1, fmt.Errorf("task %d: cannot reference itself", i)
+		}
+		return ids[n], n, nil
+	}
+	if !h.store.Visible(ref, session) {
+		return "", -1, fmt.Errorf("task %d: reference to unknown task ID %q", i, ref)
+	}
+	return ref, -1, nil
 }
 
 // handleCheckTasks returns a compact status overview: aggregate counts plus
 // per-task status (without full result content). This is the primary polling
 // tool — designed to be cheap on the caller's context window.
-func (h *ToolHandlers) handleCheckTasks(_ context.Context, _ *mcp.CallToolRequest, args CheckTasksArgs) (*mcp.CallToolResult, CheckTasksOutput, error) {
-	summary, statuses := h.store.Summary(args.TaskIDs, args.Tag)
+func (h *ToolHandlers) handleCheckTasks(_ context.Context, req *mcp.CallToolRequest, args CheckTasksArgs) (*mcp.CallToolResult, CheckTasksOutput, error) {
+	summary, statuses := h.store.Summary(args.TaskIDs, args.Tag, sessionID(req))
+	positions := h.pool.QueuePositions()
+	for i := range statuses {
+		statuses[i].QueuePosition = positions[statuses[i].ID]
+	}
+	if statuses == nil {
+		// Nothing matched (e.g. another session's tag). The output schema
+		// requires an array, so return an empty one rather than null.
+		statuses = []TaskStatus{}
+	}
 	return nil, CheckTasksOutput{
 		Summary: summary,
 		Tasks:   statuses,
@@ -133,37 +510,118 @@ func (h *ToolHandlers) handleCheckTasks(_ context.Context, _ *mcp.CallToolReques
 // handleGetResult retrieves the full Ollama response content for specific
 // tasks. The caller should use this selectively — e.g. spot-checking a few
 // results or investigating failures — rather than retrieving everything.
-func (h *ToolHandlers) handleGetResult(_ context.Context, _ *mcp.CallToolRequest, args GetResultArgs) (*mcp.CallToolResult, GetResultOutput, error) {
-	results := h.store.Results(args.TaskIDs)
+func (h *ToolHandlers) handleGetResult(_ context.Context, req *mcp.CallToolRequest, args GetResultArgs) (*mcp.CallToolResult, GetResultOutput, error) {
+	results := h.store.Results(args.TaskIDs, sessionID(req))
+	if args.IncludeDiff {
+		for i, r := range results {
+			if r.OutputFile == "" {
+				continue
+			}
+			diff, err := h.store.Diff(r.ID)
+			if err != nil {
+				results[i].DiffError = err.Error()
+				continue
+			}
+			results[i].Diff = diff
+		}
+	}
 	return nil, GetResultOutput{Results: results}, nil
 }
 
 // handleCancelTasks cancels pending or running tasks. Running tasks have
 // their context cancelled, which aborts the in-flight Ollama request.
-func (h *ToolHandlers) handleCancelTasks(_ context.Context, _ *mcp.CallToolRequest, args CancelTasksArgs) (*mcp.CallToolResult, CancelTasksOutput, error) {
-	count := h.store.Cancel(args.TaskIDs, args.Tag)
+func (h *ToolHandlers) handleCancelTasks(_ context.Context, req *mcp.CallToolRequest, args CancelTasksArgs) (*mcp.CallToolResult, CancelTasksOutput, error) {
+	count := h.store.Cancel(args.TaskIDs, args.Tag, sessionID(req))
 	return nil, CancelTasksOutput{Cancelled: count}, nil
 }
 
+// defaultPeekTailChars and maxPeekTailChars bound how much of a running
+// task's response peek_task returns.
+const (
+	defaultPeekTailChars = 500
+	maxPeekTailChars     = 20000
+)
+
+// handlePeekTask returns a live view of a running task's Ollama call: tokens
+// generated so far, generation speed, and the tail of the response. Tasks
+// that aren't running report only their status.
+func (h *ToolHandlers) handlePeekTask(_ context.Context, req *mcp.CallToolRequest, args PeekTaskArgs) (*mcp.CallToolResult, PeekTaskOutput, error) {
+	tailChars := defaultPeekTailChars
+	if args.TailChars != nil {
+		tailChars = *args.TailChars
+	}
+	if tailChars < 0 || tailChars > maxPeekTailChars {
+		return nil, PeekTaskOutput{}, fmt.Errorf("tail_chars must be between 0 and %d, got %d", maxPeekTailChars, tailChars)
+	}
+	status := h.store.Results([]string{args.TaskID}, sessionID(req))[0].Status
+	if status == "not_found" {
+		return nil, PeekTaskOutput{}, fmt.Errorf("task %s not found", args.TaskID)
+	}
+	out := PeekTaskOutput{ID: args.TaskID, Status: status}
+	if status == "running" || status == "retrying" {
+		h.pool.peekLive(args.TaskID, tailChars, &out)
+	}
+	return nil, out, nil
+}
+
+// handleUndoTasks restores the output files written by finished tasks to
+// their pre-write contents (or removes them if they didn't exist before).
+func (h *ToolHandlers) handleUndoTasks(_ context.Context, req *mcp.CallToolRequest, args UndoTasksArgs) (*mcp.CallToolResult, UndoTasksOutput, error) {
+	results := h.pool.Undo(args.TaskIDs, args.Tag, sessionID(req))
+	if results == nil {
+		results = []UndoResult{}
+	}
+	restored := 0
+	for _, r := range results {
+		if r.Action == "restored" || r.Action == "removed" {
+			restored++
+		}
+	}
+	return nil, UndoTasksOutput{Restored: restored, Results: results}, nil
+}
+
+// handleApplyStaged promotes the staged output of finished tasks into place.
+// Either every staged file is promoted or, if any can't be prepared, none is.
+func (h *ToolHandlers) handleApplyStaged(_ context.Context, req *mcp.CallToolRequest, args ApplyStagedArgs) (*mcp.CallToolResult, ApplyStagedOutput, error) {
+	results, err := h.pool.ApplyStaged(args.TaskIDs, args.Tag, sessionID(req))
+	if err != nil {
+		return nil, ApplyStagedOutput{}, err
+	}
+	if results == nil {
+		results = []StagedFileResult{}
+	}
+	applied := 0
+	for _, r := range results {
+		if r.Action == "applied" {
+			applied++
+		}
+	}
+	return nil, ApplyStagedOutput{Applied: applied, Results: results}, nil
+}
+
+// handleDiscardStaged deletes the staged output of finished tasks, leaving
+// the real files untouched.
+func (h *ToolHandlers) handleDiscardStaged(_ context.Context, req *mcp.CallToolRequest, args DiscardStagedArgs) (*mcp.CallToolResult, DiscardStagedOutput, error) {
+	results := h.pool.DiscardStaged(args.TaskIDs, args.Tag, sessionID(req))
+	if results == nil {
+		results = []StagedFileResult{}
+	}
+	discarded := 0
+	for _, r := range results {
+		if r.Action == "discarded" {
+			discarded++
+		}
+	}
+	return nil, DiscardStagedOutput{Discarded: discarded, Results: results}, nil
+}
+
 // handleListModels queries the local Ollama instance for available models.
 // Claude should call this at the start of each session to understand what
 // models are available and calibrate expectations for worker capability.
 func (h *ToolHandlers) handleListModels(ctx context.Context, _ *mcp.CallToolRequest, _ ListModelsArgs) (*mcp.CallToolResult, ListModelsOutput, error) {
-	resp, err := h.pool.client.List(ctx)
+	out, err := h.pool.listModels(ctx)
 	if err != nil {
-		return nil, ListModelsOutput{}, fmt.Errorf("failed to list Ollama models: %v", err)
-	}
-
-	models := make([]ModelInfo, 0, len(resp.Models))
-	for _, m := range resp.Models {
-		models = append(models, ModelInfo{
-			Name:              m.Name,
-			Size:              m.Size,
-			ParameterSize:     m.Details.ParameterSize,
-			QuantizationLevel: m.Details.QuantizationLevel,
-			Family:            m.Details.Family,
-		})
+		return nil, ListModelsOutput{}, err
 	}
-
-	return nil, ListModelsOutput{Models: models}, nil
+	return nil, out, nil
 }
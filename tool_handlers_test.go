@@ -2,10 +2,18 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/modelcontextprotocol/go-sdk/mcp"
 	"github.com/ollama/ollama/api"
 )
 
@@ -767,3 +775,2208 @@ func TestHandleSubmitTasksConcurrencyNilIgnored(t *testing.T) {
 		t.Fatalf("expected concurrency to remain %d, got %d", originalConcurrency, h.pool.Concurrency())
 	}
 }
+
+// ---------------------------------------------------------------------------
+// submit_tasks retry defaults
+// ---------------------------------------------------------------------------
+
+func TestHandleSubmitTasksMaxRetriesDefault(t *testing.T) {
+	h := newTestHandlers(&mockOllamaClient{})
+	zero := 0
+
+	_, out, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Tasks: []TaskSpec{
+			{SystemPrompt: "sys", Prompt: "p"},
+			{SystemPrompt: "sys", Prompt: "p", MaxRetries: &zero, RetryBackoffSeconds: 3},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	h.store.mu.Lock()
+	defaulted := h.store.tasks[out.TaskIDs[0]].MaxRetries
+	explicit := h.store.tasks[out.TaskIDs[1]]
+	h.store.mu.Unlock()
+
+	if defaulted != defaultMaxRetries {
+		t.Fatalf("expected default max_retries %d, got %d", defaultMaxRetries, defaulted)
+	}
+	if explicit.MaxRetries != 0 || explicit.RetryBackoff != 3*time.Second {
+		t.Fatalf("expected explicit max_retries 0 and 3s backoff, got %d / %v", explicit.MaxRetries, explicit.RetryBackoff)
+	}
+}
+
+func TestHandleSubmitTasksNegativeMaxRetriesRejected(t *testing.T) {
+	h := newTestHandlers(&mockOllamaClient{})
+	neg := -1
+
+	_, _, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Tasks: []TaskSpec{{SystemPrompt: "sys", Prompt: "p", MaxRetries: &neg}},
+	})
+	if err == nil {
+		t.Fatal("expected error for negative max_retries")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// submit_tasks depends_on
+// ---------------------------------------------------------------------------
+
+func TestHandleSubmitTasksDependsOnOrdering(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	releaseFirst := make(chan struct{})
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			prompt := req.Messages[1].Content
+			if prompt == "interface" {
+				<-releaseFirst
+			}
+			mu.Lock()
+			order = append(order, prompt)
+			mu.Unlock()
+			fn(api.ChatResponse{Message: api.Message{Content: "ok"}})
+			return nil
+		},
+	}
+	h := newTestHandlers(mock)
+
+	_, out, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Tasks: []TaskSpec{
+			{SystemPrompt: "sys", Prompt: "interface"},
+			{SystemPrompt: "sys", Prompt: "impl", DependsOn: []string{"0"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	summary, statuses := h.store.Summary([]string{out.TaskIDs[1]}, "", "")
+	if summary.Blocked != 1 {
+		t.Fatalf("expected dependent task to be blocked, got %+v", summary)
+	}
+	if len(statuses[0].BlockedOn) != 1 || statuses[0].BlockedOn[0] != out.TaskIDs[0] {
+		t.Fatalf("expected blocked_on to list the upstream task, got %v", statuses[0].BlockedOn)
+	}
+
+	close(releaseFirst)
+	waitForStatus(t, h.store, out.TaskIDs[1], 2*time.Second, "completed")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) != 2 || order[0] != "interface" || order[1] != "impl" {
+		t.Fatalf("expected interface before impl, got %v", order)
+	}
+}
+
+func TestHandleSubmitTasksDependsOnCascadesFailure(t *testing.T) {
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			if req.Messages[1].Content == "upstream" {
+				return fmt.Errorf("model not found")
+			}
+			fn(api.ChatResponse{Message: api.Message{Content: "ok"}})
+			return nil
+		},
+	}
+	h := newTestHandlers(mock)
+
+	_, out, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Tasks: []TaskSpec{
+			{SystemPrompt: "sys", Prompt: "upstream"},
+			{SystemPrompt: "sys", Prompt: "middle", DependsOn: []string{"0"}},
+			{SystemPrompt: "sys", Prompt: "leaf", DependsOn: []string{"1"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	waitForStatus(t, h.store, out.TaskIDs[2], 2*time.Second, "failed")
+	results := h.store.Results(out.TaskIDs, "")
+	if results[1].Status != "failed" || !strings.Contains(results[1].Error, out.TaskIDs[0]) {
+		t.Fatalf("expected middle to fail citing upstream, got %+v", results[1])
+	}
+	if !strings.Contains(results[2].Error, out.TaskIDs[1]) {
+		t.Fatalf("expected leaf to fail citing middle, got %q", results[2].Error)
+	}
+}
+
+func TestHandleSubmitTasksDependsOnCascadesCancel(t *testing.T) {
+	blocker := make(chan struct{})
+	defer close(blocker)
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			select {
+			case <-blocker:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			return nil
+		},
+	}
+	h := newTestHandlers(mock)
+
+	_, first, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Tasks: []TaskSpec{{SystemPrompt: "sys", Prompt: "upstream"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Dependency on a task from an earlier batch, by ID
+	_, second, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Tasks: []TaskSpec{{SystemPrompt: "sys", Prompt: "downstream", DependsOn: []string{first.TaskIDs[0]}}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	waitForStatus(t, h.store, first.TaskIDs[0], 2*time.Second, "running")
+	h.store.Cancel(first.TaskIDs, "", "")
+	waitForStatus(t, h.store, second.TaskIDs[0], 2*time.Second, "cancelled")
+}
+
+func TestHandleSubmitTasksDependsOnValidation(t *testing.T) {
+	h := newTestHandlers(&mockOllamaClient{})
+	tests := []struct {
+		name  string
+		tasks []TaskSpec
+	}{
+		{"out of range", []TaskSpec{{Prompt: "a", DependsOn: []string{"1"}}}},
+		{"negative index", []TaskSpec{{Prompt: "a", DependsOn: []string{"-1"}}}},
+		{"self reference", []TaskSpec{{Prompt: "a", DependsOn: []string{"0"}}}},
+		{"unknown ID", []TaskSpec{{Prompt: "a", DependsOn: []string{"no-such-task"}}}},
+		{"cycle", []TaskSpec{
+			{Prompt: "a", DependsOn: []string{"2"}},
+			{Prompt: "b", DependsOn: []string{"0"}},
+			{Prompt: "c", DependsOn: []string{"1"}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{Tasks: tt.tasks})
+			if err == nil {
+				t.Fatal("expected validation error")
+			}
+		})
+	}
+	// Nothing should have been enqueued by the rejected batches
+	if summary, _ := h.store.Summary(nil, "", ""); summary.Total != 0 {
+		t.Fatalf("expected no tasks after rejected batches, got %d", summary.Total)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// submit_tasks output chaining
+// ---------------------------------------------------------------------------
+
+func TestHandleSubmitTasksResultPlaceholder(t *testing.T) {
+	var mu sync.Mutex
+	prompts := make(map[string]string)
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			prompt := req.Messages[1].Content
+			mu.Lock()
+			prompts[req.Messages[0].Content] = prompt
+			mu.Unlock()
+			switch req.Messages[0].Content {
+			case "summarize-a":
+				fn(api.ChatResponse{Message: api.Message{Content: "```\nsummary A\n```"}})
+			case "summarize-b":
+				fn(api.ChatResponse{Message: api.Message{Content: "summary B"}})
+			default:
+				fn(api.ChatResponse{Message: api.Message{Content: "synthesis"}})
+			}
+			return nil
+		},
+	}
+	h := newTestHandlers(mock)
+
+	_, out, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Tasks: []TaskSpec{
+			{SystemPrompt: "summarize-a", Prompt: "a"},
+			{SystemPrompt: "summarize-b", Prompt: "b"},
+			{SystemPrompt: "synthesize", Prompt: "A: {{result:0}}\nB: {{result:1}}\nA again: {{result:0}}"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitForStatus(t, h.store, out.TaskIDs[2], 2*time.Second, "completed")
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := "A: summary A\nB: summary B\nA again: summary A"
+	if prompts["synthesize"] != want {
+		t.Fatalf("expected resolved prompt %q, got %q", want, prompts["synthesize"])
+	}
+}
+
+func TestHandleSubmitTasksInputFromTaskReadsOutputFile(t *testing.T) {
+	var mu sync.Mutex
+	var downstreamPrompt string
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			if req.Messages[0].Content == "downstream" {
+				mu.Lock()
+				downstreamPrompt = req.Messages[1].Content
+				mu.Unlock()
+			}
+			fn(api.ChatResponse{Message: api.Message{Content: "generated interface"}})
+			return nil
+		},
+	}
+	h := newTestHandlers(mock)
+	outPath := filepath.Join(t.TempDir(), "iface.go")
+
+	_, first, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Tasks: []TaskSpec{{SystemPrompt: "upstream", Prompt: "p", OutputFile: outPath}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, second, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Tasks: []TaskSpec{{SystemPrompt: "downstream", Prompt: "implement this:", InputFromTask: first.TaskIDs[0]}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitForStatus(t, h.store, second.TaskIDs[0], 2*time.Second, "completed")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if downstreamPrompt != "implement this:\n\ngenerated interface" {
+		t.Fatalf("unexpected downstream prompt %q", downstreamPrompt)
+	}
+}
+
+func TestHandleSubmitTasksChainingUnknownRef(t *testing.T) {
+	h := newTestHandlers(&mockOllamaClient{})
+	_, _, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Tasks: []TaskSpec{{SystemPrompt: "sys", Prompt: "use {{result:missing}}"}},
+	})
+	if err == nil {
+		t.Fatal("expected error for placeholder referencing an unknown task")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// check_tasks queue_position
+// ---------------------------------------------------------------------------
+
+func TestHandleCheckTasksQueuePosition(t *testing.T) {
+	blocker := make(chan struct{})
+	defer close(blocker)
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			select {
+			case <-blocker:
+			case <-ctx.Done():
+			}
+			return nil
+		},
+	}
+	h := newTestHandlers(mock)
+	h.pool.SetConcurrency(1)
+
+	_, out, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Tasks: []TaskSpec{
+			{SystemPrompt: "sys", Prompt: "first"},
+			{SystemPrompt: "sys", Prompt: "second"},
+			{SystemPrompt: "sys", Prompt: "urgent", Priority: 10},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitForStatus(t, h.store, out.TaskIDs[0], 2*time.Second, "running")
+
+	_, check, err := h.handleCheckTasks(context.Background(), nil, CheckTasksArgs{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := make(map[string]int)
+	for _, s := range check.Tasks {
+		got[s.ID] = s.QueuePosition
+	}
+	if got[out.TaskIDs[0]] != 0 || got[out.TaskIDs[2]] != 1 || got[out.TaskIDs[1]] != 2 {
+		t.Fatalf("unexpected queue positions: %v", got)
+	}
+	h.store.Cancel(nil, "", "")
+}
+
+// ---------------------------------------------------------------------------
+// submit_tasks fair_share / tag_weights
+// ---------------------------------------------------------------------------
+
+func TestHandleSubmitTasksFairShareSettings(t *testing.T) {
+	h := newTestHandlers(&mockOllamaClient{})
+
+	fairShare := true
+	_, _, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		FairShare:  &fairShare,
+		TagWeights: map[string]int{"interactive": 3},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !h.pool.FairShare() {
+		t.Fatal("expected fair share to be enabled")
+	}
+
+	// Omitting fair_share keeps the current setting
+	if _, _, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !h.pool.FairShare() {
+		t.Fatal("expected fair share to stay enabled when omitted")
+	}
+}
+
+func TestHandleSubmitTasksRejectedBatchKeepsSchedulerSettings(t *testing.T) {
+	h := newTestHandlers(&mockOllamaClient{})
+
+	concurrency := 5
+	fairShare := true
+	_, _, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Concurrency:      &concurrency,
+		FairShare:        &fairShare,
+		TagWeights:       map[string]int{"bg": 3},
+		ModelConcurrency: map[string]int{"big": 1},
+		Tasks:            []TaskSpec{{SystemPrompt: "sys", Prompt: "p", InputFile: "relative.go"}},
+	})
+	if err == nil {
+		t.Fatal("expected error for relative input_file")
+	}
+	if h.pool.Concurrency() == concurrency || h.pool.FairShare() {
+		t.Fatal("scheduler settings should not change when the batch is rejected")
+	}
+	if limits := h.pool.ModelLimits(); len(limits) > 0 {
+		t.Fatalf("model limits should not change when the batch is rejected, got %v", limits)
+	}
+	h.pool.mu.Lock()
+	defer h.pool.mu.Unlock()
+	if _, ok := h.pool.tagWeights["bg"]; ok {
+		t.Fatal("tag weights should not change when the batch is rejected")
+	}
+}
+
+func TestHandleSubmitTasksTagWeightRejected(t *testing.T) {
+	h := newTestHandlers(&mockOllamaClient{})
+
+	concurrency := 5
+	_, _, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Concurrency: &concurrency,
+		TagWeights:  map[string]int{"bg": 0},
+		Tasks:       []TaskSpec{{SystemPrompt: "sys", Prompt: "p"}},
+	})
+	if err == nil {
+		t.Fatal("expected error for non-positive tag weight")
+	}
+	if h.pool.Concurrency() == concurrency {
+		t.Fatal("concurrency should not change when the request is rejected")
+	}
+}
+
+func TestHandleSubmitTasksModelConcurrency(t *testing.T) {
+	mock := &mockOllamaClient{
+		listFn: func(ctx context.Context) (*api.ListResponse, error) {
+			return &api.ListResponse{Models: []api.ListModelResponse{{Name: "qwen2.5-coder:32b"}, {Name: "llama3.2:latest"}}}, nil
+		},
+	}
+	h := newTestHandlers(mock)
+
+	if _, _, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		ModelConcurrency: map[string]int{"qwen2.5-coder:32b": 1},
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A zero limit is rejected and leaves the existing limits alone
+	_, _, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		ModelConcurrency: map[string]int{"qwen2.5-coder:32b": 0},
+	})
+	if err == nil {
+		t.Fatal("expected error for non-positive model concurrency")
+	}
+
+	// list_models shows the limit on the limited model only
+	_, out, err := h.handleListModels(context.Background(), nil, ListModelsArgs{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Models[0].Concurrency != 1 || out.Models[1].Concurrency != 0 {
+		t.Fatalf("expected concurrency 1 for the 32b model only, got %+v", out.Models)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// submit_tasks options
+// ---------------------------------------------------------------------------
+
+func TestHandleSubmitTasksOptionsMerged(t *testing.T) {
+	var mu sync.Mutex
+	var got map[string]any
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			mu.Lock()
+			got = req.Options
+			mu.Unlock()
+			fn(api.ChatResponse{Message: api.Message{Content: "ok"}})
+			return nil
+		},
+	}
+	h := newTestHandlers(mock)
+
+	_, out, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Options: map[string]any{"temperature": 0.7, "num_ctx": float64(8192)},
+		Tasks: []TaskSpec{{
+			SystemPrompt: "sys",
+			Prompt:       "p",
+			Options:      map[string]any{"temperature": float64(0), "seed": float64(42), "stop": []any{"<END>"}},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitForStatus(t, h.store, out.TaskIDs[0], 2*time.Second, "completed")
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := map[string]any{"temperature": float64(0), "num_ctx": float64(8192), "seed": float64(42), "stop": []any{"<END>"}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expected options %v, got %v", want, got)
+	}
+}
+
+func TestHandleSubmitTasksNoOptions(t *testing.T) {
+	var mu sync.Mutex
+	got := map[string]any{"sentinel": true}
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			mu.Lock()
+			got = req.Options
+			mu.Unlock()
+			return nil
+		},
+	}
+	h := newTestHandlers(mock)
+
+	_, out, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Tasks: []TaskSpec{{SystemPrompt: "sys", Prompt: "p"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitForStatus(t, h.store, out.TaskIDs[0], 2*time.Second, "completed")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got != nil {
+		t.Fatalf("expected nil options so Ollama uses model defaults, got %v", got)
+	}
+}
+
+func TestHandleSubmitTasksOptionsValidation(t *testing.T) {
+	h := newTestHandlers(&mockOllamaClient{})
+
+	cases := []struct {
+		name string
+		args SubmitTasksArgs
+		want string
+	}{
+		{
+			name: "unknown task option",
+			args: SubmitTasksArgs{Tasks: []TaskSpec{{SystemPrompt: "sys", Prompt: "p", Options: map[string]any{"temprature": float64(0)}}}},
+			want: `task 0: options: unknown Ollama option(s) temprature`,
+		},
+		{
+			name: "unknown batch option",
+			args: SubmitTasksArgs{Options: map[string]any{"ctx_size": float64(4096)}, Tasks: []TaskSpec{{SystemPrompt: "sys", Prompt: "p"}}},
+			want: `options: unknown Ollama option(s) ctx_size`,
+		},
+		{
+			name: "wrong type",
+			args: SubmitTasksArgs{Tasks: []TaskSpec{{SystemPrompt: "sys", Prompt: "p", Options: map[string]any{"temperature": "hot"}}}},
+			want: `task 0: options: option "temperature" must be of type float32`,
+		},
+		{
+			name: "stop must be strings",
+			args: SubmitTasksArgs{Tasks: []TaskSpec{{SystemPrompt: "sys", Prompt: "p", Options: map[string]any{"stop": "<END>"}}}},
+			want: `task 0: options: option "stop" must be of type array`,
+		},
+	}
+	for _, tc := range cases {
+		_, _, err := h.handleSubmitTasks(context.Background(), nil, tc.args)
+		if err == nil || err.Error() != tc.want {
+			t.Fatalf("%s: expected error %q, got %v", tc.name, tc.want, err)
+		}
+	}
+	if len(h.store.List(nil, "", "")) != 0 {
+		t.Fatal("no tasks should be created when options are invalid")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// submit_tasks json_schema
+// ---------------------------------------------------------------------------
+
+var personSchema = map[string]any{
+	"type":     "object",
+	"required": []any{"name", "age"},
+	"properties": map[string]any{
+		"name": map[string]any{"type": "string"},
+		"age":  map[string]any{"type": "integer"},
+	},
+}
+
+func TestHandleSubmitTasksJSONSchemaConforming(t *testing.T) {
+	var mu sync.Mutex
+	var format string
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			mu.Lock()
+			format = string(req.Format)
+			mu.Unlock()
+			fn(api.ChatResponse{Message: api.Message{Content: `{"name": "Ada", "age": 36}`}})
+			return nil
+		},
+	}
+	h := newTestHandlers(mock)
+
+	_, out, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Tasks: []TaskSpec{{SystemPrompt: "sys", Prompt: "p", JSONSchema: personSchema}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitForStatus(t, h.store, out.TaskIDs[0], 2*time.Second, "completed")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !strings.Contains(format, `"required":["name","age"]`) {
+		t.Fatalf("expected the schema to be passed as the format, got %s", format)
+	}
+	if got := h.store.Get(out.TaskIDs[0]); got.ResponseHint != "json" {
+		t.Fatalf("expected json_schema to imply response_hint json, got %q", got.ResponseHint)
+	}
+}
+
+func TestHandleSubmitTasksJSONSchemaViolation(t *testing.T) {
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			fn(api.ChatResponse{Message: api.Message{Content: `{"name": "Ada", "age": "old"}`}})
+			return nil
+		},
+	}
+	h := newTestHandlers(mock)
+	outPath := filepath.Join(t.TempDir(), "out.json")
+
+	_, out, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Tasks: []TaskSpec{{SystemPrompt: "sys", Prompt: "p", JSONSchema: personSchema, OutputFile: outPath}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitForStatus(t, h.store, out.TaskIDs[0], 2*time.Second, "failed")
+
+	res := h.store.Results(out.TaskIDs, "")[0]
+	if !strings.Contains(res.Error, "response does not match json_schema") || !strings.Contains(res.Error, "age") {
+		t.Fatalf("expected a schema validation error naming the field, got %q", res.Error)
+	}
+	if res.Content != `{"name": "Ada", "age": "old"}` {
+		t.Fatalf("expected the raw response to be preserved, got %q", res.Content)
+	}
+	if _, err := os.Stat(outPath); !os.IsNotExist(err) {
+		t.Fatal("non-conforming output should not be written to output_file")
+	}
+}
+
+func TestHandleSubmitTasksJSONHintWithoutSchema(t *testing.T) {
+	var mu sync.Mutex
+	var format string
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			mu.Lock()
+			format = string(req.Format)
+			mu.Unlock()
+			fn(api.ChatResponse{Message: api.Message{Content: "Sure! Here is the data you asked for."}})
+			return nil
+		},
+	}
+	h := newTestHandlers(mock)
+
+	_, out, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Tasks: []TaskSpec{{SystemPrompt: "sys", Prompt: "p", ResponseHint: "json"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitForStatus(t, h.store, out.TaskIDs[0], 2*time.Second, "failed")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if format != `"json"` {
+		t.Fatalf("expected plain JSON mode, got format %s", format)
+	}
+	if res := h.store.Results(out.TaskIDs, "")[0]; !strings.Contains(res.Error, "response is not valid JSON") {
+		t.Fatalf("expected invalid JSON error, got %q", res.Error)
+	}
+}
+
+func TestHandleSubmitTasksJSONSchemaValidation(t *testing.T) {
+	h := newTestHandlers(&mockOllamaClient{})
+
+	cases := []struct {
+		name string
+		spec TaskSpec
+	}{
+		{"malformed schema", TaskSpec{SystemPrompt: "sys", Prompt: "p", JSONSchema: map[string]any{"type": 42}}},
+		{"unsupported draft", TaskSpec{SystemPrompt: "sys", Prompt: "p", JSONSchema: map[string]any{"$schema": "http://json-schema.org/draft-07/schema#"}}},
+		{"conflicting hint", TaskSpec{SystemPrompt: "sys", Prompt: "p", ResponseHint: "content", JSONSchema: personSchema}},
+	}
+	for _, tc := range cases {
+		// A valid task ahead of the invalid one must not be created either
+		valid := TaskSpec{SystemPrompt: "sys", Prompt: "p", JSONSchema: personSchema}
+		if _, _, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{Tasks: []TaskSpec{valid, tc.spec}}); err == nil || !strings.HasPrefix(err.Error(), "task 1:") {
+			t.Fatalf("%s: expected an error for task 1, got %v", tc.name, err)
+		}
+	}
+	if len(h.store.List(nil, "", "")) != 0 {
+		t.Fatal("no tasks should be created when json_schema is invalid")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// submit_tasks validate_cmd
+// ---------------------------------------------------------------------------
+
+func TestHandleSubmitTasksValidateCmdValidation(t *testing.T) {
+	h := newTestHandlers(&mockOllamaClient{})
+
+	_, _, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Tasks: []TaskSpec{{SystemPrompt: "sys", Prompt: "p", ValidateCmd: "go build ./..."}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "validate_cmd requires output_file") {
+		t.Fatalf("expected output_file error, got %v", err)
+	}
+
+	negative := -1
+	_, _, err = h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Tasks: []TaskSpec{{SystemPrompt: "sys", Prompt: "p", OutputFile: "/tmp/x.go", ValidateCmd: "true", MaxRepairAttempts: &negative}},
+	})
+	if err == nil {
+		t.Fatal("expected error for negative max_repair_attempts")
+	}
+}
+
+func TestHandleSubmitTasksMaxRepairAttemptsDefault(t *testing.T) {
+	h := newTestHandlers(&mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	})
+	_, out, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Tasks: []TaskSpec{{SystemPrompt: "sys", Prompt: "p", OutputFile: filepath.Join(t.TempDir(), "x.go"), ValidateCmd: "true"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer h.store.Cancel(nil, "", "")
+	if got := h.store.Get(out.TaskIDs[0]).MaxRepairAttempts; got != defaultMaxRepairAttempts {
+		t.Fatalf("expected default max repair attempts %d, got %d", defaultMaxRepairAttempts, got)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// undo_tasks
+// ---------------------------------------------------------------------------
+
+func TestHandleUndoTasks(t *testing.T) {
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			fn(api.ChatResponse{Message: api.Message{Content: "rewritten"}})
+			return nil
+		},
+	}
+	h := newTestHandlers(mock)
+	h.pool.BackupDir = t.TempDir()
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing.go")
+	created := filepath.Join(dir, "created.go")
+	if err := os.WriteFile(existing, []byte("original"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, out, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Tasks: []TaskSpec{
+			{SystemPrompt: "sys", Prompt: "p", InputFile: existing, OutputFile: existing, Tag: "edit"},
+			{SystemPrompt: "sys", Prompt: "p", OutputFile: created, Tag: "edit"},
+			{SystemPrompt: "sys", Prompt: "p", Tag: "edit"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, id := range out.TaskIDs {
+		waitForStatus(t, h.store, id, 2*time.Second, "completed")
+	}
+	if data, _ := os.ReadFile(existing); string(data) != "rewritten" {
+		t.Fatalf("expected rewritten file, got %q", data)
+	}
+
+	_, undo, err := h.handleUndoTasks(context.Background(), nil, UndoTasksArgs{Tag: "edit"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if undo.Restored != 2 || len(undo.Results) != 2 {
+		t.Fatalf("expected 2 files undone and the no-output task left out, got %+v", undo)
+	}
+	if undo.Results[0].Action != "restored" || undo.Results[1].Action != "removed" {
+		t.Fatalf("unexpected actions: %+v", undo.Results)
+	}
+	data, _ := os.ReadFile(existing)
+	if string(data) != "original" {
+		t.Fatalf("expected original contents restored, got %q", data)
+	}
+	if info, _ := os.Stat(existing); info.Mode().Perm() != 0600 {
+		t.Fatalf("expected original mode 0600 preserved, got %v", info.Mode().Perm())
+	}
+	if _, err := os.Stat(created); !os.IsNotExist(err) {
+		t.Fatal("expected file that didn't exist before to be removed")
+	}
+
+	// Undoing again is a no-op
+	_, undo, _ = h.handleUndoTasks(context.Background(), nil, UndoTasksArgs{TaskIDs: out.TaskIDs[:1]})
+	if undo.Restored != 0 || undo.Results[0].Action != "skipped" || undo.Results[0].Error != "already undone" {
+		t.Fatalf("expected second undo to be skipped, got %+v", undo)
+	}
+	_, check, _ := h.handleCheckTasks(context.Background(), nil, CheckTasksArgs{TaskIDs: out.TaskIDs[:1]})
+	if !check.Tasks[0].Undone {
+		t.Fatal("expected check_tasks to report the task as undone")
+	}
+}
+
+func TestHandleUndoTasksSameFileRestoresEarliestOriginal(t *testing.T) {
+	var mu sync.Mutex
+	n := 0
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			mu.Lock()
+			n++
+			content := fmt.Sprintf("pass %d", n)
+			mu.Unlock()
+			fn(api.ChatResponse{Message: api.Message{Content: content}})
+			return nil
+		},
+	}
+	h := newTestHandlers(mock)
+	h.pool.BackupDir = t.TempDir()
+	path := filepath.Join(t.TempDir(), "f.go")
+	os.WriteFile(path, []byte("original"), 0644)
+
+	// Two chained passes over the same file
+	_, out, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Tasks: []TaskSpec{
+			{SystemPrompt: "sys", Prompt: "p", InputFile: path, OutputFile: path},
+			{SystemPrompt: "sys", Prompt: "p", InputFile: path, OutputFile: path, DependsOn: []string{"0"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitForStatus(t, h.store, out.TaskIDs[1], 2*time.Second, "completed")
+
+	_, undo, _ := h.handleUndoTasks(context.Background(), nil, UndoTasksArgs{TaskIDs: out.TaskIDs})
+	if undo.Restored != 2 {
+		t.Fatalf("expected both tasks undone, got %+v", undo)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "original" {
+		t.Fatalf("expected the pre-batch original, got %q", data)
+	}
+}
+
+func TestHandleUndoTasksSkipsRunning(t *testing.T) {
+	h := newTestHandlers(&mockOllamaClient{})
+	h.store.Add([]*Task{makeTask("r", "", "pending")})
+	h.store.SetRunning("r")
+
+	_, undo, _ := h.handleUndoTasks(context.Background(), nil, UndoTasksArgs{TaskIDs: []string{"r", "missing"}})
+	if undo.Restored != 0 || undo.Results[0].Action != "skipped" || !strings.Contains(undo.Results[0].Error, "running") {
+		t.Fatalf("expected running task to be skipped, got %+v", undo.Results)
+	}
+	if len(undo.Results) != 1 {
+		t.Fatalf("unknown IDs should not be reported, got %+v", undo.Results)
+	}
+}
+
+func TestHandleUndoTasksPrunedBackup(t *testing.T) {
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			fn(api.ChatResponse{Message: api.Message{Content: "rewritten"}})
+			return nil
+		},
+	}
+	h := newTestHandlers(mock)
+	h.pool.BackupDir = t.TempDir()
+	h.pool.BackupRetention = 1
+	dir := t.TempDir()
+	var specs []TaskSpec
+	for i := range 3 {
+		path := filepath.Join(dir, fmt.Sprintf("f%d.go", i))
+		if err := os.WriteFile(path, []byte("original"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		spec := TaskSpec{SystemPrompt: "sys", Prompt: "p", OutputFile: path}
+		if i > 0 {
+			spec.DependsOn = []string{fmt.Sprint(i - 1)}
+		}
+		specs = append(specs, spec)
+	}
+
+	_, out, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{Tasks: specs})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitForStatus(t, h.store, out.TaskIDs[2], 2*time.Second, "completed")
+
+	// When the third task backed up its file, only the most recently
+	// finished task kept its backup.
+	entries, _ := os.ReadDir(h.pool.BackupDir)
+	if len(entries) != 2 {
+		t.Fatalf("expected the oldest backup to be pruned, got %d backups", len(entries))
+	}
+	_, undo, _ := h.handleUndoTasks(context.Background(), nil, UndoTasksArgs{TaskIDs: out.TaskIDs})
+	if undo.Restored != 2 || undo.Results[0].Action != "skipped" || !strings.Contains(undo.Results[0].Error, "pruned") {
+		t.Fatalf("expected the pruned task to be skipped and the others restored, got %+v", undo.Results)
+	}
+}
+
+func TestHandleApplyStaged(t *testing.T) {
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			// Echo the input so the second pass shows which file it read
+			fn(api.ChatResponse{Message: api.Message{Content: req.Messages[1].Content + "+"}})
+			return nil
+		},
+	}
+	h := newTestHandlers(mock)
+	h.pool.BackupDir = t.TempDir()
+	h.pool.StagingDir = t.TempDir()
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.go")
+	if err := os.WriteFile(file, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, out, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Staging: true,
+		Tasks: []TaskSpec{
+			{SystemPrompt: "sys", Prompt: "p", InputFile: file, OutputFile: file, Tag: "edit", PostWriteCmd: "echo formatted >> " + file},
+			{SystemPrompt: "sys", Prompt: "q", InputFile: file, OutputFile: file, Tag: "edit", DependsOn: []string{"0"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, id := range out.TaskIDs {
+		waitForStatus(t, h.store, id, 2*time.Second, "completed")
+	}
+	if data, _ := os.ReadFile(file); string(data) != "original" {
+		t.Fatalf("expected real file untouched while staged, got %q", data)
+	}
+	_, check, _ := h.handleCheckTasks(context.Background(), nil, CheckTasksArgs{Tag: "edit"})
+	staged := check.Tasks[0].StagedFile
+	if check.Tasks[0].Staging != "staged" || staged != filepath.Join(h.pool.StagingDir, "local", "tag_edit", file) {
+		t.Fatalf("unexpected staging status: %+v", check.Tasks[0])
+	}
+	// The second pass read the first pass's staged output, and post_write_cmd
+	// ran against the staged copy.
+	want := "q\n\np\n\noriginal+formatted\n+"
+	if data, _ := os.ReadFile(staged); string(data) != want {
+		t.Fatalf("expected staged content %q, got %q", want, data)
+	}
+
+	_, applied, err := h.handleApplyStaged(context.Background(), nil, ApplyStagedArgs{Tag: "edit"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if applied.Applied != 2 || applied.Results[0].Action != "applied" || applied.Results[1].Action != "applied" {
+		t.Fatalf("expected both tasks applied, got %+v", applied)
+	}
+	if data, _ := os.ReadFile(file); string(data) != want {
+		t.Fatalf("expected staged content promoted, got %q", data)
+	}
+	if _, err := os.Stat(staged); !os.IsNotExist(err) {
+		t.Fatal("expected staged file removed after apply")
+	}
+
+	// Applying again is a no-op; undo restores the pre-apply original
+	_, applied, _ = h.handleApplyStaged(context.Background(), nil, ApplyStagedArgs{TaskIDs: out.TaskIDs[:1]})
+	if applied.Applied != 0 || applied.Results[0].Error != "already applied" {
+		t.Fatalf("expected second apply to be skipped, got %+v", applied)
+	}
+	_, undo, _ := h.handleUndoTasks(context.Background(), nil, UndoTasksArgs{Tag: "edit"})
+	if undo.Restored != 1 {
+		t.Fatalf("expected one restore, got %+v", undo)
+	}
+	if data, _ := os.ReadFile(file); string(data) != "original" {
+		t.Fatalf("expected original restored by undo, got %q", data)
+	}
+}
+
+func TestHandleApplyStagedAllOrNothing(t *testing.T) {
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			fn(api.ChatResponse{Message: api.Message{Content: "new"}})
+			return nil
+		},
+	}
+	h := newTestHandlers(mock)
+	h.pool.BackupDir = t.TempDir()
+	h.pool.StagingDir = t.TempDir()
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.go")
+	bad := filepath.Join(dir, "missing", "bad.go") // destination directory doesn't exist
+
+	_, out, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Staging: true,
+		Tasks: []TaskSpec{
+			{SystemPrompt: "sys", Prompt: "p", OutputFile: good, Tag: "b"},
+			{SystemPrompt: "sys", Prompt: "p", OutputFile: bad, Tag: "b"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, id := range out.TaskIDs {
+		waitForStatus(t, h.store, id, 2*time.Second, "completed")
+	}
+
+	if _, _, err := h.handleApplyStaged(context.Background(), nil, ApplyStagedArgs{Tag: "b"}); err == nil {
+		t.Fatal("expected apply to fail")
+	}
+	if _, err := os.Stat(good); !os.IsNotExist(err) {
+		t.Fatal("expected no file applied when one destination can't be prepared")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("expected temp files cleaned up, got %v", entries)
+	}
+	_, check, _ := h.handleCheckTasks(context.Background(), nil, CheckTasksArgs{Tag: "b"})
+	if check.Tasks[0].Staging != "staged" {
+		t.Fatalf("expected task still staged, got %q", check.Tasks[0].Staging)
+	}
+}
+
+func TestHandleApplyStagedRollsBack(t *testing.T) {
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			fn(api.ChatResponse{Message: api.Message{Content: "new"}})
+			return nil
+		},
+	}
+	h := newTestHandlers(mock)
+	h.pool.BackupDir = t.TempDir()
+	h.pool.StagingDir = t.TempDir()
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.go")
+	second := filepath.Join(dir, "second.go")
+	for _, f := range []string{first, second} {
+		if err := os.WriteFile(f, []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, out, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Staging: true,
+		Tasks: []TaskSpec{
+			{SystemPrompt: "sys", Prompt: "p", OutputFile: first, Tag: "b"},
+			{SystemPrompt: "sys", Prompt: "p", OutputFile: second, Tag: "b"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, id := range out.TaskIDs {
+		waitForStatus(t, h.store, id, 2*time.Second, "completed")
+	}
+	// A directory where the second file's backup should go makes the
+	// backup fail after the first file was already promoted
+	if err := os.Mkdir(filepath.Join(h.pool.BackupDir, out.TaskIDs[1]), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = h.handleApplyStaged(context.Background(), nil, ApplyStagedArgs{Tag: "b"})
+	if err == nil || !strings.HasPrefix(err.Error(), "nothing was applied: applying "+second) {
+		t.Fatalf("expected the failed promotion to be reported, got %v", err)
+	}
+	for _, f := range []string{first, second} {
+		if data, _ := os.ReadFile(f); string(data) != "old" {
+			t.Fatalf("expected %s rolled back, got %q", f, data)
+		}
+	}
+	_, check, _ := h.handleCheckTasks(context.Background(), nil, CheckTasksArgs{Tag: "b"})
+	for _, task := range check.Tasks {
+		if task.Staging != "staged" {
+			t.Fatalf("expected every task still staged, got %+v", task)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Fatalf("expected temp files cleaned up, got %v", entries)
+	}
+}
+
+func TestHandleDiscardStaged(t *testing.T) {
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			fn(api.ChatResponse{Message: api.Message{Content: "new"}})
+			return nil
+		},
+	}
+	h := newTestHandlers(mock)
+	h.pool.StagingDir = t.TempDir()
+	file := filepath.Join(t.TempDir(), "a.go")
+
+	_, out, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Staging: true,
+		Tasks:   []TaskSpec{{SystemPrompt: "sys", Prompt: "p", OutputFile: file}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitForStatus(t, h.store, out.TaskIDs[0], 2*time.Second, "completed")
+
+	_, discarded, _ := h.handleDiscardStaged(context.Background(), nil, DiscardStagedArgs{})
+	if discarded.Discarded != 1 {
+		t.Fatalf("expected one file discarded, got %+v", discarded)
+	}
+	if _, err := os.Stat(discarded.Results[0].StagedFile); !os.IsNotExist(err) {
+		t.Fatal("expected staged file deleted")
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatal("expected real file never written")
+	}
+	_, applied, _ := h.handleApplyStaged(context.Background(), nil, ApplyStagedArgs{TaskIDs: out.TaskIDs})
+	if applied.Applied != 0 || applied.Results[0].Error != "already discarded" {
+		t.Fatalf("expected discarded task to be skipped by apply, got %+v", applied)
+	}
+}
+
+func TestHandleSubmitTasksStagedCommandMustNameOutputFile(t *testing.T) {
+	h := newTestHandlers(&mockOllamaClient{})
+	h.pool.StagingDir = t.TempDir()
+	file := filepath.Join(t.TempDir(), "a.go")
+
+	for _, spec := range []TaskSpec{
+		{SystemPrompt: "sys", Prompt: "p", OutputFile: file, ValidateCmd: "go build ./..."},
+		{SystemPrompt: "sys", Prompt: "p", OutputFile: file, PostWriteCmd: "gofmt -w " + file + ".bak"},
+		{SystemPrompt: "sys", Prompt: "p", PostWriteCmd: "gofmt -w ."},
+	} {
+		_, _, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{Staging: true, Tasks: []TaskSpec{spec}})
+		if err == nil || !strings.Contains(err.Error(), "must name output_file") {
+			t.Fatalf("expected %+v to be rejected, got %v", spec, err)
+		}
+	}
+
+	// Without staging the commands run as written
+	_, out, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Tasks: []TaskSpec{{SystemPrompt: "sys", Prompt: "p", OutputFile: file, ValidateCmd: "go build ./..."}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	h.store.Cancel(out.TaskIDs, "", "")
+}
+
+func TestStagedPathPerSession(t *testing.T) {
+	p := &WorkerPool{StagingDir: "/staging"}
+	a, err := p.stagedPath("s1", "edit", "/repo/a.go")
+	if err != nil || a != "/staging/session_s1/tag_edit/repo/a.go" {
+		t.Fatalf("expected session s1's tree, got %q, %v", a, err)
+	}
+	if b, _ := p.stagedPath("s2", "edit", "/repo/a.go"); b == a {
+		t.Fatalf("expected sessions with the same tag to get different staged paths, both got %q", a)
+	}
+	for _, path := range []string{"/../../etc/passwd", "/../tag_other/repo/a.go", "/.."} {
+		if staged, err := p.stagedPath("s1", "edit", path); err == nil {
+			t.Errorf("expected %q to be rejected, got %q", path, staged)
+		}
+	}
+}
+
+func TestHandleSubmitTasksStagedPathEscape(t *testing.T) {
+	h := newTestHandlers(&mockOllamaClient{})
+	h.pool.StagingDir = t.TempDir()
+	valid := TaskSpec{SystemPrompt: "sys", Prompt: "p", OutputFile: "/repo/a.go"}
+	_, _, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Staging: true,
+		Tasks:   []TaskSpec{valid, {SystemPrompt: "sys", Prompt: "p", OutputFile: "/../../../etc/cron.d/x"}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "task 1: output_file") || !strings.Contains(err.Error(), "outside the staging tree") {
+		t.Fatalf("expected escaping output_file to be rejected, got %v", err)
+	}
+	_, _, err = h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Staging: true,
+		Tasks:   []TaskSpec{valid},
+		Reduce:  &ReduceSpec{Prompt: "sum up", OutputFile: "/../../x"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "reduce: output_file") {
+		t.Fatalf("expected escaping reduce output_file to be rejected, got %v", err)
+	}
+	if tasks := h.store.List(nil, "", ""); len(tasks) != 0 {
+		t.Fatalf("expected no tasks created, got %d", len(tasks))
+	}
+}
+
+func TestStagedCommandRewritesWholePaths(t *testing.T) {
+	task := &Task{OutputFile: "/repo/a.go", StagedFile: "/staging/repo/a.go"}
+	got := stagedCommand(task, "gofmt -w '/repo/a.go' && cp /repo/a.go /repo/a.go.bak && cat /x/repo/a.go")
+	want := "gofmt -w '/staging/repo/a.go' && cp /staging/repo/a.go /repo/a.go.bak && cat /x/repo/a.go"
+	if got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestHandleSubmitTasksOutputModeValidation(t *testing.T) {
+	h := newTestHandlers(&mockOllamaClient{})
+	tests := []struct {
+		name    string
+		spec    TaskSpec
+		wantErr string
+	}{
+		{"unknown mode", TaskSpec{SystemPrompt: "s", Prompt: "p", OutputMode: "patch"}, `unknown output_mode "patch"`},
+		{"missing input_file", TaskSpec{SystemPrompt: "s", Prompt: "p", OutputFile: "/tmp/out", OutputMode: "unified_diff"}, "requires input_file and output_file"},
+		{"missing output_file", TaskSpec{SystemPrompt: "s", Prompt: "p", InputFile: "/tmp/in", OutputMode: "search_replace"}, "requires input_file and output_file"},
+		{"json output", TaskSpec{SystemPrompt: "s", Prompt: "p", InputFile: "/tmp/in", OutputFile: "/tmp/out", OutputMode: "unified_diff", ResponseHint: "json"}, "can't be combined with json output"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{Tasks: []TaskSpec{tt.spec}})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestHandleGetResultIncludeDiff(t *testing.T) {
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			fn(api.ChatResponse{Message: api.Message{Content: "one\nTWO\nthree\nfour"}})
+			return nil
+		},
+	}
+	h := newTestHandlers(mock)
+	h.pool.BackupDir = t.TempDir()
+	file := filepath.Join(t.TempDir(), "f.txt")
+	if err := os.WriteFile(file, []byte("one\ntwo\nthree\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, out, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Tasks: []TaskSpec{
+			{SystemPrompt: "sys", Prompt: "p", OutputFile: file},
+			{SystemPrompt: "sys", Prompt: "p"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, id := range out.TaskIDs {
+		waitForStatus(t, h.store, id, 2*time.Second, "completed")
+	}
+
+	_, check, _ := h.handleCheckTasks(context.Background(), nil, CheckTasksArgs{TaskIDs: out.TaskIDs[:1]})
+	if check.Tasks[0].LinesAdded != 2 || check.Tasks[0].LinesRemoved != 1 {
+		t.Fatalf("expected diff stat +2 -1, got %+v", check.Tasks[0])
+	}
+
+	_, res, _ := h.handleGetResult(context.Background(), nil, GetResultArgs{TaskIDs: out.TaskIDs, IncludeDiff: true})
+	want := "--- a" + file + "\n+++ b" + file + "\n@@ -1,3 +1,4 @@\n one\n-two\n+TWO\n three\n+four\n"
+	if res.Results[0].Diff != want {
+		t.Fatalf("unexpected diff:\n%s", res.Results[0].Diff)
+	}
+	if res.Results[1].Diff != "" || res.Results[1].DiffError != "" {
+		t.Fatalf("expected no diff for a task without output_file, got %+v", res.Results[1])
+	}
+
+	// The diff is what the task wrote, not what the file holds after a
+	// later edit
+	if err := os.WriteFile(file, []byte("edited by hand\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, res, _ = h.handleGetResult(context.Background(), nil, GetResultArgs{TaskIDs: out.TaskIDs[:1], IncludeDiff: true})
+	if res.Results[0].Diff != want {
+		t.Fatalf("expected the diff recorded at completion after a later edit, got:\n%s", res.Results[0].Diff)
+	}
+
+	// Without include_diff, no diff is returned
+	_, res, _ = h.handleGetResult(context.Background(), nil, GetResultArgs{TaskIDs: out.TaskIDs[:1]})
+	if res.Results[0].Diff != "" {
+		t.Fatal("expected no diff without include_diff")
+	}
+
+	// Once undone there is nothing to diff against
+	h.handleUndoTasks(context.Background(), nil, UndoTasksArgs{TaskIDs: out.TaskIDs[:1]})
+	_, res, _ = h.handleGetResult(context.Background(), nil, GetResultArgs{TaskIDs: out.TaskIDs[:1], IncludeDiff: true})
+	if res.Results[0].DiffError != "output was undone" {
+		t.Fatalf("expected diff error after undo, got %+v", res.Results[0])
+	}
+}
+
+func TestHandleSubmitTasksInputGlob(t *testing.T) {
+	// Task 0 never finishes, so the expanded tasks stay blocked and their
+	// prompts can be inspected.
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+	h := newTestHandlers(mock)
+	root := t.TempDir()
+	for _, f := range []string{"a.go", "a_test.go", "pkg/b.go", "pkg/notes.txt", "vendor/c.go"} {
+		path := filepath.Join(root, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, out, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Tasks: []TaskSpec{
+			{SystemPrompt: "s", Prompt: "write the interface", Tag: "gen"},
+			{
+				SystemPrompt: "s",
+				Prompt:       "Write tests for {{name}} using {{result:0}}",
+				InputGlob:    root + "/**/*.go",
+				Exclude:      []string{"*_test.go", "vendor"},
+				OutputFile:   "{{dir}}/{{stem}}_test{{ext}}",
+				Tag:          "gen",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(out.TaskIDs) != 3 || len(out.Expanded) != 2 {
+		t.Fatalf("expected 1 + 2 expanded tasks, got %+v", out)
+	}
+	wantFiles := [][2]string{
+		{filepath.Join(root, "a.go"), filepath.Join(root, "a_test.go")},
+		{filepath.Join(root, "pkg/b.go"), filepath.Join(root, "pkg/b_test.go")},
+	}
+	for i, e := range out.Expanded {
+		if e.ID != out.TaskIDs[i+1] || e.InputFile != wantFiles[i][0] || e.OutputFile != wantFiles[i][1] {
+			t.Fatalf("unexpected expansion %d: %+v", i, e)
+		}
+		task := h.store.Get(e.ID)
+		if task.Prompt != "Write tests for "+filepath.Base(e.InputFile)+" using {{result:"+out.TaskIDs[0]+"}}" {
+			t.Fatalf("expected templated prompt with remapped reference, got %q", task.Prompt)
+		}
+		if len(task.DependsOn) != 1 || task.DependsOn[0] != out.TaskIDs[0] {
+			t.Fatalf("expected dependency on task 0, got %v", task.DependsOn)
+		}
+	}
+	h.handleCancelTasks(context.Background(), nil, CancelTasksArgs{Tag: "gen"})
+}
+
+func TestHandleSubmitTasksInputGlobErrors(t *testing.T) {
+	h := newTestHandlers(&mockOllamaClient{})
+	root := t.TempDir()
+	for _, name := range []string{"a.go", "b.go"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		specs   []TaskSpec
+		wantErr string
+	}{
+		{"no matches", []TaskSpec{{SystemPrompt: "s", Prompt: "p", InputGlob: root + "/*.rs"}}, "matched no files"},
+		{"relative", []TaskSpec{{SystemPrompt: "s", Prompt: "p", InputGlob: "*.go"}}, "must be an absolute path"},
+		{"with input_file", []TaskSpec{{SystemPrompt: "s", Prompt: "p", InputGlob: root, InputFile: "/x"}}, "mutually exclusive"},
+		{"index reference to glob", []TaskSpec{
+			{SystemPrompt: "s", Prompt: "p", InputGlob: root},
+			{SystemPrompt: "s", Prompt: "p", DependsOn: []string{"0"}},
+		}, "task 1: cannot reference task 0 by index"},
+		{"fixed output_file", []TaskSpec{{SystemPrompt: "s", Prompt: "p", InputGlob: root + "/*.go", OutputFile: "/out/summary.md"}}, "the same output file /out/summary.md"},
+		{"output_file placeholders collide", []TaskSpec{{SystemPrompt: "s", Prompt: "p", InputGlob: root + "/*.go", OutputFile: "/out/x{{ext}}"}}, "the same output file /out/x.go"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{Tasks: tt.specs})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+	if tasks := h.store.List(nil, "", ""); len(tasks) != 0 {
+		t.Fatalf("expected no tasks created, got %d", len(tasks))
+	}
+
+	// A glob matching one file may write a fixed output_file
+	_, out, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Tasks: []TaskSpec{{SystemPrompt: "s", Prompt: "p", InputGlob: root + "/a.go", OutputFile: filepath.Join(t.TempDir(), "summary.md")}},
+	})
+	if err != nil || len(out.TaskIDs) != 1 {
+		t.Fatalf("expected a single-file glob with a fixed output_file to be accepted, got %+v, %v", out, err)
+	}
+	h.store.Cancel(out.TaskIDs, "", "")
+
+	// The limit is checked on the match count, before building tasks
+	_, _, err = expandInputGlobs([]TaskSpec{{Prompt: "p"}, {Prompt: "p", InputGlob: root}}, 2)
+	if err == nil || !strings.Contains(err.Error(), "input_glob expands to 3 tasks, exceeding the maximum of 2") {
+		t.Fatalf("expected the batch limit error, got %v", err)
+	}
+}
+
+func TestHandleSubmitTasksReduce(t *testing.T) {
+	var mu sync.Mutex
+	var reducePrompt string
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			user := req.Messages[1].Content
+			switch {
+			case req.Messages[0].Content == "reducer":
+				mu.Lock()
+				reducePrompt = user
+				mu.Unlock()
+				fn(api.ChatResponse{Message: api.Message{Content: "overview"}})
+			case strings.Contains(user, "broken"):
+				return fmt.Errorf("model not found")
+			default:
+				fn(api.ChatResponse{Message: api.Message{Content: "summary of " + user}})
+			}
+			return nil
+		},
+	}
+	h := newTestHandlers(mock)
+	input := filepath.Join(t.TempDir(), "a.go")
+	if err := os.WriteFile(input, []byte("package a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, out, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Tasks: []TaskSpec{
+			{SystemPrompt: "sys", Prompt: "a", Tag: "map", InputFile: input},
+			{SystemPrompt: "sys", Prompt: "broken", Tag: "map"},
+			{SystemPrompt: "sys", Prompt: "c", Tag: "map"},
+		},
+		Reduce: &ReduceSpec{SystemPrompt: "reducer", Prompt: "Combine these."},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.ReduceTaskID == "" || len(out.TaskIDs) != 3 {
+		t.Fatalf("expected 3 task IDs and a reduce task ID, got %+v", out)
+	}
+	if task := h.store.Get(out.ReduceTaskID); task.Tag != "map" {
+		t.Fatalf("expected the reduce task to inherit the batch tag, got %q", task.Tag)
+	}
+
+	waitForStatus(t, h.store, out.ReduceTaskID, 2*time.Second, "completed", "failed")
+	result := h.store.Results([]string{out.ReduceTaskID}, "")[0]
+	if result.Status != "completed" || result.Content != "overview" {
+		t.Fatalf("expected the reduce task to complete with the combined result, got %+v", result)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, want := range []string{"Combine these.", "1 of 3 inputs failed", "### Result for " + input + "\nsummary of a", "### Result for task " + out.TaskIDs[2] + "\nsummary of c"} {
+		if !strings.Contains(reducePrompt, want) {
+			t.Fatalf("expected reduce prompt to contain %q, got:\n%s", want, reducePrompt)
+		}
+	}
+	if strings.Contains(reducePrompt, "broken") {
+		t.Fatalf("expected the failed task to be left out, got:\n%s", reducePrompt)
+	}
+}
+
+func TestHandleSubmitTasksReduceHierarchical(t *testing.T) {
+	var mu sync.Mutex
+	var partialCalls, finalCalls int
+	var finalPrompt string
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			user := req.Messages[1].Content
+			if req.Messages[0].Content != "reducer" {
+				fn(api.ChatResponse{Message: api.Message{Content: strings.Repeat(user, 1500)}})
+				return nil
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if strings.Contains(user, "This is group") {
+				partialCalls++
+				fn(api.ChatResponse{Message: api.Message{Content: "partial"}})
+			} else {
+				finalCalls++
+				finalPrompt = user
+				fn(api.ChatResponse{Message: api.Message{Content: "overview"}})
+			}
+			return nil
+		},
+	}
+	h := newTestHandlers(mock)
+
+	var specs []TaskSpec
+	for _, p := range []string{"a", "b", "c", "d"} {
+		specs = append(specs, TaskSpec{SystemPrompt: "sys", Prompt: p})
+	}
+	_, out, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Tasks:  specs,
+		Reduce: &ReduceSpec{SystemPrompt: "reducer", Prompt: "Combine these.", Options: map[string]any{"num_ctx": float64(1024)}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	waitForStatus(t, h.store, out.ReduceTaskID, 2*time.Second, "completed", "failed")
+	if result := h.store.Results([]string{out.ReduceTaskID}, "")[0]; result.Content != "overview" {
+		t.Fatalf("expected the final reduce result, got %+v", result)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// Each 1500-character result fills most of a 1024-token window, so each
+	// is reduced on its own before the partial results are combined.
+	if partialCalls != 4 || finalCalls != 1 {
+		t.Fatalf("expected 4 partial reduces and 1 final, got %d and %d", partialCalls, finalCalls)
+	}
+	if !strings.Contains(finalPrompt, "### Partial result 4 of 4\npartial") {
+		t.Fatalf("expected the final prompt to combine the partial results, got:\n%s", finalPrompt)
+	}
+}
+
+func TestHandleSubmitTasksReduceValidation(t *testing.T) {
+	h := newTestHandlers(&mockOllamaClient{})
+	tests := []struct {
+		name    string
+		args    SubmitTasksArgs
+		wantErr string
+	}{
+		{"no tasks", SubmitTasksArgs{Reduce: &ReduceSpec{Prompt: "p"}}, "at least one task"},
+		{"no prompt", SubmitTasksArgs{Tasks: []TaskSpec{{Prompt: "p"}}, Reduce: &ReduceSpec{}}, "reduce: prompt is required"},
+		{"relative output", SubmitTasksArgs{Tasks: []TaskSpec{{Prompt: "p"}}, Reduce: &ReduceSpec{Prompt: "p", OutputFile: "out.md"}}, "reduce: output_file must be an absolute path"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := h.handleSubmitTasks(context.Background(), nil, tt.args)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestHandleSubmitTasksProgressNotifications(t *testing.T) {
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			if req.Messages[1].Content == "broken" {
+				return fmt.Errorf("model not found")
+			}
+			fn(api.ChatResponse{Message: api.Message{Content: "ok"}})
+			return nil
+		},
+	}
+	h := newTestHandlers(mock)
+
+	// Connect a real client so notifications travel over a session
+	server := mcp.NewServer(&mcp.Implementation{Name: "test"}, nil)
+	mcp.AddTool(server, &mcp.Tool{Name: "submit_tasks"}, h.handleSubmitTasks)
+	var mu sync.Mutex
+	var notes []*mcp.ProgressNotificationParams
+	done := make(chan struct{})
+	client := mcp.NewClient(&mcp.Implementation{Name: "test-client"}, &mcp.ClientOptions{
+		ProgressNotificationHandler: func(ctx context.Context, req *mcp.ProgressNotificationClientRequest) {
+			mu.Lock()
+			defer mu.Unlock()
+			notes = append(notes, req.Params)
+			if strings.Contains(req.Params.Message, "; batch done") {
+				close(done)
+			}
+		},
+	})
+	ctx := context.Background()
+	serverTransport, clientTransport := mcp.NewInMemoryTransports()
+	if _, err := server.Connect(ctx, serverTransport, nil); err != nil {
+		t.Fatal(err)
+	}
+	session, err := client.Connect(ctx, clientTransport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	params := &mcp.CallToolParams{
+		Meta: mcp.Meta{"progressToken": "batch-1"},
+		Name: "submit_tasks",
+		Arguments: SubmitTasksArgs{Wait: true, Tasks: []TaskSpec{
+			{SystemPrompt: "sys", Prompt: "ok", Tag: "t"},
+			{SystemPrompt: "sys", Prompt: "broken", Tag: "t"},
+		}},
+	}
+	res, err := session.CallTool(ctx, params)
+	if err != nil || res.IsError {
+		t.Fatalf("submit_tasks failed: %v %+v", err, res)
+	}
+
+	// The call returned only once the batch had finished
+	var out SubmitTasksOutput
+	data, _ := json.Marshal(res.StructuredContent)
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !out.Finished || out.Summary == nil || out.Summary.Completed != 1 || out.Summary.Failed != 1 {
+		t.Fatalf("expected a finished batch summary, got %+v", out)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the batch done notification")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	var started, completed, failed int
+	for i, n := range notes {
+		if n.ProgressToken != "batch-1" || n.Total != 2 {
+			t.Fatalf("unexpected notification %+v", n)
+		}
+		// The spec requires progress to increase with every notification
+		if i > 0 && n.Progress <= notes[i-1].Progress {
+			t.Fatalf("progress didn't increase: %v after %v", n.Progress, notes[i-1].Progress)
+		}
+		message, _, _ := strings.Cut(n.Message, "; batch done")
+		switch {
+		case strings.HasSuffix(message, " started"):
+			started++
+		case strings.HasSuffix(message, " completed"):
+			completed++
+		case strings.Contains(message, " failed: model not found"):
+			failed++
+		}
+	}
+	last := notes[len(notes)-1]
+	if started != 2 || completed != 1 || failed != 1 || last.Progress != 2 ||
+		!strings.HasSuffix(last.Message, "; batch done: 1 completed, 1 failed, 0 cancelled") {
+		t.Fatalf("unexpected notifications: %d started, %d completed, %d failed, last %+v", started, completed, failed, last)
+	}
+}
+
+func TestHandleSubmitTasksWaitStopsWhenCancelled(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			<-release
+			fn(api.ChatResponse{Message: api.Message{Content: "ok"}})
+			return nil
+		},
+	}
+	h := newTestHandlers(mock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, out, err := h.handleSubmitTasks(ctx, nil, SubmitTasksArgs{
+		Wait:  true,
+		Tasks: []TaskSpec{{SystemPrompt: "sys", Prompt: "p"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Finished || out.Summary == nil || out.Summary.Running != 1 {
+		t.Fatalf("expected an unfinished batch with its task still running, got %+v", out)
+	}
+	h.store.mu.Lock()
+	watches := len(h.store.watches)
+	h.store.mu.Unlock()
+	if watches != 0 {
+		t.Fatalf("expected the batch watch to be removed, got %d watches", watches)
+	}
+}
+
+func TestHandlePeekTask(t *testing.T) {
+	streamed := make(chan struct{})
+	release := make(chan struct{})
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			for _, chunk := range []string{"func ", "a() ", "{}\n", "// héllo"} {
+				fn(api.ChatResponse{Message: api.Message{Content: chunk}})
+				time.Sleep(5 * time.Millisecond)
+			}
+			close(streamed)
+			select {
+			case <-release:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			fn(api.ChatResponse{Done: true, Metrics: api.Metrics{EvalCount: 7}})
+			return nil
+		},
+	}
+	h := newTestHandlers(mock)
+	_, submitted, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Tasks: []TaskSpec{{SystemPrompt: "sys", Prompt: "go"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	id := submitted.TaskIDs[0]
+
+	<-streamed
+	tailChars := 6
+	_, out, err := h.handlePeekTask(context.Background(), nil, PeekTaskArgs{TaskID: id, TailChars: &tailChars})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Status != "running" || out.Call != 1 || out.Tokens != 4 || out.Chars != 20 || out.Tail != " héllo" {
+		t.Fatalf("unexpected live view: %+v", out)
+	}
+	if out.TokensPerSecond <= 0 {
+		t.Fatalf("expected a generation speed, got %+v", out)
+	}
+
+	close(release)
+	waitForStatus(t, h.store, id, 2*time.Second, "completed")
+	_, out, err = h.handlePeekTask(context.Background(), nil, PeekTaskArgs{TaskID: id})
+	if err != nil || out.Status != "completed" || out.Tokens != 0 || out.Tail != "" {
+		t.Fatalf("expected only the status of a finished task, got %+v (%v)", out, err)
+	}
+
+	if _, _, err := h.handlePeekTask(context.Background(), nil, PeekTaskArgs{TaskID: "nope"}); err == nil {
+		t.Fatal("expected an error for an unknown task")
+	}
+	tooMany := maxPeekTailChars + 1
+	if _, _, err := h.handlePeekTask(context.Background(), nil, PeekTaskArgs{TaskID: id, TailChars: &tooMany}); err == nil {
+		t.Fatal("expected an error for tail_chars over the maximum")
+	}
+}
+
+func TestHandleCheckTasksEvalMetrics(t *testing.T) {
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			fn(api.ChatResponse{Message: api.Message{Content: "ok"}})
+			fn(api.ChatResponse{Done: true, Metrics: api.Metrics{
+				PromptEvalCount:    100,
+				EvalCount:          50,
+				LoadDuration:       200 * time.Millisecond,
+				PromptEvalDuration: 100 * time.Millisecond,
+				EvalDuration:       2 * time.Second,
+			}})
+			return nil
+		},
+	}
+	h := newTestHandlers(mock)
+	_, out, err := h.handleSubmitTasks(context.Background(), nil, SubmitTasksArgs{
+		Tasks: []TaskSpec{
+			{SystemPrompt: "sys", Prompt: "a", Model: "small", Tag: "m"},
+			{SystemPrompt: "sys", Prompt: "b", Model: "small", Tag: "m"},
+			{SystemPrompt: "sys", Prompt: "c", Model: "big", Tag: "m"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, id := range out.TaskIDs {
+		waitForStatus(t, h.store, id, 2*time.Second, "completed")
+	}
+
+	_, check, err := h.handleCheckTasks(context.Background(), nil, CheckTasksArgs{Tag: "m"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := EvalMetrics{Calls: 1, PromptEvalCount: 100, MaxPromptEvalCount: 100, EvalCount: 50, LoadMs: 200, PromptEvalMs: 100, EvalMs: 2000, TokensPerSecond: 25}
+	if m := check.Tasks[0].Metrics; m == nil || *m != want {
+		t.Fatalf("expected task metrics %+v, got %+v", want, m)
+	}
+	s := check.Summary
+	if s.PromptEvalCount != 300 || s.EvalCount != 150 || s.EvalSeconds != 6 || len(s.Models) != 2 {
+		t.Fatalf("unexpected summary totals: %+v", s)
+	}
+	wantSmall := ModelMetrics{Model: "small", Tasks: 2, PromptEvalCount: 200, MaxPromptEvalCount: 100, EvalCount: 100, LoadSeconds: 0.4, EvalSeconds: 4, TokensPerSecond: 25}
+	if s.Models[0].Model != "big" || s.Models[1] != wantSmall {
+		t.Fatalf("expected per-model totals sorted by name with small = %+v, got %+v", wantSmall, s.Models)
+	}
+
+	_, results, err := h.handleGetResult(context.Background(), nil, GetResultArgs{TaskIDs: out.TaskIDs[:1]})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m := results.Results[0].Metrics; m == nil || *m != want {
+		t.Fatalf("expected get_result metrics %+v, got %+v", want, m)
+	}
+}
+
+func TestTaskResources(t *testing.T) {
+	release := make(chan struct{})
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			select {
+			case <-release:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			fn(api.ChatResponse{Message: api.Message{Content: "the answer"}})
+			return nil
+		},
+	}
+	h := newTestHandlers(mock)
+
+	server := mcp.NewServer(&mcp.Implementation{Name: "test"}, &mcp.ServerOptions{
+		SubscribeHandler:   acceptSubscription,
+		UnsubscribeHandler: acceptUnsubscription,
+	})
+	registerResources(server, h)
+	go h.publishResourceUpdates(server)
+	updated := make(chan string, 16)
+	client := mcp.NewClient(&mcp.Implementation{Name: "test-client"}, &mcp.ClientOptions{
+		ResourceUpdatedHandler: func(ctx context.Context, req *mcp.ResourceUpdatedNotificationRequest) {
+			updated <- req.Params.URI
+		},
+	})
+	ctx := context.Background()
+	serverTransport, clientTransport := mcp.NewInMemoryTransports()
+	if _, err := server.Connect(ctx, serverTransport, nil); err != nil {
+		t.Fatal(err)
+	}
+	session, err := client.Connect(ctx, clientTransport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	_, out, err := h.handleSubmitTasks(ctx, nil, SubmitTasksArgs{
+		Tasks: []TaskSpec{{SystemPrompt: "be brief", Prompt: "what is it?", Tag: "res kit"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	id := out.TaskIDs[0]
+	read := func(uri string) (string, error) {
+		res, err := session.ReadResource(ctx, &mcp.ReadResourceParams{URI: uri})
+		if err != nil {
+			return "", err
+		}
+		return res.Contents[0].Text, nil
+	}
+
+	waitForStatus(t, h.store, id, 2*time.Second, "running")
+	prompt, err := read("task://" + id + "/prompt")
+	if err != nil || !strings.Contains(prompt, "be brief") || !strings.Contains(prompt, "what is it?") {
+		t.Fatalf("expected the running task's prompts, got %q (%v)", prompt, err)
+	}
+	if _, err := read("task://" + id + "/result"); err == nil {
+		t.Fatal("expected an error reading the result of a running task")
+	}
+
+	resultURI := "task://" + id + "/result"
+	if err := session.Subscribe(ctx, &mcp.SubscribeParams{URI: resultURI}); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	deadline := time.After(2 * time.Second)
+	for got := ""; got != resultURI; {
+		select {
+		case got = <-updated:
+		case <-deadline:
+			t.Fatal("timed out waiting for a resources/updated notification")
+		}
+	}
+	waitForStatus(t, h.store, id, 2*time.Second, "completed")
+
+	if result, err := read(resultURI); err != nil || result != "the answer" {
+		t.Fatalf("expected the task's result, got %q (%v)", result, err)
+	}
+	summary, err := read("tag://res%20kit/summary")
+	if err != nil || !strings.Contains(summary, `"completed": 1`) {
+		t.Fatalf("expected the tag summary, got %q (%v)", summary, err)
+	}
+	if _, err := read("task://" + id + "/prompt"); err == nil {
+		t.Fatal("expected an error reading the prompt of a finished task")
+	}
+	if _, err := read("task://nope/result"); err == nil {
+		t.Fatal("expected an error for an unknown task")
+	}
+}
+
+func TestPromptRecipes(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.go", "b.go", "a_test.go"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("package x\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			<-ctx.Done() // keep the submitted plans from touching the files
+			return ctx.Err()
+		},
+	}
+	h := newTestHandlers(mock)
+	defer h.pool.Shutdown()
+
+	server := mcp.NewServer(&mcp.Implementation{Name: "test"}, nil)
+	registerPrompts(server)
+	client := mcp.NewClient(&mcp.Implementation{Name: "test-client"}, nil)
+	ctx := context.Background()
+	serverTransport, clientTransport := mcp.NewInMemoryTransports()
+	if _, err := server.Connect(ctx, serverTransport, nil); err != nil {
+		t.Fatal(err)
+	}
+	session, err := client.Connect(ctx, clientTransport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	list, err := session.ListPrompts(ctx, nil)
+	if err != nil || len(list.Prompts) != len(recipes) {
+		t.Fatalf("expected %d prompts, got %v (%v)", len(recipes), list, err)
+	}
+
+	glob := filepath.Join(dir, "*.go")
+	cases := map[string]map[string]string{
+		"refactor-files":     {"input_glob": glob, "instruction": "Rename Foo to Bar.", "exclude": "*_test.go"},
+		"summarize-codebase": {"input_glob": glob, "exclude": "*_test.go", "focus": "error handling", "output_file": filepath.Join(dir, "OVERVIEW.md")},
+		"add-struct-tags":    {"input_glob": glob, "tags": "json, yaml", "tag": "tags1"},
+		"generate-tests":     {"input_glob": glob, "validate_cmd": "cd " + dir + " && go vet ./..."},
+	}
+	for name, args := range cases {
+		res, err := session.GetPrompt(ctx, &mcp.GetPromptParams{Name: name, Arguments: args})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		text := res.Messages[0].Content.(*mcp.TextContent).Text
+		start := strings.Index(text, "```json\n")
+		end := strings.Index(text[start+8:], "\n```")
+		if start < 0 || end < 0 {
+			t.Fatalf("%s: no plan in %q", name, text)
+		}
+		var plan SubmitTasksArgs
+		if err := json.Unmarshal([]byte(text[start+8:start+8+end]), &plan); err != nil {
+			t.Fatalf("%s: plan doesn't parse: %v", name, err)
+		}
+		_, out, err := h.handleSubmitTasks(ctx, nil, plan)
+		if err != nil {
+			t.Fatalf("%s: plan rejected by submit_tasks: %v", name, err)
+		}
+		if len(out.Expanded) != 2 {
+			t.Errorf("%s: expected a.go and b.go, got %+v", name, out.Expanded)
+		}
+		if name == "summarize-codebase" && out.ReduceTaskID == "" {
+			t.Errorf("%s: expected a reduce task", name)
+		}
+	}
+
+	bad := []struct {
+		name string
+		args map[string]string
+		want string
+	}{
+		{"refactor-files", map[string]string{"input_glob": glob}, "instruction is required"},
+		{"generate-tests", map[string]string{"input_glob": "src/*.go"}, "must be an absolute path"},
+		{"summarize-codebase", map[string]string{"input_glob": glob, "output_file": "overview.md"}, "must be an absolute path"},
+	}
+	for _, tc := range bad {
+		_, err := session.GetPrompt(ctx, &mcp.GetPromptParams{Name: tc.name, Arguments: tc.args})
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s %v: expected error containing %q, got %v", tc.name, tc.args, tc.want, err)
+		}
+	}
+}
+
+// callTool calls a tool over session and decodes its structured output.
+// A tool error is returned as err.
+func callTool[T any](ctx context.Context, session *mcp.ClientSession, name string, args any) (T, error) {
+	var out T
+	res, err := session.CallTool(ctx, &mcp.CallToolParams{Name: name, Arguments: args})
+	if err != nil {
+		return out, err
+	}
+	if res.IsError {
+		return out, fmt.Errorf("%s: %s", name, res.Content[0].(*mcp.TextContent).Text)
+	}
+	data, err := json.Marshal(res.StructuredContent)
+	if err != nil {
+		return out, err
+	}
+	return out, json.Unmarshal(data, &out)
+}
+
+func TestHTTPTransportSessionIsolation(t *testing.T) {
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+	h := newTestHandlers(mock)
+	defer h.pool.Shutdown()
+	ts := httptest.NewServer(httpHandler(newServer(h), "", 0))
+	defer ts.Close()
+
+	ctx := context.Background()
+	connect := func() *mcp.ClientSession {
+		client := mcp.NewClient(&mcp.Implementation{Name: "test-client"}, nil)
+		session, err := client.Connect(ctx, &mcp.StreamableClientTransport{Endpoint: ts.URL + "/mcp"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return session
+	}
+	owner, other := connect(), connect()
+	defer owner.Close()
+	defer other.Close()
+
+	submitted, err := callTool[SubmitTasksOutput](ctx, owner, "submit_tasks", map[string]any{
+		"tasks": []map[string]any{{"system_prompt": "sys", "prompt": "work", "tag": "shared"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := submitted.TaskIDs[0]
+
+	// The other session sees none of it...
+	checked, err := callTool[CheckTasksOutput](ctx, other, "check_tasks", map[string]any{"tag": "shared"})
+	if err != nil || checked.Summary.Total != 0 {
+		t.Fatalf("expected the other session to see no tasks, got %+v (%v)", checked.Summary, err)
+	}
+	results, err := callTool[GetResultOutput](ctx, other, "get_result", map[string]any{"task_ids": []string{id}})
+	if err != nil || results.Results[0].Status != "not_found" {
+		t.Fatalf("expected the first session's task to be not_found for the other session, got %+v (%v)", results, err)
+	}
+	cancelled, err := callTool[CancelTasksOutput](ctx, other, "cancel_tasks", map[string]any{})
+	if err != nil || cancelled.Cancelled != 0 {
+		t.Fatalf("expected the second session's cancel-all to leave the first session's task alone, got %+v (%v)", cancelled, err)
+	}
+	if undone, err := callTool[UndoTasksOutput](ctx, other, "undo_tasks", map[string]any{}); err != nil || len(undone.Results) != 0 {
+		t.Fatalf("expected the second session's undo-all to match nothing, got %+v (%v)", undone, err)
+	}
+	_, err = callTool[SubmitTasksOutput](ctx, other, "submit_tasks", map[string]any{
+		"tasks": []map[string]any{{"system_prompt": "sys", "prompt": "next", "depends_on": []string{id}}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "unknown task ID") {
+		t.Fatalf("expected the second session's depends_on on the first session's task to be rejected, got %v", err)
+	}
+
+	// ...while the submitting session sees its task running on the shared pool.
+	checked, err = callTool[CheckTasksOutput](ctx, owner, "check_tasks", map[string]any{"tag": "shared"})
+	if err != nil || checked.Summary.Total != 1 || checked.Tasks[0].ID != id {
+		t.Fatalf("expected the owner to see its task, got %+v (%v)", checked, err)
+	}
+}
+
+func TestHTTPTransportReleasesClosedSessions(t *testing.T) {
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			if strings.Contains(req.Messages[1].Content, "block") {
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			fn(api.ChatResponse{Message: api.Message{Content: "staged content"}})
+			return nil
+		},
+	}
+	h := newTestHandlers(mock)
+	defer h.pool.Shutdown()
+	h.pool.StagingDir = t.TempDir()
+	s := newServer(h)
+	releaseClosedSessions(s, h.pool.ReleaseSession)
+	noTimeout := httptest.NewServer(httpHandler(s, "", 0))
+	defer noTimeout.Close()
+	shortTimeout := httptest.NewServer(httpHandler(s, "", 300*time.Millisecond))
+	defer shortTimeout.Close()
+
+	ctx := context.Background()
+	connect := func(ts *httptest.Server) *mcp.ClientSession {
+		client := mcp.NewClient(&mcp.Implementation{Name: "test-client"}, nil)
+		session, err := client.Connect(ctx, &mcp.StreamableClientTransport{Endpoint: ts.URL + "/mcp"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return session
+	}
+	waitGone := func(ids ...string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for _, id := range ids {
+			for h.store.Get(id) != nil {
+				if time.Now().After(deadline) {
+					t.Fatalf("expected task %s to be removed after its session closed", id)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+	file := filepath.Join(t.TempDir(), "a.go")
+
+	// A session that disconnects: its tasks and staging tree go with it.
+	closing := connect(noTimeout)
+	defer closing.Close()
+	submitted, err := callTool[SubmitTasksOutput](ctx, closing, "submit_tasks", map[string]any{
+		"staging": true,
+		"tasks": []map[string]any{
+			{"system_prompt": "sys", "prompt": "write", "output_file": file},
+			{"system_prompt": "sys", "prompt": "block"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	staged, blocked := submitted.TaskIDs[0], submitted.TaskIDs[1]
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		checked, err := callTool[CheckTasksOutput](ctx, closing, "check_tasks", map[string]any{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if checked.Tasks[0].Status == "completed" && checked.Tasks[1].Status == "running" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the staged task to finish, got %+v", checked.Tasks)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sessionDir := h.pool.sessionStagingDir(closing.ID())
+	if _, err := os.Stat(sessionDir); err != nil {
+		t.Fatalf("expected the session's staging tree to exist: %v", err)
+	}
+	closing.Close()
+	waitGone(staged, blocked)
+	if _, err := os.Stat(sessionDir); !os.IsNotExist(err) {
+		t.Fatalf("expected the session's staging tree to be deleted, got %v", err)
+	}
+
+	// A session that goes quiet past the timeout is released the same way.
+	idle := connect(shortTimeout)
+	defer idle.Close()
+	submitted, err = callTool[SubmitTasksOutput](ctx, idle, "submit_tasks", map[string]any{
+		"tasks": []map[string]any{{"system_prompt": "sys", "prompt": "block"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitGone(submitted.TaskIDs[0])
+}
+
+func TestResourceUpdatesOnlyToOwner(t *testing.T) {
+	release := make(chan struct{})
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			select {
+			case <-release:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			fn(api.ChatResponse{Message: api.Message{Content: "done"}})
+			return nil
+		},
+	}
+	h := newTestHandlers(mock)
+	defer h.pool.Shutdown()
+	s := newServer(h)
+	go h.publishResourceUpdates(s)
+	ts := httptest.NewServer(httpHandler(s, "", 0))
+	defer ts.Close()
+
+	ctx := context.Background()
+	const summaryURI = "tag://shared/summary"
+	connect := func(updated chan<- string) *mcp.ClientSession {
+		client := mcp.NewClient(&mcp.Implementation{Name: "test-client"}, &mcp.ClientOptions{
+			ResourceUpdatedHandler: func(ctx context.Context, req *mcp.ResourceUpdatedNotificationRequest) {
+				if _, ok := req.Params.Meta[updateOwnerKey]; ok {
+					t.Errorf("expected the owner key stripped from %+v", req.Params)
+				}
+				updated <- req.Params.URI
+			},
+		})
+		session, err := client.Connect(ctx, &mcp.StreamableClientTransport{Endpoint: ts.URL + "/mcp"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := session.Subscribe(ctx, &mcp.SubscribeParams{URI: summaryURI}); err != nil {
+			t.Fatal(err)
+		}
+		return session
+	}
+	ownerUpdates, otherUpdates := make(chan string, 16), make(chan string, 16)
+	owner, other := connect(ownerUpdates), connect(otherUpdates)
+	defer owner.Close()
+	defer other.Close()
+
+	submitted, err := callTool[SubmitTasksOutput](ctx, owner, "submit_tasks", map[string]any{
+		"tasks": []map[string]any{{"system_prompt": "sys", "prompt": "work", "tag": "shared"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(submitted.TaskIDs) != 1 {
+		t.Fatalf("expected one task, got %+v", submitted)
+	}
+	close(release)
+
+	deadline := time.After(2 * time.Second)
+	for got := ""; got != summaryURI; {
+		select {
+		case got = <-ownerUpdates:
+		case <-deadline:
+			t.Fatal("timed out waiting for the owner's resources/updated notification")
+		}
+	}
+	// Notifications go out in order on one goroutine, so give any stray one
+	// to the other session a moment to arrive.
+	select {
+	case uri := <-otherUpdates:
+		t.Fatalf("expected no notification for another session's task, got %s", uri)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestHTTPTransportGuard(t *testing.T) {
+	h := newTestHandlers(&mockOllamaClient{})
+	defer h.pool.Shutdown()
+
+	cases := []struct {
+		name   string
+		token  string
+		host   string
+		header map[string]string
+		want   int
+	}{
+		{name: "foreign origin", host: "127.0.0.1:11435", header: map[string]string{"Origin": "https://evil.example"}, want: http.StatusForbidden},
+		{name: "foreign origin with token", token: "secret", host: "10.0.0.5:11435", header: map[string]string{"Origin": "https://evil.example", "Authorization": "Bearer secret"}, want: http.StatusForbidden},
+		{name: "rebound host", host: "evil.example:11435", want: http.StatusForbidden},
+		{name: "missing token", token: "secret", host: "10.0.0.5:11435", want: http.StatusUnauthorized},
+		{name: "wrong token", token: "secret", host: "10.0.0.5:11435", header: map[string]string{"Authorization": "Bearer nope"}, want: http.StatusUnauthorized},
+		{name: "loopback", host: "localhost:11435", header: map[string]string{"Origin": "http://localhost:3000"}},
+		{name: "token", token: "secret", host: "10.0.0.5:11435", header: map[string]string{"Authorization": "Bearer secret"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/mcp", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"ping"}`))
+			req.Host = c.host
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Accept", "application/json, text/event-stream")
+			for k, v := range c.header {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			httpHandler(newServer(h), c.token, 0).ServeHTTP(rec, req)
+			if c.want != 0 && rec.Code != c.want {
+				t.Errorf("status = %d, want %d", rec.Code, c.want)
+			}
+			if c.want == 0 && (rec.Code == http.StatusForbidden || rec.Code == http.StatusUnauthorized) {
+				t.Errorf("status = %d, want the request to reach the MCP handler", rec.Code)
+			}
+		})
+	}
+
+	if err := serveHTTP(newServer(h), "0.0.0.0:0", ""); err == nil || !strings.Contains(err.Error(), "HTTP_TOKEN") {
+		t.Errorf("serveHTTP on a non-loopback address without a token: err = %v, want an HTTP_TOKEN error", err)
+	}
+}
@@ -0,0 +1,24 @@
+// undo_tasks.go defines the undo_tasks tool types.
+package main
+
+// UndoTasksArgs is the input for the undo_tasks tool.
+type UndoTasksArgs struct {
+	// TaskIDs undoes specific tasks. If both TaskIDs and Tag are empty,
+	// every task that wrote an output file is undone.
+	TaskIDs []string `json:"task_ids,omitempty" jsonschema:"Specific task IDs whose output files to restore. Empty with no tag undoes all."`
+	Tag     string   `json:"tag,omitempty"      jsonschema:"Undo all tasks with this tag"`
+}
+
+// UndoTasksOutput reports what happened to each matched task's output file.
+type UndoTasksOutput struct {
+	Restored int          `json:"restored"` // files restored or removed
+	Results  []UndoResult `json:"results"`
+}
+
+// UndoResult is the outcome of undoing a single task.
+type UndoResult struct {
+	ID         string `json:"id"`
+	OutputFile string `json:"output_file,omitempty"`
+	Action     string `json:"action"`          // restored, removed (file didn't exist before), skipped, failed
+	Error      string `json:"error,omitempty"` // why the task was skipped or the restore failed
+}
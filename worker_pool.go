@@ -1,10 +1,14 @@
 // worker.go implements the worker pool that processes tasks against Ollama.
 //
-// Each submitted task gets its own goroutine, but a semaphore (buffered channel)
-// limits how many tasks can call Ollama concurrently. This keeps things simple:
-//   - No dispatcher loop or work channel needed
+// Each submitted task gets its own goroutine, but an explicit scheduler queue
+// (see scheduler.go) limits how many tasks can call Ollama concurrently and
+// decides which waiting task gets the next free slot:
+//   - Higher priority first, FIFO within a priority — a small urgent batch
+//     isn't starved by a large batch submitted earlier
+//   - Optionally, fair share across tags within a priority, so an
+//     interactive batch makes progress alongside a large background one
 //   - Each goroutine manages its own lifecycle including cancellation
-//   - The semaphore is the only coordination primitive
+//   - No dispatcher loop: a slot is handed over whenever one is released
 //
 // Concurrency is bounded because Ollama model inference is GPU-bound. On an
 // M3 Pro with 36GB RAM running a 14B model, 2 concurrent workers is a safe
@@ -22,13 +26,14 @@ import (
 	"time"
 
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
 )
 
 const (
 	defaultConcurrency         = 2                   // max parallel Ollama requests (GPU-bound)
 	defaultModel               = "qwen2.5-coder:14b" // fallback when task doesn't specify a model
-	defaultTaskTimeoutSec      = 600                  // 10 minutes per task
-	defaultPostWriteCmdTimeout = 30 * time.Second     // timeout for post-write commands (e.g. gofmt)
+	defaultTaskTimeoutSec      = 600                 // 10 minutes per task
+	defaultPostWriteCmdTimeout = 30 * time.Second    // timeout for post-write commands (e.g. gofmt)
 )
 
 // OllamaClient is the subset of the Ollama API client used by WorkerPool.
@@ -36,62 +41,129 @@ const (
 type OllamaClient interface {
 	Chat(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error
 	List(ctx context.Context) (*api.ListResponse, error)
+	Show(ctx context.Context, req *api.ShowRequest) (*api.ShowResponse, error)
+	ListRunning(ctx context.Context) (*api.ProcessResponse, error)
 }
 
 // WorkerPool manages concurrent Ollama inference requests.
 type WorkerPool struct {
-	sem                chan struct{}   // semaphore: buffered to max concurrent workers
-	semMu              sync.RWMutex   // guards sem for hot-swap via SetConcurrency
-	client             OllamaClient   // Ollama API client, created once and reused
-	store              *TaskStore     // shared task store for status updates
-	wg                 sync.WaitGroup // tracks in-flight goroutines for graceful shutdown
-	PostWriteCmdTimeout time.Duration // timeout for post-write commands; 0 means use default
+	mu                  sync.Mutex          // guards the scheduler fields below
+	queue               []*slotRequest      // tasks waiting for a worker slot (see scheduler.go)
+	running             int                 // slots currently held
+	concurrency         int                 // max slots; adjustable via SetConcurrency
+	nextSeq             uint64              // submission counter for FIFO ordering within a priority
+	fairShare           bool                // share slots across tags (see scheduler.go)
+	tagWeights          map[string]int      // fair-share weight per tag; missing means 1
+	tagPass             map[string]float64  // fair-share pass per tag
+	virtualTime         float64             // pass of the most recently granted request
+	modelLimits         map[string]int      // model → max slots per backend; missing means no limit (see model_limits.go)
+	backends            []*backend          // Ollama servers; one unless OLLAMA_HOSTS lists several (see backends.go)
+	assigned            map[string]*backend // task ID → backend of the slot it holds
+	stopChecks          chan struct{}       // closed on shutdown to stop backend health checks
+	store               *TaskStore          // shared task store for status updates
+	wg                  sync.WaitGroup      // tracks in-flight goroutines for graceful shutdown
+	PostWriteCmdTimeout time.Duration       // timeout for post-write commands; 0 means use default
+	ValidateCmdTimeout  time.Duration       // timeout for validation commands; 0 means use default
+	BackupDir           string              // where pre-write backups go; empty means use default (see backup.go)
+	BackupRetention     int                 // finished tasks whose backups are kept; 0 means use default
+	StagingDir          string              // staging root; empty means use default (see staging.go)
+
+	backupMu      sync.Mutex // guards tempBackupDir
+	tempBackupDir string     // per-process backup directory, once created (see backup.go)
+
+	ctxMu          sync.Mutex     // guards contextLengths
+	contextLengths map[string]int // model → trained context length, from Ollama's show endpoint (see chunking.go)
+
+	liveMu sync.Mutex             // guards live
+	live   map[string]*liveOutput // task ID → its in-flight Ollama call, for peek_task (see live_output.go)
 }
 
 // NewWorkerPool creates a worker pool connected to the local Ollama instance.
 // The Ollama client connects to http://127.0.0.1:11434 by default, or to
-// whatever is specified in the OLLAMA_HOST environment variable.
+// whatever is specified in the OLLAMA_HOST environment variable. With
+// OLLAMA_HOSTS set, it spreads tasks across the listed servers instead and
+// checks their health in the background (see backends.go).
 func NewWorkerPool(store *TaskStore) (*WorkerPool, error) {
-	client, err := api.ClientFromEnvironment()
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to Ollama: %v", err)
-	}
-
-	concurrency := defaultConcurrency
+	concurrency := 0
 	if v := os.Getenv("WORKER_CONCURRENCY"); v != "" {
 		if n, err := strconv.Atoi(v); err == nil && n > 0 {
 			concurrency = n
 		}
 	}
 
-	return &WorkerPool{
-		sem:    make(chan struct{}, concurrency),
-		client: client,
-		store:  store,
-	}, nil
+	var backends []*backend
+	if hosts := os.Getenv("OLLAMA_HOSTS"); hosts != "" {
+		var err error
+		if backends, err = parseBackends(hosts, defaultConcurrency); err != nil {
+			return nil, err
+		}
+	} else {
+		client, err := api.ClientFromEnvironment()
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to Ollama: %v", err)
+		}
+		backends = []*backend{{host: envconfig.Host().String(), client: client, healthy: true}}
+	}
+	if concurrency == 0 {
+		concurrency = defaultConcurrency
+		if len(backends) > 1 {
+			concurrency = 0
+			for _, b := range backends {
+				concurrency += b.concurrency
+			}
+		}
+	}
+
+	modelLimits := make(map[string]int)
+	if v := os.Getenv("MODEL_CONCURRENCY"); v != "" {
+		var err error
+		if modelLimits, err = parseModelLimits(v); err != nil {
+			return nil, err
+		}
+	}
+
+	p := &WorkerPool{
+		concurrency: concurrency,
+		tagWeights:  make(map[string]int),
+		tagPass:     make(map[string]float64),
+		modelLimits: modelLimits,
+		backends:    backends,
+		assigned:    make(map[string]*backend),
+		store:       store,
+	}
+	if len(backends) > 1 {
+		p.checkBackends()
+	} else {
+		// A single backend is used whether or not it answers, so don't hold
+		// up startup for its first check
+		go p.checkBackends()
+	}
+	p.stopChecks = make(chan struct{})
+	go p.checkBackendsLoop(p.stopChecks)
+	return p, nil
 }
 
-// SetConcurrency replaces the semaphore with a new one of capacity n.
-// In-flight goroutines that already acquired a slot on the old semaphore
-// will release back to it when done — they drain naturally. New tasks
-// will acquire from the new semaphore.
+// SetConcurrency changes the maximum number of concurrent slots to n.
+// Lowering it doesn't interrupt tasks already running — they drain
+// naturally and no new slots are granted until running < n. Raising it
+// grants slots to queued tasks immediately.
 func (p *WorkerPool) SetConcurrency(n int) {
-	p.semMu.Lock()
-	p.sem = make(chan struct{}, n)
-	p.semMu.Unlock()
+	p.mu.Lock()
+	p.concurrency = n
+	p.mu.Unlock()
+	p.dispatch()
 }
 
-// Concurrency returns the current worker concurrency (semaphore capacity).
+// Concurrency returns the current worker concurrency (max slots).
 func (p *WorkerPool) Concurrency() int {
-	p.semMu.RLock()
-	c := cap(p.sem)
-	p.semMu.RUnlock()
-	return c
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.concurrency
 }
 
 // Submit starts a background goroutine to process the task. The goroutine
-// will block on the semaphore until a worker slot is available, then call
-// Ollama and update the task store with the result.
+// waits in the scheduler queue until it is granted a worker slot, then calls
+// Ollama and updates the task store with the result.
 //
 // The caller must create the task context and set task.Cancel BEFORE adding
 // the task to the store. This ensures the cancel function is visible to
@@ -99,18 +171,67 @@ func (p *WorkerPool) Concurrency() int {
 // The context should be derived from context.Background(), not the request
 // context, because tasks must outlive the submit_tasks MCP request.
 func (p *WorkerPool) Submit(ctx context.Context, cancel context.CancelFunc, task *Task) {
+	p.mu.Lock()
+	seq := p.nextSeq
+	p.nextSeq++
+	p.mu.Unlock()
+
+	// Queue the task now, not when the goroutine gets scheduled, so FIFO
+	// order within a priority is submission order. Blocked tasks queue once
+	// their dependencies complete.
+	var req *slotRequest
+	if len(task.DependsOn) == 0 && len(task.ReduceOver) == 0 {
+		req = p.enqueue(task, seq)
+	}
+
 	p.wg.Add(1)
 	go func() {
 		defer p.wg.Done()
 		defer cancel()
-		p.run(ctx, task)
+		p.run(ctx, task, seq, req)
 	}()
 }
 
+// Resume re-queues pending tasks recovered from the store's journal after a
+// restart. Each task gets a fresh context (derived from context.Background(),
+// like handleSubmitTasks) attached to the store before submission so
+// cancel_tasks can reach it. Returns the number of tasks re-queued.
+func (p *WorkerPool) Resume() int {
+	count := 0
+	for _, task := range p.store.Resumable() {
+		ctx, cancel := context.WithCancel(context.Background())
+		if !p.store.AttachCancel(task.ID, cancel) {
+			cancel()
+			continue
+		}
+		p.Submit(ctx, cancel, task)
+		count++
+	}
+	return count
+}
+
+// ReleaseSession forgets a closed MCP session: its unfinished tasks are
+// cancelled, all of its tasks are dropped from the store, and their backups
+// and the session's staging tree are deleted. Nothing else can reach them —
+// a client that reconnects gets a new session ID.
+func (p *WorkerPool) ReleaseSession(session string) {
+	if session == "" {
+		return
+	}
+	for _, path := range p.store.RemoveSession(session) {
+		os.Remove(path)
+	}
+	os.RemoveAll(p.sessionStagingDir(session))
+}
+
 // Shutdown cancels all pending/running tasks and waits up to 5 seconds for
-// worker goroutines to finish. Called when the MCP server stops.
+// worker goroutines to finish, then removes the per-process backup directory
+// if there is one (see backup.go). Called when the MCP server stops.
 func (p *WorkerPool) Shutdown() {
-	p.store.Cancel(nil, "")
+	if p.stopChecks != nil {
+		close(p.stopChecks)
+	}
+	p.store.CancelAll()
 	done := make(chan struct{})
 	go func() {
 		p.wg.Wait()
@@ -120,6 +241,7 @@ func (p *WorkerPool) Shutdown() {
 	case <-done:
 	case <-time.After(5 * time.Second):
 	}
+	p.removeTempBackupDir()
 }
 
 // getTaskTimeout returns the timeout duration for a task. It checks (in order):
@@ -146,137 +268,346 @@ func (p *WorkerPool) postWriteCmdTimeout() time.Duration {
 	return defaultPostWriteCmdTimeout
 }
 
-// run is the goroutine body for a single task. It acquires a semaphore slot,
-// reads input files, calls Ollama with a timeout, optionally strips fences,
-// writes output files, runs post-write commands, and updates the store.
-func (p *WorkerPool) run(ctx context.Context, task *Task) {
-	// Capture the current semaphore under RLock. If SetConcurrency swaps
-	// in a new channel between now and when we release, we drain the old
-	// one correctly — no slots are leaked.
-	p.semMu.RLock()
-	sem := p.sem
-	p.semMu.RUnlock()
-
-	// Acquire a worker slot. Blocks here if all slots are in use — this is
-	// effectively the queue. The task stays in "pending" status while waiting.
-	select {
-	case sem <- struct{}{}:
-		defer func() { <-sem }()
-	case <-ctx.Done():
-		// Task was cancelled while waiting in the queue
-		return
+// validateCmdTimeout returns the configured validation command timeout. Like
+// PostWriteCmdTimeout, the ValidateCmdTimeout field overrides the default.
+func (p *WorkerPool) validateCmdTimeout() time.Duration {
+	if p.ValidateCmdTimeout > 0 {
+		return p.ValidateCmdTimeout
+	}
+	return defaultValidateCmdTimeout
+}
+
+// run is the goroutine body for a single task. It acquires a worker slot,
+// reads input files, calls Ollama with a timeout (retrying transient errors),
+// optionally strips fences, writes output files, runs post-write commands,
+// runs the validation command (asking the model to repair its output when it
+// fails), and updates the store.
+func (p *WorkerPool) run(ctx context.Context, task *Task, seq uint64, req *slotRequest) {
+	// Wait for upstream tasks before queueing for a worker slot, so blocked
+	// tasks never hold GPU capacity.
+	if req == nil {
+		if !p.awaitDependencies(ctx, task) {
+			return
+		}
+		req = p.enqueue(task, seq)
 	}
 
-	// Double-check cancellation after acquiring the slot
-	if ctx.Err() != nil {
+	// Acquire a worker slot. Blocks here in the scheduler queue if all slots
+	// are in use. The task stays in "pending" status while waiting.
+	release, ok := p.awaitSlot(ctx, req)
+	if !ok {
+		// Task was cancelled while waiting in the queue
 		return
 	}
+	defer func() { release() }()
 
 	if !p.store.SetRunning(task.ID) {
 		return // task was cancelled while waiting in the queue
 	}
+	defer p.endLive(task.ID)
 
-	// Apply per-task timeout so a hung Ollama call doesn't block a
-	// semaphore slot forever.
-	timeout := getTaskTimeout(task)
-	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, timeout)
-	defer timeoutCancel()
-
-	// Step 1: Read input file if specified
-	var fileContent string
+	// Step 1: Read input file if specified (a staged task sees earlier
+	// staged output from its tag; see staging.go). base is what edit-mode
+	// responses are applied to (see patch.go) and what chunk mode splits;
+	// extra is the rest of the context.
+	var base, extra string
 	if task.InputFile != "" {
 		var err error
-		fileContent, err = readInputFile(task.InputFile)
+		base, err = readInputFile(p.stagedInput(task, task.InputFile))
 		if err != nil {
 			p.store.SetFailed(task.ID, fmt.Sprintf("failed to read input file: %v", err))
 			return
 		}
 	}
-
-	// Step 2: Call Ollama
-	result, err := p.callOllama(timeoutCtx, task, fileContent)
-	if err != nil {
-		if ctx.Err() != nil {
-			// Parent context was cancelled (user called cancel_tasks).
-			// The store.Cancel method already set the status.
+	if len(task.InputFiles) > 0 {
+		sections, err := readInputFiles(task.InputFiles, func(path string) (string, error) {
+			return readInputFile(p.stagedInput(task, path))
+		})
+		if err != nil {
+			p.store.SetFailed(task.ID, err.Error())
 			return
 		}
-		if timeoutCtx.Err() == context.DeadlineExceeded {
-			p.store.SetFailed(task.ID, fmt.Sprintf(
-				"TIMEOUT: task exceeded %d second limit. Resubmit with a larger timeout_seconds value if the task needs more time.",
-				int(timeout.Seconds()),
-			))
+		extra = sections
+	}
+
+	// Step 1b: Resolve output chaining — {{result:<id>}} placeholders in the
+	// prompt and input_from_task. Dependencies have completed by now.
+	prompt, err := p.resolveChainedPrompt(task.Prompt)
+	if err != nil {
+		p.store.SetFailed(task.ID, err.Error())
+		return
+	}
+	if task.InputFromTask != "" {
+		upstream, err := p.upstreamOutput(task.InputFromTask)
+		if err != nil {
+			p.store.SetFailed(task.ID, err.Error())
 			return
 		}
+		extra = joinSections(extra, upstream)
+	}
+	userMessage := joinSections(prompt, joinSections(base, extra))
+
+	// Step 2: Call Ollama, retrying transient failures with backoff. A
+	// prompt that can't fit in the context window fails up front, unless the
+	// task is chunked (see chunking.go). A reduce task builds its own
+	// prompts from the map results (see reduce.go).
+	messages := []api.Message{
+		{Role: "system", Content: joinSections(task.SystemPrompt, editInstructions(task.OutputMode))},
+		{Role: "user", Content: userMessage},
+	}
+	var result string
+	if len(task.ReduceOver) > 0 {
+		result, ok = p.generateReduce(ctx, task, prompt, seq, &release)
+	} else if task.Chunk {
+		result, ok = p.generateChunked(ctx, task, prompt, base, extra, seq, &release)
+	} else if err := p.checkContextWindow(ctx, task, messages); err != nil {
 		p.store.SetFailed(task.ID, err.Error())
 		return
+	} else {
+		result, ok = p.generate(ctx, task, messages, seq, &release)
 	}
-
-	// Step 3: Strip markdown fences if configured
-	output := result
-	if task.StripMarkdownFences {
-		output = stripMarkdownFences(result)
+	if !ok {
+		return
 	}
 
-	// Step 4: Write output file if specified
-	if task.OutputFile != "" {
-		if err := writeOutputFile(task.OutputFile, output); err != nil {
-			p.store.SetFailedWithResult(task.ID, result, fmt.Sprintf("failed to write output file: %v", err))
-			return
+	postWriteCmd := stagedCommand(task, task.PostWriteCmd)
+	validateCmd := stagedCommand(task, task.ValidateCmd)
+	backedUp := false
+	for repairs := 0; ; repairs++ {
+		// Step 3: Strip markdown fences if configured, or apply an edit-mode
+		// response to the input file. After a repair turn the model's new
+		// edit is relative to the file it last produced.
+		output := result
+		if isEditMode(task.OutputMode) {
+			if output, err = applyEdit(task.OutputMode, base, result); err != nil {
+				p.store.SetFailedWithResult(task.ID, result, fmt.Sprintf("%s response does not apply to input_file: %v", task.OutputMode, err))
+				return
+			}
+			base = output
+		} else if task.StripMarkdownFences && !task.Chunk { // chunks are stripped one by one
+			output = stripMarkdownFences(result)
+		}
+
+		// Step 3b: Validate structured output before it reaches disk
+		if len(ollamaFormat(task)) > 0 {
+			if err := validateJSONOutput(output, task.JSONSchema); err != nil {
+				p.store.SetFailedWithResult(task.ID, result, err.Error())
+				return
+			}
+		}
+
+		// Step 4: Write output file if specified, saving the original first
+		// so undo_tasks can restore it (repair rewrites keep that backup).
+		// Staged output goes to the staging tree instead; the real file is
+		// backed up when apply_staged promotes it.
+		if task.StagedFile != "" {
+			if err := writeStagedFile(task.StagedFile, output); err != nil {
+				p.store.SetFailedWithResult(task.ID, result, fmt.Sprintf("failed to write staged output file: %v", err))
+				return
+			}
+			p.store.SetFileWritten(task.ID)
+		} else if task.OutputFile != "" {
+			if !backedUp {
+				backup, err := p.backupOutputFile(task)
+				if err != nil {
+					p.store.SetFailedWithResult(task.ID, result, fmt.Sprintf("failed to back up output file before writing: %v", err))
+					return
+				}
+				p.store.SetBackup(task.ID, backup)
+				p.pruneBackups()
+				backedUp = true
+			}
+			if err := writeOutputFile(task.OutputFile, output); err != nil {
+				p.store.SetFailedWithResult(task.ID, result, fmt.Sprintf("failed to write output file: %v", err))
+				return
+			}
+			p.store.SetFileWritten(task.ID)
 		}
-		p.store.SetFileWritten(task.ID)
-	}
 
-	// Step 5: Run post-write command if specified
-	if task.PostWriteCmd != "" {
-		if cmdOutput, err := runPostWriteCmd(task.PostWriteCmd, p.postWriteCmdTimeout()); err != nil {
-			errMsg := fmt.Sprintf("post-write command failed: %v", err)
-			if cmdOutput != "" {
-				errMsg += ": " + cmdOutput
+		// Step 5: Run post-write command if specified
+		if postWriteCmd != "" {
+			if cmdOutput, err := runPostWriteCmd(postWriteCmd, p.postWriteCmdTimeout()); err != nil {
+				errMsg := fmt.Sprintf("post-write command failed: %v", err)
+				if cmdOutput != "" {
+					errMsg += ": " + cmdOutput
+				}
+				p.recordDiff(task)
+				p.store.SetFailedWithResult(task.ID, result, errMsg)
+				return
 			}
-			p.store.SetFailedWithResult(task.ID, result, errMsg)
+		}
+
+		// Step 5b: Run the validation command; on failure, feed its output
+		// back to the model as a follow-up turn and go around again (see
+		// repair.go).
+		if validateCmd == "" {
+			break
+		}
+		messages = append(messages, api.Message{Role: "assistant", Content: result})
+		cmdOutput, err := runPostWriteCmd(validateCmd, p.validateCmdTimeout())
+		if err == nil {
+			p.store.SetConversation(task.ID, repairs, conversationTurns(messages))
+			break
+		}
+		if repairs >= task.MaxRepairAttempts {
+			p.store.SetConversation(task.ID, repairs, conversationTurns(messages))
+			p.recordDiff(task)
+			p.store.SetFailedWithResult(task.ID, result, validationFailedError(err, cmdOutput, repairs))
+			return
+		}
+		messages = append(messages, api.Message{Role: "user", Content: repairPrompt(validateCmd, err, cmdOutput)})
+		p.store.SetConversation(task.ID, repairs+1, conversationTurns(messages))
+		if result, ok = p.generate(ctx, task, messages, seq, &release); !ok {
 			return
 		}
 	}
 
+	// Step 5c: Record the diff for get_result and check_tasks (see diff.go)
+	p.recordDiff(task)
+
 	// Step 6: Mark completed (uses the raw Ollama result, not stripped —
 	// stripped version is already on disk if OutputFile was set)
 	p.store.SetCompleted(task.ID, result)
 }
 
-// callOllama sends the task to Ollama using the Chat API and streams the
-// response. The Chat API is used instead of Generate because it cleanly
-// separates system and user messages, which maps naturally to how the
-// caller (Opus) structures its prompts.
-func (p *WorkerPool) callOllama(ctx context.Context, task *Task, fileContent string) (string, error) {
-	// Build the user message: prompt first, then file content (if any)
-	// separated by a blank line.
-	userMessage := task.Prompt
-	if fileContent != "" {
-		userMessage = task.Prompt + "\n\n" + fileContent
+// generate sends messages to Ollama under the per-task timeout, retrying
+// transient failures with backoff. While backing off the worker slot is given
+// up so other tasks can use the GPU, then re-queued for; *release always
+// holds the release function of the slot currently held. Returns false if
+// the task should stop — it has already been failed, or was cancelled.
+func (p *WorkerPool) generate(ctx context.Context, task *Task, messages []api.Message, seq uint64, release *func()) (string, bool) {
+	timeout := getTaskTimeout(task)
+	for attempt := 1; ; attempt++ {
+		result, timedOut, err := p.callOllamaWithTimeout(ctx, task, messages, timeout)
+		if err == nil {
+			return result, true
+		}
+		if ctx.Err() != nil {
+			// Parent context was cancelled (user called cancel_tasks).
+			// The store.Cancel method already set the status.
+			return "", false
+		}
+		if timedOut {
+			p.store.SetFailed(task.ID, fmt.Sprintf(
+				"TIMEOUT: task exceeded %d second limit. Resubmit with a larger timeout_seconds value if the task needs more time.",
+				int(timeout.Seconds()),
+			))
+			return "", false
+		}
+		if attempt > task.MaxRetries || !isRetryableError(err) {
+			if attempt > 1 {
+				p.store.SetFailed(task.ID, fmt.Sprintf("%v (after %d retries)", err, attempt-1))
+			} else {
+				p.store.SetFailed(task.ID, err.Error())
+			}
+			return "", false
+		}
+
+		// Transient error: give up the worker slot while backing off so
+		// other tasks can use the GPU, then queue for a slot again.
+		if !p.store.SetRetrying(task.ID, err.Error()) {
+			return "", false
+		}
+		(*release)()
+		*release = func() {}
+		select {
+		case <-time.After(retryBackoff(task, attempt)):
+		case <-ctx.Done():
+			return "", false
+		}
+		var ok bool
+		if *release, ok = p.awaitSlot(ctx, p.enqueue(task, seq)); !ok {
+			return "", false
+		}
+		if !p.store.SetRunning(task.ID) {
+			return "", false
+		}
 	}
+}
 
-	messages := []api.Message{
-		{Role: "system", Content: task.SystemPrompt},
-		{Role: "user", Content: userMessage},
+// awaitDependencies blocks until all of task's dependencies complete and then
+// moves it from "blocked" to "pending". If a dependency fails or is cancelled,
+// the outcome cascades: the task is failed or cancelled without running.
+// Returns false if the task should not proceed.
+func (p *WorkerPool) awaitDependencies(ctx context.Context, task *Task) bool {
+	depID, depStatus, err := p.store.WaitForDependencies(ctx, task.ID)
+	if err != nil {
+		return false // task was cancelled while blocked
 	}
+	switch depStatus {
+	case "":
+		return p.store.SetUnblocked(task.ID)
+	case "cancelled":
+		p.store.SetCancelled(task.ID)
+	case "not_found":
+		p.store.SetDependencyFailed(task.ID, fmt.Sprintf("dependency %s not found; task was not run", depID))
+	default:
+		p.store.SetDependencyFailed(task.ID, fmt.Sprintf("dependency %s failed; task was not run", depID))
+	}
+	return false
+}
+
+// callOllamaWithTimeout runs a single Ollama attempt under the per-task
+// timeout, so a hung Ollama call doesn't block a worker slot forever.
+// timedOut reports whether the attempt failed because the timeout expired
+// (as opposed to the parent context being cancelled).
+func (p *WorkerPool) callOllamaWithTimeout(ctx context.Context, task *Task, messages []api.Message, timeout time.Duration) (result string, timedOut bool, err error) {
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, timeout)
+	defer timeoutCancel()
+
+	result, err = p.callOllama(timeoutCtx, task, messages)
+	if err != nil && ctx.Err() == nil && timeoutCtx.Err() == context.DeadlineExceeded {
+		return "", true, err
+	}
+	return result, false, err
+}
 
-	// Stream the response, accumulating chunks into a string builder.
+// callOllama sends the conversation to Ollama using the Chat API and streams
+// the response. The Chat API is used instead of Generate because it cleanly
+// separates system and user messages, which maps naturally to how the
+// caller (Opus) structures its prompts — and because repair turns (see
+// repair.go) are just more messages in the same conversation.
+func (p *WorkerPool) callOllama(ctx context.Context, task *Task, messages []api.Message) (string, error) {
+	// Stream the response, accumulating chunks into a string builder and
+	// recording them for peek_task as they arrive. The final chunk carries
+	// the call's metrics (see eval_metrics.go).
 	var result strings.Builder
-	err := p.client.Chat(ctx, &api.ChatRequest{
+	var metrics api.Metrics
+	p.startLive(task.ID)
+	err := p.taskClient(task.ID).Chat(ctx, &api.ChatRequest{
 		Model:    task.Model,
 		Messages: messages,
+		Options:  task.Options,
+		Format:   ollamaFormat(task),
 	}, func(resp api.ChatResponse) error {
 		result.WriteString(resp.Message.Content)
+		p.appendLive(task.ID, resp.Message.Content, resp.EvalCount)
+		if resp.Done {
+			metrics = resp.Metrics
+		}
 		return nil
 	})
 
 	if err != nil {
 		return "", err
 	}
+	p.store.AddEvalMetrics(task.ID, metrics)
 	return result.String(), nil
 }
 
+// joinSections builds the user message: prompt first, then file content (if
+// any) separated by a blank line. Also used to append chained upstream output
+// after input file contents.
+func joinSections(first, second string) string {
+	if second == "" {
+		return first
+	}
+	if first == "" {
+		return second
+	}
+	return first + "\n\n" + second
+}
+
 // readInputFile reads a file from disk and returns its contents as a string.
 // Called by run() when a task specifies InputFile. The contents are appended
 // to the prompt before sending to Ollama, so the orchestrating agent never
@@ -324,13 +655,19 @@ func stripMarkdownFences(s string) string {
 // writeOutputFile writes the Ollama response to disk at the specified path.
 // Called by run() when a task specifies OutputFile. After a successful write,
 // the result is cleared from memory (via SetFileWritten + SetCompleted) since
-// the content is on disk. Creates or overwrites the file with mode 0644.
+// the content is on disk. The write is atomic (see backup.go): an existing
+// file keeps its permissions, a new one is created with mode 0644.
 func writeOutputFile(path, content string) error {
-	return os.WriteFile(path, []byte(content), 0644)
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	return writeFileAtomic(path, []byte(content), mode)
 }
 
 // runPostWriteCmd runs a shell command after a successful file write (e.g.
-// "gofmt -w /path/to/file.go"). Executes via "sh -c" with the given timeout.
+// "gofmt -w /path/to/file.go", or a validate_cmd like "go build ./...").
+// Executes via "sh -c" with the given timeout.
 // Returns the command's combined stdout/stderr on failure for error reporting.
 // If the command fails, the output file has already been written — the task
 // is marked as failed with the Ollama result preserved via SetFailedWithResult.
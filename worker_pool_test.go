@@ -21,6 +21,8 @@ import (
 type mockOllamaClient struct {
 	chatFn func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error
 	listFn func(ctx context.Context) (*api.ListResponse, error)
+	showFn func(ctx context.Context, req *api.ShowRequest) (*api.ShowResponse, error)
+	psFn   func(ctx context.Context) (*api.ProcessResponse, error)
 }
 
 func (m *mockOllamaClient) Chat(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
@@ -37,12 +39,29 @@ func (m *mockOllamaClient) List(ctx context.Context) (*api.ListResponse, error)
 	return &api.ListResponse{}, nil
 }
 
+func (m *mockOllamaClient) Show(ctx context.Context, req *api.ShowRequest) (*api.ShowResponse, error) {
+	if m.showFn != nil {
+		return m.showFn(ctx, req)
+	}
+	return nil, fmt.Errorf("model %q not found", req.Model)
+}
+
+func (m *mockOllamaClient) ListRunning(ctx context.Context) (*api.ProcessResponse, error) {
+	if m.psFn != nil {
+		return m.psFn(ctx)
+	}
+	return &api.ProcessResponse{}, nil
+}
+
 // newTestPool creates a WorkerPool with a mock client and the given concurrency.
 func newTestPool(store *TaskStore, concurrency int, client OllamaClient) *WorkerPool {
 	return &WorkerPool{
-		sem:    make(chan struct{}, concurrency),
-		client: client,
-		store:  store,
+		concurrency: concurrency,
+		tagWeights:  make(map[string]int),
+		tagPass:     make(map[string]float64),
+		backends:    []*backend{{host: "http://mock", client: client, healthy: true}},
+		assigned:    make(map[string]*backend),
+		store:       store,
 	}
 }
 
@@ -59,7 +78,7 @@ func submitTestTask(store *TaskStore, pool *WorkerPool, task *Task) {
 // getStatus returns the status of a task using Results (which copies under the lock),
 // avoiding a data race from reading the Task struct pointer directly.
 func getStatus(store *TaskStore, id string) string {
-	results := store.Results([]string{id})
+	results := store.Results([]string{id}, "")
 	if len(results) == 1 {
 		return results[0].Status
 	}
@@ -111,7 +130,7 @@ func TestWorkerSuccessfulLifecycle(t *testing.T) {
 	submitTestTask(store, pool, task)
 
 	waitForStatus(t, store, "t1", 2*time.Second, "completed")
-	results := store.Results([]string{"t1"})
+	results := store.Results([]string{"t1"}, "")
 	if results[0].Content != "hello world" {
 		t.Fatalf("expected 'hello world', got %q", results[0].Content)
 	}
@@ -519,7 +538,7 @@ func TestWorkerOutputFileWrite(t *testing.T) {
 	}
 
 	// Verify result was cleared from memory (FileWritten)
-	results := store.Results([]string{"t1"})
+	results := store.Results([]string{"t1"}, "")
 	if results[0].Content != "" {
 		t.Fatal("Result should be cleared when file was written")
 	}
@@ -835,8 +854,8 @@ func TestNewWorkerPoolConcurrencyEnvVar(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if cap(pool.sem) != 5 {
-		t.Fatalf("expected concurrency 5, got %d", cap(pool.sem))
+	if pool.Concurrency() != 5 {
+		t.Fatalf("expected concurrency 5, got %d", pool.Concurrency())
 	}
 
 	// Invalid (non-numeric) falls back to default
@@ -845,8 +864,8 @@ func TestNewWorkerPoolConcurrencyEnvVar(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if cap(pool.sem) != defaultConcurrency {
-		t.Fatalf("expected default concurrency %d, got %d", defaultConcurrency, cap(pool.sem))
+	if pool.Concurrency() != defaultConcurrency {
+		t.Fatalf("expected default concurrency %d, got %d", defaultConcurrency, pool.Concurrency())
 	}
 
 	// Negative falls back to default
@@ -855,8 +874,8 @@ func TestNewWorkerPoolConcurrencyEnvVar(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if cap(pool.sem) != defaultConcurrency {
-		t.Fatalf("expected default concurrency %d for negative value, got %d", defaultConcurrency, cap(pool.sem))
+	if pool.Concurrency() != defaultConcurrency {
+		t.Fatalf("expected default concurrency %d for negative value, got %d", defaultConcurrency, pool.Concurrency())
 	}
 
 	// Unset falls back to default
@@ -865,8 +884,8 @@ func TestNewWorkerPoolConcurrencyEnvVar(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if cap(pool.sem) != defaultConcurrency {
-		t.Fatalf("expected default concurrency %d for empty value, got %d", defaultConcurrency, cap(pool.sem))
+	if pool.Concurrency() != defaultConcurrency {
+		t.Fatalf("expected default concurrency %d for empty value, got %d", defaultConcurrency, pool.Concurrency())
 	}
 }
 
@@ -1248,3 +1267,1158 @@ func TestConcurrencyGetter(t *testing.T) {
 		t.Fatalf("expected 1, got %d", pool.Concurrency())
 	}
 }
+
+// ---------------------------------------------------------------------------
+// Retry on transient Ollama errors
+// ---------------------------------------------------------------------------
+
+func TestWorkerRetriesTransientError(t *testing.T) {
+	store := NewTaskStore()
+	var calls atomic.Int32
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			if calls.Add(1) < 3 {
+				return api.StatusError{StatusCode: 503, Status: "503 Service Unavailable", ErrorMessage: "server busy"}
+			}
+			fn(api.ChatResponse{Message: api.Message{Content: "ok"}})
+			return nil
+		},
+	}
+	pool := newTestPool(store, 1, mock)
+
+	task := &Task{ID: "t1", Prompt: "p", Status: "pending", CreatedAt: time.Now(), MaxRetries: 3, RetryBackoff: time.Millisecond}
+	submitTestTask(store, pool, task)
+
+	waitForStatus(t, store, "t1", 2*time.Second, "completed")
+	_, statuses := store.Summary([]string{"t1"}, "", "")
+	if statuses[0].Retries != 2 {
+		t.Fatalf("expected 2 retries, got %d", statuses[0].Retries)
+	}
+	if !strings.Contains(statuses[0].LastAttemptError, "server busy") {
+		t.Fatalf("expected last attempt error to mention server busy, got %q", statuses[0].LastAttemptError)
+	}
+}
+
+func TestWorkerRetriesExhausted(t *testing.T) {
+	store := NewTaskStore()
+	var calls atomic.Int32
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			calls.Add(1)
+			return fmt.Errorf("dial tcp 127.0.0.1:11434: connect: connection refused")
+		},
+	}
+	pool := newTestPool(store, 1, mock)
+
+	task := &Task{ID: "t1", Prompt: "p", Status: "pending", CreatedAt: time.Now(), MaxRetries: 2, RetryBackoff: time.Millisecond}
+	submitTestTask(store, pool, task)
+
+	waitForStatus(t, store, "t1", 2*time.Second, "failed")
+	if n := calls.Load(); n != 3 {
+		t.Fatalf("expected 3 attempts (1 + 2 retries), got %d", n)
+	}
+	if got := store.Results([]string{"t1"}, "")[0].Error; !strings.Contains(got, "after 2 retries") {
+		t.Fatalf("expected error to mention retries, got %q", got)
+	}
+}
+
+func TestWorkerPermanentErrorNotRetried(t *testing.T) {
+	store := NewTaskStore()
+	var calls atomic.Int32
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			calls.Add(1)
+			return api.StatusError{StatusCode: 404, ErrorMessage: "model not found"}
+		},
+	}
+	pool := newTestPool(store, 1, mock)
+
+	task := &Task{ID: "t1", Prompt: "p", Status: "pending", CreatedAt: time.Now(), MaxRetries: 5, RetryBackoff: time.Millisecond}
+	submitTestTask(store, pool, task)
+
+	waitForStatus(t, store, "t1", 2*time.Second, "failed")
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("permanent error should not be retried, got %d attempts", n)
+	}
+}
+
+func TestWorkerCancelWhileRetrying(t *testing.T) {
+	store := NewTaskStore()
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			return fmt.Errorf("connection refused")
+		},
+	}
+	pool := newTestPool(store, 1, mock)
+
+	task := &Task{ID: "t1", Prompt: "p", Status: "pending", CreatedAt: time.Now(), MaxRetries: 1, RetryBackoff: time.Hour}
+	submitTestTask(store, pool, task)
+
+	waitForStatus(t, store, "t1", 2*time.Second, "retrying")
+	if !store.SetCancelled("t1") {
+		t.Fatal("retrying task should be cancellable")
+	}
+	pool.Shutdown() // must not wait out the hour-long backoff
+	if got := getStatus(store, "t1"); got != "cancelled" {
+		t.Fatalf("expected cancelled, got %s", got)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Scheduler: priority order, FIFO within a priority, queue positions
+// ---------------------------------------------------------------------------
+
+func TestSchedulerPriorityOrder(t *testing.T) {
+	store := NewTaskStore()
+	blocker := make(chan struct{})
+	var mu sync.Mutex
+	var order []string
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			if req.Model == "blocker" {
+				<-blocker
+			} else {
+				mu.Lock()
+				order = append(order, req.Messages[1].Content)
+				mu.Unlock()
+			}
+			fn(api.ChatResponse{Message: api.Message{Content: "ok"}})
+			return nil
+		},
+	}
+	pool := newTestPool(store, 1, mock)
+
+	submitTestTask(store, pool, &Task{ID: "blocker", Prompt: "p", Model: "blocker", Status: "pending", CreatedAt: time.Now()})
+	waitForStatus(t, store, "blocker", 2*time.Second, "running")
+
+	for _, spec := range []struct {
+		id       string
+		priority int
+	}{{"bg1", 0}, {"bg2", 0}, {"urgent1", 5}, {"bg3", 0}, {"urgent2", 5}} {
+		submitTestTask(store, pool, &Task{ID: spec.id, Prompt: spec.id, Priority: spec.priority, Status: "pending", CreatedAt: time.Now()})
+	}
+
+	positions := pool.QueuePositions()
+	want := map[string]int{"urgent1": 1, "urgent2": 2, "bg1": 3, "bg2": 4, "bg3": 5}
+	for id, pos := range want {
+		if positions[id] != pos {
+			t.Fatalf("expected %s at queue position %d, got %d (all: %v)", id, pos, positions[id], positions)
+		}
+	}
+	if _, ok := positions["blocker"]; ok {
+		t.Fatal("running task should not have a queue position")
+	}
+
+	close(blocker)
+	waitForStatus(t, store, "bg3", 2*time.Second, "completed")
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{"urgent1", "urgent2", "bg1", "bg2", "bg3"}
+	if fmt.Sprint(order) != fmt.Sprint(expected) {
+		t.Fatalf("expected execution order %v, got %v", expected, order)
+	}
+}
+
+func TestSchedulerCancelledRequestLeavesQueue(t *testing.T) {
+	store := NewTaskStore()
+	blocker := make(chan struct{})
+	defer close(blocker)
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			<-blocker
+			return nil
+		},
+	}
+	pool := newTestPool(store, 1, mock)
+
+	submitTestTask(store, pool, &Task{ID: "blocker", Prompt: "p", Status: "pending", CreatedAt: time.Now()})
+	waitForStatus(t, store, "blocker", 2*time.Second, "running")
+	submitTestTask(store, pool, &Task{ID: "q1", Prompt: "p", Status: "pending", CreatedAt: time.Now()})
+	submitTestTask(store, pool, &Task{ID: "q2", Prompt: "p", Status: "pending", CreatedAt: time.Now()})
+
+	store.SetCancelled("q1")
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if positions := pool.QueuePositions(); len(positions) == 1 && positions["q2"] == 1 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected only q2 queued at position 1, got %v", pool.QueuePositions())
+}
+
+func TestSchedulerFairShareAcrossTags(t *testing.T) {
+	store := NewTaskStore()
+	blocker := make(chan struct{})
+	var mu sync.Mutex
+	var order []string
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			if req.Model == "blocker" {
+				<-blocker
+			} else {
+				mu.Lock()
+				order = append(order, req.Messages[1].Content)
+				mu.Unlock()
+			}
+			fn(api.ChatResponse{Message: api.Message{Content: "ok"}})
+			return nil
+		},
+	}
+	pool := newTestPool(store, 1, mock)
+	pool.SetFairShare(true)
+	pool.SetTagWeights(map[string]int{"interactive": 2})
+
+	submitTestTask(store, pool, &Task{ID: "blocker", Prompt: "p", Model: "blocker", Status: "pending", CreatedAt: time.Now()})
+	waitForStatus(t, store, "blocker", 2*time.Second, "running")
+
+	// A large background batch is queued before a small interactive one
+	for _, id := range []string{"bg1", "bg2", "bg3", "bg4"} {
+		submitTestTask(store, pool, &Task{ID: id, Tag: "background", Prompt: id, Status: "pending", CreatedAt: time.Now()})
+	}
+	for _, id := range []string{"i1", "i2", "i3", "i4"} {
+		submitTestTask(store, pool, &Task{ID: id, Tag: "interactive", Prompt: id, Status: "pending", CreatedAt: time.Now()})
+	}
+
+	// Weight 2 gives interactive two slots for each background slot
+	expected := []string{"bg1", "i1", "i2", "bg2", "i3", "i4", "bg3", "bg4"}
+	positions := pool.QueuePositions()
+	for i, id := range expected {
+		if positions[id] != i+1 {
+			t.Fatalf("expected %s at queue position %d, got %d (all: %v)", id, i+1, positions[id], positions)
+		}
+	}
+
+	close(blocker)
+	waitForStatus(t, store, "bg4", 2*time.Second, "completed")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(order) != fmt.Sprint(expected) {
+		t.Fatalf("expected execution order %v, got %v", expected, order)
+	}
+}
+
+func TestSchedulerFairShareRespectsPriority(t *testing.T) {
+	store := NewTaskStore()
+	blocker := make(chan struct{})
+	defer close(blocker)
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			<-blocker
+			return nil
+		},
+	}
+	pool := newTestPool(store, 1, mock)
+	pool.SetFairShare(true)
+
+	submitTestTask(store, pool, &Task{ID: "blocker", Prompt: "p", Status: "pending", CreatedAt: time.Now()})
+	waitForStatus(t, store, "blocker", 2*time.Second, "running")
+	submitTestTask(store, pool, &Task{ID: "a1", Tag: "a", Prompt: "p", Status: "pending", CreatedAt: time.Now()})
+	submitTestTask(store, pool, &Task{ID: "a2", Tag: "a", Prompt: "p", Status: "pending", CreatedAt: time.Now()})
+	submitTestTask(store, pool, &Task{ID: "b1", Tag: "b", Prompt: "p", Status: "pending", CreatedAt: time.Now()})
+	submitTestTask(store, pool, &Task{ID: "urgent", Tag: "a", Prompt: "p", Priority: 1, Status: "pending", CreatedAt: time.Now()})
+
+	// urgent jumps the queue regardless of tag, and the slot it takes counts
+	// toward tag a's share, so b1 goes before a1
+	positions := pool.QueuePositions()
+	want := map[string]int{"urgent": 1, "b1": 2, "a1": 3, "a2": 4}
+	for id, pos := range want {
+		if positions[id] != pos {
+			t.Fatalf("expected %s at queue position %d, got %d (all: %v)", id, pos, positions[id], positions)
+		}
+	}
+	store.Cancel(nil, "", "")
+}
+
+// ---------------------------------------------------------------------------
+// Scheduler: per-model limits, loaded model first
+// ---------------------------------------------------------------------------
+
+func TestSchedulerModelLimit(t *testing.T) {
+	store := NewTaskStore()
+	release := make(chan struct{})
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			<-release
+			fn(api.ChatResponse{Message: api.Message{Content: "ok"}})
+			return nil
+		},
+	}
+	pool := newTestPool(store, 4, mock)
+	pool.SetModelLimits(map[string]int{"big": 1})
+
+	for _, spec := range []struct{ id, model string }{{"big1", "big:latest"}, {"big2", "big"}, {"small1", "small"}, {"small2", "small"}} {
+		submitTestTask(store, pool, &Task{ID: spec.id, Prompt: "p", Model: spec.model, Status: "pending", CreatedAt: time.Now()})
+	}
+
+	// big2 waits for big1 while the small tasks take the free slots
+	for _, id := range []string{"big1", "small1", "small2"} {
+		waitForStatus(t, store, id, 2*time.Second, "running")
+	}
+	if got := getStatus(store, "big2"); got != "pending" {
+		t.Fatalf("expected big2 to wait for the model's only slot, got %s", got)
+	}
+
+	close(release)
+	waitForStatus(t, store, "big2", 2*time.Second, "completed")
+}
+
+func TestSchedulerLoadedModelFirst(t *testing.T) {
+	store := NewTaskStore()
+	blocker := make(chan struct{})
+	var mu sync.Mutex
+	var order []string
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			if req.Messages[1].Content == "blocker" {
+				<-blocker
+			} else {
+				mu.Lock()
+				order = append(order, req.Messages[1].Content)
+				mu.Unlock()
+			}
+			fn(api.ChatResponse{Message: api.Message{Content: "ok"}})
+			return nil
+		},
+	}
+	pool := newTestPool(store, 1, mock)
+
+	submitTestTask(store, pool, &Task{ID: "blocker", Prompt: "blocker", Model: "a", Status: "pending", CreatedAt: time.Now()})
+	waitForStatus(t, store, "blocker", 2*time.Second, "running")
+
+	// Model a is loaded, so its tasks go ahead of b's; b's run once a's
+	// queue is empty. A higher priority still comes first.
+	for _, spec := range []struct {
+		id, model string
+		priority  int
+	}{{"b1", "b", 0}, {"a1", "a", 0}, {"b2", "b", 0}, {"a2", "a:latest", 0}, {"b3", "b", 1}} {
+		submitTestTask(store, pool, &Task{ID: spec.id, Prompt: spec.id, Model: spec.model, Priority: spec.priority, Status: "pending", CreatedAt: time.Now()})
+	}
+
+	expected := []string{"b3", "b1", "b2", "a1", "a2"}
+	positions := pool.QueuePositions()
+	for i, id := range []string{"b3", "a1", "a2", "b1", "b2"} {
+		if positions[id] != i+1 {
+			t.Fatalf("expected %s at queue position %d, got %d (all: %v)", id, i+1, positions[id], positions)
+		}
+	}
+
+	close(blocker)
+	waitForStatus(t, store, "a2", 2*time.Second, "completed")
+	waitForStatus(t, store, "b2", 2*time.Second, "completed")
+
+	// Once b3 has loaded b, the other b tasks follow it before going back
+	// to a.
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(order) != fmt.Sprint(expected) {
+		t.Fatalf("expected execution order %v, got %v", expected, order)
+	}
+}
+
+func TestSchedulerLoadedModelFromRunningModels(t *testing.T) {
+	store := NewTaskStore()
+	blocker := make(chan struct{})
+	defer close(blocker)
+	var psErr error
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			<-blocker
+			return nil
+		},
+		psFn: func(ctx context.Context) (*api.ProcessResponse, error) {
+			if psErr != nil {
+				return nil, psErr
+			}
+			return &api.ProcessResponse{Models: []api.ProcessModelResponse{{Name: "c:latest", Model: "c:latest"}}}, nil
+		},
+	}
+	pool := newTestPool(store, 1, mock)
+	pool.checkBackends()
+
+	submitTestTask(store, pool, &Task{ID: "blocker", Prompt: "p", Model: "a", Status: "pending", CreatedAt: time.Now()})
+	waitForStatus(t, store, "blocker", 2*time.Second, "running")
+	submitTestTask(store, pool, &Task{ID: "b1", Prompt: "p", Model: "b", Status: "pending", CreatedAt: time.Now()})
+	submitTestTask(store, pool, &Task{ID: "c1", Prompt: "p", Model: "c", Status: "pending", CreatedAt: time.Now()})
+
+	// Ollama reports c in memory, so c1 goes ahead of b1 although c never
+	// ran through the pool
+	if positions := pool.QueuePositions(); positions["c1"] != 1 || positions["b1"] != 2 {
+		t.Fatalf("expected c1 ahead of b1, got %v", positions)
+	}
+
+	// Without /api/ps, only the last model run counts as loaded, and
+	// submission order decides between b and c
+	psErr = fmt.Errorf("404 page not found")
+	pool.checkBackends()
+	if positions := pool.QueuePositions(); positions["b1"] != 1 || positions["c1"] != 2 {
+		t.Fatalf("expected b1 ahead of c1 without /api/ps, got %v", positions)
+	}
+	store.Cancel(nil, "", "")
+}
+
+func TestSchedulerLoadedModelDoesNotStarveOthers(t *testing.T) {
+	store := NewTaskStore()
+	blocker := make(chan struct{})
+	var mu sync.Mutex
+	var order []string
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			if req.Messages[1].Content == "blocker" {
+				<-blocker
+			} else {
+				mu.Lock()
+				order = append(order, req.Messages[1].Content)
+				mu.Unlock()
+			}
+			fn(api.ChatResponse{Message: api.Message{Content: "ok"}})
+			return nil
+		},
+	}
+	pool := newTestPool(store, 1, mock)
+
+	submitTestTask(store, pool, &Task{ID: "blocker", Prompt: "blocker", Model: "a", Status: "pending", CreatedAt: time.Now()})
+	waitForStatus(t, store, "blocker", 2*time.Second, "running")
+
+	submitTestTask(store, pool, &Task{ID: "b1", Prompt: "b1", Model: "b", Status: "pending", CreatedAt: time.Now()})
+	for i := range maxModelSkips + 2 {
+		id := fmt.Sprintf("a%d", i)
+		submitTestTask(store, pool, &Task{ID: id, Prompt: id, Model: "a", Status: "pending", CreatedAt: time.Now()})
+	}
+
+	close(blocker)
+	waitForStatus(t, store, fmt.Sprintf("a%d", maxModelSkips+1), 2*time.Second, "completed")
+	waitForStatus(t, store, "b1", 2*time.Second, "completed")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) != maxModelSkips+3 || order[maxModelSkips] != "b1" {
+		t.Fatalf("expected b1 to run after %d a tasks, got %v", maxModelSkips, order)
+	}
+}
+
+func TestParseModelLimits(t *testing.T) {
+	limits, err := parseModelLimits("qwen2.5-coder:32b=1, llama3.2=8 ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"qwen2.5-coder:32b": 1, "llama3.2:latest": 8}
+	if fmt.Sprint(limits) != fmt.Sprint(want) {
+		t.Fatalf("expected %v, got %v", want, limits)
+	}
+
+	for _, bad := range []string{"llama3.2", "=2", "llama3.2=0", "llama3.2=x"} {
+		if _, err := parseModelLimits(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// validate_cmd repair loop
+// ---------------------------------------------------------------------------
+
+func TestWorkerValidateCmdRepairs(t *testing.T) {
+	store := NewTaskStore()
+	var mu sync.Mutex
+	var requests [][]api.Message
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			mu.Lock()
+			requests = append(requests, req.Messages)
+			n := len(requests)
+			mu.Unlock()
+			if n == 1 {
+				fn(api.ChatResponse{Message: api.Message{Content: "broken"}})
+			} else {
+				fn(api.ChatResponse{Message: api.Message{Content: "fixed"}})
+			}
+			return nil
+		},
+	}
+	pool := newTestPool(store, 1, mock)
+	outPath := filepath.Join(t.TempDir(), "out.txt")
+
+	submitTestTask(store, pool, &Task{
+		ID:                "t1",
+		SystemPrompt:      "sys",
+		Prompt:            "p",
+		OutputFile:        outPath,
+		ValidateCmd:       "grep -q fixed " + outPath + " || { echo 'undefined: foo'; exit 1; }",
+		MaxRepairAttempts: 2,
+		Status:            "pending",
+		Model:             "m",
+	})
+	waitForStatus(t, store, "t1", 2*time.Second, "completed")
+
+	data, _ := os.ReadFile(outPath)
+	if string(data) != "fixed" {
+		t.Fatalf("expected repaired output on disk, got %q", data)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 Ollama calls, got %d", len(requests))
+	}
+	second := requests[1]
+	if len(second) != 4 || second[2].Role != "assistant" || second[2].Content != "broken" {
+		t.Fatalf("expected the repair turn to continue the conversation, got %+v", second)
+	}
+	if second[3].Role != "user" || !strings.Contains(second[3].Content, "undefined: foo") {
+		t.Fatalf("expected validation output in the repair prompt, got %q", second[3].Content)
+	}
+
+	res := store.Results([]string{"t1"}, "")[0]
+	if res.RepairAttempts != 1 {
+		t.Fatalf("expected 1 repair attempt, got %d", res.RepairAttempts)
+	}
+	if len(res.Conversation) != 5 || res.Conversation[4].Content != "fixed" {
+		t.Fatalf("expected full 5-turn conversation ending in the fix, got %+v", res.Conversation)
+	}
+}
+
+func TestWorkerValidateCmdRepairsExhausted(t *testing.T) {
+	store := NewTaskStore()
+	var mu sync.Mutex
+	calls := 0
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			mu.Lock()
+			calls++
+			mu.Unlock()
+			fn(api.ChatResponse{Message: api.Message{Content: "still broken"}})
+			return nil
+		},
+	}
+	pool := newTestPool(store, 1, mock)
+	outPath := filepath.Join(t.TempDir(), "out.txt")
+
+	submitTestTask(store, pool, &Task{
+		ID:                "t1",
+		Prompt:            "p",
+		OutputFile:        outPath,
+		ValidateCmd:       "echo 'syntax error'; exit 1",
+		MaxRepairAttempts: 1,
+		Status:            "pending",
+		Model:             "m",
+	})
+	waitForStatus(t, store, "t1", 2*time.Second, "failed")
+
+	res := store.Results([]string{"t1"}, "")[0]
+	if !strings.Contains(res.Error, "validation command failed after 1 repair attempt(s)") || !strings.Contains(res.Error, "syntax error") {
+		t.Fatalf("unexpected error: %q", res.Error)
+	}
+	if res.Content != "still broken" {
+		t.Fatalf("expected last response preserved, got %q", res.Content)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 2 {
+		t.Fatalf("expected 2 Ollama calls (initial + 1 repair), got %d", calls)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Edit output modes (patch.go)
+// ---------------------------------------------------------------------------
+
+func TestApplyEdit(t *testing.T) {
+	original := "package main\n\nfunc a() {\n\treturn\n}\n\nfunc b() {\n\treturn\n}\n"
+	tests := []struct {
+		name     string
+		mode     string
+		response string
+		want     string
+		wantErr  string
+	}{
+		{
+			name:     "unified diff",
+			mode:     outputModeUnifiedDiff,
+			response: "--- a/x.go\n+++ b/x.go\n@@ -7,3 +7,4 @@\n func b() {\n+\tprintln()\n \treturn\n }\n",
+			want:     "package main\n\nfunc a() {\n\treturn\n}\n\nfunc b() {\n\tprintln()\n\treturn\n}\n",
+		},
+		{
+			name:     "unified diff with wrong line numbers and fences",
+			mode:     outputModeUnifiedDiff,
+			response: "```diff\n@@ -1,3 +1,3 @@\n func b() {\n-\treturn\n+\treturn // b\n }\n```",
+			want:     "package main\n\nfunc a() {\n\treturn\n}\n\nfunc b() {\n\treturn // b\n}\n",
+		},
+		{
+			name:     "unified diff hunk mismatch",
+			mode:     outputModeUnifiedDiff,
+			response: "@@ -3,3 +3,3 @@\n func c() {\n-\treturn\n+\treturn 1\n",
+			wantErr:  "hunk 1 (@@ -3,3 +3,3 @@) does not apply",
+		},
+		{
+			name:     "unified diff without hunks",
+			mode:     outputModeUnifiedDiff,
+			response: "Here is the whole file: package main",
+			wantErr:  "no unified diff hunks",
+		},
+		{
+			name:     "search replace",
+			mode:     outputModeSearchReplace,
+			response: "<<<<<<< SEARCH\nfunc a() {\n\treturn\n=======\nfunc a() {\n\treturn // a\n>>>>>>> REPLACE\n",
+			want:     "package main\n\nfunc a() {\n\treturn // a\n}\n\nfunc b() {\n\treturn\n}\n",
+		},
+		{
+			name:     "search replace ambiguous",
+			mode:     outputModeSearchReplace,
+			response: "<<<<<<< SEARCH\n\treturn\n=======\n\treturn nil\n>>>>>>> REPLACE\n",
+			wantErr:  "block 1 does not apply: SEARCH text matches more than one place (lines 4 and 8)",
+		},
+		{
+			name:     "search replace not found",
+			mode:     outputModeSearchReplace,
+			response: "<<<<<<< SEARCH\nfunc c() {\n=======\nfunc d() {\n>>>>>>> REPLACE\n",
+			wantErr:  "block 1 does not apply: SEARCH text not found",
+		},
+		{
+			name:     "search replace unterminated",
+			mode:     outputModeSearchReplace,
+			response: "<<<<<<< SEARCH\nfunc a() {\n=======\n",
+			wantErr:  "not terminated",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyEdit(tt.mode, original, tt.response)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("applyEdit() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyEditUnifiedDiffDashLines(t *testing.T) {
+	original := "-- users\nSELECT *\n-- TODO: drop\nFROM users;\n"
+	tests := []struct {
+		name     string
+		response string
+		want     string
+	}{
+		{
+			// With counts, "--- TODO: drop" is a removed line, not a header
+			name:     "removed comment",
+			response: "--- a/q.sql\n+++ b/q.sql\n@@ -2,3 +2,2 @@\n SELECT *\n--- TODO: drop\n FROM users;\n",
+			want:     "-- users\nSELECT *\nFROM users;\n",
+		},
+		{
+			name:     "added comment",
+			response: "@@ -1,2 +1,3 @@\n -- users\n+++ counted\n SELECT *\n",
+			want:     "-- users\n++ counted\nSELECT *\n-- TODO: drop\nFROM users;\n",
+		},
+		{
+			// Counts used up: the next file's headers end the hunk
+			name:     "second file",
+			response: "@@ -4 +4 @@\n-FROM users;\n+FROM people;\n--- a/other.sql\n+++ b/other.sql\n",
+			want:     "-- users\nSELECT *\n-- TODO: drop\nFROM people;\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyEdit(outputModeUnifiedDiff, original, tt.response)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("applyEdit() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWorkerUnifiedDiffOutputMode(t *testing.T) {
+	store := NewTaskStore()
+	var systemPrompt string
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			systemPrompt = req.Messages[0].Content
+			fn(api.ChatResponse{Message: api.Message{Content: "@@ -2,1 +2,1 @@\n-two\n+TWO\n"}})
+			return nil
+		},
+	}
+	pool := newTestPool(store, 1, mock)
+	path := filepath.Join(t.TempDir(), "f.txt")
+	if err := os.WriteFile(path, []byte("one\ntwo\nthree\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	submitTestTask(store, pool, &Task{
+		ID:           "t1",
+		SystemPrompt: "sys",
+		Prompt:       "p",
+		InputFile:    path,
+		OutputFile:   path,
+		OutputMode:   outputModeUnifiedDiff,
+		Status:       "pending",
+		Model:        "m",
+	})
+	waitForStatus(t, store, "t1", 2*time.Second, "completed")
+
+	if data, _ := os.ReadFile(path); string(data) != "one\nTWO\nthree\n" {
+		t.Fatalf("expected patched file, got %q", data)
+	}
+	if !strings.HasPrefix(systemPrompt, "sys\n\n") || !strings.Contains(systemPrompt, "unified diff") {
+		t.Fatalf("expected diff instructions appended to the system prompt, got %q", systemPrompt)
+	}
+}
+
+func TestWorkerUnifiedDiffOutputModeMismatch(t *testing.T) {
+	store := NewTaskStore()
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			fn(api.ChatResponse{Message: api.Message{Content: "@@ -2,1 +2,1 @@\n-zwei\n+TWO\n"}})
+			return nil
+		},
+	}
+	pool := newTestPool(store, 1, mock)
+	path := filepath.Join(t.TempDir(), "f.txt")
+	if err := os.WriteFile(path, []byte("one\ntwo\nthree\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	submitTestTask(store, pool, &Task{
+		ID:         "t1",
+		Prompt:     "p",
+		InputFile:  path,
+		OutputFile: path,
+		OutputMode: outputModeUnifiedDiff,
+		Status:     "pending",
+		Model:      "m",
+	})
+	waitForStatus(t, store, "t1", 2*time.Second, "failed")
+
+	res := store.Results([]string{"t1"}, "")[0]
+	if !strings.Contains(res.Error, "unified_diff response does not apply to input_file: hunk 1") {
+		t.Fatalf("unexpected error: %q", res.Error)
+	}
+	if res.Content == "" {
+		t.Fatal("expected the rejected patch preserved in the result")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "one\ntwo\nthree\n" {
+		t.Fatalf("expected file untouched, got %q", data)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	before := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\nm\n"
+	after := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\nm\nn\n"
+	diff, added, removed := unifiedDiff("/x.txt", before, after)
+	want := "--- a/x.txt\n+++ b/x.txt\n" +
+		"@@ -1,5 +1,5 @@\n a\n-b\n+B\n c\n d\n e\n" +
+		"@@ -11,3 +11,4 @@\n k\n l\n m\n+n\n"
+	if diff != want {
+		t.Fatalf("unexpected diff:\n%s\nwant:\n%s", diff, want)
+	}
+	if added != 2 || removed != 1 {
+		t.Fatalf("expected +2 -1, got +%d -%d", added, removed)
+	}
+
+	// The diff applies back cleanly with the unified_diff output mode
+	if got, err := applyEdit(outputModeUnifiedDiff, before, diff); err != nil || got != after {
+		t.Fatalf("round trip failed: %q, %v", got, err)
+	}
+
+	if diff, _, _ := unifiedDiff("/x.txt", before, before); diff != "" {
+		t.Fatalf("expected empty diff for identical input, got %q", diff)
+	}
+	if diff, added, _ := unifiedDiff("/x.txt", "", "new\n"); added != 1 || !strings.Contains(diff, "@@ -0,0 +1 @@") {
+		t.Fatalf("unexpected diff for a new file: %q", diff)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// input_files — labeled context sections
+// ---------------------------------------------------------------------------
+
+func TestWorkerInputFiles(t *testing.T) {
+	store := NewTaskStore()
+	var userMsg string
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			userMsg = req.Messages[1].Content
+			fn(api.ChatResponse{Message: api.Message{Content: "ok"}})
+			return nil
+		},
+	}
+	pool := newTestPool(store, 1, mock)
+	dir := t.TempDir()
+	impl := filepath.Join(dir, "impl.go")
+	iface := filepath.Join(dir, "iface.go")
+	notes := filepath.Join(dir, "NOTES")
+	os.WriteFile(impl, []byte("package impl\n"), 0644)
+	os.WriteFile(iface, []byte("type Store interface{}\n"), 0644)
+	os.WriteFile(notes, []byte("see ```x```\n"), 0644)
+
+	submitTestTask(store, pool, &Task{
+		ID:         "t1",
+		Prompt:     "p",
+		InputFile:  impl,
+		InputFiles: []string{iface, notes},
+		Status:     "pending",
+		Model:      "m",
+	})
+	waitForStatus(t, store, "t1", 2*time.Second, "completed")
+
+	want := "p\n\npackage impl\n\n\n" +
+		"File: " + iface + " (go)\n```go\ntype Store interface{}\n```\n\n" +
+		"File: " + notes + "\n````\nsee ```x```\n````"
+	if userMsg != want {
+		t.Fatalf("unexpected user message:\n%q\nwant:\n%q", userMsg, want)
+	}
+}
+
+func TestWorkerInputFilesMissing(t *testing.T) {
+	store := NewTaskStore()
+	pool := newTestPool(store, 1, &mockOllamaClient{})
+	dir := t.TempDir()
+	present := filepath.Join(dir, "a.go")
+	missing := filepath.Join(dir, "b.go")
+	os.WriteFile(present, []byte("x"), 0644)
+
+	submitTestTask(store, pool, &Task{
+		ID:         "t1",
+		Prompt:     "p",
+		InputFiles: []string{present, missing},
+		Status:     "pending",
+		Model:      "m",
+	})
+	waitForStatus(t, store, "t1", 2*time.Second, "failed")
+
+	res := store.Results([]string{"t1"}, "")[0]
+	if !strings.HasPrefix(res.Error, "failed to read input_files[1] "+missing+":") {
+		t.Fatalf("expected error naming the missing file, got %q", res.Error)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Context window checks and chunk mode (chunking.go)
+// ---------------------------------------------------------------------------
+
+func TestSplitChunks(t *testing.T) {
+	decl := func(name string, body int) string {
+		return "// " + name + " does things.\nfunc " + name + "() {\n" + strings.Repeat("\tx++\n", body) + "}\n"
+	}
+	content := "package p\n\n" + decl("a", 10) + "\n" + decl("b", 10) + "\n" + decl("huge", 60)
+
+	chunks := splitChunks(content, 120)
+	var joined strings.Builder
+	for _, c := range chunks {
+		joined.WriteString(c.text)
+		if len(c.text) > 120 {
+			t.Errorf("chunk over the limit (%d bytes): %q", len(c.text), c.text)
+		}
+	}
+	if joined.String() != content {
+		t.Fatal("chunks don't concatenate back to the original")
+	}
+	// The package clause and a fit together; b doesn't fit after them, and
+	// huge has to be split between lines.
+	if !strings.Contains(chunks[0].text, "func a()") || !strings.HasPrefix(chunks[1].text, "// b does things.") ||
+		!strings.HasPrefix(chunks[2].text, "// huge does things.") || len(chunks) < 4 {
+		t.Fatalf("expected chunks to start at declarations, got %q", chunks)
+	}
+	if chunks[0].firstLine != 1 || chunks[1].firstLine != chunks[0].endLine+1 {
+		t.Fatalf("unexpected line ranges: %+v", chunks[:2])
+	}
+
+	if got := splitChunks(content, 1<<20); len(got) != 1 || got[0].text != content {
+		t.Fatalf("expected a small file to be one chunk, got %d", len(got))
+	}
+}
+
+func TestWorkerChunkMode(t *testing.T) {
+	store := NewTaskStore()
+	var mu sync.Mutex
+	var notes []string
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			user := req.Messages[1].Content
+			mu.Lock()
+			notes = append(notes, strings.SplitN(user, "\n\n", 3)[1])
+			mu.Unlock()
+			var names []string
+			for _, n := range []string{"alpha", "beta", "gamma"} {
+				if strings.Contains(user, "func "+n) {
+					names = append(names, n)
+				}
+			}
+			fn(api.ChatResponse{Message: api.Message{Content: "```go\n// processed " + strings.Join(names, ",") + "\n```"}})
+			return nil
+		},
+	}
+	pool := newTestPool(store, 1, mock)
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.go")
+	out := filepath.Join(dir, "out.go")
+	var content strings.Builder
+	for _, n := range []string{"alpha", "beta", "gamma"} {
+		content.WriteString("func " + n + "() {\n" + strings.Repeat("\t// filler line\n", 90) + "}\n\n")
+	}
+	os.WriteFile(in, []byte(strings.TrimSuffix(content.String(), "\n")), 0644)
+
+	submitTestTask(store, pool, &Task{
+		ID:                  "t1",
+		Prompt:              "p",
+		InputFile:           in,
+		OutputFile:          out,
+		StripMarkdownFences: true,
+		Chunk:               true,
+		Options:             map[string]any{"num_ctx": float64(1024)},
+		Status:              "pending",
+		Model:               "m",
+	})
+	waitForStatus(t, store, "t1", 2*time.Second, "completed")
+
+	data, _ := os.ReadFile(out)
+	if string(data) != "// processed alpha\n\n// processed beta\n\n// processed gamma\n" {
+		t.Fatalf("unexpected stitched output: %q", data)
+	}
+	_, statuses := store.Summary([]string{"t1"}, "", "")
+	if statuses[0].Chunks != 3 || statuses[0].ChunksDone != 3 {
+		t.Fatalf("expected 3/3 chunks, got %d/%d", statuses[0].ChunksDone, statuses[0].Chunks)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !strings.HasPrefix(notes[1], "This is part 2 of 3 of "+in) {
+		t.Fatalf("expected a part note in the prompt, got %q", notes[1])
+	}
+}
+
+func TestWorkerContextWindowExceeded(t *testing.T) {
+	store := NewTaskStore()
+	called := false
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			called = true
+			return nil
+		},
+		showFn: func(ctx context.Context, req *api.ShowRequest) (*api.ShowResponse, error) {
+			return &api.ShowResponse{ModelInfo: map[string]any{"qwen2.context_length": float64(512)}}, nil
+		},
+	}
+	pool := newTestPool(store, 1, mock)
+	in := filepath.Join(t.TempDir(), "big.txt")
+	os.WriteFile(in, []byte(strings.Repeat("word ", 1000)), 0644)
+
+	submitTestTask(store, pool, &Task{
+		ID:        "t1",
+		Prompt:    "p",
+		InputFile: in,
+		Status:    "pending",
+		Model:     "m",
+	})
+	waitForStatus(t, store, "t1", 2*time.Second, "failed")
+
+	res := store.Results([]string{"t1"}, "")[0]
+	if !strings.Contains(res.Error, "prompt too large for the context window") || !strings.Contains(res.Error, "window is 512 tokens") {
+		t.Fatalf("unexpected error: %q", res.Error)
+	}
+	if called {
+		t.Fatal("expected Ollama not to be called")
+	}
+}
+
+func TestWorkerContextWindowDefault(t *testing.T) {
+	t.Setenv("OLLAMA_CONTEXT_LENGTH", "")
+	store := NewTaskStore()
+	var called atomic.Bool
+	mock := &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			called.Store(true)
+			fn(api.ChatResponse{Message: api.Message{Content: "ok"}})
+			return nil
+		},
+		showFn: func(ctx context.Context, req *api.ShowRequest) (*api.ShowResponse, error) {
+			return &api.ShowResponse{ModelInfo: map[string]any{"qwen2.context_length": float64(131072)}}, nil
+		},
+	}
+	pool := newTestPool(store, 1, mock)
+	in := filepath.Join(t.TempDir(), "big.txt")
+	os.WriteFile(in, []byte(strings.Repeat("word ", 8000)), 0644) // ~10000 tokens
+
+	// Without num_ctx Ollama runs the model with its default window, not the
+	// trained 128K, so the prompt would be truncated
+	submitTestTask(store, pool, &Task{ID: "t1", Prompt: "p", InputFile: in, Status: "pending", Model: "m"})
+	waitForStatus(t, store, "t1", 2*time.Second, "failed")
+	if res := store.Results([]string{"t1"}, "")[0]; !strings.Contains(res.Error, fmt.Sprintf("window is %d tokens", defaultChunkContext)) {
+		t.Fatalf("unexpected error: %q", res.Error)
+	}
+	if called.Load() {
+		t.Fatal("expected Ollama not to be called")
+	}
+
+	// With num_ctx set, the same prompt fits
+	submitTestTask(store, pool, &Task{ID: "t2", Prompt: "p", InputFile: in, Status: "pending", Model: "m", Options: map[string]any{"num_ctx": float64(16384)}})
+	waitForStatus(t, store, "t2", 2*time.Second, "completed")
+}
+
+// ---------------------------------------------------------------------------
+// Multiple backends
+// ---------------------------------------------------------------------------
+
+// newBackendMock returns a mock backend with the given models whose Chat
+// calls block until release is closed.
+func newBackendMock(release chan struct{}, models ...string) *mockOllamaClient {
+	return &mockOllamaClient{
+		chatFn: func(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+			select {
+			case <-release:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			fn(api.ChatResponse{Message: api.Message{Content: "ok"}, Done: true})
+			return nil
+		},
+		listFn: func(ctx context.Context) (*api.ListResponse, error) {
+			resp := &api.ListResponse{}
+			for _, m := range models {
+				resp.Models = append(resp.Models, api.ListModelResponse{Name: m})
+			}
+			return resp, nil
+		},
+	}
+}
+
+func TestWorkerBackendRouting(t *testing.T) {
+	store := NewTaskStore()
+	release := make(chan struct{})
+	pool := newTestPool(store, 4, nil)
+	pool.backends = []*backend{
+		{host: "http://a:11434", client: newBackendMock(release, "small:latest"), concurrency: 1},
+		{host: "http://b:11434", client: newBackendMock(release, "small:latest", "big:latest"), concurrency: 1},
+	}
+	pool.checkBackends()
+	defer pool.Shutdown()
+
+	// big only fits on b; small then goes to a, the only backend left free.
+	submitTestTask(store, pool, &Task{ID: "big", Status: "pending", Model: "big"})
+	waitForStatus(t, store, "big", 2*time.Second, "running")
+	submitTestTask(store, pool, &Task{ID: "small", Status: "pending", Model: "small"})
+	waitForStatus(t, store, "small", 2*time.Second, "running")
+
+	// Both backends are at their limit, so this waits even though the pool
+	// has slots to spare...
+	submitTestTask(store, pool, &Task{ID: "waiting", Status: "pending", Model: "small"})
+	// ...while a model no backend has fails right away.
+	submitTestTask(store, pool, &Task{ID: "missing", Status: "pending", Model: "huge"})
+	waitForStatus(t, store, "missing", 2*time.Second, "failed")
+	if res := store.Results([]string{"missing"}, "")[0]; !strings.Contains(res.Error, `model "huge" is not installed on any healthy Ollama backend`) {
+		t.Fatalf("unexpected error: %q", res.Error)
+	}
+	if status := getStatus(store, "waiting"); status != "pending" {
+		t.Fatalf("expected the third task to wait for a backend, got %s", status)
+	}
+
+	_, statuses := store.Summary([]string{"big", "small"}, "", "")
+	if statuses[0].Backend != "http://b:11434" || statuses[1].Backend != "http://a:11434" {
+		t.Fatalf("unexpected backends: %q, %q", statuses[0].Backend, statuses[1].Backend)
+	}
+
+	close(release)
+	waitForStatus(t, store, "waiting", 2*time.Second, "completed")
+
+	out, err := pool.listModels(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Models) != 2 || out.Models[0].Name != "big:latest" || len(out.Models[1].Backends) != 2 {
+		t.Fatalf("expected big on one backend and small on both, got %+v", out.Models)
+	}
+	if len(out.Backends) != 2 || !out.Backends[0].Healthy || out.Backends[1].Models != 2 {
+		t.Fatalf("unexpected backend statuses: %+v", out.Backends)
+	}
+}
+
+func TestWorkerBackendUnhealthy(t *testing.T) {
+	store := NewTaskStore()
+	release := make(chan struct{})
+	close(release)
+	down := newBackendMock(release, "big:latest")
+	down.listFn = func(ctx context.Context) (*api.ListResponse, error) {
+		return nil, fmt.Errorf("connection refused")
+	}
+	pool := newTestPool(store, 2, nil)
+	pool.backends = []*backend{
+		{host: "http://a:11434", client: newBackendMock(release, "small:latest"), concurrency: 1},
+		{host: "http://b:11434", client: down, concurrency: 1},
+	}
+	pool.checkBackends()
+	defer pool.Shutdown()
+
+	// b has the model but doesn't answer health checks, so it isn't used.
+	submitTestTask(store, pool, &Task{ID: "big", Status: "pending", Model: "big"})
+	waitForStatus(t, store, "big", 2*time.Second, "failed")
+	submitTestTask(store, pool, &Task{ID: "small", Status: "pending", Model: "small"})
+	waitForStatus(t, store, "small", 2*time.Second, "completed")
+
+	out, err := pool.listModels(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Backends[1].Healthy || !strings.Contains(out.Backends[1].Error, "connection refused") {
+		t.Fatalf("expected b to be reported unhealthy, got %+v", out.Backends[1])
+	}
+}
+
+func TestParseBackends(t *testing.T) {
+	backends, err := parseBackends("http://127.0.0.1:11434=2, spare.local ,https://gpu.example.com/ollama=1", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		host  string
+		limit int
+	}{
+		{"http://127.0.0.1:11434", 2},
+		{"http://spare.local:11434", 3},
+		{"https://gpu.example.com:11434/ollama", 1},
+	}
+	for i, w := range want {
+		if backends[i].host != w.host || backends[i].concurrency != w.limit {
+			t.Errorf("backend %d: got %s=%d, want %s=%d", i, backends[i].host, backends[i].concurrency, w.host, w.limit)
+		}
+	}
+
+	for _, bad := range []string{"http://a=0", "http://a=x", "http://a,http://a:11434", " , "} {
+		if _, err := parseBackends(bad, 1); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestBackupDirPerProcess(t *testing.T) {
+	t.Setenv("BACKUP_DIR", "")
+	t.Setenv("STATE_DIR", "")
+	t.Setenv("TMPDIR", t.TempDir())
+	pool := newTestPool(NewTaskStore(), 1, &mockOllamaClient{})
+
+	dir, err := pool.backupDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := pool.backupDir(); again != dir {
+		t.Fatalf("expected the same directory on every call, got %s and %s", dir, again)
+	}
+	if !strings.HasPrefix(dir, os.Getenv("TMPDIR")) || !strings.Contains(filepath.Base(dir), "OpusGoLlama-backups-") {
+		t.Fatalf("expected a per-process directory under TMPDIR, got %s", dir)
+	}
+
+	pool.Shutdown()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be removed on shutdown", dir)
+	}
+}